@@ -0,0 +1,560 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	gosync "sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mizhka/todosync/pkg/config"
+	"github.com/mizhka/todosync/pkg/drive"
+	"github.com/mizhka/todosync/pkg/gauth"
+	"github.com/mizhka/todosync/pkg/gitstore"
+	"github.com/mizhka/todosync/pkg/gtasks"
+	"github.com/mizhka/todosync/pkg/health"
+	"github.com/mizhka/todosync/pkg/lock"
+	"github.com/mizhka/todosync/pkg/notify"
+	"github.com/mizhka/todosync/pkg/simulate"
+	"github.com/mizhka/todosync/pkg/sync"
+	"github.com/mizhka/todosync/pkg/tui"
+	"github.com/mizhka/todosync/pkg/web"
+)
+
+// commands maps command names to functions running them with the loaded
+// profiles and arguments following the name.
+var commands = map[string]func(ctx context.Context, profiles []*config.Config, args []string) error{
+	"daemon":    runDaemon,
+	"sync":      runSync,
+	"status":    runStatus,
+	"auth":      runAuth,
+	"history":   runHistory,
+	"conflicts": runConflicts,
+	"digest":    runDigest,
+	"simulate":  runSimulate,
+	"tui":       runTUI,
+}
+
+// selectProfiles returns the profile called name, or all profiles when
+// name is empty.
+func selectProfiles(profiles []*config.Config, name string) ([]*config.Config, error) {
+	if name == "" {
+		return profiles, nil
+	}
+	for _, cfg := range profiles {
+		if cfg.Name == name {
+			return []*config.Config{cfg}, nil
+		}
+	}
+	return nil, fmt.Errorf("no profile %q in config", name)
+}
+
+// runDaemon syncs every profile until ctx is cancelled. Profiles run
+// concurrently, and one failing doesn't stop the others; once all did, their
+// errors are returned in the order they stopped. Their health is
+// served over HTTP and reported to the systemd watchdog when enabled, and
+// the dashboard shows and controls them.
+func runDaemon(ctx context.Context, profiles []*config.Config, args []string) error {
+	flags := flag.NewFlagSet("daemon", flag.ExitOnError)
+	profile := flags.String("profile", "", "sync only the named profile")
+	wait := flags.Bool("wait", false, "wait for other todosync processes syncing the profiles to finish")
+	flags.Parse(args)
+	profiles, err := selectProfiles(profiles, *profile)
+	if err != nil {
+		return err
+	}
+	for _, cfg := range profiles {
+		l, err := lockProfile(ctx, cfg, *wait)
+		if err != nil {
+			return err
+		}
+		defer l.Release()
+	}
+
+	// Load rejects health and web settings of single profiles, so the
+	// first profile has those of every one.
+	hc := profiles[0].Health
+	monitor := health.New(hc.Failures, hc.MaxAge)
+	syncers := make([]*sync.Syncer, len(profiles))
+	for i, cfg := range profiles {
+		syncers[i], err = newSyncer(ctx, cfg, false)
+		if err != nil {
+			return err
+		}
+		syncers[i].Health = monitor.Add(cfg.Name)
+	}
+	// The health endpoint and the dashboard may share an address.
+	muxes := map[string]*http.ServeMux{}
+	mux := func(addr string) *http.ServeMux {
+		if muxes[addr] == nil {
+			muxes[addr] = http.NewServeMux()
+		}
+		return muxes[addr]
+	}
+	if hc.Listen != "" {
+		mux(hc.Listen).Handle("/healthz", monitor)
+	}
+	if addr := profiles[0].Web.Listen; addr != "" {
+		views := make([]web.Profile, len(profiles))
+		for i, cfg := range profiles {
+			views[i] = web.Profile{Name: cfg.Name, Syncer: syncers[i]}
+			if cfg.Calendar.Serve {
+				opts := calendarOptions(cfg)
+				views[i].Calendar = &opts
+			}
+		}
+		mux(addr).Handle("/", web.New(monitor, views))
+	}
+	for addr, m := range muxes {
+		if err := serveHTTP(ctx, addr, m); err != nil {
+			return err
+		}
+	}
+	go func() {
+		if err := monitor.Watchdog(ctx); err != nil && ctx.Err() == nil {
+			slog.Warn("Systemd watchdog stopped", "err", err)
+		}
+	}()
+	if err := health.Notify("READY=1"); err != nil {
+		slog.Warn("Can't notify systemd", "err", err)
+	}
+	defer health.Notify("STOPPING=1")
+
+	// Errors are collected in the order profiles stop.
+	var (
+		wg   gosync.WaitGroup
+		mu   gosync.Mutex
+		errs []error
+	)
+	for i, s := range syncers {
+		wg.Add(1)
+		go func(name string, s *sync.Syncer) {
+			defer wg.Done()
+			err := s.Run(ctx)
+			if ctx.Err() == nil {
+				s.Health.Stop(err)
+				if len(syncers) > 1 {
+					s.Logger.Error("Stopped", "err", err)
+					err = fmt.Errorf("profile %s: %w", name, err)
+				}
+			}
+			mu.Lock()
+			errs = append(errs, err)
+			mu.Unlock()
+		}(profiles[i].Name, s)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if len(syncers) == 1 {
+		return errs[0]
+	}
+	return fmt.Errorf("all profiles stopped: %w", errors.Join(errs...))
+}
+
+// serveHTTP serves handler on addr until ctx is cancelled.
+func serveHTTP(ctx context.Context, addr string, handler http.Handler) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: handler}
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			slog.Error("HTTP server stopped", "addr", addr, "err", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	return nil
+}
+
+// runSync runs a single sync cycle of each profile.
+func runSync(ctx context.Context, profiles []*config.Config, args []string) error {
+	flags := flag.NewFlagSet("sync", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "print what the cycle would do without changing anything")
+	profile := flags.String("profile", "", "sync only the named profile")
+	wait := flags.Bool("wait", false, "wait for other todosync processes syncing the profiles to finish")
+	flags.Parse(args)
+	profiles, err := selectProfiles(profiles, *profile)
+	if err != nil {
+		return err
+	}
+
+	cycle := func(cfg *config.Config) error {
+		if !*dryRun {
+			l, err := lockProfile(ctx, cfg, false)
+			if errors.Is(err, lock.ErrLocked) && cfg.Web.Listen != "" {
+				// A daemon syncing the profile runs the cycle itself.
+				err := web.NewClient(cfg.Web.Listen).Sync(ctx, cfg.Name)
+				var netErr net.Error
+				if !errors.As(err, &netErr) {
+					return err
+				}
+				logger(cfg).Warn("Can't reach the daemon", "err", err)
+			}
+			if errors.Is(err, lock.ErrLocked) {
+				l, err = lockProfile(ctx, cfg, *wait)
+			}
+			if err != nil {
+				return err
+			}
+			defer l.Release()
+		}
+		s, err := newSyncer(ctx, cfg, *dryRun)
+		if err != nil {
+			return err
+		}
+		// Like in daemon mode, a signal doesn't interrupt the cycle.
+		return s.Cycle(context.Background())
+	}
+	var failed []string
+	for _, cfg := range profiles {
+		err := cycle(cfg)
+		if err != nil && len(profiles) == 1 {
+			return err
+		}
+		if err != nil {
+			logger(cfg).Error("Sync failed", "err", err)
+			failed = append(failed, cfg.Name)
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("sync failed for profiles %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// runStatus prints what the next sync cycle would do to each file.
+func runStatus(ctx context.Context, profiles []*config.Config, args []string) error {
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	profile := flags.String("profile", "", "show only the named profile")
+	flags.Parse(args)
+	profiles, err := selectProfiles(profiles, *profile)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, cfg := range profiles {
+		s, err := newSyncer(ctx, cfg, true)
+		if err != nil {
+			return err
+		}
+		files, err := s.Status(ctx)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			if len(profiles) > 1 {
+				fmt.Fprintf(w, "%s\t", cfg.Name)
+			}
+			fmt.Fprintf(w, "%s\t%s\n", f.Name, f.Status)
+		}
+	}
+	return w.Flush()
+}
+
+// runAuth asks the user to authorize access to Google services in use,
+// replacing saved tokens, or revokes the access. Profiles sharing a token
+// file are authorized once.
+func runAuth(ctx context.Context, profiles []*config.Config, args []string) error {
+	flags := flag.NewFlagSet("auth", flag.ExitOnError)
+	noBrowser := flags.Bool("no-browser", false, "authorize in a browser on another device and paste back the redirect address")
+	profile := flags.String("profile", "", "authorize only the named profile")
+	flags.Parse(args)
+	revoke := flags.Arg(0) == "revoke"
+	if flags.NArg() > 1 || (flags.NArg() == 1 && !revoke) {
+		return fmt.Errorf("usage: todosync auth [-no-browser] [-profile name] [revoke]")
+	}
+	profiles, err := selectProfiles(profiles, *profile)
+	if err != nil {
+		return err
+	}
+
+	type service struct {
+		tokenFile string
+		authorize func(ctx context.Context, creds *gauth.Credentials, noBrowser bool) error
+	}
+	done := map[string]bool{}
+	for _, cfg := range profiles {
+		if cfg.Auth != gauth.ModeUser {
+			if len(profiles) == 1 {
+				return fmt.Errorf("%s auth needs no authorization", cfg.Auth)
+			}
+			continue
+		}
+		var services []service
+		if cfg.Remote.Type == "drive" {
+			services = append(services, service{cfg.Token, drive.Authorize})
+		}
+		if cfg.Tasks.Provider == "google" {
+			services = append(services, service{cfg.Tasks.Token, gtasks.Authorize})
+		}
+		for _, svc := range services {
+			if done[svc.tokenFile] {
+				continue
+			}
+			done[svc.tokenFile] = true
+			creds, err := credentials(cfg, svc.tokenFile)
+			if err != nil {
+				return err
+			}
+			if revoke {
+				err = gauth.Revoke(ctx, creds.Tokens)
+			} else {
+				err = svc.authorize(ctx, creds, *noBrowser)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// runHistory prints commits changing a synced file.
+func runHistory(ctx context.Context, profiles []*config.Config, args []string) error {
+	flags := flag.NewFlagSet("history", flag.ExitOnError)
+	limit := flags.Int("n", 20, "number of commits to show, 0 for all")
+	profile := flags.String("profile", "", "profile whose repo is searched")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: todosync history [-n N] [-profile name] file")
+	}
+	profiles, err := selectProfiles(profiles, *profile)
+	if err != nil {
+		return err
+	}
+	if len(profiles) > 1 {
+		return fmt.Errorf("history needs -profile with several profiles configured")
+	}
+
+	repo, err := gitstore.Open(profiles[0].Repo)
+	if err != nil {
+		return err
+	}
+	changes, err := repo.Log(flags.Arg(0), *limit)
+	if err != nil {
+		return err
+	}
+	for _, c := range changes {
+		msg := strings.SplitN(c.Message, "\n", 2)[0]
+		fmt.Printf("%s %s %-12s %s\n", c.Hash[:8], c.When.Format("2006-01-02 15:04"), c.Author, msg)
+	}
+	return nil
+}
+
+// runDigest prints a digest of changes synced over a period ending now for
+// each profile, or sends it to their notifiers.
+func runDigest(ctx context.Context, profiles []*config.Config, args []string) error {
+	flags := flag.NewFlagSet("digest", flag.ExitOnError)
+	since := flags.Duration("since", 24*time.Hour, "length of the period")
+	send := flags.Bool("send", false, "send the digest to notifiers instead of printing it")
+	profile := flags.String("profile", "", "profile whose changes are summarized")
+	flags.Parse(args)
+	profiles, err := selectProfiles(profiles, *profile)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, cfg := range profiles {
+		repo, err := gitstore.Open(cfg.Repo)
+		if err != nil {
+			return err
+		}
+		s := sync.New(nil, repo, cfg.LocalDir)
+		s.TodoFile, s.DoneFile, s.StateFile = cfg.Todo, cfg.Done, cfg.State
+		d, err := s.Digest(now.Add(-*since), now)
+		if err != nil {
+			return err
+		}
+		if !*send {
+			if cfg.Name != "" {
+				fmt.Printf("[%s] ", cfg.Name)
+			}
+			fmt.Print(d)
+			continue
+		}
+		if len(cfg.Notify) == 0 {
+			return fmt.Errorf("no notifiers configured to send the digest to")
+		}
+		err = notifier(cfg).Notify(ctx, notify.Event{Type: notify.EventDigest, Message: d.String()})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runSimulate replays a scenario file with the settings of a profile
+// against an in-memory remote and scratch directories, printing the
+// actions the engine takes.
+func runSimulate(ctx context.Context, profiles []*config.Config, args []string) error {
+	flags := flag.NewFlagSet("simulate", flag.ExitOnError)
+	profile := flags.String("profile", "", "profile whose settings the scenario runs with")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: todosync simulate [-profile name] scenario")
+	}
+	profiles, err := selectProfiles(profiles, *profile)
+	if err != nil {
+		return err
+	}
+	if len(profiles) > 1 {
+		return fmt.Errorf("simulate needs -profile with several profiles configured")
+	}
+	sc, err := simulate.Load(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	cfg := *profiles[0]
+	if !sc.Config.IsZero() {
+		if err := sc.Config.Decode(&cfg); err != nil {
+			return fmt.Errorf("can't parse config of scenario %s: %w", flags.Arg(0), err)
+		}
+		if err := cfg.Validate(); err != nil {
+			return fmt.Errorf("invalid config of scenario %s: %w", flags.Arg(0), err)
+		}
+	}
+	return sc.Run(ctx, func(s *sync.Syncer) error {
+		return applySettings(s, &cfg)
+	}, os.Stdout)
+}
+
+// runConflicts lists versions quarantined on conflicts or resolves one of
+// them.
+func runConflicts(ctx context.Context, profiles []*config.Config, args []string) error {
+	const usage = "usage: todosync conflicts [-profile name] [-wait] [list | resolve id keep|take]"
+	flags := flag.NewFlagSet("conflicts", flag.ExitOnError)
+	profile := flags.String("profile", "", "profile whose conflicts are shown or resolved")
+	wait := flags.Bool("wait", false, "wait for other todosync processes syncing the profile to finish before resolving")
+	flags.Parse(args)
+	profiles, err := selectProfiles(profiles, *profile)
+	if err != nil {
+		return err
+	}
+
+	switch flags.Arg(0) {
+	case "", "list":
+		if flags.NArg() > 1 {
+			return fmt.Errorf(usage)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		for _, cfg := range profiles {
+			conflicts, err := sync.ListConflicts(cfg.State)
+			if err != nil {
+				return err
+			}
+			for _, c := range conflicts {
+				if len(profiles) > 1 {
+					fmt.Fprintf(w, "%s\t", cfg.Name)
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", c.ID, c.File, c.Time.Format("2006-01-02 15:04"), c.From, c.Path)
+			}
+		}
+		return w.Flush()
+	case "resolve":
+		if flags.NArg() != 3 || (flags.Arg(2) != "keep" && flags.Arg(2) != "take") {
+			return fmt.Errorf(usage)
+		}
+		if len(profiles) > 1 {
+			return fmt.Errorf("conflicts resolve needs -profile with several profiles configured")
+		}
+		l, err := lockProfile(ctx, profiles[0], *wait)
+		if err != nil {
+			return err
+		}
+		defer l.Release()
+		s, err := newSyncer(ctx, profiles[0], false)
+		if err != nil {
+			return err
+		}
+		// Like a sync cycle, resolution isn't interrupted by a signal.
+		return s.ResolveConflict(context.Background(), flags.Arg(1), flags.Arg(2) == "take")
+	default:
+		return fmt.Errorf(usage)
+	}
+}
+
+// runTUI syncs a profile like the daemon does, showing its files and
+// events in the terminal until the user quits.
+func runTUI(ctx context.Context, profiles []*config.Config, args []string) error {
+	flags := flag.NewFlagSet("tui", flag.ExitOnError)
+	profile := flags.String("profile", "", "profile to sync and show")
+	wait := flags.Bool("wait", false, "wait for other todosync processes syncing the profile to finish")
+	flags.Parse(args)
+	profiles, err := selectProfiles(profiles, *profile)
+	if err != nil {
+		return err
+	}
+	if len(profiles) > 1 {
+		return fmt.Errorf("tui needs -profile with several profiles configured")
+	}
+	cfg := profiles[0]
+	l, err := lockProfile(ctx, cfg, *wait)
+	if err != nil {
+		return err
+	}
+	defer l.Release()
+	s, err := newSyncer(ctx, cfg, false)
+	if err != nil {
+		return err
+	}
+
+	title := cfg.Name
+	if title == "" {
+		title = cfg.LocalDir
+	}
+	ui := tui.New(s, title)
+	// Messages go to the event log instead of messing up the screen.
+	var level slog.Level
+	level.UnmarshalText([]byte(cfg.Log.Level))
+	log := slog.New(slog.NewTextHandler(ui.Log(), &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				return slog.String(a.Key, a.Value.Time().Format("15:04:05"))
+			}
+			return a
+		},
+	}))
+	s.Logger = log
+	if r, ok := s.Repo.(*gitstore.Repo); ok {
+		r.Logger = log
+	}
+	slog.SetDefault(log)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		err := s.Run(ctx)
+		if ctx.Err() == nil {
+			log.Error("Stopped", "err", err)
+		}
+		done <- err
+	}()
+	err = ui.Run(ctx)
+	cancel()
+	// A cycle in progress finishes first.
+	if runErr := <-done; err == nil && ctx.Err() == nil {
+		err = runErr
+	}
+	return err
+}
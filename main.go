@@ -2,293 +2,554 @@ package main
 
 import (
 	"context"
-	"crypto/md5"
-	"encoding/hex"
-	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
-	"net/http"
+	"log/slog"
 	"os"
+	"os/signal"
 	"path/filepath"
-	"time"
-
-	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
-	"google.golang.org/api/drive/v3"
-	"google.golang.org/api/googleapi"
-	"google.golang.org/api/option"
-
-	git "github.com/go-git/go-git/v5"
-	"github.com/go-git/go-git/v5/plumbing/object"
+	"runtime"
+	"strings"
+	"syscall"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/mizhka/todosync/pkg/config"
+	"github.com/mizhka/todosync/pkg/crypt"
+	"github.com/mizhka/todosync/pkg/drive"
+	"github.com/mizhka/todosync/pkg/gauth"
+	"github.com/mizhka/todosync/pkg/gitstore"
+	"github.com/mizhka/todosync/pkg/gtasks"
+	"github.com/mizhka/todosync/pkg/ical"
+	"github.com/mizhka/todosync/pkg/lock"
+	"github.com/mizhka/todosync/pkg/notify"
+	"github.com/mizhka/todosync/pkg/ratelimit"
+	"github.com/mizhka/todosync/pkg/remote"
+	"github.com/mizhka/todosync/pkg/sync"
+	"github.com/mizhka/todosync/pkg/webdav"
 )
 
-// Retrieve a token, saves the token, then returns the generated client.
-func getClient(config *oauth2.Config) *http.Client {
-	// The file token.json stores the user's access and refresh tokens, and is
-	// created automatically when the authorization flow completes for the first
-	// time.
-	tokFile := "token.json"
-	tok, err := tokenFromFile(tokFile)
-	if err != nil {
-		tok = getTokenFromWeb(config)
-		saveToken(tokFile, tok)
+const usage = `Usage: todosync [-config file] [-configdir dir] [-statedir dir] [command] [arguments]
+
+Commands:
+  init [flags]      write a configuration file from flags or answers to
+                    questions, authorize access to Google Drive, create
+                    the Drive folder and the repo, and with -systemd a
+                    systemd user unit running the daemon
+  daemon            sync whenever files change (default)
+  sync [-dry-run]   run a single sync cycle
+  status            show files out of sync
+  auth [-no-browser] [revoke]
+                    authorize access to Google Drive and Google Tasks,
+                    or revoke it and delete saved tokens
+  history [-n N] file
+                    show git history of a synced file
+  digest [-since 24h] [-send]
+                    show tasks added, completed and removed and conflicts
+                    since a while ago, or send it to notifiers
+  simulate scenario replay edits of a scenario file, laid out like
+                    scenario.example.yaml, against an in-memory remote
+                    with the settings of the configuration and print the
+                    actions sync takes, without touching the configured
+                    files, repo or remote
+  conflicts [list]  list versions quarantined on conflicts
+  conflicts resolve id keep|take
+                    keep the local version or take the quarantined one,
+                    and sync the result
+  tui               sync like daemon while showing files, their state
+                    and events live in the terminal, with keys to sync,
+                    pause and diff a file against its last synced version
+
+Each command accepts -profile name to act on a single profile of the
+configuration instead of all of them.
+
+Only one todosync process syncs a profile at a time. daemon, sync, tui and
+conflicts resolve fail when another one does, or wait for it to finish
+with -wait. sync asks a daemon serving the web API to run the cycle
+instead.
+
+OAuth client secrets are read from todosync in $XDG_CONFIG_HOME, tokens
+and sync state are kept in todosync in $XDG_STATE_HOME, unless their paths
+are configured. Files left by earlier versions in the current directory
+are moved there.
+
+Flags:
+`
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	cfgPath := flag.String("config", "", "path to configuration file (default "+config.DefaultPath+" in the current directory or in todosync in the user's configuration directory)")
+	var dirs config.Dirs
+	flag.StringVar(&dirs.Config, "configdir", "", "directory of OAuth client secrets, overriding configdir of the configuration file")
+	flag.StringVar(&dirs.State, "statedir", "", "directory of tokens and sync state, overriding statedir of the configuration file")
+	once := flag.Bool("once", false, "same as the sync command")
+	dryRun := flag.Bool("dry-run", false, "same as sync -dry-run")
+	flag.Parse()
+
+	name, args := "daemon", flag.Args()
+	switch {
+	case len(args) > 0:
+		name, args = args[0], args[1:]
+	case *dryRun:
+		name, args = "sync", []string{"-dry-run"}
+	case *once:
+		name = "sync"
+	}
+	cmd, ok := commands[name]
+	if !ok && name != "init" {
+		fmt.Fprintf(flag.CommandLine.Output(), "Unknown command %q\n", name)
+		flag.Usage()
+		os.Exit(2)
 	}
-	return config.Client(context.Background(), tok)
-}
 
-// Request a token from the web, then returns the retrieved token.
-func getTokenFromWeb(config *oauth2.Config) *oauth2.Token {
-	authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
-	fmt.Printf("Go to the following link in your browser then type the "+
-		"authorization code: \n%v\n", authURL)
+	// The first SIGINT or SIGTERM lets the running cycle finish, the
+	// second one kills the process.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
 
-	var authCode string
-	if _, err := fmt.Scan(&authCode); err != nil {
-		log.Fatalf("Unable to read authorization code %v", err)
+	if name == "init" {
+		if err := runInit(ctx, *cfgPath, dirs, args); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
-
-	tok, err := config.Exchange(context.TODO(), authCode)
-	if err != nil {
-		log.Fatalf("Unable to retrieve token from web %v", err)
+	if *cfgPath == "" {
+		*cfgPath = config.Find()
 	}
-	return tok
-}
-
-// Retrieves a token from a local file.
-func tokenFromFile(file string) (*oauth2.Token, error) {
-	f, err := os.Open(file)
+	profiles, err := config.Load(*cfgPath, dirs)
 	if err != nil {
-		return nil, err
+		log.Fatal(err)
+	}
+	// Messages not tied to a profile follow log settings of the first one.
+	slog.SetDefault(newLogger(profiles[0].Log))
+	for _, cfg := range profiles {
+		moved, err := cfg.Migrate()
+		for _, m := range moved {
+			slog.Info("Moved file to its new location", "from", m.From, "to", m.To)
+		}
+		if err != nil {
+			slog.Error("Can't migrate files", "err", err)
+			os.Exit(1)
+		}
 	}
-	defer f.Close()
-	tok := &oauth2.Token{}
-	err = json.NewDecoder(f).Decode(tok)
-	return tok, err
-}
 
-// Saves a token to a file path.
-func saveToken(path string, token *oauth2.Token) {
-	fmt.Printf("Saving credential file to: %s\n", path)
-	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	err = cmd(ctx, profiles, args)
+	if errors.Is(err, context.Canceled) {
+		slog.Info("Shutting down")
+		return
+	}
 	if err != nil {
-		log.Fatalf("Unable to cache oauth token: %v", err)
+		slog.Error("Stopped", "err", err)
+		os.Exit(1)
 	}
-	defer f.Close()
-	json.NewEncoder(f).Encode(token)
 }
 
-func main() {
-	ctx := context.Background()
-	b, err := ioutil.ReadFile("credentials.json")
-	if err != nil {
-		log.Fatalf("Unable to read client secret file: %v", err)
+// newSyncer sets up the remote store, git and the sync engine as
+// configured. A dry run doesn't follow the Drive changes feed, which would
+// save its position.
+func newSyncer(ctx context.Context, cfg *config.Config, dryRun bool) (*sync.Syncer, error) {
+	var store remote.Store
+	var feed *drive.ChangeFeed
+	var limiter *ratelimit.Limiter
+	switch cfg.Remote.Type {
+	case "webdav":
+		c, err := webdav.New(cfg.Remote.URL, cfg.Remote.Username, cfg.Remote.Password)
+		if err != nil {
+			return nil, err
+		}
+		store = c
+	default:
+		if cfg.RateLimit > 0 {
+			limiter = ratelimit.New(cfg.RateLimit)
+		}
+		d, err := newDrive(ctx, cfg, limiter)
+		if err != nil {
+			return nil, err
+		}
+		if !dryRun {
+			feed, err = d.ChangeFeed(ctx, cfg.Watch.PageToken)
+			if err != nil {
+				return nil, err
+			}
+		}
+		store = d
 	}
-
-	// If modifying these scopes, delete your previously saved token.json.
-	config, err := google.ConfigFromJSON(b, drive.DriveScope)
-	if err != nil {
-		log.Fatalf("Unable to parse client secret file to config: %v", err)
+	if cfg.Encryption.Enabled {
+		key, created, err := crypt.LoadKey(cfg.Encryption.Key)
+		if err != nil {
+			return nil, err
+		}
+		if created {
+			slog.Warn("Created encryption key, back it up: remote files can't be read without it", "file", cfg.Encryption.Key)
+		}
+		store = crypt.New(store, key)
 	}
-	client := getClient(config)
 
-	srv, err := drive.NewService(ctx, option.WithHTTPClient(client))
+	repo, err := openRepo(ctx, cfg, dryRun)
 	if err != nil {
-		log.Fatalf("Unable to retrieve Drive client: %v", err)
+		return nil, err
 	}
 
-	ticker := time.NewTicker(5 * time.Second)
-	quit := make(chan struct{})
-
-	go func() {
-		for {
-			select {
-			case <-ticker.C:
-				cycle(srv, "/home/mizhka/repo/fbsd/todorepo", "/home/mizhka/notes/todos")
-			case <-quit:
-				ticker.Stop()
-				return
-			}
+	s := sync.New(store, repo, cfg.LocalDir)
+	if err := applySettings(s, cfg); err != nil {
+		return nil, err
+	}
+	s.Interval = cfg.Interval
+	s.MaxInterval = cfg.MaxInterval
+	s.IdleAfter = cfg.IdleAfter
+	for _, q := range cfg.Quiet {
+		start, end, err := q.Hours()
+		if err != nil {
+			return nil, err
 		}
-	}()
-
-	<-quit
-
-	return
-}
-
-func cycle(srv *drive.Service, repo, localdir string) {
-
-	var files = []string{"todo.txt", "done.txt"}
-	var changes []string
-	var commit_required bool = false
-
-	// Google to git
-	r, err := srv.Files.List().OrderBy("name").
-		Q("name = 'todo.txt' or name = 'done.txt'").Fields("nextPageToken, files(id, name)").Do()
-	if err != nil {
-		log.Fatalf("Unable to retrieve files: %v", err)
+		s.QuietHours = append(s.QuietHours, sync.QuietHours{Start: start, End: end, Interval: q.Interval})
 	}
-	if len(r.Files) == 0 {
-		log.Fatal("No files found in google drive")
+	s.Limiter = limiter
+	s.Timeout = cfg.Timeout
+	s.Parallelism = cfg.Parallelism
+	s.Feed = feed
+	s.Webhook = cfg.Watch.Webhook
+	s.Listen = cfg.Watch.Listen
+	s.StateFile = cfg.State
+	s.Revisions = cfg.Revisions
+	s.DryRun = dryRun
+	s.Logger = logger(cfg)
+	if len(cfg.Notify) > 0 {
+		s.Notifier = notifier(cfg)
 	}
-
-	for _, i := range r.Files {
-		resp, err := srv.Files.Get(i.Id).Fields("md5Checksum", "size", "version").Do()
+	if cfg.Digest.At != "" {
+		at, weekday, err := cfg.Digest.Schedule()
 		if err != nil {
-			log.Fatalf("Unable to download file: %s %v", i.Name, err)
+			return nil, err
 		}
-
-		filename := filepath.Join(repo, i.Name)
-		if resp.Md5Checksum == filemd5(filename) {
-			log.Println("skip, no gdrive update:", i.Name, i.Id)
-			continue
+		s.Digests = &sync.DigestSchedule{At: at}
+		if weekday != nil {
+			s.Digests.Weekly, s.Digests.Weekday = true, *weekday
 		}
-
-		log.Printf("md5=%s vers=%d size=%d", resp.Md5Checksum, resp.Version, resp.Size)
-		data, err := srv.Files.Get(i.Id).Download()
-		defer data.Body.Close()
-
-		saveFile(filename, data)
-		commit_required = true
-		changes = append(changes, filename)
-	}
-	if commit_required {
-		commitToGit(repo, changes, "Push from mobile")
-		for _, filename := range changes {
-			pushToLocal(repo, localdir, filepath.Base(filename))
+	}
+	s.Targets = targets(cfg)
+	if cfg.Calendar.File != "" || cfg.Calendar.CalDAV != "" {
+		e := &ical.Exporter{Todo: cfg.Todo, File: cfg.Calendar.File, Options: calendarOptions(cfg)}
+		if cfg.Calendar.CalDAV != "" {
+			e.CalDAV = &ical.CalDAV{URL: cfg.Calendar.CalDAV, Username: cfg.Calendar.Username, Password: cfg.Calendar.Password}
 		}
-		commit_required = false
-		changes = []string{}
+		s.Targets = append(s.Targets, e)
 	}
-
-	// Local to git
-	for _, filename := range files {
-		fullpath := filepath.Join(localdir, filename)
-		localmd5 := filemd5(fullpath)
-		repofile := filepath.Join(repo, filename)
-		repomd5 := filemd5(repofile)
-		if localmd5 == repomd5 {
-			log.Println("skip, no local update:", filename)
-			continue
-		} else {
-			log.Println("Changed local file:", filename)
+	s.Push = cfg.Git.Push
+	s.Pull = cfg.Git.Pull
+	if cfg.Tasks.Provider == "google" {
+		creds, err := credentials(cfg, cfg.Tasks.Token)
+		if err != nil {
+			return nil, err
 		}
-
-		pushToLocal(localdir, repo, filename)
-		changes = append(changes, repofile)
-		commit_required = true
-	}
-	if commit_required {
-		commitToGit(repo, changes, "Push from local")
-		for _, filename := range changes {
-			pushToDrive(srv, repo, filepath.Base(filename))
+		t, err := gtasks.NewClient(ctx, creds)
+		if err != nil {
+			return nil, err
 		}
+		if cfg.Tasks.List != "" {
+			t.TaskList = cfg.Tasks.List
+		}
+		s.Tasks = t
+		s.TasksInterval = cfg.Tasks.Interval
 	}
+	return s, nil
 }
 
-func saveFile(filename string, data *http.Response) {
-	out, err := os.Create(filename)
-	if err != nil {
-		log.Fatalf("Can't create file %s", filename)
+// applySettings sets how s merges, resolves and lays out synced files from
+// cfg, the settings which simulate replays scenarios with.
+func applySettings(s *sync.Syncer, cfg *config.Config) error {
+	if cfg.CommitMessage != "" {
+		t, err := sync.ParseCommitMessage(cfg.CommitMessage)
+		if err != nil {
+			return fmt.Errorf("invalid commitmessage: %w", err)
+		}
+		s.CommitMessage = t
+	}
+	s.Files = cfg.Files
+	s.Conflict = sync.ConflictMode(cfg.Conflict)
+	s.ConflictDir = cfg.ConflictDir
+	s.Merge = sync.MergeMode(cfg.Merge)
+	s.Deletions = sync.DeleteMode(cfg.Deletions)
+	s.Duplicates = sync.DuplicateMode(cfg.Duplicates)
+	s.Normalize = sync.Normalization{
+		TrailingSpace: cfg.Normalize.TrailingSpace,
+		EOL:           cfg.Normalize.EOL,
+		FinalNewline:  cfg.Normalize.FinalNewline,
+	}
+	switch cfg.LineEnding {
+	case "lf":
+		s.LineEnding = sync.LineEndingLF
+	case "crlf":
+		s.LineEnding = sync.LineEndingCRLF
+	case "native":
+		s.LineEnding = sync.LineEndingLF
+		if runtime.GOOS == "windows" {
+			s.LineEnding = sync.LineEndingCRLF
+		}
 	}
-	defer out.Close()
-	io.Copy(out, data.Body)
+	for _, r := range cfg.Directions {
+		s.Directions = append(s.Directions, sync.DirectionRule{Pattern: r.Pattern, Direction: sync.Direction(r.Direction)})
+	}
+	s.TodoFile = cfg.Todo
+	s.DoneFile = cfg.Done
+	s.Archive = sync.ArchivePolicy{
+		MaxLines: cfg.Archive.MaxLines,
+		MaxSize:  int64(cfg.Archive.MaxKB) * 1024,
+		Monthly:  cfg.Archive.Monthly,
+		Age:      cfg.Archive.Age,
+		Dir:      cfg.Archive.Dir,
+	}
+	return nil
 }
 
-func pushToLocal(from, to, filename string) {
-	//Read all the contents of the  original file
-	bytesRead, err := ioutil.ReadFile(filepath.Join(from, filename))
+// newDrive connects to Google Drive and locates the configured folder.
+func newDrive(ctx context.Context, cfg *config.Config, limiter *ratelimit.Limiter) (*drive.Client, error) {
+	creds, err := credentials(cfg, cfg.Token)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-
-	//Copy all the contents to the desitination file
-	err = ioutil.WriteFile(filepath.Join(to, filename), bytesRead, 0644)
+	d, err := drive.NewClient(ctx, creds, limiter)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-}
-
-func filemd5(filename string) string {
-	f, err := os.ReadFile(filename)
-	if os.IsNotExist(err) {
-		return ""
+	d.Folder = cfg.Folder
+	d.Docs = drive.DocsMode(cfg.Docs.Mode)
+	if cfg.Docs.Format == "markdown" {
+		d.DocsFormat = "text/markdown"
 	}
-	if err != nil {
-		log.Fatalf("Can't open file %s: %e", filename, err.Error())
+	if cfg.Lease > 0 {
+		d.Lease = cfg.Lease
+		d.Holder = leaseHolder(cfg)
+	}
+	l := logger(cfg)
+	d.Progress = func(name string, sent, total int64) {
+		l.Debug("Uploading", "file", name, "sent", sent, "size", total)
+	}
+	if cfg.FolderPath != "" {
+		d.Folder, err = d.ResolveFolder(ctx, cfg.FolderPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if d.Folder == "" {
+		l.Warn("No Drive folder configured, files are looked up by name anywhere in Drive")
 	}
-	hash := md5.Sum(f)
-	return hex.EncodeToString(hash[:])
+	return d, nil
 }
 
-func commitToGit(repo string, changes []string, msg string) {
-
-	if len(changes) == 0 {
-		log.Println("Nothing to commit")
-		return
+// lockProfile keeps other todosync processes from syncing the profile
+// until the lock is released. With wait it waits for them to finish
+// instead of failing.
+func lockProfile(ctx context.Context, cfg *config.Config, wait bool) (*lock.Lock, error) {
+	what := "repo " + cfg.Repo
+	if cfg.Name != "" {
+		what = "profile " + cfg.Name
 	}
-
-	r, err := git.PlainOpen(repo)
-
-	if err != nil {
-		log.Fatalf("Can't open repo %s: %s", repo, err.Error())
+	path := lock.Path(cfg.Repo)
+	l, err := lock.Acquire(ctx, path, false)
+	if errors.Is(err, lock.ErrLocked) && wait {
+		logger(cfg).Info("Waiting for another todosync to finish syncing", "lock", path)
+		l, err = lock.Acquire(ctx, path, true)
 	}
-
-	wt, err := r.Worktree()
-	if err != nil {
-		log.Fatalf("Can't open worktree %s: %s", repo, err.Error())
+	if errors.Is(err, lock.ErrLocked) {
+		return nil, fmt.Errorf("another todosync is syncing %s: %w; stop it or pass -wait", what, err)
 	}
+	return l, err
+}
 
-	for _, filename := range changes {
-		hash, err := wt.Add(filepath.Base(filename))
+// openRepo opens the repo, creating it on first use, and recovers it from
+// an interrupted run.
+func openRepo(ctx context.Context, cfg *config.Config, dryRun bool) (*gitstore.Repo, error) {
+	var auth transport.AuthMethod
+	switch {
+	case cfg.Git.SSHKey != "":
+		var err error
+		auth, err = gitstore.SSHKeyAuth(cfg.Git.SSHKey, cfg.Git.SSHPassphrase)
 		if err != nil {
-			log.Fatalf("Can't add file to git %s: %s", filename, err.Error())
-		} else {
-			log.Println("Added file", filename, "with hash", hash.String())
+			return nil, err
 		}
+	case cfg.Git.Token != "":
+		auth = gitstore.TokenAuth(cfg.Git.Username, cfg.Git.Token)
 	}
 
-	hash, err := wt.Commit(msg, &git.CommitOptions{
-		Author: &object.Signature{
-			Name:  "ToDo Sync",
-			Email: "todosync@unclebear.ru",
-			When:  time.Now(),
-		}})
+	repo, err := gitstore.Open(cfg.Repo)
+	if errors.Is(err, gitstore.ErrNoRepo) {
+		if dryRun {
+			return nil, fmt.Errorf("repo %s doesn't exist yet, sync without -dry-run to create it", cfg.Repo)
+		}
+		if err := createRepo(ctx, cfg, auth); err != nil {
+			return nil, err
+		}
+		repo, err = gitstore.Open(cfg.Repo)
+	}
 	if err != nil {
-		log.Fatalf("Can't commit to git: %s", err.Error())
-	} else {
-		log.Println("Committed with hash:", hash.String())
+		return nil, err
+	}
+	repo.Logger = logger(cfg)
+	if cfg.Author.Name != "" {
+		repo.Author.Name = cfg.Author.Name
+	}
+	if cfg.Author.Email != "" {
+		repo.Author.Email = cfg.Author.Email
 	}
+	repo.Remote = cfg.Git.Remote
+	repo.Auth = auth
+	if !dryRun {
+		if err := repo.Recover(); err != nil {
+			return nil, err
+		}
+	}
+	return repo, nil
 }
 
-func pushToDrive(srv *drive.Service, repo, filename string) {
-	r, err := srv.Files.List().OrderBy("name").
-		Q("name = '" + filename + "'").Fields("nextPageToken, files(id, name)").Do()
+// createRepo initializes the repo or clones git.url into it. Without files
+// to start from, empty todo and done files listed in files are created in
+// localdir, so that the first sync uploads them.
+func createRepo(ctx context.Context, cfg *config.Config, auth transport.AuthMethod) error {
+	l := logger(cfg)
+	if err := gitstore.Create(ctx, cfg.Repo, cfg.Git.Remote, cfg.Git.URL, auth); err != nil {
+		return err
+	}
+	l.Info("Created repo", "repo", cfg.Repo, "url", cfg.Git.URL)
 
+	entries, err := ioutil.ReadDir(cfg.Repo)
 	if err != nil {
-		log.Fatalf("Unable to retrieve files: %v", err)
+		return err
 	}
+	if len(entries) > 1 {
+		// Cloned files are copied to localdir by the first sync.
+		return nil
+	}
+	for _, f := range cfg.Files {
+		if f != cfg.Todo && f != cfg.Done {
+			continue
+		}
+		path := filepath.Join(cfg.LocalDir, filepath.FromSlash(f))
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			continue
+		}
+		if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+			return err
+		}
+		l.Info("Created empty file", "file", path)
+	}
+	return nil
+}
 
-	gfile := r.Files[0]
-
-	f, err := os.Open(filepath.Join(repo, filename))
+// notifier routes sync events to the notifiers configured for the
+// profile.
+func notifier(cfg *config.Config) *notify.Router {
+	r := &notify.Router{Profile: cfg.Name}
+	for _, n := range cfg.Notify {
+		switch n.Type {
+		case "desktop":
+			r.Add(notify.Desktop{}, n.Events...)
+		case "webhook":
+			r.Add(&notify.Webhook{URL: n.URL}, n.Events...)
+		case "email":
+			r.Add(&notify.Email{Addr: n.SMTP, Username: n.Username, Password: n.Password, From: n.From, To: n.To}, n.Events...)
+		case "telegram":
+			r.Add(&notify.Telegram{Token: n.Token, Chat: n.Chat}, n.Events...)
+		case "stdout":
+			r.Add(&notify.Writer{}, n.Events...)
+		}
+	}
+	return r
+}
 
-	if err != nil {
-		log.Fatal("Can't open file", filename)
+// targets returns the mirror directories of the profile.
+func targets(cfg *config.Config) []sync.LocalTarget {
+	var ts []sync.LocalTarget
+	for _, m := range cfg.Mirrors {
+		t := &sync.DirTarget{Dir: m.Dir, Files: m.Files, Prefix: m.Prefix, Ext: m.Ext}
+		// Front matter goes on top of the output of the command.
+		if len(m.Command) > 0 {
+			t.Transforms = append(t.Transforms, sync.Command(m.Command))
+		}
+		if len(m.FrontMatter) > 0 {
+			t.Transforms = append(t.Transforms, sync.FrontMatter(m.FrontMatter))
+		}
+		ts = append(ts, t)
 	}
-	defer f.Close()
+	return ts
+}
+
+// calendarOptions returns how tasks of the profile are exported to
+// calendars.
+func calendarOptions(cfg *config.Config) ical.Options {
+	return ical.Options{Name: cfg.Calendar.Name, Events: cfg.Calendar.Events}
+}
 
-	var updatedgFile drive.File
+// newLogger returns a logger writing to stderr as configured.
+func newLogger(cfg config.Log) *slog.Logger {
+	var level slog.Level
+	level.UnmarshalText([]byte(cfg.Level))
+	opts := &slog.HandlerOptions{Level: level}
+	if cfg.Format == "json" {
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts))
+	}
+	return slog.New(slog.NewTextHandler(os.Stderr, opts))
+}
 
-	updatedgFile.Name = gfile.Name
-	updatedgFile.Parents = gfile.Parents
-	updatedgFile.Description = gfile.Description
+// logger returns the logger of the profile, tagging its messages with the
+// profile name.
+func logger(cfg *config.Config) *slog.Logger {
+	l := newLogger(cfg.Log)
+	if cfg.Name != "" {
+		l = l.With("profile", cfg.Name)
+	}
+	return l
+}
 
-	_, err = srv.Files.Update(gfile.Id, &updatedgFile).Media(f, googleapi.ContentType("text/plain")).Fields("appProperties,modifiedTime,name,id").Do()
+// leaseHolder identifies this process in Drive upload leases, by host and
+// profile.
+func leaseHolder(cfg *config.Config) string {
+	host, err := os.Hostname()
 	if err != nil {
-		log.Fatal("Can't upload file: ", err.Error(), " ", gfile.Id, " ", filename)
+		host = "localhost"
 	}
+	holder := "todosync@" + strings.ReplaceAll(host, " ", "-")
+	if cfg.Name != "" {
+		holder += "/" + cfg.Name
+	}
+	return holder
+}
 
+// credentials returns the configured Google credentials, keeping the
+// user's token in tokenFile.
+func credentials(cfg *config.Config, tokenFile string) (*gauth.Credentials, error) {
+	creds := &gauth.Credentials{
+		Mode:         cfg.Auth,
+		ClientSecret: cfg.Credentials,
+		KeyFile:      cfg.ServiceAccount,
+		Subject:      cfg.Subject,
+	}
+	if cfg.Auth == gauth.ModeUser {
+		if cfg.TokenStore == gauth.StoreKeyring {
+			// Keyring entries are named after the token file.
+			for _, old := range cfg.Legacy(tokenFile) {
+				moved, err := gauth.MoveKeyring(old, tokenFile)
+				if err != nil {
+					slog.Debug("Can't move token in keyring", "from", old, "err", err)
+				} else if moved {
+					slog.Info("Moved token in keyring", "from", old, "to", tokenFile)
+				}
+			}
+		}
+		var err error
+		creds.Tokens, err = gauth.NewTokenStore(cfg.TokenStore, tokenFile, cfg.TokenPassphrase)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return creds, nil
 }
@@ -0,0 +1,21 @@
+// Package backoff computes exponential backoff delays with jitter.
+package backoff
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Delay returns the delay before retry number attempt, counting from 1:
+// base doubled for every previous attempt and capped at max, randomized
+// to between half and full of that value so that retries don't align.
+func Delay(attempt int, base, max time.Duration) time.Duration {
+	d := base
+	for i := 1; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
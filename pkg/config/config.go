@@ -0,0 +1,1190 @@
+// Package config loads the todosync configuration file.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mizhka/todosync/pkg/fsutil"
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultPath is the name of the configuration file looked up by Find.
+const DefaultPath = "todosync.yaml"
+
+// Find returns DefaultPath if it exists in the current directory, or else
+// the path of DefaultPath in ConfigDir.
+func Find() string {
+	if _, err := os.Stat(DefaultPath); err == nil {
+		return DefaultPath
+	}
+	dir, err := ConfigDir()
+	if err != nil {
+		return DefaultPath
+	}
+	path := filepath.Join(dir, DefaultPath)
+	if _, err := os.Stat(path); err != nil {
+		return DefaultPath
+	}
+	return path
+}
+
+// ConfigDir returns the directory of the configuration file and OAuth
+// client secrets: todosync in $XDG_CONFIG_HOME, or else in the user's
+// configuration directory, ~/.config on Linux, ~/Library/Application
+// Support on macOS and %AppData% on Windows.
+func ConfigDir() (string, error) {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		var err error
+		if dir, err = os.UserConfigDir(); err != nil {
+			return "", err
+		}
+	}
+	return filepath.Join(dir, "todosync"), nil
+}
+
+// StateDir returns the directory of tokens and sync state: todosync in
+// $XDG_STATE_HOME, or else in ~/.local/state, ~/Library/Application
+// Support on macOS and %LocalAppData% on Windows.
+func StateDir() (string, error) {
+	dir := os.Getenv("XDG_STATE_HOME")
+	if dir == "" {
+		var err error
+		switch runtime.GOOS {
+		case "windows":
+			dir, err = os.UserCacheDir()
+		case "darwin", "ios":
+			dir, err = os.UserConfigDir()
+		default:
+			dir, err = os.UserHomeDir()
+			dir = filepath.Join(dir, ".local", "state")
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return filepath.Join(dir, "todosync"), nil
+}
+
+// Dirs overrides the directories files are kept in by default.
+type Dirs struct {
+	// Config keeps OAuth client secrets, ConfigDir when empty.
+	Config string `yaml:"configdir"`
+	// State keeps tokens, positions in the changes feed and sync state,
+	// StateDir when empty.
+	State string `yaml:"statedir"`
+}
+
+// Author is the identity used for git commits.
+type Author struct {
+	Name  string `yaml:"name"`
+	Email string `yaml:"email"`
+}
+
+// Watch configures detection of Drive changes.
+type Watch struct {
+	// PageToken is the file storing the position in the Drive changes feed.
+	PageToken string `yaml:"pagetoken"`
+	// Webhook is the public HTTPS address receiving Drive push
+	// notifications. Changes are polled every interval when empty.
+	Webhook string `yaml:"webhook"`
+	// Listen is the local address of the push notification server.
+	Listen string `yaml:"listen"`
+}
+
+// Remote selects the storage synced with the repo.
+type Remote struct {
+	// Type is either "drive" or "webdav".
+	Type string `yaml:"type"`
+	// URL is the WebDAV collection mapped to the repo.
+	URL string `yaml:"url"`
+	// Username and Password authenticate to the WebDAV server.
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// Encryption configures encryption of files stored remotely.
+type Encryption struct {
+	// Enabled encrypts files before uploading them and decrypts them after
+	// downloading. The repo and localdir keep them plain.
+	Enabled bool `yaml:"enabled"`
+	// Key is the file holding the key, created on first use. Losing it
+	// makes the remote copies unreadable.
+	Key string `yaml:"key"`
+}
+
+// Docs configures syncing of Google Docs, which Drive keeps in its own
+// format and exports as text.
+type Docs struct {
+	// Mode is "skip", "readonly" or "convert": whether Google Docs are left
+	// out, exported and synced pull-only, or exported with local changes
+	// converted back into the document.
+	Mode string `yaml:"mode"`
+	// Format is "text" or "markdown", the format documents are exported
+	// to. Their files get the extension .txt or .md.
+	Format string `yaml:"format"`
+}
+
+// Normalize configures differences of text files ignored when comparing
+// their versions.
+type Normalize struct {
+	// TrailingSpace ignores spaces and tabs at the end of lines.
+	TrailingSpace bool `yaml:"trailingspace"`
+	// EOL ignores CRLF versus LF line endings.
+	EOL bool `yaml:"eol"`
+	// FinalNewline ignores newlines at the end of files.
+	FinalNewline bool `yaml:"finalnewline"`
+}
+
+// Archive configures rotation of the done file: completed tasks are moved
+// to an archive file per month of completion.
+type Archive struct {
+	// MaxLines and MaxKB rotate the done file once it has more lines or
+	// kilobytes.
+	MaxLines int `yaml:"maxlines"`
+	MaxKB    int `yaml:"maxkb"`
+	// Monthly rotates the done file at the start of each month.
+	Monthly bool `yaml:"monthly"`
+	// Age is how long ago tasks were completed to be archived.
+	Age time.Duration `yaml:"age"`
+	// Dir is the directory of archive files, relative to repo, localdir
+	// and the remote folder.
+	Dir string `yaml:"dir"`
+}
+
+// Enabled reports whether the done file is ever rotated.
+func (a Archive) Enabled() bool {
+	return a.MaxLines > 0 || a.MaxKB > 0 || a.Monthly
+}
+
+// Calendar configures export of tasks with due dates of the todo file to
+// calendars.
+type Calendar struct {
+	// File is where the calendar is written, relative to localdir. Inside
+	// localdir, it's synced push-only like other files.
+	File string `yaml:"file"`
+	// Serve serves the calendar at /calendar.ics of the dashboard.
+	Serve bool `yaml:"serve"`
+	// Name is the name of the calendar shown by calendar apps.
+	Name string `yaml:"name"`
+	// Events exports tasks as all-day events instead of to-dos, which
+	// calendars such as Google Calendar don't show.
+	Events bool `yaml:"events"`
+	// CalDAV is the URL of a calendar collection receiving tasks as
+	// to-dos, authenticated by Username and Password.
+	CalDAV   string `yaml:"caldav"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// Tasks configures mirroring of the task list to a task service.
+type Tasks struct {
+	// Provider is "google" for Google Tasks. Tasks aren't mirrored when
+	// empty.
+	Provider string `yaml:"provider"`
+	// List is the ID of the task list, the default list when empty.
+	List string `yaml:"list"`
+	// Token is the file caching the user's OAuth token for the service.
+	Token string `yaml:"token"`
+	// Interval is the delay between checks of the service.
+	Interval time.Duration `yaml:"interval"`
+}
+
+// Git configures the git remote the repo is pushed to.
+type Git struct {
+	// Push enables pushing after each commit.
+	Push bool `yaml:"push"`
+	// Pull enables merging remote commits before each sync cycle.
+	Pull bool `yaml:"pull"`
+	// Remote is the name of the git remote.
+	Remote string `yaml:"remote"`
+	// URL of the git remote is cloned when the repo doesn't exist yet.
+	URL string `yaml:"url"`
+	// SSHKey is the private key file for ssh remotes.
+	SSHKey string `yaml:"sshkey"`
+	// SSHPassphrase decrypts SSHKey.
+	SSHPassphrase string `yaml:"sshpassphrase"`
+	// Username and Token authenticate to https remotes.
+	Username string `yaml:"username"`
+	Token    string `yaml:"token"`
+}
+
+// Log configures log output.
+type Log struct {
+	// Level is "debug", "info", "warn" or "error". Cycles that change
+	// nothing are only logged at debug level.
+	Level string `yaml:"level"`
+	// Format is "text" or "json".
+	Format string `yaml:"format"`
+}
+
+// Health configures health reporting of the daemon.
+type Health struct {
+	// Listen is the address serving /healthz, which is disabled when
+	// empty.
+	Listen string `yaml:"listen"`
+	// Failures is the number of consecutive failed cycles making a
+	// profile unhealthy.
+	Failures int `yaml:"failures"`
+	// MaxAge is how long a profile may go without syncing or checking
+	// for changes successfully before it's unhealthy, unlimited when 0.
+	MaxAge time.Duration `yaml:"maxage"`
+}
+
+// Web configures the dashboard of the daemon.
+type Web struct {
+	// Listen is the address serving the dashboard, which is disabled when
+	// empty. It may be the address of Health.
+	Listen string `yaml:"listen"`
+}
+
+// Notifier configures a channel telling the user about sync events.
+type Notifier struct {
+	// Type is "desktop", "webhook", "email", "telegram" or "stdout".
+	Type string `yaml:"type"`
+	// URL receives events as JSON with the webhook type.
+	URL string `yaml:"url"`
+	// SMTP is the host:port of the mail server of the email type, which
+	// sends mail from From to To, authenticated by Username and Password
+	// when set.
+	SMTP     string   `yaml:"smtp"`
+	From     string   `yaml:"from"`
+	To       []string `yaml:"to"`
+	Username string   `yaml:"username"`
+	Password string   `yaml:"password"`
+	// Token authenticates the bot of the telegram type, which sends
+	// messages to the chat with ID Chat.
+	Token string `yaml:"token"`
+	Chat  string `yaml:"chat"`
+	// Events lists the types of events sent: conflict, remote, deleted,
+	// error and digest. All of them are sent when empty.
+	Events []string `yaml:"events"`
+}
+
+// Digest schedules digests of changes synced, sent to notifiers.
+type Digest struct {
+	// At is the time of day digests are sent, such as "21:00". No digest
+	// is sent when empty.
+	At string `yaml:"at"`
+	// Weekday, such as "sunday", sends a digest of the week on that day
+	// instead of a digest of the day every day.
+	Weekday string `yaml:"weekday"`
+}
+
+// Schedule returns the time of day of digests as the duration since
+// midnight and their weekday, if weekly.
+func (d Digest) Schedule() (time.Duration, *time.Weekday, error) {
+	t, err := time.Parse("15:04", d.At)
+	if err != nil {
+		return 0, nil, fmt.Errorf("digest.at: %q is not a time such as 21:00", d.At)
+	}
+	at := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	if d.Weekday == "" {
+		return at, nil, nil
+	}
+	for w := time.Sunday; w <= time.Saturday; w++ {
+		if strings.EqualFold(d.Weekday, w.String()) {
+			return at, &w, nil
+		}
+	}
+	return 0, nil, fmt.Errorf("digest.weekday: %q is not a day of the week", d.Weekday)
+}
+
+// Quiet configures quiet hours polling less often.
+type Quiet struct {
+	// From and To are times of day such as "23:00" and "07:00". To
+	// before From spans midnight.
+	From string `yaml:"from"`
+	To   string `yaml:"to"`
+	// Interval is the delay between sync cycles meanwhile.
+	Interval time.Duration `yaml:"interval"`
+}
+
+// Hours returns From and To as durations since midnight.
+func (q Quiet) Hours() (time.Duration, time.Duration, error) {
+	var hours [2]time.Duration
+	for i, v := range []string{q.From, q.To} {
+		t, err := time.Parse("15:04", v)
+		if err != nil {
+			return 0, 0, fmt.Errorf("%q is not a time such as 23:00", v)
+		}
+		hours[i] = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	return hours[0], hours[1], nil
+}
+
+// Mirror configures a directory receiving copies of the last synced
+// versions of files, which aren't synced back when edited there.
+type Mirror struct {
+	// Type is "dir" for plain copies, as for a Syncthing folder, or
+	// "obsidian" for notes of an Obsidian vault, which get the ".md"
+	// extension by default.
+	Type string `yaml:"type"`
+	// Dir is the mirror directory.
+	Dir string `yaml:"dir"`
+	// Files, when set, select mirrored files with patterns of the syntax
+	// of Config.Files.
+	Files []string `yaml:"files"`
+	// Prefix is the subdirectory of Dir files go to.
+	Prefix string `yaml:"prefix"`
+	// Ext replaces extensions of file names when set.
+	Ext string `yaml:"ext"`
+	// FrontMatter lists fields of YAML front matter prepended to files.
+	// The value {{file}} is replaced by the path of the file.
+	FrontMatter map[string]string `yaml:"frontmatter"`
+	// Command, when set, is run with content of each file on stdin and
+	// its path in $TODOSYNC_FILE, and writes the mirrored content to
+	// stdout.
+	Command []string `yaml:"command"`
+}
+
+// DirectionRule restricts which way files matching Pattern are synced.
+type DirectionRule struct {
+	// Pattern has the syntax of Config.Files.
+	Pattern string `yaml:"pattern"`
+	// Direction is "bidirectional", "push-only" or "pull-only".
+	Direction string `yaml:"direction"`
+}
+
+// Config describes what to sync and where.
+type Config struct {
+	// Name identifies the profile, empty in a configuration without
+	// profiles.
+	Name string `yaml:"-"`
+	// Dirs keep files whose paths aren't configured.
+	Dirs `yaml:",inline"`
+	// Repo is the path of the git repository keeping history of files.
+	Repo string `yaml:"repo"`
+	// LocalDir is the directory with working copies of files.
+	LocalDir string `yaml:"localdir"`
+	// Files lists slash separated path patterns of synced files, such as
+	// todo.txt, *.txt or projects/**. Wildcards require Folder.
+	Files []string `yaml:"files"`
+	// Directions restrict which way files are synced, the first rule
+	// matching a file applies. Files matching none are synced both ways.
+	Directions []DirectionRule `yaml:"directions"`
+	// Remote selects Google Drive or a WebDAV server.
+	Remote Remote `yaml:"remote"`
+	// Encryption keeps files stored remotely encrypted.
+	Encryption Encryption `yaml:"encryption"`
+	// Folder is the ID of the Drive folder mapped to the repo. Without it
+	// files are looked up by name anywhere in Drive.
+	Folder string `yaml:"folder"`
+	// FolderPath locates the Drive folder by its path from the root of My
+	// Drive instead of Folder.
+	FolderPath string `yaml:"folderpath"`
+	// Docs configures syncing of Google Docs.
+	Docs Docs `yaml:"docs"`
+	// Lease, when set, makes uploads to Drive hold a lease of that
+	// duration on the file, which cooperating apps honor by not writing
+	// it meanwhile.
+	Lease time.Duration `yaml:"lease"`
+	// Interval is the delay between sync cycles.
+	Interval time.Duration `yaml:"interval"`
+	// MaxInterval limits the interval slowed down while Drive rejects
+	// requests for exceeding quota or nothing changes.
+	MaxInterval time.Duration `yaml:"maxinterval"`
+	// IdleAfter slows polling down once nothing changed for that long,
+	// never when 0.
+	IdleAfter time.Duration `yaml:"idleafter"`
+	// Quiet lists times of day with a longer interval.
+	Quiet []Quiet `yaml:"quiet"`
+	// RateLimit is the number of Drive requests sent per second at most,
+	// unlimited when negative.
+	RateLimit float64 `yaml:"ratelimit"`
+	// Timeout limits duration of a single sync cycle.
+	Timeout time.Duration `yaml:"timeout"`
+	// Parallelism is the number of files transferred at once.
+	Parallelism int `yaml:"parallelism"`
+	// Author signs git commits. Missing parts are taken from the git
+	// config of the repo.
+	Author Author `yaml:"author"`
+	// CommitMessage is a text/template of commit messages, see
+	// sync.CommitInfo for the data it gets.
+	CommitMessage string `yaml:"commitmessage"`
+	// Auth is "user", "serviceaccount" or "adc": whether Google APIs are
+	// accessed as the user authorized through OAuth, as a service account
+	// or with Application Default Credentials.
+	Auth string `yaml:"auth"`
+	// ServiceAccount is the JSON key of the service account.
+	ServiceAccount string `yaml:"serviceaccount"`
+	// Subject is the user impersonated by the service account through
+	// domain-wide delegation.
+	Subject string `yaml:"subject"`
+	// Credentials is the OAuth client secret file.
+	Credentials string `yaml:"credentials"`
+	// Token is the file caching the user's OAuth token.
+	Token string `yaml:"token"`
+	// TokenStore is "file", "keyring" or "encrypted": where OAuth tokens
+	// are kept. The keyring falls back to an encrypted Token file where
+	// there is none.
+	TokenStore string `yaml:"tokenstore"`
+	// TokenPassphrase encrypts token files, $TODOSYNC_TOKEN_PASSPHRASE
+	// when empty.
+	TokenPassphrase string `yaml:"tokenpassphrase"`
+	// Watch configures detection of Drive changes.
+	Watch Watch `yaml:"watch"`
+	// State is the file keeping checksums of last synced versions.
+	State string `yaml:"state"`
+	// Conflict is "quarantine", "copy" or "markers": how files changed
+	// incompatibly in Drive and locally are written out.
+	Conflict string `yaml:"conflict"`
+	// ConflictDir keeps versions quarantined on conflicts.
+	ConflictDir string `yaml:"conflictdir"`
+	// Merge is either "lines" or "todotxt": how files changed both in
+	// Drive and locally are merged.
+	Merge string `yaml:"merge"`
+	// Deletions is either "restore" or "propagate": whether files deleted
+	// on one side are copied back from the other one or deleted there
+	// too.
+	Deletions string `yaml:"deletions"`
+	// LineEnding is "keep", "lf", "crlf" or "native": whether files are
+	// copied byte for byte, or text files get the given line endings in
+	// localdir and LF in the repo and the remote. Native is CRLF on Windows
+	// and LF elsewhere.
+	LineEnding string `yaml:"lineending"`
+	// Duplicates is either "newest" or "error": whether of several remote
+	// files sharing a path the one synced before or else the most recently
+	// modified one is synced, or syncing stops until they are removed.
+	Duplicates string `yaml:"duplicates"`
+	// Normalize selects differences ignored when comparing versions, so
+	// that apps rewriting whitespace don't make files look changed.
+	Normalize Normalize `yaml:"normalize"`
+	// Revisions commits each Drive revision of a file changed only in
+	// Drive since the last sync, dated by the time it was saved, instead
+	// of its latest content only.
+	Revisions bool `yaml:"revisions"`
+	// Todo and Done name the task list and the list of finished tasks
+	// merged task by task in "todotxt" mode.
+	Todo string `yaml:"todo"`
+	Done string `yaml:"done"`
+	// Archive configures rotation of the done file.
+	Archive Archive `yaml:"archive"`
+	// Calendar configures export of tasks with due dates.
+	Calendar Calendar `yaml:"calendar"`
+	// Git configures the git remote.
+	Git Git `yaml:"git"`
+	// Tasks configures the task service mirroring the todo file.
+	Tasks Tasks `yaml:"tasks"`
+	// Log configures log output.
+	Log Log `yaml:"log"`
+	// Health configures health reporting, for all profiles at once.
+	Health Health `yaml:"health"`
+	// Web configures the dashboard, for all profiles at once.
+	Web Web `yaml:"web"`
+	// Notify lists channels notifying the user about sync events.
+	Notify []Notifier `yaml:"notify"`
+	// Digest schedules digests of changes sent to Notify.
+	Digest Digest `yaml:"digest"`
+	// Mirrors list directories receiving copies of synced files.
+	Mirrors []Mirror `yaml:"mirrors"`
+
+	// moves are files found where an earlier version kept them by
+	// default.
+	moves []Move
+}
+
+// file is the layout of the configuration file: settings of the top
+// level apply to every profile unless the profile overrides them.
+type file struct {
+	Config   `yaml:",inline"`
+	Profiles map[string]yaml.Node `yaml:"profiles"`
+}
+
+// profileName restricts profile names to ones usable in file names.
+var profileName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Load reads, fills defaults and validates the configuration file. It
+// returns a Config for each profile sorted by name, or a single unnamed
+// Config when the file defines no profiles. Relative paths in the file are
+// relative to its directory. Directories set in dirs override the ones of
+// the file.
+func Load(path string, dirs Dirs) ([]*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("can't read config: %w", err)
+	}
+	dir, err := filepath.Abs(filepath.Dir(path))
+	if err != nil {
+		return nil, fmt.Errorf("can't read config: %w", err)
+	}
+
+	f := &file{}
+	if err := decode(b, f); err != nil {
+		return nil, fmt.Errorf("can't parse config %s: %w", path, err)
+	}
+	if len(f.Profiles) == 0 {
+		c := &f.Config
+		c.setDefaults(dir, dirs)
+		if err := c.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid config %s: %w", path, err)
+		}
+		return []*Config{c}, nil
+	}
+
+	var profiles []*Config
+	for name, node := range f.Profiles {
+		if !profileName.MatchString(name) {
+			return nil, fmt.Errorf("invalid config %s: profile %q: name may only contain letters, digits, - and _", path, name)
+		}
+		// Decoding over a copy of the top level keeps settings the profile
+		// doesn't mention.
+		c := f.Config
+		c.Name = name
+		pb, err := yaml.Marshal(&node)
+		if err != nil {
+			return nil, err
+		}
+		if err := decode(pb, &c); err != nil {
+			return nil, fmt.Errorf("can't parse config %s: profile %s: %w", path, name, err)
+		}
+		if c.Health != f.Health {
+			return nil, fmt.Errorf("invalid config %s: profile %s: health can only be set at the top level", path, name)
+		}
+		if c.Web != f.Web {
+			return nil, fmt.Errorf("invalid config %s: profile %s: web can only be set at the top level", path, name)
+		}
+		c.setDefaults(dir, dirs)
+		if err := c.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid config %s: profile %s: %w", path, name, err)
+		}
+		profiles = append(profiles, &c)
+	}
+	sort.Slice(profiles, func(i, j int) bool { return profiles[i].Name < profiles[j].Name })
+	if err := checkProfiles(profiles); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	return profiles, nil
+}
+
+// decode parses YAML rejecting unknown fields.
+func decode(b []byte, v interface{}) error {
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	err := dec.Decode(v)
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+// checkProfiles reports files and addresses used by several profiles,
+// which would make them overwrite each other's work.
+func checkProfiles(profiles []*Config) error {
+	seen := map[[2]string]string{}
+	for _, c := range profiles {
+		for _, f := range []struct{ field, value string }{
+			{"repo", c.Repo},
+			{"localdir", c.LocalDir},
+			{"state", c.State},
+			{"conflictdir", c.ConflictDir},
+			{"watch.pagetoken", c.Watch.PageToken},
+			{"watch.listen", c.Watch.Listen},
+		} {
+			if f.value == "" {
+				continue
+			}
+			key := [2]string{f.field, f.value}
+			if other, ok := seen[key]; ok {
+				return fmt.Errorf("profiles %s and %s share %s %s", other, c.Name, f.field, f.value)
+			}
+			seen[key] = c.Name
+		}
+	}
+	return nil
+}
+
+// setDefaults fills in defaults and makes paths relative to dir absolute.
+func (c *Config) setDefaults(dir string, dirs Dirs) {
+	if dirs.Config != "" {
+		c.Dirs.Config = dirs.Config
+	}
+	if dirs.State != "" {
+		c.Dirs.State = dirs.State
+	}
+	c.Dirs.Config = defaultDir(dir, c.Dirs.Config, ConfigDir)
+	c.Dirs.State = defaultDir(dir, c.Dirs.State, StateDir)
+
+	if c.Remote.Type == "" {
+		c.Remote.Type = "drive"
+	}
+	if c.Docs.Mode == "" {
+		c.Docs.Mode = "skip"
+	}
+	if c.Docs.Format == "" {
+		c.Docs.Format = "text"
+	}
+	if len(c.Files) == 0 {
+		c.Files = []string{"todo.txt", "done.txt"}
+	}
+	if c.Interval == 0 {
+		c.Interval = 5 * time.Second
+	}
+	if c.MaxInterval == 0 {
+		// Intervals set above the default aren't slowed down further.
+		c.MaxInterval = 5 * time.Minute
+		if c.Interval > c.MaxInterval {
+			c.MaxInterval = c.Interval
+		}
+	}
+	if c.RateLimit == 0 {
+		c.RateLimit = 10
+	}
+	if c.Timeout == 0 {
+		c.Timeout = 5 * time.Minute
+	}
+	if c.Parallelism == 0 {
+		c.Parallelism = 4
+	}
+	if c.Auth == "" {
+		c.Auth = "user"
+	}
+	c.defaultFile(&c.Credentials, dir, c.Dirs.Config, "credentials.json")
+	c.defaultFile(&c.Token, dir, c.Dirs.State, "token.json")
+	if c.TokenStore == "" {
+		c.TokenStore = "file"
+	}
+	if c.TokenPassphrase == "" {
+		c.TokenPassphrase = os.Getenv("TODOSYNC_TOKEN_PASSPHRASE")
+	}
+
+	// Profiles keep their position in the changes feed, sync state and
+	// conflicts apart by default.
+	suffix := ""
+	if c.Name != "" {
+		suffix = "-" + c.Name
+	}
+	c.defaultFile(&c.Watch.PageToken, dir, c.Dirs.State, "pagetoken"+suffix+".txt")
+	c.defaultFile(&c.State, dir, c.Dirs.State, "state"+suffix+".json")
+	if c.Conflict == "" {
+		c.Conflict = "quarantine"
+	}
+	if c.ConflictDir == "" {
+		c.ConflictDir = filepath.Join(c.Dirs.State, "conflicts"+suffix)
+	}
+	if c.Merge == "" {
+		c.Merge = "lines"
+	}
+	if c.Deletions == "" {
+		c.Deletions = "restore"
+	}
+	if c.LineEnding == "" {
+		c.LineEnding = "keep"
+	}
+	if c.Duplicates == "" {
+		c.Duplicates = "newest"
+	}
+	c.defaultFile(&c.Tasks.Token, dir, c.Dirs.State, "tasks-token.json")
+	if c.Encryption.Key == "" {
+		c.Encryption.Key = filepath.Join(c.Dirs.Config, "encryption.key")
+	}
+	if c.Tasks.Interval == 0 {
+		c.Tasks.Interval = time.Minute
+	}
+	if c.Git.Remote == "" {
+		c.Git.Remote = "origin"
+	}
+	if c.Todo == "" {
+		c.Todo = "todo.txt"
+	}
+	if c.Health.Failures == 0 {
+		c.Health.Failures = 3
+	}
+	if c.Health.MaxAge == 0 {
+		c.Health.MaxAge = time.Hour
+	}
+	if c.Log.Level == "" {
+		c.Log.Level = "info"
+	}
+	if c.Log.Format == "" {
+		c.Log.Format = "text"
+	}
+	if c.Done == "" {
+		c.Done = "done.txt"
+	}
+	if c.Archive.Age == 0 {
+		c.Archive.Age = 30 * 24 * time.Hour
+	}
+	if c.Archive.Dir == "" {
+		c.Archive.Dir = "archive"
+	}
+	if c.Calendar.Name == "" {
+		c.Calendar.Name = "todo.txt"
+	}
+
+	for _, p := range []*string{
+		&c.Repo, &c.LocalDir, &c.Credentials, &c.ServiceAccount, &c.Token,
+		&c.Watch.PageToken, &c.State, &c.ConflictDir, &c.Git.SSHKey, &c.Tasks.Token,
+		&c.Encryption.Key,
+	} {
+		*p = resolvePath(dir, *p)
+	}
+	// Patterns are slash separated, but Windows users may write them with
+	// backslashes.
+	for i, f := range c.Files {
+		c.Files[i] = filepath.ToSlash(f)
+	}
+	for i, r := range c.Directions {
+		c.Directions[i].Pattern = filepath.ToSlash(r.Pattern)
+	}
+	for i := range c.Mirrors {
+		m := &c.Mirrors[i]
+		m.Dir = resolvePath(dir, m.Dir)
+		m.Prefix = filepath.ToSlash(m.Prefix)
+		for j, f := range m.Files {
+			m.Files[j] = filepath.ToSlash(f)
+		}
+		if m.Type == "obsidian" && m.Ext == "" {
+			m.Ext = ".md"
+		}
+	}
+	// Archive files are synced like the done file.
+	c.Archive.Dir = filepath.ToSlash(c.Archive.Dir)
+	if c.Archive.Enabled() {
+		archives := path.Join(c.Archive.Dir, "done-*.txt")
+		found := false
+		for _, f := range c.Files {
+			found = found || f == archives
+		}
+		if !found {
+			c.Files = append(c.Files, archives)
+		}
+	}
+	// A calendar written to localdir is synced, but never edited there.
+	if c.Calendar.File != "" {
+		c.Calendar.File = resolvePath(c.LocalDir, c.Calendar.File)
+		if rel, err := filepath.Rel(c.LocalDir, c.Calendar.File); err == nil && within(c.Calendar.File, c.LocalDir) {
+			rel = filepath.ToSlash(rel)
+			found := false
+			for _, f := range c.Files {
+				found = found || f == rel
+			}
+			if !found {
+				c.Files = append(c.Files, rel)
+			}
+			rule := DirectionRule{Pattern: rel, Direction: "push-only"}
+			if len(c.Directions) == 0 || c.Directions[0] != rule {
+				c.Directions = append([]DirectionRule{rule}, c.Directions...)
+			}
+		}
+	}
+}
+
+// defaultDir resolves path against dir, or returns the directory given by
+// def when path is empty. dir itself is used when def fails, such as when
+// the home directory is unknown.
+func defaultDir(dir, path string, def func() (string, error)) string {
+	if path != "" {
+		return resolvePath(dir, path)
+	}
+	d, err := def()
+	if err != nil {
+		return dir
+	}
+	return d
+}
+
+// defaultFile sets an unconfigured path to name in def. Earlier versions
+// kept name in the working directory or in dir, the directory of the
+// configuration file, so files found there are recorded to be moved.
+func (c *Config) defaultFile(path *string, dir, def, name string) {
+	if *path != "" {
+		return
+	}
+	*path = filepath.Join(def, name)
+	seen := map[string]bool{*path: true}
+	for _, from := range []string{filepath.Join(dir, name), name} {
+		from, err := filepath.Abs(from)
+		if err != nil || seen[from] {
+			continue
+		}
+		seen[from] = true
+		c.moves = append(c.moves, Move{From: from, To: *path})
+	}
+}
+
+// resolvePath expands a leading ~ in path and makes it relative to dir
+// unless it's absolute. Empty paths stay empty.
+func resolvePath(dir, path string) string {
+	path = expandHome(path)
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// Move is a file moved by Migrate.
+type Move struct {
+	From, To string
+}
+
+// Migrate moves files kept by earlier versions in the working directory
+// or next to the configuration file to their default location, unless
+// there is a file there already. It returns the files moved.
+func (c *Config) Migrate() ([]Move, error) {
+	var moved []Move
+	for _, m := range c.moves {
+		if _, err := os.Stat(m.To); !os.IsNotExist(err) {
+			continue
+		}
+		st, err := os.Stat(m.From)
+		if err != nil || !st.Mode().IsRegular() {
+			continue
+		}
+		if err := moveFile(m.From, m.To, st.Mode().Perm()); err != nil {
+			return moved, fmt.Errorf("can't move %s to %s: %w", m.From, m.To, err)
+		}
+		moved = append(moved, m)
+	}
+	return moved, nil
+}
+
+// Legacy returns the paths an earlier version used by default for the file
+// now at path, which isn't configured.
+func (c *Config) Legacy(path string) []string {
+	var paths []string
+	for _, m := range c.moves {
+		if m.To == path {
+			paths = append(paths, m.From)
+		}
+	}
+	return paths
+}
+
+// moveFile renames from to, copying it where renaming fails, such as
+// across file systems.
+func moveFile(from, to string, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(to), 0700); err != nil {
+		return err
+	}
+	if err := os.Rename(from, to); err == nil {
+		return nil
+	}
+	b, err := ioutil.ReadFile(from)
+	if err != nil {
+		return err
+	}
+	if err := fsutil.WriteFile(to, b, perm); err != nil {
+		return err
+	}
+	return os.Remove(from)
+}
+
+// Validate reports the first problem found in the configuration.
+func (c *Config) Validate() error {
+	if c.Repo == "" {
+		return errors.New("repo is required")
+	}
+	// A missing repo is created on first use.
+	if st, err := os.Stat(c.Repo); err == nil && !st.IsDir() {
+		return fmt.Errorf("repo: %s is not a directory", c.Repo)
+	}
+	if c.LocalDir == "" {
+		return errors.New("localdir is required")
+	}
+	if err := checkDir("localdir", c.LocalDir); err != nil {
+		return err
+	}
+	if c.Archive.Enabled() {
+		if d := c.Archive.Dir; path.IsAbs(d) || strings.HasPrefix(path.Clean(d), "..") || path.Clean(d) == "." {
+			return fmt.Errorf("archive.dir: %q must be a relative path of a subdirectory", d)
+		}
+		if c.Archive.MaxLines < 0 || c.Archive.MaxKB < 0 || c.Archive.Age < 0 {
+			return errors.New("archive: maxlines, maxkb and age can't be negative")
+		}
+		if c.Remote.Type == "drive" && c.Folder == "" && c.FolderPath == "" {
+			return errors.New("archive requires folder")
+		}
+	}
+	for _, f := range c.Files {
+		if f == "" || path.IsAbs(f) || strings.HasPrefix(path.Clean(f), "..") {
+			return fmt.Errorf("files: %q must be a relative path", f)
+		}
+		if _, err := path.Match(f, ""); err != nil {
+			return fmt.Errorf("files: %q: %w", f, err)
+		}
+		if strings.ContainsAny(f, "*?[\\") && c.Remote.Type == "drive" && c.Folder == "" && c.FolderPath == "" {
+			return fmt.Errorf("files: pattern %q requires folder", f)
+		}
+	}
+	for i, r := range c.Directions {
+		if r.Pattern == "" || path.IsAbs(r.Pattern) || strings.HasPrefix(path.Clean(r.Pattern), "..") {
+			return fmt.Errorf("directions[%d].pattern: %q must be a relative path", i, r.Pattern)
+		}
+		if _, err := path.Match(r.Pattern, ""); err != nil {
+			return fmt.Errorf("directions[%d].pattern: %q: %w", i, r.Pattern, err)
+		}
+		switch r.Direction {
+		case "bidirectional", "push-only", "pull-only":
+		default:
+			return fmt.Errorf("directions[%d].direction: %q is neither bidirectional, push-only nor pull-only", i, r.Direction)
+		}
+	}
+	switch c.Remote.Type {
+	case "drive":
+	case "webdav":
+		u, err := url.Parse(c.Remote.URL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("remote.url: %q must be an http(s) URL", c.Remote.URL)
+		}
+		if c.Folder != "" || c.FolderPath != "" || c.Watch.Webhook != "" {
+			return errors.New("folder, folderpath and watch.webhook require the drive remote")
+		}
+		if c.Docs.Mode != "skip" {
+			return errors.New("docs: only Drive keeps Google Docs")
+		}
+		if c.Lease != 0 {
+			return errors.New("lease requires the drive remote")
+		}
+	default:
+		return fmt.Errorf("remote.type: %q is neither drive nor webdav", c.Remote.Type)
+	}
+	if c.Lease < 0 {
+		return fmt.Errorf("lease: %s is negative", c.Lease)
+	}
+	if c.Interval < time.Second {
+		return fmt.Errorf("interval: %s is shorter than 1s", c.Interval)
+	}
+	if c.MaxInterval < c.Interval {
+		return fmt.Errorf("maxinterval: %s is shorter than interval %s", c.MaxInterval, c.Interval)
+	}
+	if c.IdleAfter < 0 {
+		return fmt.Errorf("idleafter: %s is negative", c.IdleAfter)
+	}
+	for i, q := range c.Quiet {
+		if _, _, err := q.Hours(); err != nil {
+			return fmt.Errorf("quiet[%d]: %w", i, err)
+		}
+		if q.Interval < c.Interval {
+			return fmt.Errorf("quiet[%d].interval: %s is shorter than interval %s", i, q.Interval, c.Interval)
+		}
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("timeout: %s is negative", c.Timeout)
+	}
+	if c.Parallelism < 1 {
+		return fmt.Errorf("parallelism: %d is less than 1", c.Parallelism)
+	}
+	if c.Folder != "" && c.FolderPath != "" {
+		return errors.New("folder and folderpath are mutually exclusive")
+	}
+	switch c.Conflict {
+	case "copy", "markers":
+	case "quarantine":
+		for _, dir := range []string{c.LocalDir, c.Repo} {
+			if within(c.ConflictDir, dir) {
+				return fmt.Errorf("conflictdir: %s is inside %s", c.ConflictDir, dir)
+			}
+		}
+	default:
+		return fmt.Errorf("conflict: %q is neither quarantine, copy nor markers", c.Conflict)
+	}
+	if c.Merge != "lines" && c.Merge != "todotxt" {
+		return fmt.Errorf("merge: %q is neither lines nor todotxt", c.Merge)
+	}
+	if c.Deletions != "restore" && c.Deletions != "propagate" {
+		return fmt.Errorf("deletions: %q is neither restore nor propagate", c.Deletions)
+	}
+	switch c.LineEnding {
+	case "keep", "lf", "crlf", "native":
+	default:
+		return fmt.Errorf("lineending: %q is neither keep, lf, crlf nor native", c.LineEnding)
+	}
+	if c.Duplicates != "newest" && c.Duplicates != "error" {
+		return fmt.Errorf("duplicates: %q is neither newest nor error", c.Duplicates)
+	}
+	switch c.Docs.Mode {
+	case "skip", "readonly":
+	case "convert":
+		// Encrypted content would be converted into the document.
+		if c.Encryption.Enabled {
+			return errors.New("docs: mode convert can't be combined with encryption")
+		}
+	default:
+		return fmt.Errorf("docs.mode: %q is neither skip, readonly nor convert", c.Docs.Mode)
+	}
+	if c.Docs.Format != "text" && c.Docs.Format != "markdown" {
+		return fmt.Errorf("docs.format: %q is neither text nor markdown", c.Docs.Format)
+	}
+	if c.Revisions && c.Remote.Type != "drive" {
+		return errors.New("revisions: only Drive keeps revisions")
+	}
+	if c.Git.SSHKey != "" && c.Git.Token != "" {
+		return errors.New("git: sshkey and token are mutually exclusive")
+	}
+	switch c.Auth {
+	case "user", "adc":
+	case "serviceaccount":
+		if c.ServiceAccount == "" {
+			return errors.New("serviceaccount is required with auth serviceaccount")
+		}
+	default:
+		return fmt.Errorf("auth: %q is neither user, serviceaccount nor adc", c.Auth)
+	}
+	if c.Subject != "" && c.Auth != "serviceaccount" {
+		return errors.New("subject requires auth serviceaccount")
+	}
+	switch c.TokenStore {
+	case "file", "keyring":
+	case "encrypted":
+		if c.TokenPassphrase == "" {
+			return errors.New("tokenstore: encrypted requires tokenpassphrase or $TODOSYNC_TOKEN_PASSPHRASE")
+		}
+	default:
+		return fmt.Errorf("tokenstore: %q is neither file, keyring nor encrypted", c.TokenStore)
+	}
+	if c.Tasks.Provider != "" && c.Tasks.Provider != "google" {
+		return fmt.Errorf("tasks.provider: %q is not google", c.Tasks.Provider)
+	}
+	if c.Tasks.Interval < time.Second {
+		return fmt.Errorf("tasks.interval: %s is shorter than 1s", c.Tasks.Interval)
+	}
+	for i, n := range c.Notify {
+		switch n.Type {
+		case "desktop", "stdout":
+		case "webhook":
+			u, err := url.Parse(n.URL)
+			if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+				return fmt.Errorf("notify[%d].url: %q must be an http(s) URL", i, n.URL)
+			}
+		case "email":
+			if _, _, err := net.SplitHostPort(n.SMTP); err != nil {
+				return fmt.Errorf("notify[%d].smtp: %q must be host:port", i, n.SMTP)
+			}
+			if n.From == "" || len(n.To) == 0 {
+				return fmt.Errorf("notify[%d]: email requires from and to", i)
+			}
+		case "telegram":
+			if n.Token == "" || n.Chat == "" {
+				return fmt.Errorf("notify[%d]: telegram requires token and chat", i)
+			}
+		default:
+			return fmt.Errorf("notify[%d].type: %q is neither desktop, webhook, email, telegram nor stdout", i, n.Type)
+		}
+		for _, e := range n.Events {
+			switch e {
+			case "conflict", "remote", "deleted", "error", "digest":
+			default:
+				return fmt.Errorf("notify[%d].events: %q is neither conflict, remote, deleted, error nor digest", i, e)
+			}
+		}
+	}
+	if c.Calendar.Serve && c.Web.Listen == "" {
+		return errors.New("calendar.serve requires web.listen")
+	}
+	if u := c.Calendar.CalDAV; u != "" {
+		if u, err := url.Parse(u); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("calendar.caldav: %q must be an http(s) URL", c.Calendar.CalDAV)
+		}
+	}
+	if f := c.Calendar.File; f != "" && (within(f, c.Repo) || f == c.LocalDir) {
+		return fmt.Errorf("calendar.file: %s is inside repo or is localdir", f)
+	}
+	for i, m := range c.Mirrors {
+		if m.Type != "dir" && m.Type != "obsidian" {
+			return fmt.Errorf("mirrors[%d].type: %q is neither dir nor obsidian", i, m.Type)
+		}
+		if m.Dir == "" {
+			return fmt.Errorf("mirrors[%d].dir is required", i)
+		}
+		for _, dir := range []string{c.LocalDir, c.Repo} {
+			if within(m.Dir, dir) || within(dir, m.Dir) {
+				return fmt.Errorf("mirrors[%d].dir: %s overlaps %s", i, m.Dir, dir)
+			}
+		}
+		if p := m.Prefix; path.IsAbs(p) || strings.HasPrefix(path.Clean(p), "..") {
+			return fmt.Errorf("mirrors[%d].prefix: %q must be a relative path", i, p)
+		}
+		if m.Ext != "" && (!strings.HasPrefix(m.Ext, ".") || strings.ContainsAny(m.Ext, `/\`)) {
+			return fmt.Errorf("mirrors[%d].ext: %q must start with a dot", i, m.Ext)
+		}
+		for _, f := range m.Files {
+			if _, err := path.Match(f, ""); err != nil {
+				return fmt.Errorf("mirrors[%d].files: %q: %w", i, f, err)
+			}
+		}
+	}
+	if c.Digest.At != "" {
+		if _, _, err := c.Digest.Schedule(); err != nil {
+			return err
+		}
+		if len(c.Notify) == 0 {
+			return errors.New("digest requires notify")
+		}
+	}
+	if c.Health.Failures < 0 {
+		return fmt.Errorf("health.failures: %d is negative", c.Health.Failures)
+	}
+	if c.Health.MaxAge < 0 {
+		return fmt.Errorf("health.maxage: %s is negative", c.Health.MaxAge)
+	}
+	switch c.Log.Level {
+	case "debug", "info", "warn", "error":
+	default:
+		return fmt.Errorf("log.level: %q is neither debug, info, warn nor error", c.Log.Level)
+	}
+	if c.Log.Format != "text" && c.Log.Format != "json" {
+		return fmt.Errorf("log.format: %q is neither text nor json", c.Log.Format)
+	}
+	if c.Watch.Webhook != "" {
+		u, err := url.Parse(c.Watch.Webhook)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("watch.webhook: %q must be an https URL", c.Watch.Webhook)
+		}
+		if c.Watch.Listen == "" {
+			return errors.New("watch.listen is required with watch.webhook")
+		}
+	}
+	return nil
+}
+
+func checkDir(field, path string) error {
+	st, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("%s: %w", field, err)
+	}
+	if !st.IsDir() {
+		return fmt.Errorf("%s: %s is not a directory", field, path)
+	}
+	return nil
+}
+
+// within reports whether path is dir or below it.
+func within(path, dir string) bool {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// expandHome replaces leading ~ with the user's home directory.
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") && !strings.HasPrefix(path, "~"+string(filepath.Separator)) {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[1:])
+}
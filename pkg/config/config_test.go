@@ -0,0 +1,175 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// load writes a configuration file with a repo and local dir in a
+// temporary directory followed by extra, and loads it.
+func load(t *testing.T, extra string) ([]*Config, error) {
+	t.Helper()
+	dir := t.TempDir()
+	local := filepath.Join(dir, "local")
+	if err := os.Mkdir(local, 0755); err != nil {
+		t.Fatal(err)
+	}
+	content := "repo: " + filepath.Join(dir, "repo") + "\nlocaldir: " + local + "\n" + extra
+	path := filepath.Join(dir, "todosync.yaml")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return Load(path, Dirs{Config: filepath.Join(dir, "config"), State: filepath.Join(dir, "state")})
+}
+
+func TestIntervals(t *testing.T) {
+	tests := []struct {
+		config   string
+		interval time.Duration
+		max      time.Duration
+		err      string
+	}{
+		{"", 5 * time.Second, 5 * time.Minute, ""},
+		{"interval: 1m\n", time.Minute, 5 * time.Minute, ""},
+		{"interval: 10m\n", 10 * time.Minute, 10 * time.Minute, ""},
+		{"interval: 10m\nmaxinterval: 1h\n", 10 * time.Minute, time.Hour, ""},
+		{"interval: 10m\nmaxinterval: 5m\n", 0, 0, "maxinterval: 5m0s is shorter than interval 10m0s"},
+	}
+	for _, tt := range tests {
+		profiles, err := load(t, tt.config)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%q: got error %v, want %q", tt.config, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.config, err)
+			continue
+		}
+		c := profiles[0]
+		if c.Interval != tt.interval || c.MaxInterval != tt.max {
+			t.Errorf("%q: got interval %s, maxinterval %s, want %s, %s", tt.config, c.Interval, c.MaxInterval, tt.interval, tt.max)
+		}
+	}
+}
+
+func TestDefaults(t *testing.T) {
+	profiles, err := load(t, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(profiles) != 1 {
+		t.Fatalf("got %d profiles, want 1", len(profiles))
+	}
+	c := profiles[0]
+	state := c.Dirs.State
+	for _, f := range []struct{ field, got, want string }{
+		{"remote.type", c.Remote.Type, "drive"},
+		{"files", strings.Join(c.Files, ","), "todo.txt,done.txt"},
+		{"conflict", c.Conflict, "quarantine"},
+		{"conflictdir", c.ConflictDir, filepath.Join(state, "conflicts")},
+		{"state", c.State, filepath.Join(state, "state.json")},
+		{"token", c.Token, filepath.Join(state, "token.json")},
+		{"encryption.key", c.Encryption.Key, filepath.Join(c.Dirs.Config, "encryption.key")},
+		{"merge", c.Merge, "lines"},
+		{"deletions", c.Deletions, "restore"},
+		{"lineending", c.LineEnding, "keep"},
+		{"docs.mode", c.Docs.Mode, "skip"},
+	} {
+		if f.got != f.want {
+			t.Errorf("%s: got %q, want %q", f.field, f.got, f.want)
+		}
+	}
+	if c.Parallelism != 4 || c.Timeout != 5*time.Minute {
+		t.Errorf("got parallelism %d, timeout %s", c.Parallelism, c.Timeout)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct{ config, err string }{
+		{"conflict: bogus\n", `conflict: "bogus" is neither quarantine, copy nor markers`},
+		{"merge: bogus\n", `merge: "bogus" is neither lines nor todotxt`},
+		{"interval: 100ms\n", "interval: 100ms is shorter than 1s"},
+		{"parallelism: -1\n", "parallelism: -1 is less than 1"},
+		{"files: [/etc/passwd]\n", `files: "/etc/passwd" must be a relative path`},
+		{"conflictdir: local/conflicts\n", "is inside"},
+		{"remote:\n  type: webdav\n  url: ftp://example.com\n", `remote.url: "ftp://example.com" must be an http(s) URL`},
+		{"remote:\n  type: webdav\n  url: https://example.com\nlease: 1m\n", "lease requires the drive remote"},
+		{"bogus: 1\n", "field bogus not found"},
+	}
+	for _, tt := range tests {
+		_, err := load(t, tt.config)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%q: got error %v, want %q", tt.config, err, tt.err)
+		}
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	profiles, err := load(t, `interval: 1m
+profiles:
+  work:
+    repo: work-repo
+    localdir: .
+    conflict: copy
+    interval: 10s
+  home: {}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(profiles) != 2 || profiles[0].Name != "home" || profiles[1].Name != "work" {
+		t.Fatalf("got profiles %v", profiles)
+	}
+	home, work := profiles[0], profiles[1]
+	if home.Interval != time.Minute || work.Interval != 10*time.Second {
+		t.Errorf("got intervals %s and %s, want 1m0s and 10s", home.Interval, work.Interval)
+	}
+	if home.Repo == work.Repo || filepath.Base(work.Repo) != "work-repo" {
+		t.Errorf("got repos %s and %s", home.Repo, work.Repo)
+	}
+	if filepath.Base(work.State) != "state-work.json" || filepath.Base(home.ConflictDir) != "conflicts-home" {
+		t.Errorf("got state %s and conflictdir %s", work.State, home.ConflictDir)
+	}
+
+	for _, tt := range []struct{ config, err string }{
+		{"profiles:\n  a: {}\n  b: {}\n", "profiles a and b share repo"},
+		{"profiles:\n  a b: {}\n", "name may only contain letters, digits, - and _"},
+		{"profiles:\n  a:\n    merge: bogus\n", `profile a: merge: "bogus"`},
+	} {
+		_, err := load(t, tt.config)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%q: got error %v, want %q", tt.config, err, tt.err)
+		}
+	}
+}
+
+func TestProfileDaemonSettings(t *testing.T) {
+	base := "health:\n  listen: localhost:8080\nweb:\n  listen: localhost:8081\n"
+	profiles, err := load(t, base+"profiles:\n  a: {}\n  b:\n    repo: b\n    localdir: .\n    conflict: copy\n    health:\n      listen: localhost:8080\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range profiles {
+		if c.Health.Listen != "localhost:8080" || c.Web.Listen != "localhost:8081" {
+			t.Errorf("profile %s: got health %s, web %s", c.Name, c.Health.Listen, c.Web.Listen)
+		}
+	}
+
+	// The daemon serves health and the dashboard once for all profiles.
+	for _, tt := range []struct{ config, err string }{
+		{"profiles:\n  a:\n    health:\n      listen: localhost:9090\n", "profile a: health can only be set at the top level"},
+		{"profiles:\n  a:\n    web:\n      listen: localhost:9090\n", "profile a: web can only be set at the top level"},
+		{"profiles:\n  a:\n    health:\n      failures: 3\n", "profile a: health can only be set at the top level"},
+	} {
+		_, err := load(t, base+tt.config)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%q: got error %v, want %q", tt.config, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+// Package crypt encrypts files kept in remote storage with a local key, so
+// that the store only ever sees ciphertext while the repo and the local
+// directory stay plain.
+package crypt
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/mizhka/todosync/pkg/fsutil"
+	"github.com/mizhka/todosync/pkg/remote"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// magic starts the content of encrypted files, followed by the nonce and
+// the sealed box.
+const magic = "todosync-secretbox-v1\n"
+
+const nonceSize = 24
+
+// ErrDecrypt is wrapped by errors of encrypted files failing to decrypt,
+// such as ones encrypted with another key or corrupted.
+var ErrDecrypt = errors.New("can't decrypt")
+
+// Key is a secretbox key.
+type Key [32]byte
+
+// LoadKey reads the key kept base64 encoded in the file at path. A missing
+// file is created with a random key, reporting created.
+func LoadKey(path string) (key *Key, created bool, err error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		key = new(Key)
+		if _, err := rand.Read(key[:]); err != nil {
+			return nil, false, err
+		}
+		text := base64.StdEncoding.EncodeToString(key[:]) + "\n"
+		if err := fsutil.WriteFile(path, []byte(text), 0600); err != nil {
+			return nil, false, fmt.Errorf("can't save encryption key: %w", err)
+		}
+		return key, true, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("can't read encryption key: %w", err)
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil || len(raw) != len(Key{}) {
+		return nil, false, fmt.Errorf("%s: not a base64 encoded %d byte key", path, len(Key{}))
+	}
+	key = new(Key)
+	copy(key[:], raw)
+	return key, false, nil
+}
+
+// Seal encrypts content with key.
+func Seal(key *Key, content []byte) ([]byte, error) {
+	var nonce [nonceSize]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	out := append([]byte(magic), nonce[:]...)
+	return secretbox.Seal(out, content, &nonce, (*[32]byte)(key)), nil
+}
+
+// Sealed reports whether content has the header of encrypted files.
+func Sealed(content []byte) bool {
+	return bytes.HasPrefix(content, []byte(magic))
+}
+
+// Open decrypts content sealed with key.
+func Open(key *Key, content []byte) ([]byte, error) {
+	if !Sealed(content) {
+		return nil, fmt.Errorf("%w: not encrypted", ErrDecrypt)
+	}
+	content = content[len(magic):]
+	if len(content) < nonceSize {
+		return nil, ErrDecrypt
+	}
+	var nonce [nonceSize]byte
+	copy(nonce[:], content)
+	plain, ok := secretbox.Open(nil, content[nonceSize:], &nonce, (*[32]byte)(key))
+	if !ok {
+		return nil, ErrDecrypt
+	}
+	return plain, nil
+}
+
+// Store encrypts files of the wrapped store. Checksums it lists are those
+// of the ciphertext, which changes on every upload, so they are left out:
+// the sync engine then tells changes by revision and the plain content.
+type Store struct {
+	store remote.Store
+	key   *Key
+}
+
+var _ remote.Store = (*Store)(nil)
+
+// New returns a store encrypting files of store with key. The result also
+// implements remote.Historian when store does.
+func New(store remote.Store, key *Key) remote.Store {
+	s := &Store{store: store, key: key}
+	if h, ok := store.(remote.Historian); ok {
+		return &historyStore{Store: s, Historian: h}
+	}
+	return s
+}
+
+// List returns files of the wrapped store without checksums.
+func (s *Store) List(ctx context.Context, patterns []string) ([]*remote.File, error) {
+	files, err := s.store.List(ctx, patterns)
+	for _, f := range files {
+		plain(f)
+	}
+	return files, err
+}
+
+// Download saves the decrypted content of the file to dst, verifying it
+// against the checksum of the plain content if f has one.
+func (s *Store) Download(ctx context.Context, f *remote.File, dst string) error {
+	content, err := s.Fetch(ctx, f)
+	if err != nil {
+		return err
+	}
+	return fsutil.WriteReader(dst, bytes.NewReader(content), 0644, f.Checksum, -1)
+}
+
+// Fetch returns the decrypted content of the file, and marks it
+// Encrypted. Plain content, written before encryption was enabled, is
+// returned as it is unless the file is marked Encrypted already: then it
+// was replaced by someone without the key, and fails to decrypt.
+func (s *Store) Fetch(ctx context.Context, f *remote.File) ([]byte, error) {
+	content, err := s.store.Fetch(ctx, f)
+	if err != nil {
+		return nil, err
+	}
+	if !Sealed(content) && !f.Encrypted {
+		return content, nil
+	}
+	content, err = Open(s.key, content)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", f.Path, err)
+	}
+	f.Encrypted = true
+	return content, nil
+}
+
+// Upload replaces content of the file by the encrypted local file src.
+func (s *Store) Upload(ctx context.Context, f *remote.File, src string) (*remote.File, error) {
+	return s.sealed(src, func(tmp string) (*remote.File, error) {
+		return s.store.Upload(ctx, f, tmp)
+	})
+}
+
+// Create uploads the encrypted local file src as a new file at the slash
+// separated path.
+func (s *Store) Create(ctx context.Context, name, src string) (*remote.File, error) {
+	return s.sealed(src, func(tmp string) (*remote.File, error) {
+		return s.store.Create(ctx, name, tmp)
+	})
+}
+
+// Delete removes the file from the wrapped store.
+func (s *Store) Delete(ctx context.Context, f *remote.File) error {
+	return s.store.Delete(ctx, f)
+}
+
+// sealed calls upload with a temporary file holding the encrypted content
+// of src and returns the uploaded file with the checksum of src.
+func (s *Store) sealed(src string, upload func(tmp string) (*remote.File, error)) (*remote.File, error) {
+	content, err := ioutil.ReadFile(src)
+	if err != nil {
+		return nil, err
+	}
+	box, err := Seal(s.key, content)
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempFile("", ".todosync-*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(box)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't encrypt %s: %w", src, err)
+	}
+	f, err := upload(tmp.Name())
+	if err != nil {
+		return nil, err
+	}
+	plain(f)
+	sum := md5.Sum(content)
+	f.Checksum, f.Size = hex.EncodeToString(sum[:]), int64(len(content))
+	f.Encrypted = true
+	return f, nil
+}
+
+// plain drops what describes the ciphertext rather than the content.
+func plain(f *remote.File) {
+	f.Checksum, f.Size = "", 0
+}
+
+// historyStore is a Store over a store keeping past versions of files.
+// Checksums of revisions are those of the ciphertext, which the wrapped
+// store verifies on fetching them.
+type historyStore struct {
+	*Store
+	remote.Historian
+}
+
+var _ remote.Historian = (*historyStore)(nil)
+
+// FetchRevision returns the decrypted content of a version of the file.
+// Plain versions are returned as they are, since they may predate
+// encryption.
+func (s *historyStore) FetchRevision(ctx context.Context, f *remote.File, rev *remote.Revision) ([]byte, error) {
+	content, err := s.Historian.FetchRevision(ctx, f, rev)
+	if err != nil || !Sealed(content) {
+		return content, err
+	}
+	content, err = Open(s.key, content)
+	if err != nil {
+		return nil, fmt.Errorf("%s revision %s: %w", f.Path, rev.ID, err)
+	}
+	return content, nil
+}
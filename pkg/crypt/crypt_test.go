@@ -0,0 +1,121 @@
+package crypt
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/mizhka/todosync/pkg/remote"
+	"github.com/mizhka/todosync/pkg/simulate"
+)
+
+func testKey(t *testing.T) *Key {
+	t.Helper()
+	key, created, err := LoadKey(filepath.Join(t.TempDir(), "encryption.key"))
+	if err != nil || !created {
+		t.Fatalf("LoadKey: created %v, %v", created, err)
+	}
+	return key
+}
+
+func TestSealOpen(t *testing.T) {
+	key := testKey(t)
+	plain := []byte("(A) Call mom\nBuy milk\n")
+	box, err := Seal(key, plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(box, []byte("Call mom")) {
+		t.Error("sealed content holds the plain text")
+	}
+	got, err := Open(key, box)
+	if err != nil || !bytes.Equal(got, plain) {
+		t.Fatalf("Open: %q, %v", got, err)
+	}
+
+	tampered := append([]byte(nil), box...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := Open(key, tampered); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("tampered: got %v, want ErrDecrypt", err)
+	}
+	if _, err := Open(testKey(t), box); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("other key: got %v, want ErrDecrypt", err)
+	}
+	if _, err := Open(key, box[:len(magic)+3]); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("truncated: got %v, want ErrDecrypt", err)
+	}
+	if _, err := Open(key, plain); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("plain: got %v, want ErrDecrypt", err)
+	}
+}
+
+func TestLoadKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "encryption.key")
+	key, _, err := LoadKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, created, err := LoadKey(path)
+	if err != nil || created || *again != *key {
+		t.Errorf("reloaded key differs: created %v, %v", created, err)
+	}
+	if err := ioutil.WriteFile(path, []byte("short\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := LoadKey(path); err == nil {
+		t.Error("invalid key loaded")
+	}
+}
+
+func TestStore(t *testing.T) {
+	ctx := context.Background()
+	key := testKey(t)
+	mem := simulate.NewStore()
+	s := New(mem, key)
+	src := filepath.Join(t.TempDir(), "todo.txt")
+	plain := []byte("Buy milk\n")
+	if err := ioutil.WriteFile(src, plain, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := s.Create(ctx, "todo.txt", src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.Encrypted {
+		t.Error("created file not marked encrypted")
+	}
+	if stored, _ := mem.Content("todo.txt"); !Sealed(stored) {
+		t.Errorf("stored plain content %q", stored)
+	}
+	listed := func() *remote.File {
+		files, err := s.List(ctx, nil)
+		if err != nil || len(files) != 1 {
+			t.Fatalf("List: %v, %v", files, err)
+		}
+		return files[0]
+	}
+	got, err := s.Fetch(ctx, listed())
+	if err != nil || !bytes.Equal(got, plain) {
+		t.Errorf("Fetch: %q, %v", got, err)
+	}
+
+	// Plain content replacing an encrypted file is refused, but taken as
+	// it is from files not known to be encrypted, as before encryption
+	// was enabled.
+	forged := []byte("Send money\n")
+	mem.Put("todo.txt", forged)
+	f = listed()
+	f.Encrypted = true
+	if _, err := s.Fetch(ctx, f); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("forged plain content: got %v, want ErrDecrypt", err)
+	}
+	f = listed()
+	got, err = s.Fetch(ctx, f)
+	if err != nil || !bytes.Equal(got, forged) || f.Encrypted {
+		t.Errorf("plain content of a file never encrypted: %q, encrypted %v, %v", got, f.Encrypted, err)
+	}
+}
@@ -0,0 +1,193 @@
+package drive
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mizhka/todosync/pkg/fsutil"
+	drive "google.golang.org/api/drive/v3"
+)
+
+// ChangeFeed follows the Drive changes feed starting from a page token
+// persisted between runs.
+type ChangeFeed struct {
+	c         *Client
+	tokenFile string
+	token     string
+
+	mu      sync.Mutex
+	channel *drive.Channel
+	secret  string
+	notify  chan struct{}
+}
+
+// ChangeFeed opens the changes feed. The page token is read from tokenFile,
+// or the current start token is requested from Drive on the first run.
+func (c *Client) ChangeFeed(ctx context.Context, tokenFile string) (*ChangeFeed, error) {
+	feed := &ChangeFeed{
+		c:         c,
+		tokenFile: tokenFile,
+		notify:    make(chan struct{}, 1),
+	}
+
+	b, err := ioutil.ReadFile(tokenFile)
+	if err == nil && len(strings.TrimSpace(string(b))) > 0 {
+		feed.token = strings.TrimSpace(string(b))
+		return feed, nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("can't read page token %s: %w", tokenFile, err)
+	}
+
+	var start *drive.StartPageToken
+	err = retry(ctx, func() (err error) {
+		start, err = c.srv.Changes.GetStartPageToken().SupportsAllDrives(true).Context(ctx).Do()
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to get start page token: %w", err)
+	}
+	if err := feed.saveToken(start.StartPageToken); err != nil {
+		return nil, err
+	}
+	return feed, nil
+}
+
+// Poll reads all changes since the stored page token and reports whether
+// any of them touches a file whose name is accepted by match, Google Docs
+// by the name they are synced at. Removed files are always reported as
+// relevant because their names are unknown.
+func (f *ChangeFeed) Poll(ctx context.Context, match func(name string) bool) (bool, error) {
+	relevant := false
+	token := f.token
+	for {
+		var r *drive.ChangeList
+		err := retry(ctx, func() (err error) {
+			r, err = f.c.srv.Changes.List(token).SupportsAllDrives(true).IncludeItemsFromAllDrives(true).
+				Fields("nextPageToken, newStartPageToken, changes(fileId, removed, file(name, mimeType))").Context(ctx).Do()
+			return err
+		})
+		if err != nil {
+			return false, fmt.Errorf("unable to list changes: %w", err)
+		}
+		for _, ch := range r.Changes {
+			switch {
+			case ch.Removed || ch.File == nil || match(ch.File.Name):
+				relevant = true
+			case ch.File.MimeType == docMimeType && f.c.synced(docMimeType):
+				relevant = relevant || match(f.c.docName(ch.File.Name))
+			}
+		}
+		if r.NewStartPageToken != "" {
+			return relevant, f.saveToken(r.NewStartPageToken)
+		}
+		token = r.NextPageToken
+	}
+}
+
+// Watch subscribes address to push notifications about changes for ttl.
+// Notifications received by the ChangeFeed handler are delivered to the
+// Notify channel. A previous subscription is stopped.
+func (f *ChangeFeed) Watch(ctx context.Context, address string, ttl time.Duration) (time.Time, error) {
+	id, err := randomHex(16)
+	if err != nil {
+		return time.Time{}, err
+	}
+	secret, err := randomHex(16)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	ch, err := f.c.srv.Changes.Watch(f.token, &drive.Channel{
+		Id:         id,
+		Type:       "web_hook",
+		Address:    address,
+		Token:      secret,
+		Expiration: time.Now().Add(ttl).UnixNano() / int64(time.Millisecond),
+	}).SupportsAllDrives(true).IncludeItemsFromAllDrives(true).Context(ctx).Do()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("unable to watch changes: %w", err)
+	}
+
+	if err := f.Stop(ctx); err != nil {
+		slog.Warn("Can't stop previous channel", "err", err)
+	}
+
+	f.mu.Lock()
+	f.channel = ch
+	f.secret = secret
+	f.mu.Unlock()
+	return time.Unix(0, ch.Expiration*int64(time.Millisecond)), nil
+}
+
+// Stop unsubscribes the current push notification channel, if any.
+func (f *ChangeFeed) Stop(ctx context.Context) error {
+	f.mu.Lock()
+	ch := f.channel
+	f.channel = nil
+	f.mu.Unlock()
+
+	if ch == nil {
+		return nil
+	}
+	err := f.c.srv.Channels.Stop(&drive.Channel{Id: ch.Id, ResourceId: ch.ResourceId}).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("unable to stop channel %s: %w", ch.Id, err)
+	}
+	return nil
+}
+
+// Notify receives a value when Drive reports a change through the webhook.
+func (f *ChangeFeed) Notify() <-chan struct{} {
+	return f.notify
+}
+
+// ServeHTTP accepts Drive push notifications for the current channel.
+func (f *ChangeFeed) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	ch, secret := f.channel, f.secret
+	f.mu.Unlock()
+
+	if ch == nil || r.Header.Get("X-Goog-Channel-ID") != ch.Id ||
+		r.Header.Get("X-Goog-Channel-Token") != secret {
+		http.Error(w, "unknown channel", http.StatusNotFound)
+		return
+	}
+
+	// The "sync" message only confirms the subscription.
+	if r.Header.Get("X-Goog-Resource-State") != "sync" {
+		select {
+		case f.notify <- struct{}{}:
+		default:
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (f *ChangeFeed) saveToken(token string) error {
+	if token == f.token {
+		return nil
+	}
+	if err := fsutil.WriteFile(f.tokenFile, []byte(token+"\n"), 0600); err != nil {
+		return fmt.Errorf("can't save page token %s: %w", f.tokenFile, err)
+	}
+	f.token = token
+	return nil
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
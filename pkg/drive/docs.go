@@ -0,0 +1,123 @@
+package drive
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/mizhka/todosync/pkg/remote"
+	drive "google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+)
+
+// docMimeType is the MIME type of Google Docs.
+const docMimeType = "application/vnd.google-apps.document"
+
+// DocsMode selects how Google Docs in the synced folder are handled.
+type DocsMode string
+
+const (
+	// DocsSkip leaves Google Docs out, as they have no content to
+	// download.
+	DocsSkip DocsMode = "skip"
+	// DocsReadOnly exports Google Docs as text, synced pull-only: local
+	// changes are overwritten by the document.
+	DocsReadOnly DocsMode = "readonly"
+	// DocsConvert exports Google Docs as text and converts local changes
+	// back into the document, which loses formatting text can't express.
+	DocsConvert DocsMode = "convert"
+)
+
+// ErrReadOnly is wrapped by errors of uploads to read-only Google Docs.
+var ErrReadOnly = errors.New("google doc is read-only")
+
+// docsFormat returns the MIME type Google Docs are exported to and the
+// extension added to their names.
+func (c *Client) docsFormat() (string, string) {
+	if c.DocsFormat == "text/markdown" {
+		return c.DocsFormat, ".md"
+	}
+	return "text/plain", ".txt"
+}
+
+// docName returns the path a Google Doc named name is synced at: its name
+// with the extension of the export format, unless it has one already.
+func (c *Client) docName(name string) string {
+	_, ext := c.docsFormat()
+	if strings.EqualFold(path.Ext(name), ext) {
+		return name
+	}
+	return name + ext
+}
+
+// docNames adds to names the names of Google Docs they may be synced from.
+func (c *Client) docNames(names []string) []string {
+	if c.Docs == "" || c.Docs == DocsSkip {
+		return names
+	}
+	_, ext := c.docsFormat()
+	all := names
+	for _, name := range names {
+		if strings.EqualFold(path.Ext(name), ext) {
+			all = append(all, strings.TrimSuffix(name, path.Ext(name)))
+		}
+	}
+	return all
+}
+
+// synced reports whether files of the MIME type are synced.
+func (c *Client) synced(mimeType string) bool {
+	if mimeType == docMimeType {
+		return c.Docs != "" && c.Docs != DocsSkip
+	}
+	return !strings.HasPrefix(mimeType, "application/vnd.google-apps.")
+}
+
+// export returns the content of the Google Doc in the export format, with
+// LF line endings and without the byte order mark of text exports.
+func (c *Client) export(ctx context.Context, f *remote.File) ([]byte, error) {
+	mimeType, _ := c.docsFormat()
+	var content []byte
+	err := retry(ctx, func() error {
+		data, err := c.srv.Files.Export(f.ID, mimeType).Context(ctx).Download()
+		if err != nil {
+			return fmt.Errorf("unable to export google doc: %s %w", f.Path, err)
+		}
+		defer data.Body.Close()
+		content, err = ioutil.ReadAll(data.Body)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	content = bytes.TrimPrefix(content, []byte("\ufeff"))
+	return bytes.ReplaceAll(content, []byte("\r\n"), []byte("\n")), nil
+}
+
+// importDoc replaces content of the Google Doc by the local file src,
+// which Drive converts from the export format.
+func (c *Client) importDoc(ctx context.Context, gfile *remote.File, src string) (*drive.File, error) {
+	if gfile.ReadOnly {
+		return nil, fmt.Errorf("can't upload %s: %w", gfile.Path, ErrReadOnly)
+	}
+	mimeType, _ := c.docsFormat()
+	var updated *drive.File
+	err := retry(ctx, func() error {
+		f, _, err := open(src)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		updated, err = c.srv.Files.Update(gfile.ID, &drive.File{}).SupportsAllDrives(true).
+			Media(f, googleapi.ContentType(mimeType)).Fields(fileFields).Context(ctx).Do()
+		if err != nil {
+			return fmt.Errorf("can't upload google doc %s (%s): %w", gfile.Path, gfile.ID, err)
+		}
+		return nil
+	})
+	return updated, err
+}
@@ -0,0 +1,479 @@
+// Package drive wraps the Google Drive API calls used by todosync.
+package drive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mizhka/todosync/pkg/fsutil"
+	"github.com/mizhka/todosync/pkg/gauth"
+	"github.com/mizhka/todosync/pkg/ratelimit"
+	"github.com/mizhka/todosync/pkg/remote"
+	drive "google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+)
+
+// folderMimeType is the MIME type of Drive folders.
+const folderMimeType = "application/vnd.google-apps.folder"
+
+// fileFields are the file metadata requested from Drive, enough to tell
+// whether a file changed without another request.
+const fileFields = "id, name, mimeType, md5Checksum, size, version, headRevisionId, modifiedTime"
+
+// listFields are the fields of file list responses.
+const listFields = "nextPageToken, files(" + fileFields + ")"
+
+// uploadChunkSize is the size of chunks of resumable uploads, a multiple of
+// googleapi.MinUploadChunkSize. Smaller files are sent in one request.
+const uploadChunkSize = 1 << 20
+
+var _ remote.Store = (*Client)(nil)
+var _ remote.Racy = (*Client)(nil)
+
+// Client is a Google Drive client authorized with the user's OAuth token.
+// It implements remote.Store, with paths relative to the Folder.
+type Client struct {
+	// Folder is the ID of the Drive folder mapped to the repository. New
+	// files are created in the root folder when empty.
+	Folder string
+	// Progress, when set, is called after each chunk of a resumable
+	// upload with the number of bytes sent and the size of the file.
+	Progress func(name string, sent, total int64)
+	// Docs selects whether Google Docs are synced, skipped when empty.
+	Docs DocsMode
+	// DocsFormat is the MIME type Google Docs are exported to, either
+	// text/plain, the default, or text/markdown.
+	DocsFormat string
+	// Lease, when set, makes uploads hold a lease of that duration on the
+	// file through its appProperties, so that cooperating clients don't
+	// write it meanwhile. Holder identifies this client in leases.
+	Lease  time.Duration
+	Holder string
+
+	srv *drive.Service
+}
+
+// NewClient builds a Drive client authorized by creds. Its requests are
+// paced by limiter unless it's nil.
+func NewClient(ctx context.Context, creds *gauth.Credentials, limiter *ratelimit.Limiter) (*Client, error) {
+	client, err := creds.Client(ctx, drive.DriveScope)
+	if err != nil {
+		return nil, err
+	}
+	if limiter != nil {
+		paced := *client
+		paced.Transport = limiter.Transport(client.Transport)
+		client = &paced
+	}
+
+	srv, err := drive.NewService(ctx, option.WithHTTPClient(client))
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve Drive client: %w", err)
+	}
+	return &Client{srv: srv}, nil
+}
+
+// Authorize asks the user to grant access to Drive and saves the token of
+// creds. With noBrowser the authorization page may be opened on another
+// device.
+func Authorize(ctx context.Context, creds *gauth.Credentials, noBrowser bool) error {
+	return creds.Authorize(ctx, noBrowser, drive.DriveScope)
+}
+
+// List returns files of the Folder and its subfolders with their
+// checksums and revisions, which come with the listing. Without a Folder
+// only files named literally in patterns are looked up by name.
+func (c *Client) List(ctx context.Context, patterns []string) ([]*remote.File, error) {
+	if c.Folder != "" {
+		return c.ListFolder(ctx)
+	}
+	var names []string
+	for _, pattern := range patterns {
+		if !strings.ContainsAny(pattern, "*?[\\") {
+			names = append(names, pattern)
+		}
+	}
+	return c.ListNames(ctx, c.docNames(names))
+}
+
+// ListNames returns the Drive files whose name matches one of names. With
+// a Folder only files directly in it are returned. Trashed files and
+// Drive native documents which aren't synced are skipped.
+func (c *Client) ListNames(ctx context.Context, names []string) ([]*remote.File, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	q := newQuery().name(names...).notTrashed()
+	if c.Folder != "" {
+		q.in(c.Folder)
+	}
+
+	var files []*remote.File
+	token := ""
+	for {
+		var r *drive.FileList
+		err := retry(ctx, func() (err error) {
+			r, err = c.srv.Files.List().SupportsAllDrives(true).IncludeItemsFromAllDrives(true).OrderBy("name").
+				PageToken(token).Q(q.String()).Fields(listFields).Context(ctx).Do()
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to retrieve files: %w", err)
+		}
+		for _, f := range r.Files {
+			if c.synced(f.MimeType) {
+				files = append(files, c.fileOf(f, f.Name))
+			}
+		}
+		token = r.NextPageToken
+		if token == "" {
+			return files, nil
+		}
+	}
+}
+
+// ResolveFolder returns the ID of the folder at the slash separated path
+// from the root of My Drive.
+func (c *Client) ResolveFolder(ctx context.Context, name string) (string, error) {
+	id := "root"
+	for _, elem := range strings.Split(strings.Trim(name, "/"), "/") {
+		if elem == "" {
+			continue
+		}
+		child, err := c.findFolder(ctx, id, elem)
+		if err != nil {
+			return "", err
+		}
+		if child == "" {
+			return "", fmt.Errorf("no folder %s in google drive", name)
+		}
+		id = child
+	}
+	return id, nil
+}
+
+// MakeFolder returns the ID of the folder at the slash separated path from
+// the root of My Drive, creating missing folders along the path.
+func (c *Client) MakeFolder(ctx context.Context, name string) (string, error) {
+	id := "root"
+	for _, elem := range strings.Split(strings.Trim(name, "/"), "/") {
+		if elem == "" {
+			continue
+		}
+		child, err := c.subfolder(ctx, id, elem)
+		if err != nil {
+			return "", err
+		}
+		id = child
+	}
+	return id, nil
+}
+
+// ListFolder returns all files in the Folder and its subfolders. Drive
+// native documents, which have no content to download, are skipped unless
+// they are Google Docs exported as set by Docs.
+func (c *Client) ListFolder(ctx context.Context) ([]*remote.File, error) {
+	var files []*remote.File
+	dirs := []*remote.File{{ID: c.Folder}}
+	for len(dirs) > 0 {
+		dir := dirs[0]
+		dirs = dirs[1:]
+
+		token := ""
+		for {
+			var r *drive.FileList
+			err := retry(ctx, func() (err error) {
+				r, err = c.srv.Files.List().SupportsAllDrives(true).IncludeItemsFromAllDrives(true).OrderBy("name").PageToken(token).
+					Q(newQuery().in(dir.ID).notTrashed().String()).
+					Fields(listFields).Context(ctx).Do()
+				return err
+			})
+			if err != nil {
+				return nil, fmt.Errorf("unable to list folder %s: %w", dir.Path, err)
+			}
+			for _, f := range r.Files {
+				file := c.fileOf(f, path.Join(dir.Path, f.Name))
+				switch {
+				case f.MimeType == folderMimeType:
+					dirs = append(dirs, file)
+				case c.synced(f.MimeType):
+					files = append(files, file)
+				}
+			}
+			token = r.NextPageToken
+			if token == "" {
+				break
+			}
+		}
+	}
+	return files, nil
+}
+
+// Stat fetches checksum, size and revision of the file.
+func (c *Client) Stat(ctx context.Context, f *remote.File) error {
+	var resp *drive.File
+	err := retry(ctx, func() (err error) {
+		resp, err = c.srv.Files.Get(f.ID).SupportsAllDrives(true).Fields(fileFields).Context(ctx).Do()
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("unable to get file metadata: %s %w", f.Path, err)
+	}
+	st := c.fileOf(resp, f.Path)
+	f.Checksum, f.Size, f.Revision = st.Checksum, st.Size, st.Revision
+	return nil
+}
+
+// Download streams content of the file to the local path dst. The content
+// must match the checksum and size of the file, if known, to replace dst.
+// Truncated or corrupted downloads are retried. Google Docs are exported.
+func (c *Client) Download(ctx context.Context, f *remote.File, dst string) error {
+	if f.Converted {
+		content, err := c.export(ctx, f)
+		if err != nil {
+			return err
+		}
+		return fsutil.WriteFile(dst, content, 0644)
+	}
+	size := f.Size
+	if f.Checksum == "" {
+		// Without a checksum the size isn't known either.
+		size = -1
+	}
+	return retryIf(ctx, isRetryableDownload, func() error {
+		data, err := c.srv.Files.Get(f.ID).SupportsAllDrives(true).Context(ctx).Download()
+		if err != nil {
+			return fmt.Errorf("unable to download file: %s %w", f.Path, err)
+		}
+		defer data.Body.Close()
+		return fsutil.WriteReader(dst, data.Body, 0644, f.Checksum, size)
+	})
+}
+
+// isRetryableDownload reports whether a download failed with err may
+// succeed when repeated.
+func isRetryableDownload(err error) bool {
+	return IsRetryable(err) || errors.Is(err, fsutil.ErrChecksum) || errors.Is(err, fsutil.ErrSize)
+}
+
+// Fetch returns content of the file, exported if it's a Google Doc.
+func (c *Client) Fetch(ctx context.Context, f *remote.File) ([]byte, error) {
+	if f.Converted {
+		return c.export(ctx, f)
+	}
+	var content []byte
+	err := retry(ctx, func() error {
+		data, err := c.srv.Files.Get(f.ID).SupportsAllDrives(true).Context(ctx).Download()
+		if err != nil {
+			return fmt.Errorf("unable to download file: %s %w", f.Path, err)
+		}
+		defer data.Body.Close()
+		content, err = ioutil.ReadAll(data.Body)
+		return err
+	})
+	return content, err
+}
+
+// Upload replaces content of the Drive file by the content of the local
+// file src. Google Docs are converted from it unless they are ReadOnly. A
+// file found changed since it was listed right before the upload isn't
+// overwritten, the error wraps remote.ErrChanged.
+func (c *Client) Upload(ctx context.Context, gfile *remote.File, src string) (*remote.File, error) {
+	return c.withLease(ctx, gfile, func() (*remote.File, error) {
+		return c.upload(ctx, gfile, src)
+	})
+}
+
+// upload replaces content of the Drive file by the local file src.
+func (c *Client) upload(ctx context.Context, gfile *remote.File, src string) (*remote.File, error) {
+	if gfile.Converted {
+		updated, err := c.importDoc(ctx, gfile, src)
+		if err != nil {
+			return nil, err
+		}
+		return c.fileOf(updated, gfile.Path), nil
+	}
+	var updated *drive.File
+	err := retry(ctx, func() error {
+		f, size, err := open(src)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		updated, err = c.srv.Files.Update(gfile.ID, &drive.File{}).SupportsAllDrives(true).
+			Media(f, googleapi.ContentType("text/plain"), googleapi.ChunkSize(uploadChunkSize)).
+			ProgressUpdater(c.progress(gfile.Path, size)).Fields(fileFields).Context(ctx).Do()
+		if err != nil {
+			return fmt.Errorf("can't upload file %s (%s): %w", gfile.Path, gfile.ID, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c.fileOf(updated, gfile.Path), nil
+}
+
+// Create uploads the local file src as a new Drive file at the slash
+// separated path relative to the Folder, creating missing subfolders.
+func (c *Client) Create(ctx context.Context, name, src string) (*remote.File, error) {
+	parent := c.Folder
+	if parent == "" {
+		parent = "root"
+	}
+	dir, base := path.Split(name)
+	for _, elem := range strings.Split(strings.Trim(dir, "/"), "/") {
+		if elem == "" {
+			continue
+		}
+		id, err := c.subfolder(ctx, parent, elem)
+		if err != nil {
+			return nil, err
+		}
+		parent = id
+	}
+
+	// Creation isn't idempotent: retry only requests rejected by Drive.
+	var created *drive.File
+	err := retryIf(ctx, isRateLimited, func() error {
+		f, size, err := open(src)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		created, err = c.srv.Files.Create(&drive.File{Name: base, Parents: []string{parent}}).SupportsAllDrives(true).
+			Media(f, googleapi.ContentType("text/plain"), googleapi.ChunkSize(uploadChunkSize)).
+			ProgressUpdater(c.progress(name, size)).Fields(fileFields).Context(ctx).Do()
+		if err != nil {
+			return fmt.Errorf("can't create file %s: %w", name, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c.fileOf(created, name), nil
+}
+
+// Delete moves the file to the Drive trash.
+func (c *Client) Delete(ctx context.Context, f *remote.File) error {
+	err := retry(ctx, func() error {
+		_, err := c.srv.Files.Update(f.ID, &drive.File{Trashed: true}).SupportsAllDrives(true).Fields("id").Context(ctx).Do()
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("can't trash file %s (%s): %w", f.Path, f.ID, err)
+	}
+	return nil
+}
+
+// findFolder returns the ID of the folder name in parent, or empty string
+// if there is none. Of several folders with the name the oldest one is
+// always picked.
+func (c *Client) findFolder(ctx context.Context, parent, name string) (string, error) {
+	var r *drive.FileList
+	err := retry(ctx, func() (err error) {
+		r, err = c.srv.Files.List().SupportsAllDrives(true).IncludeItemsFromAllDrives(true).OrderBy("createdTime").
+			Q(newQuery().name(name).in(parent).mimeType(folderMimeType).notTrashed().String()).
+			Fields("files(id)").Context(ctx).Do()
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to find folder %s: %w", name, err)
+	}
+	if len(r.Files) == 0 {
+		return "", nil
+	}
+	if len(r.Files) > 1 {
+		slog.Warn("Several Drive folders share the name, using the oldest", "folder", name, "count", len(r.Files), "id", r.Files[0].Id)
+	}
+	return r.Files[0].Id, nil
+}
+
+// subfolder returns the ID of the folder name in parent, creating it if
+// needed.
+func (c *Client) subfolder(ctx context.Context, parent, name string) (string, error) {
+	id, err := c.findFolder(ctx, parent, name)
+	if err != nil || id != "" {
+		return id, err
+	}
+
+	var created *drive.File
+	err = retryIf(ctx, isRateLimited, func() (err error) {
+		created, err = c.srv.Files.Create(&drive.File{
+			Name:     name,
+			Parents:  []string{parent},
+			MimeType: folderMimeType,
+		}).SupportsAllDrives(true).Fields("id").Context(ctx).Do()
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("can't create folder %s: %w", name, err)
+	}
+	return created.Id, nil
+}
+
+// open opens the local file src for upload and returns its size.
+func open(src string) (*os.File, int64, error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return nil, 0, fmt.Errorf("can't open file %s: %w", src, err)
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, fmt.Errorf("can't open file %s: %w", src, err)
+	}
+	return f, st.Size(), nil
+}
+
+// progress returns the upload progress callback for the file name of the
+// given size.
+func (c *Client) progress(name string, size int64) googleapi.ProgressUpdater {
+	return func(current, total int64) {
+		if c.Progress != nil {
+			c.Progress(name, current, size)
+		}
+	}
+}
+
+// fileOf describes the Drive file at the given path. Its revision is the
+// head revision, which unlike the version doesn't change with metadata.
+// Files without revisions, such as Drive native documents, fall back to
+// the version. Google Docs are described as their export, at a path with
+// the extension of the export format.
+func (c *Client) fileOf(f *drive.File, name string) *remote.File {
+	rev := f.HeadRevisionId
+	if rev == "" {
+		rev = strconv.FormatInt(f.Version, 10)
+	}
+	modified, _ := time.Parse(time.RFC3339, f.ModifiedTime)
+	file := &remote.File{
+		ID:       f.Id,
+		Path:     name,
+		Checksum: f.Md5Checksum,
+		Revision: rev,
+		Size:     f.Size,
+		Modified: modified,
+	}
+	if f.MimeType == docMimeType {
+		file.Path = c.docName(name)
+		file.Converted = true
+		file.ReadOnly = c.Docs != DocsConvert
+		// The size is that of the document, not of its export.
+		file.Size = 0
+	}
+	return file
+}
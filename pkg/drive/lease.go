@@ -0,0 +1,204 @@
+package drive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mizhka/todosync/pkg/remote"
+	drive "google.golang.org/api/drive/v3"
+)
+
+// LeaseProperty is the appProperties key of upload leases, holding the
+// holder and the expiry time in RFC 3339 format separated by a space.
+// Other clients writing synced files, such as phone apps, may honor it.
+const LeaseProperty = "todosync-lease"
+
+// ErrLeased is wrapped by errors of uploads of files leased by another
+// client.
+var ErrLeased = errors.New("file leased by another client")
+
+// lease is an upload lease set on a file.
+type lease struct {
+	holder string
+	until  time.Time
+}
+
+// parseLease parses the value of LeaseProperty.
+func parseLease(v string) (lease, bool) {
+	holder, until, ok := strings.Cut(v, " ")
+	if !ok {
+		return lease{}, false
+	}
+	t, err := time.Parse(time.RFC3339, until)
+	if err != nil {
+		return lease{}, false
+	}
+	return lease{holder: holder, until: t}, true
+}
+
+func (l lease) String() string {
+	return l.holder + " " + l.until.UTC().Format(time.RFC3339)
+}
+
+// withLease runs upload unless the file changed since it was listed or
+// another client holds a lease on it. Drive has no conditional updates, so
+// this is checked by reading the metadata back right before upload: a
+// change made between the check and the upload is overwritten, and only
+// kept in the revision history of the file. See UploadsRace.
+//
+// When Lease is set, a lease is acquired as well, renewed while upload runs
+// and released afterwards. Setting the lease changes the version of the
+// file, so that a client writing concurrently is found out when the lease
+// is read back. Clients honoring the lease then keep off the file during
+// upload; others still race with it. The version of converted files, their
+// revision, changes with the lease too, so the uploaded file is described
+// with the version it has once the lease is released. Otherwise the next
+// cycle would take the release for a remote change.
+func (c *Client) withLease(ctx context.Context, f *remote.File, upload func() (*remote.File, error)) (uploaded *remote.File, err error) {
+	if c.Lease <= 0 {
+		cur, err := c.current(ctx, f)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.check(f, cur); err != nil {
+			return nil, err
+		}
+		return upload()
+	}
+	if err := c.acquire(ctx, f); err != nil {
+		return nil, err
+	}
+	defer func() {
+		// Released even when ctx is cancelled, or it stays until it
+		// expires.
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		version, rerr := c.setLease(ctx, f, "")
+		if rerr != nil {
+			slog.Warn("Can't release lease", "file", f.Path, "err", rerr)
+			return
+		}
+		if err == nil && uploaded.Converted {
+			uploaded.Revision = strconv.FormatInt(version, 10)
+		}
+	}()
+
+	done := make(chan struct{})
+	renewed := make(chan struct{})
+	go func() {
+		defer close(renewed)
+		t := time.NewTicker(c.Lease / 2)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				if _, err := c.setLease(ctx, f, c.newLease().String()); err != nil {
+					slog.Warn("Can't renew lease", "file", f.Path, "err", err)
+				}
+			}
+		}
+	}()
+	uploaded, err = upload()
+	close(done)
+	<-renewed
+	return uploaded, err
+}
+
+// UploadsRace reports that changes made by other clients during an upload
+// can be overwritten, see withLease.
+func (c *Client) UploadsRace() bool {
+	return true
+}
+
+// acquire sets a lease of this client on the file.
+func (c *Client) acquire(ctx context.Context, f *remote.File) error {
+	cur, err := c.current(ctx, f)
+	if err != nil {
+		return err
+	}
+	if err := c.check(f, cur); err != nil {
+		return err
+	}
+	l := c.newLease()
+	version, err := c.setLease(ctx, f, l.String())
+	if err != nil {
+		return err
+	}
+	// Of clients setting a lease at once, the last one wins and the
+	// others find a later version.
+	cur, err = c.current(ctx, f)
+	if err != nil {
+		return err
+	}
+	if cur.Version != version || cur.AppProperties[LeaseProperty] != l.String() {
+		if cur.AppProperties[LeaseProperty] == l.String() {
+			if _, err := c.setLease(ctx, f, ""); err != nil {
+				slog.Warn("Can't release lease", "file", f.Path, "err", err)
+			}
+		}
+		return fmt.Errorf("can't lease %s (%s): %w", f.Path, f.ID, remote.ErrChanged)
+	}
+	return nil
+}
+
+// check returns an error if cur, the current metadata of the file, has a
+// lease of another client or a revision other than the listed one.
+func (c *Client) check(f *remote.File, cur *drive.File) error {
+	if l, ok := parseLease(cur.AppProperties[LeaseProperty]); ok && l.holder != c.Holder && time.Now().Before(l.until) {
+		return fmt.Errorf("can't upload %s (%s): %w: %s until %s", f.Path, f.ID, ErrLeased, l.holder, l.until.Format(time.RFC3339))
+	}
+	if rev := c.fileOf(cur, f.Path).Revision; f.Revision != "" && rev != f.Revision {
+		return fmt.Errorf("can't upload %s (%s): %w: revision %s, listed %s", f.Path, f.ID, remote.ErrChanged, rev, f.Revision)
+	}
+	return nil
+}
+
+// newLease returns a lease of this client expiring after Lease.
+func (c *Client) newLease() lease {
+	return lease{holder: c.Holder, until: time.Now().Add(c.Lease)}
+}
+
+// current returns the current metadata of the file with its appProperties.
+func (c *Client) current(ctx context.Context, f *remote.File) (*drive.File, error) {
+	var cur *drive.File
+	err := retry(ctx, func() (err error) {
+		cur, err = c.srv.Files.Get(f.ID).SupportsAllDrives(true).
+			Fields(fileFields + ", appProperties").Context(ctx).Do()
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("can't read metadata of %s (%s): %w", f.Path, f.ID, err)
+	}
+	return cur, nil
+}
+
+// setLease sets the lease property of the file to value, or removes it
+// when value is empty, and returns the new version of the file.
+func (c *Client) setLease(ctx context.Context, f *remote.File, value string) (int64, error) {
+	update := &drive.File{}
+	if value != "" {
+		update.AppProperties = map[string]string{LeaseProperty: value}
+	} else {
+		// The map has to be sent for the key to be cleared.
+		update.AppProperties = map[string]string{}
+		update.ForceSendFields = []string{"AppProperties"}
+		update.NullFields = []string{"AppProperties." + LeaseProperty}
+	}
+	var updated *drive.File
+	err := retry(ctx, func() (err error) {
+		updated, err = c.srv.Files.Update(f.ID, update).SupportsAllDrives(true).
+			Fields("id, version").Context(ctx).Do()
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("can't set lease of %s (%s): %w", f.Path, f.ID, err)
+	}
+	return updated.Version, nil
+}
@@ -0,0 +1,117 @@
+package drive
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	gosync "sync"
+	"testing"
+	"time"
+
+	"github.com/mizhka/todosync/pkg/remote"
+	drive "google.golang.org/api/drive/v3"
+	"google.golang.org/api/option"
+)
+
+// fakeDoc serves the metadata of a single Google Doc, whose version grows
+// with every change as on Drive.
+type fakeDoc struct {
+	mu      gosync.Mutex
+	version int64
+	props   map[string]string
+}
+
+func (d *fakeDoc) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !strings.HasSuffix(r.URL.Path, "/files/doc") {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method == http.MethodPatch {
+		var update struct {
+			AppProperties map[string]*string `json:"appProperties"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for k, v := range update.AppProperties {
+			if v == nil {
+				delete(d.props, k)
+			} else {
+				d.props[k] = *v
+			}
+		}
+		d.version++
+	}
+	json.NewEncoder(w).Encode(&drive.File{
+		Id:            "doc",
+		Name:          "notes",
+		MimeType:      docMimeType,
+		Version:       d.version,
+		AppProperties: d.props,
+	})
+}
+
+// edit changes content of the document.
+func (d *fakeDoc) edit() int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.version++
+	return d.version
+}
+
+func newFakeClient(t *testing.T, h http.Handler) *Client {
+	t.Helper()
+	ts := httptest.NewServer(h)
+	t.Cleanup(ts.Close)
+	srv, err := drive.NewService(context.Background(), option.WithEndpoint(ts.URL+"/"), option.WithHTTPClient(ts.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Client{srv: srv, Holder: "laptop", Lease: time.Minute}
+}
+
+func TestLeasedUploadRevision(t *testing.T) {
+	doc := &fakeDoc{version: 7, props: map[string]string{}}
+	c := newFakeClient(t, doc)
+	f := &remote.File{ID: "doc", Path: "notes.txt", Revision: "7", Converted: true}
+
+	uploaded, err := c.withLease(context.Background(), f, func() (*remote.File, error) {
+		return &remote.File{ID: "doc", Path: "notes.txt", Revision: strconv.FormatInt(doc.edit(), 10), Converted: true}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cur, err := c.current(context.Background(), f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cur.AppProperties[LeaseProperty]; ok {
+		t.Errorf("lease not released: %v", cur.AppProperties)
+	}
+	// Listed next, the document must not look changed.
+	if rev := c.fileOf(cur, "notes").Revision; uploaded.Revision != rev {
+		t.Errorf("uploaded revision %s, listed afterwards as %s", uploaded.Revision, rev)
+	}
+}
+
+func TestUploadChanged(t *testing.T) {
+	doc := &fakeDoc{version: 7, props: map[string]string{}}
+	c := newFakeClient(t, doc)
+	c.Lease = 0
+	doc.edit()
+	f := &remote.File{ID: "doc", Path: "notes.txt", Revision: "7", Converted: true}
+	_, err := c.withLease(context.Background(), f, func() (*remote.File, error) {
+		t.Error("uploaded over a changed file")
+		return f, nil
+	})
+	if !errors.Is(err, remote.ErrChanged) {
+		t.Errorf("got %v, want ErrChanged", err)
+	}
+}
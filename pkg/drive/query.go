@@ -0,0 +1,57 @@
+package drive
+
+import "strings"
+
+// query builds a Drive files search query out of conditions joined with
+// "and", escaping the values compared.
+type query struct {
+	terms []string
+}
+
+// newQuery returns a query matching all files.
+func newQuery() *query {
+	return &query{}
+}
+
+// name matches files named one of names.
+func (q *query) name(names ...string) *query {
+	var or []string
+	for _, name := range names {
+		or = append(or, "name = "+quote(name))
+	}
+	if len(or) == 1 {
+		return q.add(or[0])
+	}
+	return q.add("(" + strings.Join(or, " or ") + ")")
+}
+
+// in matches files in the folder with the given ID.
+func (q *query) in(folder string) *query {
+	return q.add(quote(folder) + " in parents")
+}
+
+// mimeType matches files of the given MIME type.
+func (q *query) mimeType(t string) *query {
+	return q.add("mimeType = " + quote(t))
+}
+
+// notTrashed matches files outside the trash.
+func (q *query) notTrashed() *query {
+	return q.add("trashed = false")
+}
+
+func (q *query) add(term string) *query {
+	q.terms = append(q.terms, term)
+	return q
+}
+
+// String returns the query in the Drive query language.
+func (q *query) String() string {
+	return strings.Join(q.terms, " and ")
+}
+
+// quote returns s as a string literal of the Drive query language, where
+// quotes and backslashes are escaped with a backslash.
+func quote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
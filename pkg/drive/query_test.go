@@ -0,0 +1,33 @@
+package drive
+
+import "testing"
+
+func TestQuote(t *testing.T) {
+	tests := []struct{ s, want string }{
+		{"todo.txt", `'todo.txt'`},
+		{"Mom's list", `'Mom\'s list'`},
+		{`C:\notes`, `'C:\\notes'`},
+		{`\'`, `'\\\''`},
+	}
+	for _, tt := range tests {
+		if got := quote(tt.s); got != tt.want {
+			t.Errorf("quote(%q) = %s, want %s", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestQuery(t *testing.T) {
+	tests := []struct {
+		q    *query
+		want string
+	}{
+		{newQuery().name("todo.txt").in("root").notTrashed(), `name = 'todo.txt' and 'root' in parents and trashed = false`},
+		{newQuery().name("todo.txt", "Mom's.txt"), `(name = 'todo.txt' or name = 'Mom\'s.txt')`},
+		{newQuery().mimeType(folderMimeType).in("a'b"), `mimeType = 'application/vnd.google-apps.folder' and 'a\'b' in parents`},
+	}
+	for _, tt := range tests {
+		if got := tt.q.String(); got != tt.want {
+			t.Errorf("got %s, want %s", got, tt.want)
+		}
+	}
+}
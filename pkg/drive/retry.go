@@ -0,0 +1,90 @@
+package drive
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/mizhka/todosync/pkg/backoff"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+)
+
+// Retries of failed Drive requests.
+const (
+	retryAttempts = 5
+	retryBase     = time.Second
+	retryMax      = 30 * time.Second
+)
+
+// IsRetryable reports whether err is a transient failure: a network error,
+// a server error or exceeded rate limit.
+func IsRetryable(err error) bool {
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) {
+		switch {
+		case gerr.Code == http.StatusTooManyRequests, gerr.Code >= 500:
+			return true
+		case gerr.Code == http.StatusForbidden:
+			return isRateLimit(gerr)
+		}
+		return false
+	}
+	var nerr net.Error
+	return errors.As(err, &nerr) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// IsAuthError reports whether err means the credentials are no longer
+// valid and the user has to authorize again.
+func IsAuthError(err error) bool {
+	var rerr *oauth2.RetrieveError
+	if errors.As(err, &rerr) {
+		return true
+	}
+	var gerr *googleapi.Error
+	return errors.As(err, &gerr) && gerr.Code == http.StatusUnauthorized
+}
+
+func isRateLimit(err *googleapi.Error) bool {
+	for _, e := range err.Errors {
+		if e.Reason == "rateLimitExceeded" || e.Reason == "userRateLimitExceeded" {
+			return true
+		}
+	}
+	return false
+}
+
+// retry calls fn until it succeeds, fails with a non retryable error, runs
+// out of attempts or ctx is done.
+func retry(ctx context.Context, fn func() error) error {
+	return retryIf(ctx, IsRetryable, fn)
+}
+
+// retryIf is retry with a custom retryable predicate.
+func retryIf(ctx context.Context, retryable func(error) bool, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt == retryAttempts || !retryable(err) || ctx.Err() != nil {
+			return err
+		}
+		delay := backoff.Delay(attempt, retryBase, retryMax)
+		slog.Warn("Drive request failed, retrying", "delay", delay, "err", err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// isRateLimited reports whether the request was rejected before being
+// executed, so that retrying a non idempotent request is safe.
+func isRateLimited(err error) bool {
+	var gerr *googleapi.Error
+	return errors.As(err, &gerr) &&
+		(gerr.Code == http.StatusTooManyRequests || (gerr.Code == http.StatusForbidden && isRateLimit(gerr)))
+}
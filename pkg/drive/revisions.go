@@ -0,0 +1,75 @@
+package drive
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/mizhka/todosync/pkg/fsutil"
+	"github.com/mizhka/todosync/pkg/remote"
+	drive "google.golang.org/api/drive/v3"
+)
+
+// revisionFields are the fields of revision list responses.
+const revisionFields = "nextPageToken, revisions(id, modifiedTime, md5Checksum, size, lastModifyingUser(displayName))"
+
+var _ remote.Historian = (*Client)(nil)
+
+// Revisions lists the revisions Drive keeps of the file, oldest first.
+// Drive prunes old revisions of files not marked to be kept forever.
+// Revisions of Google Docs can't be downloaded and aren't listed.
+func (c *Client) Revisions(ctx context.Context, f *remote.File) ([]*remote.Revision, error) {
+	if f.Converted {
+		return nil, nil
+	}
+	var revs []*remote.Revision
+	token := ""
+	for {
+		var resp *drive.RevisionList
+		err := retry(ctx, func() (err error) {
+			resp, err = c.srv.Revisions.List(f.ID).PageSize(1000).PageToken(token).
+				Fields(revisionFields).Context(ctx).Do()
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to list revisions: %s %w", f.Path, err)
+		}
+		for _, r := range resp.Revisions {
+			modified, _ := time.Parse(time.RFC3339, r.ModifiedTime)
+			rev := &remote.Revision{ID: r.Id, Modified: modified, Checksum: r.Md5Checksum, Size: r.Size}
+			if r.LastModifyingUser != nil {
+				rev.Author = r.LastModifyingUser.DisplayName
+			}
+			revs = append(revs, rev)
+		}
+		token = resp.NextPageToken
+		if token == "" {
+			return revs, nil
+		}
+	}
+}
+
+// FetchRevision returns content of a revision of the file, which must
+// match its checksum if known.
+func (c *Client) FetchRevision(ctx context.Context, f *remote.File, rev *remote.Revision) ([]byte, error) {
+	var content []byte
+	err := retryIf(ctx, isRetryableDownload, func() error {
+		data, err := c.srv.Revisions.Get(f.ID, rev.ID).Context(ctx).Download()
+		if err != nil {
+			return fmt.Errorf("unable to download revision %s of %s: %w", rev.ID, f.Path, err)
+		}
+		defer data.Body.Close()
+		content, err = ioutil.ReadAll(data.Body)
+		if err != nil {
+			return err
+		}
+		if sum := md5.Sum(content); rev.Checksum != "" && hex.EncodeToString(sum[:]) != rev.Checksum {
+			return fmt.Errorf("revision %s of %s: %w", rev.ID, f.Path, fsutil.ErrChecksum)
+		}
+		return nil
+	})
+	return content, err
+}
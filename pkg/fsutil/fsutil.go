@@ -0,0 +1,125 @@
+// Package fsutil writes files atomically, so that a crash leaves either
+// the old or the new content but never a truncated file.
+package fsutil
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// renameAttempts is how many times a file is renamed over another on
+// Windows before giving up.
+const renameAttempts = 5
+
+// ErrChecksum is wrapped by errors of writes whose content doesn't match
+// the expected checksum.
+var ErrChecksum = errors.New("checksum mismatch")
+
+// ErrSize is wrapped by errors of writes whose content doesn't have the
+// expected size, such as truncated downloads.
+var ErrSize = errors.New("size mismatch")
+
+// WriteFile atomically replaces the file at path by data, creating missing
+// parent directories.
+func WriteFile(path string, data []byte, perm os.FileMode) error {
+	return WriteReader(path, bytes.NewReader(data), perm, "", -1)
+}
+
+// WriteReader atomically replaces the file at path by content streamed
+// from r. The content goes to a temporary file in the same directory, which
+// is synced and renamed over path. A replaced file keeps its permissions,
+// perm applies to new files. With md5sum, the hex md5 checksum of the
+// content, and a non-negative size, path is replaced only if the content
+// matches them.
+func WriteReader(path string, r io.Reader, perm os.FileMode, md5sum string, size int64) (err error) {
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, "."+base+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("can't create file %s: %w", path, err)
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	var sum hash.Hash = md5.New()
+	n, err := io.Copy(io.MultiWriter(tmp, sum), r)
+	if err != nil {
+		return fmt.Errorf("can't write file %s: %w", path, err)
+	}
+	if size >= 0 && n != size {
+		return fmt.Errorf("%s: got %d bytes, want %d: %w", path, n, size, ErrSize)
+	}
+	if md5sum != "" {
+		if got := hex.EncodeToString(sum.Sum(nil)); got != md5sum {
+			return fmt.Errorf("%s: got md5 %s, want %s: %w", path, got, md5sum, ErrChecksum)
+		}
+	}
+	if st, err := os.Stat(path); err == nil {
+		perm = st.Mode().Perm()
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		return fmt.Errorf("can't write file %s: %w", path, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fmt.Errorf("can't write file %s: %w", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("can't write file %s: %w", path, err)
+	}
+	if err := rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("can't replace file %s: %w", path, err)
+	}
+	syncDir(dir)
+	return nil
+}
+
+// rename renames oldpath to newpath. On Windows, where a file open in
+// another process such as an editor or a virus scanner can't be replaced,
+// it retries for a while.
+func rename(oldpath, newpath string) error {
+	for attempt := 1; ; attempt++ {
+		err := os.Rename(oldpath, newpath)
+		if err == nil || runtime.GOOS != "windows" || attempt == renameAttempts {
+			return err
+		}
+		time.Sleep(time.Duration(attempt) * 100 * time.Millisecond)
+	}
+}
+
+// IsTemp reports whether the file named name is a temporary file of an
+// unfinished write.
+func IsTemp(name string) bool {
+	base := filepath.Base(name)
+	return strings.HasPrefix(base, ".") && strings.HasSuffix(base, ".tmp")
+}
+
+// syncDir persists the rename in dir. Not all systems support syncing
+// directories, so errors are ignored.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
@@ -0,0 +1,183 @@
+// Package gauth authorizes access to Google APIs with the user's OAuth
+// token.
+package gauth
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// Authorization modes of Credentials.
+const (
+	// ModeUser authorizes as the user through the OAuth flow.
+	ModeUser = "user"
+	// ModeServiceAccount authorizes as a service account with a JSON key.
+	ModeServiceAccount = "serviceaccount"
+	// ModeDefault uses Application Default Credentials: the key in
+	// $GOOGLE_APPLICATION_CREDENTIALS, gcloud credentials or the metadata
+	// server on Google Cloud.
+	ModeDefault = "adc"
+)
+
+// Credentials selects how to authorize to Google APIs.
+type Credentials struct {
+	// Mode is ModeUser, ModeServiceAccount or ModeDefault.
+	Mode string
+	// ClientSecret is the OAuth client secret file used in ModeUser.
+	ClientSecret string
+	// Tokens keeps the user's token in ModeUser.
+	Tokens TokenStore
+	// KeyFile is the service account JSON key used in ModeServiceAccount.
+	KeyFile string
+	// Subject is the user the service account impersonates through
+	// domain-wide delegation, none when empty.
+	Subject string
+}
+
+// Client returns an HTTP client authorized for scopes. In ModeUser the
+// token is created on first run.
+func (c *Credentials) Client(ctx context.Context, scopes ...string) (*http.Client, error) {
+	switch c.Mode {
+	case ModeServiceAccount:
+		b, err := ioutil.ReadFile(c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read service account key: %w", err)
+		}
+		config, err := google.JWTConfigFromJSON(b, scopes...)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse service account key: %w", err)
+		}
+		config.Subject = c.Subject
+		return config.Client(ctx), nil
+	case ModeDefault:
+		client, err := google.DefaultClient(ctx, scopes...)
+		if err != nil {
+			return nil, fmt.Errorf("unable to find default credentials: %w", err)
+		}
+		return client, nil
+	}
+
+	config, err := oauthConfig(c.ClientSecret, scopes)
+	if err != nil {
+		return nil, err
+	}
+	return getClient(ctx, config, c.Tokens)
+}
+
+// Retrieve a token, saves the token, then returns the generated client.
+func getClient(ctx context.Context, config *oauth2.Config, tokens TokenStore) (*http.Client, error) {
+	// The store keeps the user's access and refresh tokens, and is filled
+	// automatically when the authorization flow completes for the first
+	// time.
+	tok, err := tokens.Load()
+	if err == ErrNoToken {
+		tok, err = getTokenFromWeb(ctx, config, false)
+		if err != nil {
+			return nil, err
+		}
+		err = tokens.Save(tok)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return config.Client(ctx, tok), nil
+}
+
+// Authorize runs the authorization flow for scopes and saves the token to
+// Tokens, replacing any previous one. With noBrowser the user opens the
+// authorization page on any device and pastes back the address Google
+// redirected to. Only ModeUser needs authorization.
+func (c *Credentials) Authorize(ctx context.Context, noBrowser bool, scopes ...string) error {
+	if c.Mode != ModeUser {
+		return fmt.Errorf("%s credentials need no authorization", c.Mode)
+	}
+	config, err := oauthConfig(c.ClientSecret, scopes)
+	if err != nil {
+		return err
+	}
+	tok, err := getTokenFromWeb(ctx, config, noBrowser)
+	if err != nil {
+		return err
+	}
+	return c.Tokens.Save(tok)
+}
+
+// revokeURL is Google's OAuth token revocation endpoint.
+const revokeURL = "https://oauth2.googleapis.com/revoke"
+
+// Revoke revokes the saved token at Google and deletes it from tokens. The
+// token is deleted even if Google can't be reached.
+func Revoke(ctx context.Context, tokens TokenStore) error {
+	tok, err := tokens.Load()
+	if err == ErrNoToken {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	token := tok.RefreshToken
+	if token == "" {
+		token = tok.AccessToken
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, revokeURL,
+		strings.NewReader(url.Values{"token": {token}}.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		slog.Warn("Can't revoke token", "err", err)
+	} else {
+		resp.Body.Close()
+		// Google answers 400 for tokens already revoked or expired.
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusBadRequest {
+			slog.Warn("Can't revoke token", "status", resp.Status)
+		}
+	}
+	return tokens.Delete()
+}
+
+// Request a token from the web, then returns the retrieved token.
+func getTokenFromWeb(ctx context.Context, config *oauth2.Config, noBrowser bool) (*oauth2.Token, error) {
+	var authCode string
+	var err error
+	if noBrowser {
+		authCode, err = pasteCode(config)
+	} else {
+		authCode, err = loopbackCode(ctx, config)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tok, err := config.Exchange(ctx, authCode)
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve token from web: %w", err)
+	}
+	return tok, nil
+}
+
+// oauthConfig reads the OAuth client secret file.
+func oauthConfig(credentialsFile string, scopes []string) (*oauth2.Config, error) {
+	b, err := ioutil.ReadFile(credentialsFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read client secret file: %w", err)
+	}
+
+	// If modifying these scopes, delete your previously saved token file.
+	config, err := google.ConfigFromJSON(b, scopes...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse client secret file to config: %w", err)
+	}
+	return config, nil
+}
@@ -0,0 +1,129 @@
+package gauth
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+// loopbackCode gets the authorization code through a temporary HTTP server
+// on localhost which Google redirects the browser to.
+func loopbackCode(ctx context.Context, config *oauth2.Config) (string, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", fmt.Errorf("can't listen for authorization redirect: %w", err)
+	}
+	defer ln.Close()
+
+	state, err := randomState()
+	if err != nil {
+		return "", err
+	}
+	// The code is exchanged with the same redirect address.
+	config.RedirectURL = "http://" + ln.Addr().String() + "/"
+
+	type result struct {
+		code string
+		err  error
+	}
+	done := make(chan result, 1)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("state") != state {
+			http.Error(w, "Unexpected authorization state", http.StatusBadRequest)
+			return
+		}
+		if e := q.Get("error"); e != "" {
+			fmt.Fprintln(w, "Authorization failed:", e)
+			done <- result{err: fmt.Errorf("authorization failed: %s", e)}
+			return
+		}
+		fmt.Fprintln(w, "Authorization complete, you can close this window.")
+		done <- result{code: q.Get("code")}
+	})}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	authURL := config.AuthCodeURL(state, oauth2.AccessTypeOffline)
+	fmt.Printf("Opening the following link in your browser:\n%v\n", authURL)
+	if err := openBrowser(authURL); err != nil {
+		fmt.Println("Can't open browser, open the link manually:", err)
+	}
+
+	select {
+	case res := <-done:
+		return res.code, res.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// pasteCode asks the user to authorize on any device and paste back the
+// address of the page Google redirected to, which fails to load, or just
+// the code from it.
+func pasteCode(config *oauth2.Config) (string, error) {
+	state, err := randomState()
+	if err != nil {
+		return "", err
+	}
+	config.RedirectURL = "http://127.0.0.1:1/"
+	authURL := config.AuthCodeURL(state, oauth2.AccessTypeOffline)
+	fmt.Printf("Go to the following link in your browser:\n%v\n"+
+		"After authorizing, the browser fails to load a page on 127.0.0.1. "+
+		"Copy its address and paste it here:\n", authURL)
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("unable to read authorization code: %w", err)
+	}
+	line = strings.TrimSpace(line)
+	if !strings.Contains(line, "://") {
+		return line, nil
+	}
+	u, err := url.Parse(line)
+	if err != nil {
+		return "", fmt.Errorf("invalid address %q: %w", line, err)
+	}
+	q := u.Query()
+	if q.Get("state") != state {
+		return "", errors.New("address is from another authorization request")
+	}
+	if e := q.Get("error"); e != "" {
+		return "", fmt.Errorf("authorization failed: %s", e)
+	}
+	return q.Get("code"), nil
+}
+
+// openBrowser opens the address in the user's default browser.
+func openBrowser(addr string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", addr)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", addr)
+	default:
+		cmd = exec.Command("xdg-open", addr)
+	}
+	return cmd.Start()
+}
+
+func randomState() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
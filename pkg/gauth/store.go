@@ -0,0 +1,321 @@
+package gauth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/mizhka/todosync/pkg/fsutil"
+	"github.com/zalando/go-keyring"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/oauth2"
+)
+
+// ErrNoToken is returned by token stores holding no token.
+var ErrNoToken = errors.New("no saved token")
+
+// errPlain is returned by encrypted stores finding a plain token file.
+var errPlain = errors.New("token file isn't encrypted")
+
+// keyringService names todosync entries in the OS keyring.
+const keyringService = "todosync"
+
+// TokenStore keeps the user's OAuth token between runs.
+type TokenStore interface {
+	// Load returns the saved token or ErrNoToken.
+	Load() (*oauth2.Token, error)
+	Save(tok *oauth2.Token) error
+	// Delete removes the saved token, if any.
+	Delete() error
+}
+
+// Token store kinds accepted by NewTokenStore.
+const (
+	// StoreFile keeps the token in a plain JSON file.
+	StoreFile = "file"
+	// StoreKeyring keeps the token in the OS keyring, or in an encrypted
+	// file where there is no keyring.
+	StoreKeyring = "keyring"
+	// StoreEncrypted keeps the token in a file encrypted with a
+	// passphrase.
+	StoreEncrypted = "encrypted"
+)
+
+// NewTokenStore returns a token store of the given kind for the token file
+// at path. The keyring entry is named after the absolute path. Encrypted
+// files need a passphrase. A plain token file found at path is moved to
+// keyring and encrypted stores on first use.
+func NewTokenStore(kind, path, passphrase string) (TokenStore, error) {
+	plain := &fileStore{path: path}
+	switch kind {
+	case StoreFile, "":
+		return plain, nil
+	case StoreEncrypted:
+		if passphrase == "" {
+			return nil, errors.New("encrypted token store requires a passphrase")
+		}
+		return &migrating{TokenStore: &encryptedStore{path: path, passphrase: passphrase}, plain: plain}, nil
+	case StoreKeyring:
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return nil, err
+		}
+		store := &keyringStore{user: abs}
+		if err := store.probe(); err != nil {
+			if passphrase == "" {
+				return nil, fmt.Errorf("keyring unavailable and no passphrase for an encrypted token file: %w", err)
+			}
+			slog.Warn("Keyring unavailable, keeping token in encrypted file", "err", err)
+			return &migrating{TokenStore: &encryptedStore{path: path, passphrase: passphrase}, plain: plain}, nil
+		}
+		return &migrating{TokenStore: store, plain: plain}, nil
+	}
+	return nil, fmt.Errorf("unknown token store %q", kind)
+}
+
+// MoveKeyring moves the keyring entry of the token file at from to the one
+// of the token file at to, unless there is one already. It reports whether
+// an entry was moved.
+func MoveKeyring(from, to string) (bool, error) {
+	from, err := filepath.Abs(from)
+	if err != nil {
+		return false, err
+	}
+	to, err = filepath.Abs(to)
+	if err != nil {
+		return false, err
+	}
+	secret, err := keyring.Get(keyringService, from)
+	if err == keyring.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	_, err = keyring.Get(keyringService, to)
+	if err == nil {
+		return false, nil
+	}
+	if err != keyring.ErrNotFound {
+		return false, err
+	}
+	if err := keyring.Set(keyringService, to, secret); err != nil {
+		return false, err
+	}
+	return true, keyring.Delete(keyringService, from)
+}
+
+// fileStore keeps the token in a plain JSON file.
+type fileStore struct {
+	path string
+}
+
+func (s *fileStore) Load() (*oauth2.Token, error) {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil, ErrNoToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	tok := &oauth2.Token{}
+	err = json.NewDecoder(f).Decode(tok)
+	return tok, err
+}
+
+func (s *fileStore) Save(tok *oauth2.Token) error {
+	fmt.Printf("Saving credential file to: %s\n", s.path)
+	b, err := json.Marshal(tok)
+	if err != nil {
+		return err
+	}
+	if err := fsutil.WriteFile(s.path, b, 0600); err != nil {
+		return fmt.Errorf("unable to cache oauth token: %w", err)
+	}
+	return nil
+}
+
+func (s *fileStore) Delete() error {
+	err := os.Remove(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// keyringStore keeps the token in the OS keyring: Secret Service, macOS
+// Keychain or Windows Credential Manager.
+type keyringStore struct {
+	user string
+}
+
+// probe checks that the keyring is reachable.
+func (s *keyringStore) probe() error {
+	_, err := keyring.Get(keyringService, s.user)
+	if err == keyring.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+func (s *keyringStore) Load() (*oauth2.Token, error) {
+	secret, err := keyring.Get(keyringService, s.user)
+	if err == keyring.ErrNotFound {
+		return nil, ErrNoToken
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't read token from keyring: %w", err)
+	}
+	tok := &oauth2.Token{}
+	if err := json.Unmarshal([]byte(secret), tok); err != nil {
+		return nil, fmt.Errorf("can't parse token from keyring: %w", err)
+	}
+	return tok, nil
+}
+
+func (s *keyringStore) Save(tok *oauth2.Token) error {
+	b, err := json.Marshal(tok)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Saving credential to keyring")
+	if err := keyring.Set(keyringService, s.user, string(b)); err != nil {
+		return fmt.Errorf("can't save token to keyring: %w", err)
+	}
+	return nil
+}
+
+func (s *keyringStore) Delete() error {
+	err := keyring.Delete(keyringService, s.user)
+	if err == keyring.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// encryptedStore keeps the token in a file encrypted with AES-GCM under a
+// key derived from the passphrase.
+type encryptedStore struct {
+	path       string
+	passphrase string
+}
+
+// sealed is the content of encrypted token files.
+type sealed struct {
+	Salt  []byte `json:"salt"`
+	Nonce []byte `json:"nonce"`
+	Data  []byte `json:"data"`
+}
+
+func (s *encryptedStore) Load() (*oauth2.Token, error) {
+	b, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, ErrNoToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	var box sealed
+	if err := json.Unmarshal(b, &box); err != nil || box.Data == nil {
+		return nil, fmt.Errorf("%s: %w", s.path, errPlain)
+	}
+	aead, err := s.cipher(box.Salt)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := aead.Open(nil, box.Nonce, box.Data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("can't decrypt %s, wrong passphrase?", s.path)
+	}
+	tok := &oauth2.Token{}
+	if err := json.Unmarshal(plain, tok); err != nil {
+		return nil, fmt.Errorf("can't parse token from %s: %w", s.path, err)
+	}
+	return tok, nil
+}
+
+func (s *encryptedStore) Save(tok *oauth2.Token) error {
+	plain, err := json.Marshal(tok)
+	if err != nil {
+		return err
+	}
+	box := sealed{Salt: make([]byte, 16)}
+	if _, err := rand.Read(box.Salt); err != nil {
+		return err
+	}
+	aead, err := s.cipher(box.Salt)
+	if err != nil {
+		return err
+	}
+	box.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(box.Nonce); err != nil {
+		return err
+	}
+	box.Data = aead.Seal(nil, box.Nonce, plain, nil)
+
+	b, err := json.Marshal(box)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Saving encrypted credential file to: %s\n", s.path)
+	if err := fsutil.WriteFile(s.path, b, 0600); err != nil {
+		return fmt.Errorf("unable to cache oauth token: %w", err)
+	}
+	return nil
+}
+
+func (s *encryptedStore) Delete() error {
+	err := os.Remove(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *encryptedStore) cipher(salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(s.passphrase), salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// migrating moves a plain token file into the wrapped store on first load.
+type migrating struct {
+	TokenStore
+	plain *fileStore
+}
+
+func (s *migrating) Load() (*oauth2.Token, error) {
+	tok, err := s.TokenStore.Load()
+	if err != ErrNoToken && !errors.Is(err, errPlain) {
+		return tok, err
+	}
+	tok, perr := s.plain.Load()
+	if perr != nil || tok.RefreshToken == "" {
+		return nil, err
+	}
+	slog.Info("Moving plain token file to a secure store", "file", s.plain.path)
+	if err := s.TokenStore.Save(tok); err != nil {
+		return nil, err
+	}
+	// An encrypted store has already replaced the plain file.
+	if _, ok := s.TokenStore.(*keyringStore); ok {
+		if err := s.plain.Delete(); err != nil {
+			return nil, err
+		}
+	}
+	return tok, nil
+}
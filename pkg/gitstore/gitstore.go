@@ -0,0 +1,249 @@
+// Package gitstore keeps synced files under version control in a local git
+// repository.
+package gitstore
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// Author is the identity signing commits.
+type Author struct {
+	Name  string
+	Email string
+}
+
+// Repo is a git repository holding the synced files.
+type Repo struct {
+	// Author signs commits made by Commit, by default the user configured
+	// in git.
+	Author Author
+	// Remote is the name of the remote Push pushes to.
+	Remote string
+	// Auth authenticates to the Remote, nil for none.
+	Auth transport.AuthMethod
+	// Logger receives progress messages.
+	Logger *slog.Logger
+
+	path string
+	repo *git.Repository
+	// mergeHead is a pulled commit which the next commit merges.
+	mergeHead plumbing.Hash
+}
+
+// Open opens the existing git repository at path.
+func Open(path string) (*Repo, error) {
+	r, err := git.PlainOpen(path)
+	if err != nil {
+		return nil, fmt.Errorf("can't open repo %s: %w", path, err)
+	}
+	return &Repo{
+		Author: defaultAuthor(r),
+		Remote: git.DefaultRemoteName,
+		Logger: slog.Default(),
+		path:   path,
+		repo:   r,
+	}, nil
+}
+
+// defaultAuthor returns the user configured in git for the repository, or
+// in the global git config. Missing parts are filled in with "ToDo Sync"
+// and todosync at the host name.
+func defaultAuthor(r *git.Repository) Author {
+	var a Author
+	if cfg, err := r.ConfigScoped(config.GlobalScope); err == nil {
+		a = Author{Name: cfg.User.Name, Email: cfg.User.Email}
+	}
+	if a.Name == "" {
+		a.Name = "ToDo Sync"
+	}
+	if a.Email == "" {
+		host, err := os.Hostname()
+		if err != nil || host == "" {
+			host = "localhost"
+		}
+		a.Email = "todosync@" + host
+	}
+	return a
+}
+
+// Path returns the root directory of the worktree.
+func (r *Repo) Path() string {
+	return r.path
+}
+
+// Commit adds the changed files, given by paths inside the worktree, to the
+// index and commits them with msg.
+func (r *Repo) Commit(changes []string, msg string) error {
+	return r.CommitAt(changes, msg, time.Now())
+}
+
+// CommitAt is Commit with when as the author date, such as the time the
+// changes were made elsewhere.
+func (r *Repo) CommitAt(changes []string, msg string, when time.Time) error {
+	if len(changes) == 0 {
+		r.Logger.Debug("Nothing to commit")
+		return nil
+	}
+
+	wt, err := r.repo.Worktree()
+	if err != nil {
+		return fmt.Errorf("can't open worktree %s: %w", r.path, err)
+	}
+
+	modified := false
+	var names []string
+	for _, filename := range changes {
+		name, err := filepath.Rel(r.path, filename)
+		if err != nil {
+			return fmt.Errorf("can't add file to git %s: %w", filename, err)
+		}
+		name = filepath.ToSlash(name)
+		hash, err := wt.Add(name)
+		if err != nil {
+			return fmt.Errorf("can't add file to git %s: %w", filename, err)
+		}
+		r.Logger.Debug("Added file", "file", filename, "hash", hash.String())
+		names = append(names, name)
+	}
+	status, err := wt.Status()
+	if err != nil {
+		return fmt.Errorf("can't get status of %s: %w", r.path, err)
+	}
+	// Status leaves out unmodified files, File would report them
+	// untracked.
+	for _, name := range names {
+		if st, ok := status[name]; ok && st.Staging != git.Unmodified {
+			modified = true
+		}
+	}
+	if !modified && r.mergeHead.IsZero() {
+		r.Logger.Debug("Nothing to commit")
+		return nil
+	}
+
+	opts := &git.CommitOptions{
+		Author: &object.Signature{
+			Name:  r.Author.Name,
+			Email: r.Author.Email,
+			When:  when,
+		},
+		Committer: &object.Signature{
+			Name:  r.Author.Name,
+			Email: r.Author.Email,
+			When:  time.Now(),
+		}}
+	if !r.mergeHead.IsZero() {
+		head, err := r.repo.Head()
+		if err != nil {
+			return fmt.Errorf("can't resolve HEAD of %s: %w", r.path, err)
+		}
+		opts.Parents = []plumbing.Hash{head.Hash(), r.mergeHead}
+	}
+	hash, err := wt.Commit(msg, opts)
+	if err != nil {
+		return fmt.Errorf("can't commit to git: %w", err)
+	}
+	r.mergeHead = plumbing.ZeroHash
+	r.Logger.Info("Committed", "hash", hash.String())
+	return nil
+}
+
+// Head returns the hash of the HEAD commit, or empty string if the
+// repository has no commits.
+func (r *Repo) Head() (string, error) {
+	ref, err := r.repo.Head()
+	if err == plumbing.ErrReferenceNotFound {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("can't resolve HEAD of %s: %w", r.path, err)
+	}
+	return ref.Hash().String(), nil
+}
+
+// HeadContent returns content of filename as of the HEAD commit. A file
+// missing from HEAD, or a repository without commits, yields nil content.
+func (r *Repo) HeadContent(filename string) ([]byte, error) {
+	head, err := r.Head()
+	if err != nil || head == "" {
+		return nil, err
+	}
+	return r.Content(head, filename)
+}
+
+// Content returns content of filename as of the given commit, or nil if
+// the commit has no such file.
+func (r *Repo) Content(rev, filename string) ([]byte, error) {
+	commit, err := r.repo.CommitObject(plumbing.NewHash(rev))
+	if err != nil {
+		return nil, fmt.Errorf("can't read commit %s: %w", rev, err)
+	}
+	f, err := commit.File(filename)
+	if err == object.ErrFileNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't read %s from %s: %w", filename, rev, err)
+	}
+	content, err := f.Contents()
+	if err != nil {
+		return nil, fmt.Errorf("can't read %s from %s: %w", filename, rev, err)
+	}
+	return []byte(content), nil
+}
+
+// Change is a commit changing a file.
+type Change struct {
+	Hash    string    `json:"hash"`
+	Author  string    `json:"author"`
+	When    time.Time `json:"when"`
+	Message string    `json:"message"`
+}
+
+// Log returns up to limit commits changing filename, or any file when
+// filename is empty, newest first. A zero limit returns all of them.
+func (r *Repo) Log(filename string, limit int) ([]Change, error) {
+	head, err := r.Head()
+	if err != nil || head == "" {
+		return nil, err
+	}
+	opts := &git.LogOptions{}
+	if filename != "" {
+		opts.FileName = &filename
+	}
+	iter, err := r.repo.Log(opts)
+	if err != nil {
+		return nil, fmt.Errorf("can't read history of %s: %w", filename, err)
+	}
+	defer iter.Close()
+
+	var changes []Change
+	for limit == 0 || len(changes) < limit {
+		c, err := iter.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("can't read history of %s: %w", filename, err)
+		}
+		changes = append(changes, Change{
+			Hash:    c.Hash.String(),
+			Author:  c.Author.Name,
+			When:    c.Author.When,
+			Message: strings.TrimSpace(c.Message),
+		})
+	}
+	return changes, nil
+}
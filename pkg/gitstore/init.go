@@ -0,0 +1,165 @@
+package gitstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/mizhka/todosync/pkg/fsutil"
+)
+
+// ErrNoRepo is returned by Open when there is no git repository at the
+// path.
+var ErrNoRepo = git.ErrRepositoryNotExists
+
+// staleLock is the age after which an index lock is considered left by a
+// crashed git process.
+const staleLock = time.Minute
+
+// Create makes a git repository at path, creating the directory if needed.
+// With url set the repository is cloned from it, naming the remote remote;
+// path must then be missing or empty. An empty remote repository is set up
+// as the remote of a new repository.
+func Create(ctx context.Context, path, remote, url string, auth transport.AuthMethod) error {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return fmt.Errorf("can't create repo %s: %w", path, err)
+	}
+	if url != "" {
+		_, err := git.PlainCloneContext(ctx, path, false, &git.CloneOptions{URL: url, RemoteName: remote, Auth: auth})
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, transport.ErrEmptyRemoteRepository) {
+			return fmt.Errorf("can't clone %s to %s: %w", url, path, err)
+		}
+	}
+	r, err := git.PlainInit(path, false)
+	if err != nil {
+		return fmt.Errorf("can't init repo %s: %w", path, err)
+	}
+	if url != "" {
+		_, err := r.CreateRemote(&config.RemoteConfig{Name: remote, URLs: []string{url}})
+		if err != nil {
+			return fmt.Errorf("can't add remote %s to %s: %w", remote, path, err)
+		}
+	}
+	return nil
+}
+
+// Recover cleans up after a process interrupted while changing the
+// repository: it removes a stale index lock, aborts a merge in progress
+// and resets tracked files changed since HEAD. Synced files reset this way
+// are copied to the worktree again by the next sync cycle.
+func (r *Repo) Recover() error {
+	gitDir := filepath.Join(r.path, git.GitDirName)
+	lock := filepath.Join(gitDir, "index.lock")
+	if st, err := os.Stat(lock); err == nil && time.Since(st.ModTime()) > staleLock {
+		r.Logger.Warn("Removing stale index lock", "file", lock)
+		if err := os.Remove(lock); err != nil {
+			return fmt.Errorf("can't remove stale lock: %w", err)
+		}
+	}
+
+	head, err := r.Head()
+	if err != nil || head == "" {
+		return err
+	}
+	merging := false
+	for _, name := range []string{"MERGE_HEAD", "MERGE_MSG", "MERGE_MODE"} {
+		err := os.Remove(filepath.Join(gitDir, name))
+		if err == nil {
+			merging = true
+		} else if !os.IsNotExist(err) {
+			return fmt.Errorf("can't abort merge: %w", err)
+		}
+	}
+	if merging {
+		r.Logger.Warn("Aborted interrupted merge", "repo", r.path)
+	}
+
+	wt, err := r.repo.Worktree()
+	if err != nil {
+		return fmt.Errorf("can't open worktree %s: %w", r.path, err)
+	}
+	status, err := wt.Status()
+	if err != nil {
+		return fmt.Errorf("can't get status of %s: %w", r.path, err)
+	}
+	var dirty []string
+	for name, st := range status {
+		if st.Staging == git.Untracked || (st.Staging == git.Unmodified && st.Worktree == git.Unmodified) {
+			continue
+		}
+		r.Logger.Warn("Resetting uncommitted change", "file", name)
+		dirty = append(dirty, name)
+	}
+	if len(dirty) == 0 && !merging {
+		return nil
+	}
+	// A hard reset would delete untracked files too.
+	if err := wt.Reset(&git.ResetOptions{Mode: git.MixedReset}); err != nil {
+		return fmt.Errorf("can't reset %s: %w", r.path, err)
+	}
+	for _, name := range dirty {
+		content, err := r.Content(head, name)
+		if err != nil {
+			return err
+		}
+		if content == nil {
+			// Added since HEAD, the file stays untracked.
+			continue
+		}
+		if err := fsutil.WriteFile(filepath.Join(r.path, filepath.FromSlash(name)), content, 0644); err != nil {
+			return fmt.Errorf("can't reset %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// Restore puts files, given as slash separated paths, back to their
+// content at HEAD in the worktree and the index, and removes those HEAD
+// doesn't have. It undoes changes made since the last commit, whether
+// staged or not.
+func (r *Repo) Restore(names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	head, err := r.Head()
+	if err != nil {
+		return err
+	}
+	if head != "" {
+		wt, err := r.repo.Worktree()
+		if err != nil {
+			return fmt.Errorf("can't open worktree %s: %w", r.path, err)
+		}
+		if err := wt.Reset(&git.ResetOptions{Mode: git.MixedReset}); err != nil {
+			return fmt.Errorf("can't reset %s: %w", r.path, err)
+		}
+	}
+	for _, name := range names {
+		var content []byte
+		if head != "" {
+			if content, err = r.Content(head, name); err != nil {
+				return err
+			}
+		}
+		path := filepath.Join(r.path, filepath.FromSlash(name))
+		if content == nil {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("can't restore %s: %w", name, err)
+			}
+			continue
+		}
+		if err := fsutil.WriteFile(path, content, 0644); err != nil {
+			return fmt.Errorf("can't restore %s: %w", name, err)
+		}
+	}
+	return nil
+}
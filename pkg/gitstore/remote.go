@@ -0,0 +1,116 @@
+package gitstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"github.com/mizhka/todosync/pkg/backoff"
+)
+
+// pushAttempts is how many times Push tries before giving up.
+const pushAttempts = 4
+
+// SSHKeyAuth authenticates with the private key in keyFile.
+func SSHKeyAuth(keyFile, passphrase string) (transport.AuthMethod, error) {
+	auth, err := ssh.NewPublicKeysFromFile("git", keyFile, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("can't load ssh key %s: %w", keyFile, err)
+	}
+	return auth, nil
+}
+
+// TokenAuth authenticates over HTTPS with an access token.
+func TokenAuth(username, token string) transport.AuthMethod {
+	if username == "" {
+		username = "git"
+	}
+	return &http.BasicAuth{Username: username, Password: token}
+}
+
+// Push pushes commits to the Remote, retrying with exponential backoff on
+// failures other than authentication errors.
+func (r *Repo) Push(ctx context.Context) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = r.repo.PushContext(ctx, &git.PushOptions{RemoteName: r.Remote, Auth: r.Auth})
+		if err == nil || err == git.NoErrAlreadyUpToDate {
+			return nil
+		}
+		if errors.Is(err, transport.ErrAuthenticationRequired) ||
+			errors.Is(err, transport.ErrAuthorizationFailed) ||
+			attempt == pushAttempts || ctx.Err() != nil {
+			break
+		}
+		delay := backoff.Delay(attempt, time.Second, 30*time.Second)
+		r.Logger.Warn("Push failed, retrying", "remote", r.Remote, "delay", delay, "err", err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+		}
+	}
+	return fmt.Errorf("can't push to %s: %w", r.Remote, err)
+}
+
+// Pull fetches the Remote and fast-forwards the current branch to its
+// remote counterpart. It returns the fetched commit bringing new content,
+// or empty string if there is none. When local and remote histories have
+// diverged HEAD stays in place and the next Commit merges the fetched
+// commit as a second parent.
+func (r *Repo) Pull(ctx context.Context) (string, error) {
+	err := r.repo.FetchContext(ctx, &git.FetchOptions{RemoteName: r.Remote, Auth: r.Auth})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return "", fmt.Errorf("can't fetch %s: %w", r.Remote, err)
+	}
+
+	head, err := r.repo.Head()
+	if err != nil {
+		return "", fmt.Errorf("can't resolve HEAD of %s: %w", r.path, err)
+	}
+	ref, err := r.repo.Reference(plumbing.NewRemoteReferenceName(r.Remote, head.Name().Short()), true)
+	if err == plumbing.ErrReferenceNotFound {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("can't resolve remote branch: %w", err)
+	}
+	if ref.Hash() == head.Hash() || ref.Hash() == r.mergeHead {
+		return "", nil
+	}
+
+	local, err := r.repo.CommitObject(head.Hash())
+	if err != nil {
+		return "", err
+	}
+	remote, err := r.repo.CommitObject(ref.Hash())
+	if err != nil {
+		return "", err
+	}
+	if merged, err := remote.IsAncestor(local); err != nil || merged {
+		return "", err
+	}
+
+	if ff, err := local.IsAncestor(remote); err != nil {
+		return "", err
+	} else if !ff {
+		r.Logger.Info("Histories diverged, merging", "remote", r.Remote, "hash", ref.Hash().String())
+		r.mergeHead = ref.Hash()
+		return ref.Hash().String(), nil
+	}
+
+	wt, err := r.repo.Worktree()
+	if err != nil {
+		return "", fmt.Errorf("can't open worktree %s: %w", r.path, err)
+	}
+	if err := wt.Reset(&git.ResetOptions{Commit: ref.Hash(), Mode: git.MergeReset}); err != nil {
+		return "", fmt.Errorf("can't fast-forward to %s: %w", ref.Hash(), err)
+	}
+	r.Logger.Info("Fast-forwarded", "hash", ref.Hash().String())
+	return ref.Hash().String(), nil
+}
@@ -0,0 +1,117 @@
+// Package gtasks mirrors tasks to a Google Tasks list.
+package gtasks
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/mizhka/todosync/pkg/gauth"
+	"github.com/mizhka/todosync/pkg/tasks"
+	"google.golang.org/api/option"
+	gtasks "google.golang.org/api/tasks/v1"
+)
+
+// DefaultList is the ID of the user's default task list.
+const DefaultList = "@default"
+
+const (
+	statusOpen      = "needsAction"
+	statusCompleted = "completed"
+)
+
+var _ tasks.Provider = (*Client)(nil)
+
+// Client is a Google Tasks list authorized with the user's OAuth token. It
+// implements tasks.Provider.
+type Client struct {
+	// TaskList is the ID of the mirrored task list.
+	TaskList string
+
+	srv *gtasks.Service
+}
+
+// NewClient builds a client of the default task list authorized by creds.
+func NewClient(ctx context.Context, creds *gauth.Credentials) (*Client, error) {
+	client, err := creds.Client(ctx, gtasks.TasksScope)
+	if err != nil {
+		return nil, err
+	}
+
+	srv, err := gtasks.NewService(ctx, option.WithHTTPClient(client))
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve Tasks client: %w", err)
+	}
+	return &Client{TaskList: DefaultList, srv: srv}, nil
+}
+
+// Authorize asks the user to grant access to Google Tasks and saves the
+// token of creds. With noBrowser the authorization page may be opened on
+// another device.
+func Authorize(ctx context.Context, creds *gauth.Credentials, noBrowser bool) error {
+	return creds.Authorize(ctx, noBrowser, gtasks.TasksScope)
+}
+
+// List returns all tasks of the list, including completed and hidden ones.
+func (c *Client) List(ctx context.Context) ([]*tasks.Item, error) {
+	var items []*tasks.Item
+	token := ""
+	for {
+		r, err := c.srv.Tasks.List(c.TaskList).ShowCompleted(true).ShowHidden(true).
+			MaxResults(100).PageToken(token).Context(ctx).Do()
+		if err != nil {
+			return nil, fmt.Errorf("unable to list tasks: %w", err)
+		}
+		for _, t := range r.Items {
+			items = append(items, itemOf(t))
+		}
+		token = r.NextPageToken
+		if token == "" {
+			return items, nil
+		}
+	}
+}
+
+// Insert adds the task at the top of the list.
+func (c *Client) Insert(ctx context.Context, item *tasks.Item) (*tasks.Item, error) {
+	t, err := c.srv.Tasks.Insert(c.TaskList, taskOf(item)).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("can't create task %q: %w", item.Title, err)
+	}
+	return itemOf(t), nil
+}
+
+// Update saves title and status of the task.
+func (c *Client) Update(ctx context.Context, item *tasks.Item) error {
+	t := taskOf(item)
+	if !item.Completed {
+		// Reopened tasks must drop their completion time.
+		t.NullFields = []string{"Completed"}
+	}
+	if _, err := c.srv.Tasks.Patch(c.TaskList, item.ID, t).Context(ctx).Do(); err != nil {
+		return fmt.Errorf("can't update task %q: %w", item.Title, err)
+	}
+	return nil
+}
+
+// Delete removes the task.
+func (c *Client) Delete(ctx context.Context, id string) error {
+	if err := c.srv.Tasks.Delete(c.TaskList, id).Context(ctx).Do(); err != nil {
+		return fmt.Errorf("can't delete task %s: %w", id, err)
+	}
+	return nil
+}
+
+func itemOf(t *gtasks.Task) *tasks.Item {
+	return &tasks.Item{ID: t.Id, Title: t.Title, Completed: t.Status == statusCompleted}
+}
+
+func taskOf(item *tasks.Item) *gtasks.Task {
+	t := &gtasks.Task{Title: item.Title, Status: statusOpen}
+	if item.Completed {
+		t.Status = statusCompleted
+		completed := time.Now().UTC().Format(time.RFC3339)
+		t.Completed = &completed
+	}
+	return t
+}
@@ -0,0 +1,176 @@
+// Package health reports whether sync profiles keep syncing, over HTTP and
+// to the systemd watchdog.
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Monitor collects Checks of all profiles run by the process.
+type Monitor struct {
+	// Failures is the number of consecutive failed cycles making a
+	// profile unhealthy.
+	Failures int
+	// MaxAge is how long a profile may go without a successful cycle.
+	// Zero disables the limit.
+	MaxAge time.Duration
+
+	mu     sync.Mutex
+	checks []*Check
+}
+
+// New returns a Monitor without Checks.
+func New(failures int, maxAge time.Duration) *Monitor {
+	return &Monitor{Failures: failures, MaxAge: maxAge}
+}
+
+// Check tracks sync cycles of a single profile.
+type Check struct {
+	name    string
+	started time.Time
+
+	mu          sync.Mutex
+	failures    int
+	lastSuccess time.Time
+	lastErr     error
+	stopped     error
+	paused      bool
+	offline     bool
+}
+
+// Add registers a Check for the profile called name.
+func (m *Monitor) Add(name string) *Check {
+	c := &Check{name: name, started: time.Now()}
+	m.mu.Lock()
+	m.checks = append(m.checks, c)
+	m.mu.Unlock()
+	return c
+}
+
+// Record notes the result of a sync cycle, nil for success.
+func (c *Check) Record(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastErr = err
+	c.offline = false
+	if err != nil {
+		c.failures++
+		return
+	}
+	c.failures = 0
+	c.lastSuccess = time.Now()
+}
+
+// Checked notes a successful check that found nothing to sync. Unless the
+// last cycle failed, the profile is as fresh as after a successful cycle.
+func (c *Check) Checked() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.failures == 0 {
+		c.lastSuccess = time.Now()
+	}
+}
+
+// Offline notes a cycle which couldn't reach the remote and committed
+// local changes instead, with err telling why. It isn't a failure, and
+// like a pause it keeps the profile healthy however long it goes without
+// syncing, until the next cycle is recorded.
+func (c *Check) Offline(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastErr = err
+	c.failures = 0
+	c.offline = true
+}
+
+// Stop notes that the profile stopped syncing because of err.
+func (c *Check) Stop(err error) {
+	c.mu.Lock()
+	c.stopped = err
+	c.mu.Unlock()
+}
+
+// Pause notes whether the profile is paused on purpose, which keeps it
+// healthy however long it goes without syncing.
+func (c *Check) Pause(paused bool) {
+	c.mu.Lock()
+	c.paused = paused
+	c.mu.Unlock()
+}
+
+// ProfileStatus is the health of a single profile.
+type ProfileStatus struct {
+	Name    string `json:"name,omitempty"`
+	Healthy bool   `json:"healthy"`
+	// Failures counts consecutive failed cycles.
+	Failures    int        `json:"failures"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	// Staleness is the time since the last successful cycle, or since
+	// the start when there was none, in seconds.
+	Staleness float64 `json:"staleness"`
+	LastError string  `json:"last_error,omitempty"`
+	Stopped   bool    `json:"stopped,omitempty"`
+	Paused    bool    `json:"paused,omitempty"`
+	Offline   bool    `json:"offline,omitempty"`
+}
+
+// Status is the health of all profiles.
+type Status struct {
+	Healthy  bool            `json:"healthy"`
+	Profiles []ProfileStatus `json:"profiles"`
+}
+
+// Status reports the health of each profile. A profile is unhealthy when
+// it stopped, its last Failures cycles failed or it hasn't synced
+// successfully for MaxAge while neither paused nor offline.
+func (m *Monitor) Status() Status {
+	m.mu.Lock()
+	checks := append([]*Check(nil), m.checks...)
+	m.mu.Unlock()
+
+	st := Status{Healthy: true}
+	now := time.Now()
+	for _, c := range checks {
+		c.mu.Lock()
+		ps := ProfileStatus{Name: c.name, Failures: c.failures, Stopped: c.stopped != nil, Paused: c.paused, Offline: c.offline}
+		since := c.started
+		if !c.lastSuccess.IsZero() {
+			t := c.lastSuccess
+			ps.LastSuccess = &t
+			since = t
+		}
+		ps.Staleness = now.Sub(since).Seconds()
+		switch {
+		case c.stopped != nil:
+			ps.LastError = c.stopped.Error()
+		case c.lastErr != nil:
+			ps.LastError = c.lastErr.Error()
+		}
+		ps.Healthy = c.stopped == nil &&
+			(m.Failures <= 0 || c.failures < m.Failures) &&
+			(m.MaxAge <= 0 || c.paused || c.offline || now.Sub(since) <= m.MaxAge)
+		c.mu.Unlock()
+
+		if !ps.Healthy {
+			st.Healthy = false
+		}
+		st.Profiles = append(st.Profiles, ps)
+	}
+	return st
+}
+
+// ServeHTTP answers with the Status as JSON, with status code 503 when any
+// profile is unhealthy.
+func (m *Monitor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	st := m.Status()
+	w.Header().Set("Content-Type", "application/json")
+	if !st.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(st)
+}
@@ -0,0 +1,158 @@
+package ical
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/mizhka/todosync/pkg/todotxt"
+)
+
+// CalDAV pushes tasks as to-dos to a calendar collection of a CalDAV
+// server, such as Nextcloud, Radicale or Fastmail.
+type CalDAV struct {
+	// URL is the calendar collection, authenticated with basic auth if
+	// Username is set.
+	URL      string
+	Username string
+	Password string
+	// Client sends requests, http.DefaultClient when nil.
+	Client *http.Client
+
+	// pushed holds checksums of tasks last pushed by UID, so that
+	// unchanged to-dos aren't sent again.
+	pushed map[string]string
+}
+
+// Push makes the collection hold a to-do per task with a due date. To-dos
+// of changed tasks are replaced, and to-dos pushed before for tasks gone
+// are deleted. Other objects of the collection are left alone.
+func (c *CalDAV) Push(ctx context.Context, tasks []*todotxt.Task) error {
+	base, err := url.Parse(c.URL)
+	if err != nil {
+		return fmt.Errorf("invalid caldav url %s: %w", c.URL, err)
+	}
+	if !strings.HasSuffix(base.Path, "/") {
+		base.Path += "/"
+	}
+	existing, err := c.list(ctx, base)
+	if err != nil {
+		return err
+	}
+	if c.pushed == nil {
+		c.pushed = map[string]string{}
+	}
+
+	now := time.Now()
+	dated, uids := Dated(tasks)
+	keep := map[string]bool{}
+	for i, t := range dated {
+		uid := uids[i]
+		keep[uid] = true
+		sum := md5.Sum([]byte(t.String()))
+		digest := hex.EncodeToString(sum[:])
+		if existing[uid] && c.pushed[uid] == digest {
+			continue
+		}
+		resp, err := c.do(ctx, http.MethodPut, base, uid+".ics", bytes.NewReader(object(t, uid, now)),
+			http.StatusOK, http.StatusCreated, http.StatusNoContent)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		c.pushed[uid] = digest
+	}
+	for uid := range existing {
+		if keep[uid] {
+			continue
+		}
+		resp, err := c.do(ctx, http.MethodDelete, base, uid+".ics", nil,
+			http.StatusOK, http.StatusNoContent, http.StatusNotFound)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		delete(c.pushed, uid)
+	}
+	return nil
+}
+
+// multistatus is the PROPFIND response.
+type multistatus struct {
+	Responses []struct {
+		Href string `xml:"href"`
+	} `xml:"response"`
+}
+
+// list returns UIDs of to-dos pushed to the collection before, found by
+// their resource names.
+func (c *CalDAV) list(ctx context.Context, base *url.URL) (map[string]bool, error) {
+	body := `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:"><d:prop><d:getetag/></d:prop></d:propfind>`
+	resp, err := c.do(ctx, "PROPFIND", base, "", strings.NewReader(body), http.StatusMultiStatus)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var ms multistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, fmt.Errorf("invalid PROPFIND response for %s: %w", base.Path, err)
+	}
+	uids := map[string]bool{}
+	for _, r := range ms.Responses {
+		u, err := url.Parse(r.Href)
+		if err != nil {
+			continue
+		}
+		name := path.Base(u.Path)
+		if strings.HasPrefix(name, "todosync-") && strings.HasSuffix(name, ".ics") {
+			uids[strings.TrimSuffix(name, ".ics")] = true
+		}
+	}
+	return uids, nil
+}
+
+// do sends a request for the resource name of the collection base and
+// checks that the response has one of codes.
+func (c *CalDAV) do(ctx context.Context, method string, base *url.URL, name string, body io.Reader, codes ...int) (*http.Response, error) {
+	u := *base
+	u.Path = base.Path + name
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if c.Username != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+	switch method {
+	case "PROPFIND":
+		req.Header.Set("Depth", "1")
+		req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+	case http.MethodPut:
+		req.Header.Set("Content-Type", "text/calendar; charset=utf-8")
+	}
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %w", method, u.Path, err)
+	}
+	for _, code := range codes {
+		if resp.StatusCode == code {
+			return resp, nil
+		}
+	}
+	resp.Body.Close()
+	return nil, fmt.Errorf("%s %s: %s", method, u.Path, resp.Status)
+}
@@ -0,0 +1,59 @@
+package ical
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"time"
+
+	"github.com/mizhka/todosync/pkg/fsutil"
+	"github.com/mizhka/todosync/pkg/todotxt"
+)
+
+// Exporter exports the todo file to File and CalDAV whenever it changes. It
+// is a sync.LocalTarget.
+type Exporter struct {
+	// Todo is the slash separated path of the todo file.
+	Todo string
+	// File, when set, is where the calendar is written.
+	File    string
+	Options Options
+	// CalDAV, when set, receives the tasks as to-dos.
+	CalDAV *CalDAV
+}
+
+// Write exports the tasks of content, if name is the todo file.
+func (e *Exporter) Write(ctx context.Context, name string, content []byte) error {
+	if name != e.Todo {
+		return nil
+	}
+	return e.export(ctx, todotxt.ParseList(content))
+}
+
+// Remove exports no tasks, if name is the todo file.
+func (e *Exporter) Remove(ctx context.Context, name string) error {
+	if name != e.Todo {
+		return nil
+	}
+	return e.export(ctx, nil)
+}
+
+func (e *Exporter) String() string {
+	return "calendar"
+}
+
+// export writes tasks to File and CalDAV, even if one of them fails. File
+// is left alone when only its time stamps would change.
+func (e *Exporter) export(ctx context.Context, tasks []*todotxt.Task) error {
+	var errs []error
+	if e.File != "" {
+		cal := Calendar(tasks, e.Options, time.Now())
+		if old, err := ioutil.ReadFile(e.File); err != nil || !Equal(old, cal) {
+			errs = append(errs, fsutil.WriteFile(e.File, cal, 0644))
+		}
+	}
+	if e.CalDAV != nil {
+		errs = append(errs, e.CalDAV.Push(ctx, tasks))
+	}
+	return errors.Join(errs...)
+}
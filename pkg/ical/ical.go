@@ -0,0 +1,207 @@
+// Package ical exports tasks of todo.txt files with due dates as iCalendar
+// data (RFC 5545): to a file, over HTTP or to a CalDAV server.
+package ical
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mizhka/todosync/pkg/todotxt"
+)
+
+// prodID identifies todosync as the producer of calendars.
+const prodID = "-//todosync//todosync//EN"
+
+// Options select how tasks are exported.
+type Options struct {
+	// Name is the name of the calendar shown by calendar apps.
+	Name string
+	// Events exports tasks as all-day events on their due date instead of
+	// to-dos, for calendars which don't show to-dos such as Google
+	// Calendar.
+	Events bool
+}
+
+// Dated returns the tasks with a valid due:YYYY-MM-DD tag, paired with
+// identifiers which stay the same as long as their descriptions do.
+func Dated(tasks []*todotxt.Task) ([]*todotxt.Task, []string) {
+	var dated []*todotxt.Task
+	var uids []string
+	seen := map[string]int{}
+	for _, t := range tasks {
+		if _, ok := due(t); !ok {
+			continue
+		}
+		sum := sha1.Sum([]byte(t.Key()))
+		uid := "todosync-" + hex.EncodeToString(sum[:10])
+		// Tasks with the same description are told apart by order.
+		if n := seen[uid]; n > 0 {
+			seen[uid]++
+			uid += fmt.Sprintf("-%d", n)
+		} else {
+			seen[uid] = 1
+		}
+		dated = append(dated, t)
+		uids = append(uids, uid)
+	}
+	return dated, uids
+}
+
+// Calendar returns a calendar with a component per task with a due date,
+// stamped with now.
+func Calendar(tasks []*todotxt.Task, opts Options, now time.Time) []byte {
+	var w writer
+	w.begin(opts.Name)
+	dated, uids := Dated(tasks)
+	for i, t := range dated {
+		w.component(t, uids[i], opts.Events, now)
+	}
+	w.line("END:VCALENDAR")
+	return w.Bytes()
+}
+
+// object returns a calendar holding the to-do of a single task, as stored
+// by CalDAV servers.
+func object(t *todotxt.Task, uid string, now time.Time) []byte {
+	var w writer
+	w.begin("")
+	w.component(t, uid, false, now)
+	w.line("END:VCALENDAR")
+	return w.Bytes()
+}
+
+// due returns the due date of the task.
+func due(t *todotxt.Task) (time.Time, bool) {
+	d, err := time.Parse(todotxt.DateLayout, t.Tags["due"])
+	return d, err == nil
+}
+
+// summary returns the description of the task without its due date.
+func summary(t *todotxt.Task) string {
+	var words []string
+	for _, w := range strings.Fields(t.Text) {
+		if !strings.HasPrefix(w, "due:") {
+			words = append(words, w)
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// writer builds iCalendar data.
+type writer struct {
+	bytes.Buffer
+}
+
+// begin starts a calendar named name.
+func (w *writer) begin(name string) {
+	w.line("BEGIN:VCALENDAR")
+	w.line("VERSION:2.0")
+	w.line("PRODID:" + prodID)
+	w.line("CALSCALE:GREGORIAN")
+	if name != "" {
+		w.text("X-WR-CALNAME", name)
+	}
+}
+
+// component writes the to-do, or the all-day event with events, of the
+// task.
+func (w *writer) component(t *todotxt.Task, uid string, events bool, now time.Time) {
+	d, _ := due(t)
+	kind := "VTODO"
+	if events {
+		kind = "VEVENT"
+	}
+	w.line("BEGIN:" + kind)
+	w.line("UID:" + uid)
+	w.line("DTSTAMP:" + now.UTC().Format("20060102T150405Z"))
+	w.text("SUMMARY", summary(t))
+	if events {
+		w.line("DTSTART;VALUE=DATE:" + d.Format("20060102"))
+		w.line("DTEND;VALUE=DATE:" + d.AddDate(0, 0, 1).Format("20060102"))
+		w.line("TRANSP:TRANSPARENT")
+	} else {
+		w.line("DUE;VALUE=DATE:" + d.Format("20060102"))
+		if t.Completed {
+			w.line("STATUS:COMPLETED")
+			if !t.CompletionDate.IsZero() {
+				w.line("COMPLETED:" + t.CompletionDate.Format("20060102T150405Z"))
+			}
+		} else {
+			w.line("STATUS:NEEDS-ACTION")
+		}
+	}
+	if !t.CreationDate.IsZero() {
+		w.line("CREATED:" + t.CreationDate.Format("20060102T150405Z"))
+	}
+	if t.Priority != 0 {
+		// A is the highest priority, 1 in iCalendar, and priorities
+		// below I are the lowest, 9.
+		p := int(t.Priority-'A') + 1
+		if p > 9 {
+			p = 9
+		}
+		w.line(fmt.Sprintf("PRIORITY:%d", p))
+	}
+	var categories []string
+	for _, p := range t.Projects {
+		categories = append(categories, escape("+"+p))
+	}
+	for _, c := range t.Contexts {
+		categories = append(categories, escape("@"+c))
+	}
+	if len(categories) > 0 {
+		w.line("CATEGORIES:" + strings.Join(categories, ","))
+	}
+	w.line("END:" + kind)
+}
+
+// text writes a property with a text value.
+func (w *writer) text(name, value string) {
+	w.line(name + ":" + escape(value))
+}
+
+// line writes a content line, folded after 75 octets without splitting
+// characters.
+func (w *writer) line(s string) {
+	limit := 75
+	for len(s) > limit {
+		i := limit
+		for i > 0 && !utf8.RuneStart(s[i]) {
+			i--
+		}
+		w.WriteString(s[:i])
+		w.WriteString("\r\n ")
+		s = s[i:]
+		// The leading space of continuation lines counts.
+		limit = 74
+	}
+	w.WriteString(s)
+	w.WriteString("\r\n")
+}
+
+// escape escapes a text value.
+func escape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`).Replace(s)
+}
+
+// Equal reports whether calendars a and b differ at most in when they were
+// generated.
+func Equal(a, b []byte) bool {
+	return bytes.Equal(unstamped(a), unstamped(b))
+}
+
+// unstamped returns the calendar without DTSTAMP lines.
+func unstamped(b []byte) []byte {
+	var res []byte
+	for _, line := range bytes.SplitAfter(b, []byte("\n")) {
+		if !bytes.HasPrefix(line, []byte("DTSTAMP:")) {
+			res = append(res, line...)
+		}
+	}
+	return res
+}
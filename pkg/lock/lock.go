@@ -0,0 +1,100 @@
+// Package lock keeps todosync processes from syncing the same files at
+// once through advisory locks on lock files.
+package lock
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrLocked is wrapped by errors of Acquire when another process holds the
+// lock.
+var ErrLocked = errors.New("locked by another process")
+
+// retry is the delay between attempts of a waiting Acquire.
+const retry = 500 * time.Millisecond
+
+// Lock is an acquired lock file.
+type Lock struct {
+	f *os.File
+}
+
+// Path returns the lock file guarding the repo at path. It's kept in
+// $XDG_RUNTIME_DIR, or the temporary directory where there is none, and
+// named after the absolute path of the repo.
+func Path(repo string) string {
+	if abs, err := filepath.Abs(repo); err == nil {
+		repo = abs
+	}
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	sum := sha256.Sum256([]byte(repo))
+	return filepath.Join(dir, "todosync-"+hex.EncodeToString(sum[:8])+".lock")
+}
+
+// Acquire takes the lock file at path, creating it if needed, and writes
+// the process ID to it. When another process holds the lock Acquire fails
+// with ErrLocked, or with wait retries until the lock is released or ctx
+// is cancelled. The lock is released by Release or when the process exits.
+func Acquire(ctx context.Context, path string, wait bool) (*Lock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("can't open lock file: %w", err)
+	}
+	for {
+		err = tryLock(f)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, ErrLocked) || !wait {
+			f.Close()
+			if errors.Is(err, ErrLocked) {
+				return nil, fmt.Errorf("%s %w%s", path, err, holder(path))
+			}
+			return nil, fmt.Errorf("can't lock %s: %w", path, err)
+		}
+		select {
+		case <-time.After(retry):
+		case <-ctx.Done():
+			f.Close()
+			return nil, ctx.Err()
+		}
+	}
+
+	if err := f.Truncate(0); err == nil {
+		f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	return &Lock{f: f}, nil
+}
+
+// holder describes the process holding the lock file at path.
+func holder(path string) string {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	if pid := strings.TrimSpace(string(b)); pid != "" {
+		return " (pid " + pid + ")"
+	}
+	return ""
+}
+
+// Release releases the lock.
+func (l *Lock) Release() error {
+	if err := unlock(l.f); err != nil {
+		l.f.Close()
+		return err
+	}
+	return l.f.Close()
+}
@@ -0,0 +1,274 @@
+// Package merge implements line based three-way merge and diff of text
+// files.
+package merge
+
+import (
+	"bytes"
+	"strings"
+)
+
+// Conflict markers written around conflicting regions.
+const (
+	markerLocal  = "<<<<<<< local\n"
+	markerSep    = "=======\n"
+	markerRemote = ">>>>>>> remote\n"
+)
+
+// Lines merges changes made in local and remote against their common base
+// line by line. Regions changed differently on both sides are kept with
+// conflict markers and reported by conflict. A missing final newline is
+// merged like a change of the last line.
+func Lines(base, local, remote []byte) (merged []byte, conflict bool) {
+	b, nb := split(base)
+	l, nl := split(local)
+	r, nr := split(remote)
+	ml, mr := match(b, l), match(b, r)
+
+	var out bytes.Buffer
+	i, a, c := 0, 0, 0
+	for {
+		// Next base line kept unchanged on both sides.
+		k := i
+		for k < len(b) && (ml[k] < a || mr[k] < c) {
+			k++
+		}
+		if k == len(b) {
+			conflict = resolve(&out, b[i:], l[a:], r[c:]) || conflict
+			break
+		}
+		conflict = resolve(&out, b[i:k], l[a:ml[k]], r[c:mr[k]]) || conflict
+		out.WriteString(b[k])
+		i, a, c = k+1, ml[k]+1, mr[k]+1
+	}
+
+	noNewline := nl
+	if nl == nb {
+		noNewline = nr
+	}
+	merged = out.Bytes()
+	if noNewline && !bytes.HasSuffix(merged, []byte(markerRemote)) {
+		merged = bytes.TrimSuffix(merged, []byte("\n"))
+	}
+	return merged, conflict
+}
+
+// Diff compares old and new line by line. It returns lines of both without
+// terminators, prefixed by "-" when only in old, "+" when only in new and
+// " " when in both.
+func Diff(old, new []byte) []string {
+	a, _ := split(old)
+	b, _ := split(new)
+	m := match(a, b)
+	var out []string
+	j := 0
+	for i, line := range a {
+		if m[i] < 0 {
+			out = append(out, "-"+strings.TrimSuffix(line, "\n"))
+			continue
+		}
+		for ; j < m[i]; j++ {
+			out = append(out, "+"+strings.TrimSuffix(b[j], "\n"))
+		}
+		out = append(out, " "+strings.TrimSuffix(line, "\n"))
+		j++
+	}
+	for ; j < len(b); j++ {
+		out = append(out, "+"+strings.TrimSuffix(b[j], "\n"))
+	}
+	return out
+}
+
+// resolve writes the outcome of a chunk and reports whether it conflicts.
+func resolve(out *bytes.Buffer, base, local, remote []string) bool {
+	switch {
+	case equal(local, base):
+		write(out, remote)
+	case equal(remote, base), equal(local, remote):
+		write(out, local)
+	default:
+		out.WriteString(markerLocal)
+		write(out, local)
+		out.WriteString(markerSep)
+		write(out, remote)
+		out.WriteString(markerRemote)
+		return true
+	}
+	return false
+}
+
+func write(out *bytes.Buffer, lines []string) {
+	for _, l := range lines {
+		out.WriteString(l)
+	}
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// split cuts text into lines keeping line terminators. A missing final
+// newline is added so that appending lines doesn't modify the last one,
+// and reported by noNewline for the caller to take it away again.
+func split(text []byte) (lines []string, noNewline bool) {
+	for len(text) > 0 {
+		n := bytes.IndexByte(text, '\n')
+		if n < 0 {
+			lines = append(lines, string(text)+"\n")
+			noNewline = true
+			break
+		}
+		lines = append(lines, string(text[:n+1]))
+		text = text[n+1:]
+	}
+	return lines, noNewline
+}
+
+// match returns for every line of a the index of the line of b it's paired
+// with in a longest common subsequence, or -1. It follows Myers' linear
+// space algorithm, so that files far larger than the changes between them
+// are compared in memory proportional to their length and time
+// proportional to the changes.
+func match(a, b []string) []int {
+	// Lines are compared as numbers.
+	ids := map[string]int{}
+	intern := func(lines []string) []int {
+		res := make([]int, len(lines))
+		for i, l := range lines {
+			id, ok := ids[l]
+			if !ok {
+				id = len(ids)
+				ids[l] = id
+			}
+			res[i] = id
+		}
+		return res
+	}
+	d := &differ{a: intern(a), b: intern(b), m: make([]int, len(a))}
+	for i := range d.m {
+		d.m[i] = -1
+	}
+	d.compare(0, len(a), 0, len(b))
+	return d.m
+}
+
+// differ pairs lines of a with lines of b in m.
+type differ struct {
+	a, b []int
+	m    []int
+}
+
+// compare pairs lines of a[a0:a1] with lines of b[b0:b1]. Common prefix and
+// suffix are paired directly, the rest is split where the shortest edit
+// scripts from either end meet and compared part by part.
+func (d *differ) compare(a0, a1, b0, b1 int) {
+	for a0 < a1 && b0 < b1 && d.a[a0] == d.b[b0] {
+		d.m[a0] = b0
+		a0++
+		b0++
+	}
+	for a0 < a1 && b0 < b1 && d.a[a1-1] == d.b[b1-1] {
+		d.m[a1-1] = b1 - 1
+		a1--
+		b1--
+	}
+	if a0 == a1 || b0 == b1 {
+		return
+	}
+	x, y, ok := d.bisect(a0, a1, b0, b1)
+	if !ok {
+		return
+	}
+	d.compare(a0, x, b0, y)
+	d.compare(x, a1, y, b1)
+}
+
+// bisect returns a point of a shortest edit script turning a[a0:a1] into
+// b[b0:b1] about halfway through it, found by following scripts from both
+// ends until they overlap. It reports false when the ranges have no line
+// in common. The ranges must differ in their first and last lines, so that
+// the point splits them into smaller ones.
+func (d *differ) bisect(a0, a1, b0, b1 int) (int, int, bool) {
+	x, y := d.a[a0:a1], d.b[b0:b1]
+	n, m := len(x), len(y)
+	maxD := (n + m + 1) / 2
+	// v holds the furthest reaching index of x for each diagonal k,
+	// offset by maxD, from the start in vf and from the end in vr.
+	size := 2*maxD + 2
+	vf, vr := make([]int, size), make([]int, size)
+	for i := range vf {
+		vf[i], vr[i] = -1, -1
+	}
+	vf[maxD+1], vr[maxD+1] = 0, 0
+	delta := n - m
+	// With an odd delta the forward scripts find the overlap.
+	front := delta%2 != 0
+	// Diagonals running off the edges are skipped.
+	fstart, fend, rstart, rend := 0, 0, 0, 0
+	for e := 0; e < maxD; e++ {
+		for k := -e + fstart; k <= e-fend; k += 2 {
+			kk := maxD + k
+			var i int
+			if k == -e || (k != e && vf[kk-1] < vf[kk+1]) {
+				i = vf[kk+1]
+			} else {
+				i = vf[kk-1] + 1
+			}
+			j := i - k
+			for i < n && j < m && x[i] == y[j] {
+				i++
+				j++
+			}
+			vf[kk] = i
+			switch {
+			case i > n:
+				fend += 2
+			case j > m:
+				fstart += 2
+			case front:
+				rk := maxD + delta - k
+				if rk >= 0 && rk < size && vr[rk] != -1 && i >= n-vr[rk] {
+					return a0 + i, b0 + j, true
+				}
+			}
+		}
+		for k := -e + rstart; k <= e-rend; k += 2 {
+			kk := maxD + k
+			var i int
+			if k == -e || (k != e && vr[kk-1] < vr[kk+1]) {
+				i = vr[kk+1]
+			} else {
+				i = vr[kk-1] + 1
+			}
+			j := i - k
+			for i < n && j < m && x[n-i-1] == y[m-j-1] {
+				i++
+				j++
+			}
+			vr[kk] = i
+			switch {
+			case i > n:
+				rend += 2
+			case j > m:
+				rstart += 2
+			case !front:
+				fk := maxD + delta - k
+				if fk >= 0 && fk < size && vf[fk] != -1 {
+					fi := vf[fk]
+					fj := fi - (fk - maxD)
+					if fi >= n-i {
+						return a0 + fi, b0 + fj, true
+					}
+				}
+			}
+		}
+	}
+	return 0, 0, false
+}
@@ -0,0 +1,104 @@
+package merge
+
+import (
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLines(t *testing.T) {
+	tests := []struct {
+		name                string
+		base, local, remote string
+		merged              string
+		conflict            bool
+	}{
+		{"clean", "a\nb\nc\n", "A\nb\nc\n", "a\nb\nC\n", "A\nb\nC\n", false},
+		{"local only", "a\nb\n", "a\nB\n", "a\nb\n", "a\nB\n", false},
+		{"conflict", "a\nb\n", "x\nb\n", "y\nb\n", "<<<<<<< local\nx\n=======\ny\n>>>>>>> remote\nb\n", true},
+		{"insert at end", "a\nb\n", "a\nb\nc\n", "A\nb\n", "A\nb\nc\n", false},
+		{"insert at end both", "a\n", "a\nb\n", "a\nc\n", "a\n<<<<<<< local\nb\n=======\nc\n>>>>>>> remote\n", true},
+		{"empty base", "", "a\n", "b\n", "<<<<<<< local\na\n=======\nb\n>>>>>>> remote\n", true},
+		{"empty base same", "", "a\n", "a\n", "a\n", false},
+		{"identical edits", "a\nb\nc\n", "a\nB\nc\n", "a\nB\nc\n", "a\nB\nc\n", false},
+		{"deletion", "a\nb\nc\n", "a\nc\n", "a\nb\nc\nd\n", "a\nc\nd\n", false},
+		{"no final newline kept", "a\nb", "a\nb", "a\nB", "a\nB", false},
+		{"no final newline untouched", "a", "a", "a", "a", false},
+		{"append after no final newline", "a\nb", "a\nb\nc\n", "A\nb", "A\nb\nc\n", false},
+		{"final newline added", "a", "a\n", "a", "a\n", false},
+		{"final newline removed", "a\nb\n", "a\nb\n", "A\nb", "A\nb", false},
+	}
+	for _, tt := range tests {
+		merged, conflict := Lines([]byte(tt.base), []byte(tt.local), []byte(tt.remote))
+		if string(merged) != tt.merged || conflict != tt.conflict {
+			t.Errorf("%s: got %q, %v, want %q, %v", tt.name, merged, conflict, tt.merged, tt.conflict)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		old, new string
+		diff     []string
+	}{
+		{"a\nb\nc\n", "a\nc\nd\n", []string{" a", "-b", " c", "+d"}},
+		{"", "a\n", []string{"+a"}},
+		{"a\n", "", []string{"-a"}},
+		{"a\nb", "a\nb\n", []string{" a", " b"}},
+		{"a\nb\n", "b\na\n", []string{"-a", " b", "+a"}},
+	}
+	for _, tt := range tests {
+		if got := Diff([]byte(tt.old), []byte(tt.new)); !reflect.DeepEqual(got, tt.diff) {
+			t.Errorf("Diff(%q, %q) = %q, want %q", tt.old, tt.new, got, tt.diff)
+		}
+	}
+}
+
+// lcs returns the length of a longest common subsequence of a and b.
+func lcs(a, b []string) int {
+	prev, cur := make([]int, len(b)+1), make([]int, len(b)+1)
+	for i := range a {
+		for j := range b {
+			switch {
+			case a[i] == b[j]:
+				cur[j+1] = prev[j] + 1
+			case prev[j+1] > cur[j]:
+				cur[j+1] = prev[j+1]
+			default:
+				cur[j+1] = cur[j]
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func TestMatch(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	lines := func() []string {
+		res := make([]string, rnd.Intn(30))
+		for i := range res {
+			res[i] = string(rune('a'+rnd.Intn(4))) + "\n"
+		}
+		return res
+	}
+	for n := 0; n < 5000; n++ {
+		a, b := lines(), lines()
+		m := match(a, b)
+		paired, last := 0, -1
+		for i, j := range m {
+			if j < 0 {
+				continue
+			}
+			if j <= last || j >= len(b) || a[i] != b[j] {
+				t.Fatalf("match(%q, %q) = %v pairs line %d with %d", strings.Join(a, ""), strings.Join(b, ""), m, i, j)
+			}
+			paired++
+			last = j
+		}
+		if want := lcs(a, b); paired != want {
+			t.Fatalf("match(%q, %q) = %v pairs %d lines, want %d", strings.Join(a, ""), strings.Join(b, ""), m, paired, want)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Desktop shows events as desktop notifications, through Notification
+// Center on macOS and notify-send elsewhere.
+type Desktop struct{}
+
+// Notify shows e, conflicts and errors with critical urgency.
+func (Desktop) Notify(ctx context.Context, e Event) error {
+	title := "todosync"
+	if e.Profile != "" {
+		title += " (" + e.Profile + ")"
+	}
+	var cmd *exec.Cmd
+	if runtime.GOOS == "darwin" {
+		script := fmt.Sprintf("display notification %s with title %s", appleString(e.Message), appleString(title))
+		cmd = exec.CommandContext(ctx, "osascript", "-e", script)
+	} else {
+		urgency := "normal"
+		if e.Type == EventConflict || e.Type == EventError {
+			urgency = "critical"
+		}
+		cmd = exec.CommandContext(ctx, "notify-send", "--app-name=todosync", "--urgency="+urgency, title, e.Message)
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s failed: %w: %s", cmd.Args[0], err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// appleString quotes s as an AppleScript string literal.
+func appleString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// Webhook posts events as JSON to URL.
+type Webhook struct {
+	URL string
+	// Client sends the requests, http.DefaultClient when nil.
+	Client *http.Client
+}
+
+// Notify posts e and expects a 2xx answer.
+func (w *Webhook) Notify(ctx context.Context, e Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := w.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook %s answered %s", w.URL, resp.Status)
+	}
+	return nil
+}
+
+// Writer prints events one per line, to standard output when W is nil.
+type Writer struct {
+	W io.Writer
+}
+
+// Notify prints e.
+func (w *Writer) Notify(ctx context.Context, e Event) error {
+	out := w.W
+	if out == nil {
+		out = os.Stdout
+	}
+	line := e.Time.Format("2006-01-02 15:04:05") + " " + e.Type
+	if e.Profile != "" {
+		line += " [" + e.Profile + "]"
+	}
+	_, err := fmt.Fprintln(out, line+": "+e.Message)
+	return err
+}
+
+// Email sends events by mail through the SMTP server at Addr, as
+// host:port. Port 465 uses implicit TLS, other ports STARTTLS when the
+// server offers it.
+type Email struct {
+	Addr string
+	// Username and Password authenticate to the server when set.
+	Username string
+	Password string
+	From     string
+	To       []string
+}
+
+// Notify mails e, with its type and profile in the subject.
+func (m *Email) Notify(ctx context.Context, e Event) error {
+	host, port, err := net.SplitHostPort(m.Addr)
+	if err != nil {
+		return fmt.Errorf("invalid smtp address %s: %w", m.Addr, err)
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", m.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(m.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject(e)))
+	fmt.Fprintf(&msg, "Date: %s\r\n", e.Time.Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(strings.ReplaceAll(e.Message, "\r\n", "\n"), "\n", "\r\n"))
+	msg.WriteString("\r\n")
+
+	var d net.Dialer
+	var conn net.Conn
+	if port == "465" {
+		conn, err = (&tls.Dialer{NetDialer: &d, Config: &tls.Config{ServerName: host}}).DialContext(ctx, "tcp", m.Addr)
+	} else {
+		conn, err = d.DialContext(ctx, "tcp", m.Addr)
+	}
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok && port != "465" {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if m.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", m.Username, m.Password, host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(m.From); err != nil {
+		return err
+	}
+	for _, to := range m.To {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg.Bytes()); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// Telegram sends events as messages of a Telegram bot to a chat.
+type Telegram struct {
+	// Token authenticates the bot, Chat is the ID of the chat.
+	Token string
+	Chat  string
+	// URL is the address of the Bot API, https://api.telegram.org when
+	// empty.
+	URL string
+	// Client sends the requests, http.DefaultClient when nil.
+	Client *http.Client
+}
+
+// Notify sends e as a message titled by its type and profile.
+func (t *Telegram) Notify(ctx context.Context, e Event) error {
+	b, err := json.Marshal(map[string]string{
+		"chat_id": t.Chat,
+		"text":    subject(e) + "\n\n" + e.Message,
+	})
+	if err != nil {
+		return err
+	}
+	base := t.URL
+	if base == "" {
+		base = "https://api.telegram.org"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(base, "/")+"/bot"+t.Token+"/sendMessage", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := t.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		// The error holds the URL, and so the token.
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			err = uerr.Err
+		}
+		return fmt.Errorf("telegram: %w", err)
+	}
+	defer resp.Body.Close()
+	var answer struct {
+		OK          bool   `json:"ok"`
+		Description string `json:"description"`
+	}
+	json.NewDecoder(resp.Body).Decode(&answer)
+	if !answer.OK {
+		return fmt.Errorf("telegram answered %s: %s", resp.Status, answer.Description)
+	}
+	return nil
+}
+
+// subject titles e in mail subjects and chat messages.
+func subject(e Event) string {
+	s := "todosync " + e.Type
+	if e.Profile != "" {
+		s += " (" + e.Profile + ")"
+	}
+	if e.File != "" {
+		s += ": " + e.File
+	}
+	return s
+}
@@ -0,0 +1,86 @@
+// Package notify tells the user about sync events such as conflicts through
+// desktop notifications, webhooks, mail, Telegram or standard output.
+package notify
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Event types.
+const (
+	// EventConflict is sent when edits of a file couldn't be merged.
+	EventConflict = "conflict"
+	// EventRemote is sent when a remote change lands in the local dir.
+	EventRemote = "remote"
+	// EventDeleted is sent when a file deleted remotely is deleted in the
+	// local dir.
+	EventDeleted = "deleted"
+	// EventError is sent when syncing starts failing or stops.
+	EventError = "error"
+	// EventDigest is sent with a digest of changes synced over a day or a
+	// week.
+	EventDigest = "digest"
+)
+
+// Event describes something that happened while syncing.
+type Event struct {
+	Type string `json:"type"`
+	// Profile names the profile the event happened in, empty without
+	// profiles.
+	Profile string `json:"profile,omitempty"`
+	// File is the slash separated path of the file concerned, if any.
+	File    string    `json:"file,omitempty"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+// Notifier delivers events to the user.
+type Notifier interface {
+	Notify(ctx context.Context, e Event) error
+}
+
+// Router sends events to the notifiers subscribed to their type.
+type Router struct {
+	// Profile is set on all routed events.
+	Profile string
+
+	routes []route
+}
+
+type route struct {
+	n      Notifier
+	events map[string]bool
+}
+
+// Add subscribes n to events of the given types, or all events when none
+// are given.
+func (r *Router) Add(n Notifier, events ...string) {
+	rt := route{n: n}
+	if len(events) > 0 {
+		rt.events = map[string]bool{}
+		for _, e := range events {
+			rt.events[e] = true
+		}
+	}
+	r.routes = append(r.routes, rt)
+}
+
+// Notify sends e to every subscribed notifier, even if some of them fail.
+func (r *Router) Notify(ctx context.Context, e Event) error {
+	e.Profile = r.Profile
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	var errs []error
+	for _, rt := range r.routes {
+		if rt.events != nil && !rt.events[e.Type] {
+			continue
+		}
+		if err := rt.n.Notify(ctx, e); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
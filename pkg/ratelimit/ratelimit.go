@@ -0,0 +1,141 @@
+// Package ratelimit paces requests to an API so that they stay within its
+// quota, slowing down further while the API rejects requests for exceeding
+// it.
+package ratelimit
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Throttling lowers the rate down to the configured one divided by
+// minFactor, and doubles it back every recoverAfter without rejections.
+const (
+	minFactor    = 16
+	recoverAfter = time.Minute
+)
+
+// Limiter lets through up to a number of requests per second, in bursts of
+// up to a second worth of requests.
+type Limiter struct {
+	rate float64
+
+	mu        sync.Mutex
+	current   float64
+	next      time.Time
+	throttled time.Time
+	changed   time.Time
+}
+
+// New returns a Limiter letting through rate requests per second, which
+// must be positive.
+func New(rate float64) *Limiter {
+	return &Limiter{rate: rate, current: rate}
+}
+
+// Wait blocks until a request may be sent or ctx is done.
+func (l *Limiter) Wait(ctx context.Context) error {
+	l.mu.Lock()
+	now := time.Now()
+	if l.current < l.rate && now.Sub(l.changed) >= recoverAfter {
+		l.current *= 2
+		if l.current > l.rate {
+			l.current = l.rate
+		}
+		l.changed = now
+	}
+	interval := time.Duration(float64(time.Second) / l.current)
+	// Time unused in the last second accumulates into a burst.
+	if earliest := now.Add(-time.Second); l.next.Before(earliest) {
+		l.next = earliest
+	}
+	at := l.next
+	l.next = l.next.Add(interval)
+	l.mu.Unlock()
+
+	d := at.Sub(now)
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Throttle notes that the API rejected a request for exceeding its quota
+// and halves the rate.
+func (l *Limiter) Throttle() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.throttled = now
+	l.changed = now
+	if l.current > l.rate/minFactor {
+		l.current /= 2
+	}
+}
+
+// Throttled returns when the API last rejected a request for exceeding its
+// quota, zero if it never did.
+func (l *Limiter) Throttled() time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.throttled
+}
+
+// Transport returns a RoundTripper sending requests through base, which is
+// http.DefaultTransport when nil, at the pace of l. Responses 429 and 403
+// with a rate limit reason, as sent by Google APIs, throttle l.
+func (l *Limiter) Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &transport{l: l, base: base}
+}
+
+type transport struct {
+	l    *Limiter
+	base http.RoundTripper
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.l.Wait(req.Context()); err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests:
+		t.l.Throttle()
+	case http.StatusForbidden:
+		// The reason is in the error body, which is small.
+		body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		resp.Body.Close()
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		if err == nil && isRateLimit(string(body)) {
+			t.l.Throttle()
+		}
+	}
+	return resp, nil
+}
+
+// isRateLimit reports whether the body of a Google API error has a rate
+// limit reason.
+func isRateLimit(body string) bool {
+	return strings.Contains(body, `"rateLimitExceeded"`) || strings.Contains(body, `"userRateLimitExceeded"`)
+}
@@ -0,0 +1,93 @@
+// Package remote defines the storage the sync engine mirrors files to.
+package remote
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrUnauthorized is wrapped by errors of stores rejecting credentials.
+var ErrUnauthorized = errors.New("unauthorized")
+
+// ErrChanged is wrapped by errors of uploads refused because the remote
+// file changed since it was listed, so that the change isn't overwritten.
+var ErrChanged = errors.New("remote file changed")
+
+// File describes a file in remote storage.
+type File struct {
+	// ID identifies the file in the store.
+	ID string
+	// Path is the slash separated path relative to the synced folder.
+	Path string
+	// Checksum is the hex md5 of the content, empty if the store doesn't
+	// provide it.
+	Checksum string
+	// Revision changes whenever the content changes.
+	Revision string
+	Size     int64
+	// Modified is the time of the last modification, zero if unknown.
+	Modified time.Time
+	// Converted files are documents in a format of the store, such as
+	// Google Docs, exported as text on download. They have no checksum.
+	Converted bool
+	// ReadOnly files reject uploads and are synced pull-only.
+	ReadOnly bool
+	// Encrypted is set by stores encrypting files on files they uploaded
+	// or decrypted. Callers set it on listed files known to be encrypted,
+	// so that such stores refuse plain content put in their place.
+	Encrypted bool
+}
+
+// Store is a remote storage holding synced files.
+type Store interface {
+	// List returns files which may match patterns, slash separated path
+	// patterns in path.Match syntax where a trailing ** matches any path
+	// below. The caller filters the result. Stores allowing several files
+	// with the same path may return all of them.
+	List(ctx context.Context, patterns []string) ([]*File, error)
+	// Download saves content of the file to the local path dst.
+	Download(ctx context.Context, f *File, dst string) error
+	// Fetch returns content of the file.
+	Fetch(ctx context.Context, f *File) ([]byte, error)
+	// Upload replaces content of the file by the local file src and
+	// returns the updated description. Stores which can tell refuse to
+	// overwrite a file changed since f was listed, with an error wrapping
+	// ErrChanged. Stores which can only check before uploading implement
+	// Racy.
+	Upload(ctx context.Context, f *File, src string) (*File, error)
+	// Create uploads the local file src as a new file at the slash
+	// separated path.
+	Create(ctx context.Context, name, src string) (*File, error)
+	// Delete removes the file, to the trash where the store has one.
+	Delete(ctx context.Context, f *File) error
+}
+
+// Racy is implemented by stores which have no conditional uploads. They
+// check for changes since a file was listed right before uploading it, so
+// that a change made in between is still overwritten.
+type Racy interface {
+	// UploadsRace reports whether such changes can be lost.
+	UploadsRace() bool
+}
+
+// Revision is a past version of a remote file.
+type Revision struct {
+	ID string
+	// Modified is the time the version was saved.
+	Modified time.Time
+	// Checksum is the hex md5 of the content, empty if unknown.
+	Checksum string
+	Size     int64
+	// Author names who saved the version, empty if unknown.
+	Author string
+}
+
+// Historian is implemented by stores keeping past versions of files.
+type Historian interface {
+	// Revisions returns the kept versions of the file, oldest first. The
+	// last one is the current content.
+	Revisions(ctx context.Context, f *File) ([]*Revision, error)
+	// FetchRevision returns content of a version of the file.
+	FetchRevision(ctx context.Context, f *File, rev *Revision) ([]byte, error)
+}
@@ -0,0 +1,287 @@
+// Package simulate replays recorded scenarios of edits against the sync
+// engine with an in-memory remote, so that merge and conflict settings can
+// be tried out without touching real files or Google Drive.
+package simulate
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/mizhka/todosync/pkg/gitstore"
+	"github.com/mizhka/todosync/pkg/sync"
+	"gopkg.in/yaml.v3"
+)
+
+// Scenario is a sequence of steps editing files on the remote and in the
+// local dir, and syncing them.
+type Scenario struct {
+	// Config overrides settings of the configuration the scenario is run
+	// with, in the same layout.
+	Config yaml.Node `yaml:"config"`
+	Steps  []Step    `yaml:"steps"`
+}
+
+// Step edits files, then syncs if asked to and checks the outcome. Files
+// are given by slash separated paths mapped to their content, null for
+// deleting a file or for expecting it missing.
+type Step struct {
+	// Note describes the step in the output.
+	Note   string             `yaml:"note"`
+	Remote map[string]*string `yaml:"remote"`
+	Local  map[string]*string `yaml:"local"`
+	// Offline takes the remote offline, or back online with false, from
+	// this step on.
+	Offline *bool `yaml:"offline"`
+	// Sync runs a sync cycle after the edits.
+	Sync   bool   `yaml:"sync"`
+	Expect Expect `yaml:"expect"`
+}
+
+// Expect is the content files must have after a step.
+type Expect struct {
+	Remote map[string]*string `yaml:"remote"`
+	Local  map[string]*string `yaml:"local"`
+}
+
+// Load reads a scenario file.
+func Load(path string) (*Scenario, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("can't read scenario: %w", err)
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	sc := &Scenario{}
+	if err := dec.Decode(sc); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("can't parse scenario %s: %w", path, err)
+	}
+	if len(sc.Steps) == 0 {
+		return nil, fmt.Errorf("scenario %s has no steps", path)
+	}
+	return sc, nil
+}
+
+// Run replays the scenario in a scratch repo and local dir removed
+// afterwards, against a Store. configure sets up the Syncer before its
+// repo, local dir and state are pointed to the scratch ones. Each step is
+// written to out with the actions the engine takes and warnings it logs.
+// Run fails if a cycle or an expectation does, after replaying every step.
+func (sc *Scenario) Run(ctx context.Context, configure func(*sync.Syncer) error, out io.Writer) error {
+	dir, err := ioutil.TempDir("", "todosync-simulate")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	repoDir, local := filepath.Join(dir, "repo"), filepath.Join(dir, "local")
+	if err := os.Mkdir(local, 0755); err != nil {
+		return err
+	}
+	if err := gitstore.Create(ctx, repoDir, "", "", nil); err != nil {
+		return err
+	}
+	repo, err := gitstore.Open(repoDir)
+	if err != nil {
+		return err
+	}
+	repo.Author = gitstore.Author{Name: "todosync simulate", Email: "simulate@localhost"}
+	logger := slog.New(slog.NewTextHandler(out, &slog.HandlerOptions{
+		Level: slog.LevelWarn,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}))
+	repo.Logger = logger
+
+	store := NewStore()
+	s := sync.New(store, repo, local)
+	if err := configure(s); err != nil {
+		return err
+	}
+	s.Repo, s.LocalDir = repo, local
+	s.StateFile = filepath.Join(dir, "state.json")
+	s.ConflictDir = filepath.Join(dir, "conflicts")
+	s.Push, s.Pull = false, false
+	// Actions are traced in a stable order.
+	s.Parallelism = 1
+	s.Trace = &indented{w: out, prefix: "    "}
+	s.Logger = logger
+
+	var failed []string
+	for i, step := range sc.Steps {
+		fmt.Fprintf(out, "Step %d", i+1)
+		if step.Note != "" {
+			fmt.Fprintf(out, ": %s", step.Note)
+		}
+		fmt.Fprintln(out)
+		if step.Offline != nil {
+			store.SetOffline(*step.Offline)
+			if *step.Offline {
+				fmt.Fprintln(out, "  remote goes offline")
+			} else {
+				fmt.Fprintln(out, "  remote is back online")
+			}
+		}
+		for _, name := range sortedKeys(step.Remote) {
+			if content := step.Remote[name]; content != nil {
+				fmt.Fprintf(out, "  edit remote %s\n", name)
+				store.Put(name, []byte(*content))
+			} else {
+				fmt.Fprintf(out, "  delete remote %s\n", name)
+				store.Remove(name)
+			}
+		}
+		for _, name := range sortedKeys(step.Local) {
+			path := filepath.Join(local, filepath.FromSlash(name))
+			if content := step.Local[name]; content != nil {
+				fmt.Fprintf(out, "  edit local %s\n", name)
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					return err
+				}
+				if err := ioutil.WriteFile(path, []byte(*content), 0644); err != nil {
+					return err
+				}
+			} else {
+				fmt.Fprintf(out, "  delete local %s\n", name)
+				if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+			}
+		}
+		if step.Sync {
+			fmt.Fprintln(out, "  sync")
+			if err := s.Cycle(ctx); err != nil {
+				fmt.Fprintf(out, "    failed: %v\n", err)
+				if !errors.Is(err, sync.ErrOffline) {
+					failed = append(failed, fmt.Sprintf("step %d: %v", i+1, err))
+				}
+			}
+		}
+		for _, side := range []struct {
+			name    string
+			files   map[string]*string
+			content func(name string) ([]byte, bool)
+		}{
+			{"remote", step.Expect.Remote, store.Content},
+			{"local", step.Expect.Local, func(name string) ([]byte, bool) {
+				b, err := ioutil.ReadFile(filepath.Join(local, filepath.FromSlash(name)))
+				return b, err == nil
+			}},
+		} {
+			for _, name := range sortedKeys(side.files) {
+				got, ok := side.content(name)
+				if msg := mismatch(side.files[name], got, ok); msg != "" {
+					fmt.Fprintf(out, "  FAIL %s %s %s\n", side.name, name, msg)
+					failed = append(failed, fmt.Sprintf("step %d: %s %s", i+1, side.name, name))
+				} else {
+					fmt.Fprintf(out, "  ok %s %s\n", side.name, name)
+				}
+			}
+		}
+	}
+
+	fmt.Fprintln(out, "Remote files:")
+	for _, name := range store.Names() {
+		content, _ := store.Content(name)
+		writeFile(out, name, content)
+	}
+	fmt.Fprintln(out, "Local files:")
+	err = filepath.Walk(local, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(local, path)
+		writeFile(out, filepath.ToSlash(rel), content)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("%d failures: %s", len(failed), strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// mismatch describes how content got, if the file exists, differs from
+// want, or returns an empty string if it doesn't.
+func mismatch(want *string, got []byte, exists bool) string {
+	switch {
+	case want == nil && !exists:
+		return ""
+	case want == nil:
+		return "exists, want it missing"
+	case !exists:
+		return "is missing"
+	case string(got) != *want:
+		return fmt.Sprintf("is\n%s  want\n%s", quote(got), quote([]byte(*want)))
+	}
+	return ""
+}
+
+// writeFile writes name and content of a file to out.
+func writeFile(out io.Writer, name string, content []byte) {
+	fmt.Fprintf(out, "  %s\n%s", name, quote(content))
+}
+
+// quote indents lines of content under a bar, marking a missing final
+// newline.
+func quote(content []byte) string {
+	var b strings.Builder
+	text := string(content)
+	final := strings.HasSuffix(text, "\n")
+	text = strings.TrimSuffix(text, "\n")
+	for _, line := range strings.Split(text, "\n") {
+		b.WriteString("    | " + line + "\n")
+	}
+	if !final && text != "" {
+		b.WriteString("    (no final newline)\n")
+	}
+	return b.String()
+}
+
+// sortedKeys returns the paths of files sorted.
+func sortedKeys(files map[string]*string) []string {
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// indented writes lines to w with a prefix.
+type indented struct {
+	w      io.Writer
+	prefix string
+}
+
+func (i *indented) Write(p []byte) (int, error) {
+	lines := strings.SplitAfter(string(p), "\n")
+	var b strings.Builder
+	for _, line := range lines {
+		if line != "" {
+			b.WriteString(i.prefix + line)
+		}
+	}
+	if _, err := io.WriteString(i.w, b.String()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,215 @@
+package simulate
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	gosync "sync"
+	"syscall"
+	"time"
+
+	"github.com/mizhka/todosync/pkg/fsutil"
+	"github.com/mizhka/todosync/pkg/remote"
+)
+
+var _ remote.Store = (*Store)(nil)
+
+// Store is a remote.Store keeping files in memory, standing in for Google
+// Drive in simulations. Revisions count changes of the store, so that
+// uploads over a file changed since it was listed are refused as Drive
+// does.
+type Store struct {
+	mu      gosync.Mutex
+	files   map[string]*file
+	changes int
+	offline bool
+}
+
+// file is a file of a Store.
+type file struct {
+	id       string
+	content  []byte
+	revision int
+	modified time.Time
+}
+
+// NewStore returns an empty Store.
+func NewStore() *Store {
+	return &Store{files: map[string]*file{}}
+}
+
+// Put sets content of the file at the slash separated path name, creating
+// it if needed, as an edit made by another device would.
+func (s *Store) Put(name string, content []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.put(name, content)
+}
+
+func (s *Store) put(name string, content []byte) *remote.File {
+	s.changes++
+	f, ok := s.files[name]
+	if !ok {
+		f = &file{id: fmt.Sprintf("sim%d", s.changes)}
+		s.files[name] = f
+	}
+	f.content = append([]byte(nil), content...)
+	f.revision = s.changes
+	f.modified = time.Now()
+	return describe(name, f)
+}
+
+// Remove deletes the file at name, if any.
+func (s *Store) Remove(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.files, name)
+}
+
+// Content returns content of the file at name, and whether there is one.
+func (s *Store) Content(name string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.files[name]
+	if !ok {
+		return nil, false
+	}
+	return f.content, true
+}
+
+// Names returns paths of the files, sorted.
+func (s *Store) Names() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for name := range s.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SetOffline makes calls fail as when the network is down, or work again.
+func (s *Store) SetOffline(offline bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.offline = offline
+}
+
+// reachable returns the error of a call while offline.
+func (s *Store) reachable() error {
+	if s.offline {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	}
+	return nil
+}
+
+// describe returns the remote.File of f.
+func describe(name string, f *file) *remote.File {
+	sum := md5.Sum(f.content)
+	return &remote.File{
+		ID:       f.id,
+		Path:     name,
+		Checksum: hex.EncodeToString(sum[:]),
+		Revision: fmt.Sprint(f.revision),
+		Size:     int64(len(f.content)),
+		Modified: f.modified,
+	}
+}
+
+// List returns all files, sorted by path.
+func (s *Store) List(ctx context.Context, patterns []string) ([]*remote.File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reachable(); err != nil {
+		return nil, err
+	}
+	var files []*remote.File
+	for name, f := range s.files {
+		files = append(files, describe(name, f))
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return files, nil
+}
+
+// Download saves content of the file to dst.
+func (s *Store) Download(ctx context.Context, f *remote.File, dst string) error {
+	content, err := s.Fetch(ctx, f)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	return fsutil.WriteFile(dst, content, 0644)
+}
+
+// Fetch returns content of the file.
+func (s *Store) Fetch(ctx context.Context, f *remote.File) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reachable(); err != nil {
+		return nil, err
+	}
+	sf, ok := s.files[f.Path]
+	if !ok || sf.id != f.ID {
+		return nil, fmt.Errorf("%s: file not found", f.Path)
+	}
+	return append([]byte(nil), sf.content...), nil
+}
+
+// Upload replaces content of the file by src, unless it changed since f
+// was listed.
+func (s *Store) Upload(ctx context.Context, f *remote.File, src string) (*remote.File, error) {
+	content, err := ioutil.ReadFile(src)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reachable(); err != nil {
+		return nil, err
+	}
+	sf, ok := s.files[f.Path]
+	if !ok || sf.id != f.ID {
+		return nil, fmt.Errorf("%s: file not found", f.Path)
+	}
+	if f.Revision != "" && f.Revision != fmt.Sprint(sf.revision) {
+		return nil, fmt.Errorf("%s: %w", f.Path, remote.ErrChanged)
+	}
+	return s.put(f.Path, content), nil
+}
+
+// Create uploads src as a new file at name.
+func (s *Store) Create(ctx context.Context, name, src string) (*remote.File, error) {
+	content, err := ioutil.ReadFile(src)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reachable(); err != nil {
+		return nil, err
+	}
+	if _, ok := s.files[name]; ok {
+		return nil, fmt.Errorf("%s: file exists", name)
+	}
+	return s.put(name, content), nil
+}
+
+// Delete removes the file.
+func (s *Store) Delete(ctx context.Context, f *remote.File) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reachable(); err != nil {
+		return err
+	}
+	delete(s.files, f.Path)
+	return nil
+}
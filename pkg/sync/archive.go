@@ -0,0 +1,160 @@
+package sync
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/mizhka/todosync/pkg/remote"
+	"github.com/mizhka/todosync/pkg/todotxt"
+)
+
+// ArchivePolicy selects when completed tasks of DoneFile are moved to
+// monthly archive files, such as archive/done-2024-06.txt for tasks
+// completed in June 2024. Archive files are synced like other files: Files
+// should match them.
+type ArchivePolicy struct {
+	// MaxLines and MaxSize, in bytes, rotate DoneFile once it's larger.
+	MaxLines int
+	MaxSize  int64
+	// Monthly rotates DoneFile in the first cycle of each month.
+	Monthly bool
+	// Age is how long ago tasks were completed to be archived. Tasks
+	// without completion date stay.
+	Age time.Duration
+	// Dir is the slash separated path of the directory of archive files.
+	Dir string
+}
+
+// enabled reports whether DoneFile is ever rotated.
+func (p ArchivePolicy) enabled() bool {
+	return p.MaxLines > 0 || p.MaxSize > 0 || p.Monthly
+}
+
+// archiveName returns the path of the archive file of tasks completed in
+// the month of t.
+func (p ArchivePolicy) archiveName(t time.Time) string {
+	return path.Join(p.Dir, "done-"+t.Format("2006-01")+".txt")
+}
+
+// isArchive reports whether the slash separated path names an archive
+// file.
+func (s *Syncer) isArchive(name string) bool {
+	if !s.Archive.enabled() || path.Dir(name) != path.Clean(s.Archive.Dir) {
+		return false
+	}
+	ok, _ := path.Match("done-[0-9][0-9][0-9][0-9]-[0-9][0-9].txt", path.Base(name))
+	return ok
+}
+
+// rotateDone moves completed tasks older than Archive.Age from DoneFile to
+// archive files once DoneFile is due for rotation, commits the result and
+// uploads it, recording the result in rfiles. DoneFile is only rotated
+// while in sync everywhere, so that the rotation doesn't race with edits.
+func (s *Syncer) rotateDone(ctx context.Context, rfiles map[string]*remote.File) error {
+	name := s.DoneFile
+	if !s.Archive.enabled() || !s.matches(name) {
+		return nil
+	}
+	repo := s.Repo.Path()
+	content, err := ioutil.ReadFile(filepath.Join(repo, filepath.FromSlash(name)))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	fs, ok := s.state.Files[name]
+	if !ok || fs.MD5 == "" {
+		return nil
+	}
+	if sum := md5.Sum(content); hex.EncodeToString(sum[:]) != fs.MD5 {
+		return nil
+	}
+	localmd5, err := s.localMD5(name)
+	if err != nil || localmd5 != fs.MD5 {
+		return err
+	}
+
+	now := time.Now()
+	p := s.Archive
+	y, m, _ := s.state.Rotated.Date()
+	ny, nm, _ := now.Date()
+	monthly := p.Monthly && (y != ny || m != nm)
+	if !monthly && (p.MaxLines <= 0 || bytes.Count(content, []byte("\n")) <= p.MaxLines) &&
+		(p.MaxSize <= 0 || int64(len(content)) <= p.MaxSize) {
+		return nil
+	}
+
+	var kept []*todotxt.Task
+	archived := map[string][]*todotxt.Task{}
+	for _, t := range todotxt.ParseList(content) {
+		if t.Completed && !t.CompletionDate.IsZero() && now.Sub(t.CompletionDate) > p.Age {
+			archive := p.archiveName(t.CompletionDate)
+			archived[archive] = append(archived[archive], t)
+		} else {
+			kept = append(kept, t)
+		}
+	}
+	if len(archived) == 0 {
+		s.Logger.Debug("No completed tasks old enough to archive", "file", name)
+		return s.rotated(now)
+	}
+
+	changed := []string{name}
+	count := 0
+	for archive, tasks := range archived {
+		old, err := s.readFile(repo, archive)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		present := map[string]bool{}
+		for _, t := range todotxt.ParseList(old) {
+			present[t.String()] = true
+		}
+		if len(old) > 0 && old[len(old)-1] != '\n' {
+			old = append(old, '\n')
+		}
+		for _, t := range tasks {
+			if !present[t.String()] {
+				old = append(old, t.Line()+"\n"...)
+			}
+		}
+		if err := s.write(archive, old); err != nil {
+			return err
+		}
+		changed = append(changed, archive)
+		count += len(tasks)
+	}
+	sort.Strings(changed[1:])
+	if err := s.write(name, todotxt.Format(kept)); err != nil {
+		return err
+	}
+	s.Logger.Info("Archived completed tasks", "file", name, "count", count, "archives", changed[1:])
+	if err := s.commit(ctx, paths(repo, changed), "archive", "Archive completed tasks"); err != nil {
+		return err
+	}
+	err = s.each(changed, func(name string) error {
+		return s.upload(ctx, name, rfiles)
+	})
+	if err != nil {
+		return err
+	}
+	if err := s.synced(changed, rfiles); err != nil {
+		return err
+	}
+	return s.rotated(now)
+}
+
+// rotated records when DoneFile was last due for rotation.
+func (s *Syncer) rotated(now time.Time) error {
+	s.state.Rotated = now
+	return s.state.save()
+}
@@ -0,0 +1,193 @@
+package sync
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/mizhka/todosync/pkg/todotxt"
+)
+
+// DefaultCommitMessage is the template of commit messages used when
+// CommitMessage is nil.
+const DefaultCommitMessage = `{{.Action}}: {{join .Files ", "}}{{with .TaskSummary}} (tasks: {{.}}){{end}}`
+
+// CommitInfo is the data commit message templates are executed with.
+type CommitInfo struct {
+	// Action describes the change, such as "Push from mobile".
+	Action string
+	// Source is where the changes come from: "remote", "local", "both",
+	// "git", "tasks" or "archive".
+	Source string
+	// Files are slash separated paths of committed files.
+	Files []string
+	Time  time.Time
+	// Added and Removed count changed lines of all Files.
+	Added, Removed int
+	// TasksAdded, TasksCompleted and TasksRemoved count tasks of TodoFile
+	// and DoneFile by their description. Removed tasks were deleted
+	// without being completed.
+	TasksAdded, TasksCompleted, TasksRemoved int
+}
+
+// TaskSummary describes task counts, such as "2 added, 1 completed", or
+// returns an empty string when no task changed.
+func (c CommitInfo) TaskSummary() string {
+	var parts []string
+	if c.TasksAdded > 0 {
+		parts = append(parts, fmt.Sprintf("%d added", c.TasksAdded))
+	}
+	if c.TasksCompleted > 0 {
+		parts = append(parts, fmt.Sprintf("%d completed", c.TasksCompleted))
+	}
+	if c.TasksRemoved > 0 {
+		parts = append(parts, fmt.Sprintf("%d removed", c.TasksRemoved))
+	}
+	return strings.Join(parts, ", ")
+}
+
+var commitFuncs = template.FuncMap{"join": strings.Join}
+
+// ParseCommitMessage parses a commit message template, rejecting ones that
+// fail to execute.
+func ParseCommitMessage(text string) (*template.Template, error) {
+	t, err := template.New("commit").Funcs(commitFuncs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	sample := CommitInfo{Action: "Push from local", Source: "local", Files: []string{"todo.txt"}, Time: time.Now()}
+	if err := t.Execute(ioutil.Discard, sample); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+var defaultCommitMessage = template.Must(ParseCommitMessage(DefaultCommitMessage))
+
+// commitMessage formats the message committing names, slash separated
+// paths of files in the repo changed at when, comparing them with HEAD.
+func (s *Syncer) commitMessage(source, action string, names []string, when time.Time) string {
+	info := CommitInfo{Action: action, Source: source, Files: names, Time: when}
+	tasks := false
+	for _, name := range names {
+		old, cur, err := s.repoVersions(name)
+		if err != nil {
+			s.Logger.Warn("Can't compare file with HEAD", "file", name, "err", err)
+			continue
+		}
+		added, removed := lineStats(old, cur)
+		info.Added += added
+		info.Removed += removed
+		if name == s.TodoFile || name == s.DoneFile || s.isArchive(name) {
+			tasks = true
+		}
+	}
+	if tasks {
+		if err := s.countTasks(&info); err != nil {
+			s.Logger.Warn("Can't count changed tasks", "err", err)
+		}
+	}
+
+	t := s.CommitMessage
+	if t == nil {
+		t = defaultCommitMessage
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, info); err != nil {
+		s.Logger.Warn("Can't format commit message", "err", err)
+		return action
+	}
+	if msg := strings.TrimSpace(b.String()); msg != "" {
+		return msg
+	}
+	return action
+}
+
+// repoVersions returns the content of a file as of HEAD and in the
+// worktree, nil where it's missing.
+func (s *Syncer) repoVersions(name string) ([]byte, []byte, error) {
+	old, err := s.Repo.HeadContent(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	cur, err := ioutil.ReadFile(filepath.Join(s.Repo.Path(), filepath.FromSlash(name)))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	return old, cur, nil
+}
+
+// lineStats counts lines of cur missing from old and the other way round.
+func lineStats(old, cur []byte) (added, removed int) {
+	count := map[string]int{}
+	for _, l := range lines(old) {
+		count[l]++
+	}
+	for _, l := range lines(cur) {
+		if count[l] > 0 {
+			count[l]--
+		} else {
+			added++
+		}
+	}
+	for _, n := range count {
+		removed += n
+	}
+	return added, removed
+}
+
+func lines(b []byte) []string {
+	if len(b) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+}
+
+// countTasks compares tasks of TodoFile, DoneFile and committed archive
+// files together, so that tasks moved to DoneFile on completion count as
+// completed and archived ones don't count at all.
+func (s *Syncer) countTasks(info *CommitInfo) error {
+	old, cur := map[string]bool{}, map[string]bool{}
+	names := []string{s.TodoFile, s.DoneFile}
+	for _, name := range info.Files {
+		if s.isArchive(name) {
+			names = append(names, name)
+		}
+	}
+	for _, name := range names {
+		o, c, err := s.repoVersions(name)
+		if err != nil {
+			return err
+		}
+		addTasks(old, o)
+		addTasks(cur, c)
+	}
+	for key, done := range cur {
+		wasDone, ok := old[key]
+		switch {
+		case !ok:
+			info.TasksAdded++
+		case done && !wasDone:
+			info.TasksCompleted++
+		}
+	}
+	for key := range old {
+		if _, ok := cur[key]; !ok {
+			info.TasksRemoved++
+		}
+	}
+	return nil
+}
+
+// addTasks records in completed whether all tasks of content sharing a
+// description are completed.
+func addTasks(completed map[string]bool, content []byte) {
+	for _, t := range todotxt.ParseList(content) {
+		done, ok := completed[t.Key()]
+		completed[t.Key()] = t.Completed && (done || !ok)
+	}
+}
@@ -0,0 +1,153 @@
+package sync
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mizhka/todosync/pkg/fsutil"
+)
+
+// Conflict is a version of a file set aside in ConflictDir because it
+// couldn't be merged with the local one.
+type Conflict struct {
+	ID string `json:"id"`
+	// File is the slash separated path of the synced file.
+	File string `json:"file"`
+	// Path is the quarantined copy of the losing version.
+	Path string `json:"path"`
+	// From names where the losing version came from, such as "remote".
+	From string    `json:"from"`
+	Time time.Time `json:"time"`
+	// MD5 is the checksum of the quarantined version.
+	MD5 string `json:"md5,omitempty"`
+}
+
+// quarantine saves content, the version of the file coming from the source
+// named from, to ConflictDir as a Conflict recorded once the file is
+// settled. A version already quarantined for the file isn't saved again.
+// It returns the path of the copy.
+func (s *Syncer) quarantine(name string, content []byte, from string) (string, error) {
+	hash := md5.Sum(content)
+	sum := hex.EncodeToString(hash[:])
+	if c := s.quarantined(name, sum); c != nil {
+		return c.Path, nil
+	}
+	now := time.Now()
+	dst := filepath.Join(s.ConflictDir, filepath.FromSlash(name)+"."+now.Format("20060102T150405")+"."+strings.ReplaceAll(from, " ", "-"))
+	err := s.apply("quarantine "+from+" version of "+name+" to "+dst, func() error {
+		if err := fsutil.WriteFile(dst, content, 0644); err != nil {
+			return err
+		}
+		s.conflicted(name, &Conflict{
+			File: name,
+			Path: dst,
+			From: from,
+			Time: now,
+			MD5:  sum,
+		})
+		return nil
+	})
+	return dst, err
+}
+
+// quarantined returns the conflict, recorded or waiting for the file to be
+// settled, which set aside the version of the file with checksum sum, or
+// nil if there's none.
+func (s *Syncer) quarantined(name, sum string) *Conflict {
+	var conflicts []*Conflict
+	if t := s.txn; t != nil {
+		t.mu.Lock()
+		conflicts = append(conflicts, t.conflicts[name]...)
+		t.mu.Unlock()
+	}
+	conflicts = append(conflicts, s.state.Conflicts...)
+	for _, c := range conflicts {
+		if c.File != name {
+			continue
+		}
+		csum := c.MD5
+		if csum == "" {
+			// Recorded before checksums were.
+			csum, _ = filemd5(c.Path)
+		}
+		if csum == sum {
+			return c
+		}
+	}
+	return nil
+}
+
+// ListConflicts returns unresolved conflicts recorded in the state file,
+// oldest first.
+func ListConflicts(stateFile string) ([]*Conflict, error) {
+	st, err := loadState(stateFile)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(st.Conflicts, func(i, j int) bool { return st.Conflicts[i].Time.Before(st.Conflicts[j].Time) })
+	return st.Conflicts, nil
+}
+
+// ResolveConflict settles the conflict with the given ID. With take the
+// quarantined version replaces the local file, otherwise the local one is
+// kept. The quarantined copy is deleted either way, and a sync cycle
+// propagates the result to git and the remote.
+func (s *Syncer) ResolveConflict(ctx context.Context, id string, take bool) error {
+	if err := s.initState(); err != nil {
+		return err
+	}
+	i := -1
+	for j, c := range s.state.Conflicts {
+		if c.ID == id {
+			i = j
+		}
+	}
+	if i < 0 {
+		return fmt.Errorf("no conflict %s", id)
+	}
+	c := s.state.Conflicts[i]
+
+	if take {
+		content, err := ioutil.ReadFile(c.Path)
+		if err != nil {
+			return fmt.Errorf("can't read quarantined version: %w", err)
+		}
+		err = s.apply("replace "+c.File+" in local dir by "+c.Path, func() error {
+			return s.writeFile(s.LocalDir, c.File, content)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	err := s.apply("delete "+c.Path, func() error {
+		if err := os.Remove(c.Path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		s.state.Conflicts = append(s.state.Conflicts[:i], s.state.Conflicts[i+1:]...)
+		return s.state.save()
+	})
+	if err != nil {
+		return err
+	}
+	return s.Cycle(ctx)
+}
+
+// nextConflictID returns an ID not used by recorded conflicts.
+func (st *state) nextConflictID() string {
+	max := 0
+	for _, c := range st.Conflicts {
+		if n, err := strconv.Atoi(c.ID); err == nil && n > max {
+			max = n
+		}
+	}
+	return strconv.Itoa(max + 1)
+}
@@ -0,0 +1,64 @@
+package sync_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/mizhka/todosync/pkg/remote"
+	"github.com/mizhka/todosync/pkg/sync"
+)
+
+func TestQuarantineRetried(t *testing.T) {
+	for _, fail := range []error{errors.New("upload failed"), remote.ErrChanged} {
+		t.Run(fail.Error(), func(t *testing.T) {
+			s, store := setup(t)
+			s.Conflict = sync.ConflictQuarantine
+			store.Put("todo.txt", []byte("Buy milk\n"))
+			cycle(t, s)
+
+			store.Put("todo.txt", []byte("Buy oat milk\n"))
+			writeLocal(t, s, "todo.txt", "Buy soy milk\n")
+			// The merged version fails to upload once: the cycle is rolled
+			// back and done again, by Cycle itself on ErrChanged.
+			store.fail = fail
+			if err := s.Cycle(context.Background()); err != nil && !errors.Is(err, fail) {
+				t.Fatal(err)
+			}
+			cycle(t, s)
+
+			conflicts, err := sync.ListConflicts(s.StateFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(conflicts) != 1 {
+				t.Fatalf("got %d conflicts, want 1: %+v", len(conflicts), conflicts)
+			}
+			files, err := ioutil.ReadDir(s.ConflictDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(files) != 1 {
+				t.Errorf("got %d quarantined copies, want 1", len(files))
+			}
+			if b, _ := ioutil.ReadFile(conflicts[0].Path); string(b) != "Buy oat milk\n" {
+				t.Errorf("quarantined %q", b)
+			}
+			d, err := s.Digest(time.Now().Add(-time.Hour), time.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d.Conflicts != 1 {
+				t.Errorf("digest counts %d conflicts, want 1", d.Conflicts)
+			}
+			if got := readLocal(t, s, "todo.txt"); got != "Buy soy milk\n" {
+				t.Errorf("local todo.txt is %q", got)
+			}
+			if got, _ := store.Content("todo.txt"); string(got) != "Buy soy milk\n" {
+				t.Errorf("remote todo.txt is %q", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package sync
+
+import "context"
+
+// Trigger asks Run to start a cycle as soon as the running one, if any,
+// finishes, even while paused. Triggers made before the cycle starts are
+// merged into one.
+func (s *Syncer) Trigger() {
+	select {
+	case s.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// SyncNow triggers a cycle and waits for its result. It only returns
+// before the cycle finishes when ctx is done, so Run must be running.
+func (s *Syncer) SyncNow(ctx context.Context) error {
+	done := make(chan error, 1)
+	s.waitMu.Lock()
+	s.waiters = append(s.waiters, done)
+	s.waitMu.Unlock()
+	s.Trigger()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// startWaiters takes the callers of SyncNow waiting for the cycle about to
+// start.
+func (s *Syncer) startWaiters() []chan<- error {
+	s.waitMu.Lock()
+	defer s.waitMu.Unlock()
+	waiters := s.waiters
+	s.waiters = nil
+	return waiters
+}
+
+// Pause stops Run from syncing on changes until Resume. Cycles requested
+// with Trigger still run.
+func (s *Syncer) Pause() {
+	if !s.paused.Swap(true) {
+		s.Logger.Info("Paused syncing")
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+		if s.Health != nil {
+			s.Health.Pause(true)
+		}
+	}
+}
+
+// Resume undoes Pause and runs a cycle to pick up changes made meanwhile.
+func (s *Syncer) Resume() {
+	if s.paused.Swap(false) {
+		s.Logger.Info("Resumed syncing")
+		if s.Health != nil {
+			s.Health.Pause(false)
+		}
+		s.Trigger()
+	}
+}
+
+// Paused reports whether syncing is paused.
+func (s *Syncer) Paused() bool {
+	return s.paused.Load()
+}
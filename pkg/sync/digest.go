@@ -0,0 +1,241 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mizhka/todosync/pkg/gitstore"
+	"github.com/mizhka/todosync/pkg/notify"
+	"github.com/mizhka/todosync/pkg/todotxt"
+)
+
+// conflictLogAge is how long times of merge conflicts are kept for
+// digests.
+const conflictLogAge = 31 * 24 * time.Hour
+
+// DigestSchedule selects when digests of changes synced are sent.
+type DigestSchedule struct {
+	// At is the time of day digests are sent, as the duration since
+	// midnight in local time.
+	At time.Duration
+	// Weekly sends a digest of the week on Weekday instead of a digest of
+	// the day every day.
+	Weekly  bool
+	Weekday time.Weekday
+}
+
+// next returns when the first digest after now is due, and the start of
+// the period it covers.
+func (d DigestSchedule) next(now time.Time) (time.Time, time.Time) {
+	y, m, day := now.Date()
+	t := time.Date(y, m, day, 0, 0, 0, 0, now.Location()).Add(d.At)
+	for !t.After(now) || (d.Weekly && t.Weekday() != d.Weekday) {
+		t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location()).Add(d.At)
+	}
+	if d.Weekly {
+		return t, t.AddDate(0, 0, -7)
+	}
+	return t, t.AddDate(0, 0, -1)
+}
+
+// Digest summarizes changes of tasks committed over a period.
+type Digest struct {
+	Since, Until time.Time
+	// Commits is the number of commits made.
+	Commits int
+	// Added, Completed and Removed are tasks of TodoFile and DoneFile
+	// matched by description. Removed tasks were deleted without being
+	// completed, so that archived tasks don't count.
+	Added, Completed, Removed []*todotxt.Task
+	// Conflicts is the number of merges with conflicting edits.
+	Conflicts int
+}
+
+// Empty reports whether nothing was committed over the period.
+func (d *Digest) Empty() bool {
+	return d.Commits == 0 && d.Conflicts == 0
+}
+
+// Summary describes the digest in a line, such as "5 tasks added, 3
+// completed, 1 conflict".
+func (d *Digest) Summary() string {
+	var parts []string
+	for _, c := range []struct {
+		n    int
+		verb string
+	}{{len(d.Added), "added"}, {len(d.Completed), "completed"}, {len(d.Removed), "removed"}} {
+		switch {
+		case c.n == 0:
+		case len(parts) > 0:
+			parts = append(parts, fmt.Sprintf("%d %s", c.n, c.verb))
+		case c.n == 1:
+			parts = append(parts, "1 task "+c.verb)
+		default:
+			parts = append(parts, fmt.Sprintf("%d tasks %s", c.n, c.verb))
+		}
+	}
+	summary := "no tasks changed"
+	if len(parts) > 0 {
+		summary = strings.Join(parts, ", ")
+	}
+	switch d.Conflicts {
+	case 0:
+	case 1:
+		summary += ", 1 conflict"
+	default:
+		summary += fmt.Sprintf(", %d conflicts", d.Conflicts)
+	}
+	return summary
+}
+
+// String formats the digest with the tasks it lists.
+func (d *Digest) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s to %s: %s\n", d.Since.Format("2006-01-02 15:04"), d.Until.Format("2006-01-02 15:04"), d.Summary())
+	for _, l := range []struct {
+		title string
+		tasks []*todotxt.Task
+	}{{"Added", d.Added}, {"Completed", d.Completed}, {"Removed", d.Removed}} {
+		if len(l.tasks) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "\n%s:\n", l.title)
+		for _, t := range l.tasks {
+			fmt.Fprintf(&b, "  %s\n", t)
+		}
+	}
+	return b.String()
+}
+
+// Digest compares tasks as committed at since and at until. The repo and
+// the state are read apart from the running cycle, if any.
+func (s *Syncer) Digest(since, until time.Time) (*Digest, error) {
+	d := &Digest{Since: since, Until: until}
+	repo, err := gitstore.Open(s.Repo.Path())
+	if err != nil {
+		return nil, err
+	}
+	log, err := repo.Log("", 0)
+	if err != nil {
+		return nil, err
+	}
+	// The log is newest first.
+	var from, to string
+	for _, c := range log {
+		switch {
+		case c.When.After(until):
+		case c.When.After(since):
+			d.Commits++
+			if to == "" {
+				to = c.Hash
+			}
+		default:
+			if to == "" {
+				to = c.Hash
+			}
+			from = c.Hash
+		}
+		if from != "" {
+			break
+		}
+	}
+
+	old, cur := map[string]*todotxt.Task{}, map[string]*todotxt.Task{}
+	for _, name := range []string{s.TodoFile, s.DoneFile} {
+		for _, v := range []struct {
+			rev   string
+			tasks map[string]*todotxt.Task
+		}{{from, old}, {to, cur}} {
+			if v.rev == "" {
+				continue
+			}
+			content, err := repo.Content(v.rev, name)
+			if err != nil {
+				return nil, err
+			}
+			for _, t := range todotxt.ParseList(content) {
+				// A completed copy of a task wins, as in countTasks.
+				if prev, ok := v.tasks[t.Key()]; !ok || !prev.Completed {
+					v.tasks[t.Key()] = t
+				}
+			}
+		}
+	}
+	for _, t := range sorted(cur) {
+		o, ok := old[t.Key()]
+		switch {
+		case !ok:
+			d.Added = append(d.Added, t)
+		case t.Completed && !o.Completed:
+			d.Completed = append(d.Completed, t)
+		}
+	}
+	for _, t := range sorted(old) {
+		if _, ok := cur[t.Key()]; !ok && !t.Completed {
+			d.Removed = append(d.Removed, t)
+		}
+	}
+
+	st, err := loadState(s.StateFile)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range st.ConflictLog {
+		if t.After(since) && !t.After(until) {
+			d.Conflicts++
+		}
+	}
+	return d, nil
+}
+
+// sorted returns tasks sorted by description, for digests to list them in
+// a stable order.
+func sorted(tasks map[string]*todotxt.Task) []*todotxt.Task {
+	var list []*todotxt.Task
+	for _, t := range tasks {
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Key() < list[j].Key() })
+	return list
+}
+
+// logConflict records the time of a merge with conflicting edits for
+// digests.
+func (st *state) logConflict(at time.Time) {
+	log := st.ConflictLog[:0]
+	for _, t := range st.ConflictLog {
+		if at.Sub(t) < conflictLogAge {
+			log = append(log, t)
+		}
+	}
+	st.ConflictLog = append(log, at)
+}
+
+// runDigests sends a digest through the Notifier as scheduled by Digests
+// until ctx is cancelled. Periods without commits are skipped.
+func (s *Syncer) runDigests(ctx context.Context) {
+	for {
+		at, since := s.Digests.next(time.Now())
+		timer := time.NewTimer(time.Until(at))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		d, err := s.Digest(since, at)
+		if err != nil {
+			s.Logger.Warn("Can't prepare digest", "err", err)
+			continue
+		}
+		if d.Empty() {
+			s.Logger.Debug("Nothing synced since the last digest")
+			continue
+		}
+		s.Logger.Info("Sending digest", "summary", d.Summary())
+		s.notify(notify.EventDigest, "", d.String())
+	}
+}
@@ -0,0 +1,192 @@
+package sync
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/mizhka/todosync/pkg/fsutil"
+)
+
+// matchPattern reports whether the slash separated name matches pattern.
+// Besides path.Match syntax a trailing ** matches any path below.
+func matchPattern(pattern, name string) bool {
+	if strings.HasSuffix(pattern, "**") {
+		return strings.HasPrefix(name, strings.TrimSuffix(pattern, "**"))
+	}
+	ok, _ := path.Match(pattern, name)
+	return ok
+}
+
+// matches reports whether the slash separated path is selected by Files
+// and not excluded by IgnoreFile.
+func (s *Syncer) matches(name string) bool {
+	if s.ignored(name, false) {
+		return false
+	}
+	for _, pattern := range s.Files {
+		if matchPattern(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// direction returns the Direction of the first rule in Directions matching
+// the slash separated path.
+func (s *Syncer) direction(name string) Direction {
+	for _, r := range s.Directions {
+		if matchPattern(r.Pattern, name) {
+			return r.Direction
+		}
+	}
+	return Bidirectional
+}
+
+// matchesBase reports whether a file named name in any folder may be
+// selected by Files.
+func (s *Syncer) matchesBase(name string) bool {
+	for _, pattern := range s.Files {
+		if strings.HasSuffix(pattern, "**") || matchPattern(path.Base(pattern), name) {
+			return true
+		}
+	}
+	return false
+}
+
+// listDir returns slash separated paths of synced files under dir.
+func (s *Syncer) listDir(dir string) ([]string, error) {
+	var names []string
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if d.IsDir() {
+			if d.Name() == ".git" || (rel != "." && s.ignored(rel, true)) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if fsutil.IsTemp(p) {
+			return nil
+		}
+		if s.matches(rel) {
+			names = append(names, rel)
+		}
+		return nil
+	})
+	return names, err
+}
+
+// localNames returns synced files found in LocalDir or the repo.
+func (s *Syncer) localNames() ([]string, error) {
+	local, err := s.listDir(s.LocalDir)
+	if err != nil {
+		return nil, err
+	}
+	repo, err := s.listDir(s.Repo.Path())
+	if err != nil {
+		return nil, err
+	}
+	return union(local, repo), nil
+}
+
+// union merges lists of names into a sorted list without duplicates.
+func union(lists ...[]string) []string {
+	seen := map[string]bool{}
+	var res []string
+	for _, list := range lists {
+		for _, name := range list {
+			if !seen[name] {
+				seen[name] = true
+				res = append(res, name)
+			}
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// readFile returns content of the file in dir, the repo or LocalDir, with
+// line endings of the repo.
+func (s *Syncer) readFile(dir, name string) ([]byte, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+	if err != nil || dir != s.LocalDir {
+		return b, err
+	}
+	return s.fromLocal(b), nil
+}
+
+// writeFile replaces the file in dir, the repo or LocalDir, by content
+// with line endings of the repo.
+func (s *Syncer) writeFile(dir, name string, content []byte) error {
+	if err := s.touch(dir, name); err != nil {
+		return err
+	}
+	if dir == s.LocalDir {
+		content = s.toLocal(content)
+	}
+	return fsutil.WriteFile(filepath.Join(dir, filepath.FromSlash(name)), content, 0644)
+}
+
+// readLocal returns content of the local copy of the file with line
+// endings of the repo, or nil if it doesn't exist.
+func (s *Syncer) readLocal(name string) ([]byte, error) {
+	b, err := s.readFile(s.LocalDir, name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return b, err
+}
+
+// localMD5 returns hex md5 of readLocal content, or empty string if the
+// file doesn't exist.
+func (s *Syncer) localMD5(name string) (string, error) {
+	if s.LineEnding == LineEndingKeep {
+		return filemd5(filepath.Join(s.LocalDir, filepath.FromSlash(name)))
+	}
+	b, err := s.readLocal(name)
+	if err != nil || b == nil {
+		return "", err
+	}
+	hash := md5.Sum(b)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// fromLocal converts text read from LocalDir to LF line endings.
+func (s *Syncer) fromLocal(b []byte) []byte {
+	if s.LineEnding == LineEndingKeep || !isText(b) {
+		return b
+	}
+	return bytes.ReplaceAll(b, []byte("\r\n"), []byte("\n"))
+}
+
+// toLocal converts text written to LocalDir to its line endings.
+func (s *Syncer) toLocal(b []byte) []byte {
+	if s.LineEnding == LineEndingKeep || !isText(b) {
+		return b
+	}
+	b = bytes.ReplaceAll(b, []byte("\r\n"), []byte("\n"))
+	if s.LineEnding == LineEndingCRLF {
+		b = bytes.ReplaceAll(b, []byte("\n"), []byte("\r\n"))
+	}
+	return b
+}
+
+// isText reports whether b looks like text rather than binary data, whose
+// line endings are left alone.
+func isText(b []byte) bool {
+	return bytes.IndexByte(b, 0) < 0
+}
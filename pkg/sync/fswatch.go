@@ -0,0 +1,106 @@
+package sync
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// debounceDelay lets a burst of file events settle before a cycle starts.
+const debounceDelay = 300 * time.Millisecond
+
+// watchFiles watches LocalDir and the repo worktree, including their
+// subdirectories, for modifications of synced files. The returned channel
+// receives a value once events settle.
+func (s *Syncer) watchFiles(ctx context.Context) (<-chan struct{}, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	roots := []string{s.LocalDir, s.Repo.Path()}
+	for _, dir := range roots {
+		if err := watchTree(w, dir); err != nil {
+			w.Close()
+			return nil, err
+		}
+	}
+
+	out := make(chan struct{}, 1)
+	timer := time.AfterFunc(debounceDelay, func() {
+		select {
+		case out <- struct{}{}:
+		default:
+		}
+	})
+	timer.Stop()
+
+	go func() {
+		defer w.Close()
+		defer timer.Stop()
+		for {
+			select {
+			case ev, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				if ev.Op&fsnotify.Create != 0 {
+					if st, err := os.Stat(ev.Name); err == nil && st.IsDir() {
+						if err := watchTree(w, ev.Name); err != nil {
+							s.Logger.Warn("Can't watch directory", "err", err)
+						}
+						continue
+					}
+				}
+				if ev.Op == fsnotify.Chmod || !s.matches(relPath(roots, ev.Name)) {
+					continue
+				}
+				timer.Reset(debounceDelay)
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				s.Logger.Warn("File watcher error", "err", err)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+// watchTree adds dir and its subdirectories except .git to the watcher.
+func watchTree(w *fsnotify.Watcher, dir string) error {
+	return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return err
+		}
+		if d.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		return w.Add(p)
+	})
+}
+
+// relPath returns name relative to the root containing it, slash separated.
+func relPath(roots []string, name string) string {
+	for _, root := range roots {
+		if rel, err := filepath.Rel(root, name); err == nil && !strings.HasPrefix(rel, "..") {
+			return filepath.ToSlash(rel)
+		}
+	}
+	return name
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,62 @@
+package sync
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+)
+
+// IgnoreFile, in LocalDir or else in the repo, lists gitignore style
+// patterns of files left out of syncing in LocalDir, the repo and the
+// Remote alike, such as editor swap files.
+const IgnoreFile = ".todosyncignore"
+
+// loadIgnore reads IgnoreFile again, so that edits apply to the next
+// cycle. A file failing to read is logged and ignores nothing.
+func (s *Syncer) loadIgnore() {
+	var content []byte
+	var err error
+	for _, dir := range []string{s.LocalDir, s.Repo.Path()} {
+		content, err = ioutil.ReadFile(filepath.Join(dir, IgnoreFile))
+		if !os.IsNotExist(err) {
+			break
+		}
+	}
+	if err != nil && !os.IsNotExist(err) {
+		s.Logger.Warn("Can't read ignore file", "err", err)
+	}
+	m := gitignore.NewMatcher(parseIgnore(content))
+	s.ignore.Store(&m)
+}
+
+// parseIgnore returns the patterns of an ignore file, skipping blank lines
+// and comments.
+func parseIgnore(content []byte) []gitignore.Pattern {
+	var ps []gitignore.Pattern
+	sc := bufio.NewScanner(bytes.NewReader(content))
+	for sc.Scan() {
+		line := strings.TrimRight(sc.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ps = append(ps, gitignore.ParsePattern(line, nil))
+	}
+	return ps
+}
+
+// ignored reports whether IgnoreFile, which is read on first use,
+// excludes the slash separated path of a file, or of a directory with all
+// files below.
+func (s *Syncer) ignored(name string, dir bool) bool {
+	m := s.ignore.Load()
+	if m == nil {
+		s.loadIgnore()
+		m = s.ignore.Load()
+	}
+	return (*m).Match(strings.Split(name, "/"), dir)
+}
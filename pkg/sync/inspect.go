@@ -0,0 +1,105 @@
+package sync
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/mizhka/todosync/pkg/gitstore"
+	"github.com/mizhka/todosync/pkg/merge"
+)
+
+// FileInfo is what is known about a synced file from its local and repo
+// copies and the state file, without asking the Remote.
+type FileInfo struct {
+	Name string
+	// Source is where the last committed change came from, as in
+	// CommitInfo, empty when unknown.
+	Source string
+	// Synced is the time of the last sync, zero if the file was never
+	// synced.
+	Synced time.Time
+	// Revision is the remote revision of the last synced version.
+	Revision string
+	// Local, Repo and Base are checksums of the local and repo copies and
+	// of the last synced version, empty where missing.
+	Local, Repo, Base string
+}
+
+// State describes how the copies of the file compare, such as "in sync"
+// or "changed locally".
+func (f FileInfo) State() string {
+	switch {
+	case f.Base == "":
+		return "not synced yet"
+	case f.Local == "" && f.Repo == "":
+		return "deleted"
+	case f.Local == "":
+		return "deleted locally"
+	case f.Local != f.Repo:
+		return "changed locally"
+	case f.Repo != f.Base:
+		return "committed, not synced"
+	}
+	return "in sync"
+}
+
+// Inspect returns what is known about synced files found locally or in
+// the state file. It only reads files, so it may run while Run is syncing.
+func (s *Syncer) Inspect() ([]FileInfo, error) {
+	st, err := loadState(s.StateFile)
+	if err != nil {
+		return nil, err
+	}
+	local, err := s.localNames()
+	if err != nil {
+		return nil, err
+	}
+	var known []string
+	for name, fs := range st.Files {
+		if fs.MD5 != "" && s.matches(name) {
+			known = append(known, name)
+		}
+	}
+
+	var infos []FileInfo
+	for _, name := range union(local, known) {
+		fs := st.file(name)
+		info := FileInfo{Name: name, Source: fs.Source, Synced: fs.Synced, Revision: fs.Revision, Base: fs.MD5}
+		if info.Local, err = s.localMD5(name); err != nil {
+			return nil, err
+		}
+		if info.Repo, err = filemd5(filepath.Join(s.Repo.Path(), filepath.FromSlash(name))); err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// Diff compares the last synced version of the file with its local copy,
+// as merge.Diff does. Like Inspect it may run while Run is syncing.
+func (s *Syncer) Diff(name string) ([]string, error) {
+	st, err := loadState(s.StateFile)
+	if err != nil {
+		return nil, err
+	}
+	// The Syncer's repo may be committing meanwhile.
+	repo, err := gitstore.Open(s.Repo.Path())
+	if err != nil {
+		return nil, err
+	}
+	var base []byte
+	if rev := st.file(name).Commit; rev != "" {
+		base, err = repo.Content(rev, name)
+	} else {
+		base, err = repo.HeadContent(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	local, err := s.readLocal(name)
+	if err != nil {
+		return nil, err
+	}
+	return merge.Diff(base, local), nil
+}
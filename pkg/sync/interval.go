@@ -0,0 +1,65 @@
+package sync
+
+import (
+	"time"
+)
+
+// QuietHours poll for changes every Interval at least from Start to End,
+// given as durations since midnight in local time. End before Start spans
+// midnight.
+type QuietHours struct {
+	Start, End time.Duration
+	Interval   time.Duration
+}
+
+// contains reports whether t is within the quiet hours.
+func (q QuietHours) contains(t time.Time) bool {
+	y, m, d := t.Date()
+	since := t.Sub(time.Date(y, m, d, 0, 0, 0, 0, t.Location()))
+	if q.Start <= q.End {
+		return since >= q.Start && since < q.End
+	}
+	return since >= q.Start || since < q.End
+}
+
+// baseInterval returns the poll interval at t without slowing down:
+// Interval, or the longest interval of QuietHours containing t.
+func (s *Syncer) baseInterval(t time.Time) time.Duration {
+	interval := s.Interval
+	for _, q := range s.QuietHours {
+		if q.contains(t) && q.Interval > interval {
+			interval = q.Interval
+		}
+	}
+	return interval
+}
+
+// pollInterval returns the poll interval following interval: doubled if
+// Limiter was throttled since the last check or nothing changed since
+// changedAt for IdleAfter, or else reset to the base interval when changes
+// were found or quiet hours started or ended.
+func (s *Syncer) pollInterval(interval time.Duration, checked, changedAt time.Time) time.Duration {
+	now := time.Now()
+	base := s.baseInterval(now)
+	prev := s.pollBase
+	s.pollBase = base
+	throttled := s.Limiter != nil && s.Limiter.Throttled().After(checked)
+	idle := s.IdleAfter > 0 && now.Sub(changedAt) >= s.IdleAfter
+	switch {
+	case throttled || idle:
+		interval *= 2
+		max := s.MaxInterval
+		if max < base {
+			max = base
+		}
+		if interval > max {
+			interval = max
+		}
+	case !changedAt.Before(checked), prev != 0 && prev != base:
+		return base
+	}
+	if interval < base {
+		interval = base
+	}
+	return interval
+}
@@ -0,0 +1,166 @@
+package sync
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/mizhka/todosync/pkg/notify"
+	"github.com/mizhka/todosync/pkg/remote"
+)
+
+// Normalization selects differences of text files ignored when comparing
+// their versions, so that apps rewriting whitespace in their own way don't
+// make files look changed and get synced back and forth.
+type Normalization struct {
+	// TrailingSpace ignores spaces and tabs at the end of lines.
+	TrailingSpace bool
+	// EOL ignores CRLF versus LF line endings.
+	EOL bool
+	// FinalNewline ignores newlines at the end of the file.
+	FinalNewline bool
+}
+
+// enabled reports whether any difference is ignored.
+func (n Normalization) enabled() bool {
+	return n.TrailingSpace || n.EOL || n.FinalNewline
+}
+
+// apply returns b without the differences n ignores.
+func (n Normalization) apply(b []byte) []byte {
+	if !isText(b) {
+		return b
+	}
+	if n.EOL {
+		b = bytes.ReplaceAll(b, []byte("\r\n"), []byte("\n"))
+	}
+	if n.TrailingSpace {
+		lines := bytes.Split(b, []byte("\n"))
+		for i, line := range lines {
+			cr := bytes.HasSuffix(line, []byte("\r"))
+			line = bytes.TrimRight(bytes.TrimSuffix(line, []byte("\r")), " \t")
+			if cr {
+				line = append(line, '\r')
+			}
+			lines[i] = line
+		}
+		b = bytes.Join(lines, []byte("\n"))
+	}
+	if n.FinalNewline {
+		b = bytes.TrimRight(b, "\r\n")
+	}
+	return b
+}
+
+// normalized returns the checksums of the local and remote versions of the
+// file, replaced by base where they differ from the last synced version
+// only as Normalize ignores, or by each other where they differ from each
+// other only so. The remote version is fetched to be compared.
+func (s *Syncer) normalized(ctx context.Context, name string, f *remote.File, hasLocal bool, base, localmd5, remotemd5 string) (string, string, error) {
+	if !s.Normalize.enabled() {
+		return localmd5, remotemd5, nil
+	}
+	var baseContent, localContent, remoteContent []byte
+	var err error
+	checkBase := base != "" && (localmd5 != base || remotemd5 != base)
+	if checkBase {
+		if baseContent, err = s.baseContent(name); err != nil {
+			return "", "", err
+		}
+		baseContent = s.Normalize.apply(baseContent)
+	}
+	checkLocal := hasLocal && localmd5 != base
+	if checkLocal {
+		if localContent, err = s.readLocal(name); err != nil {
+			return "", "", err
+		}
+		localContent = s.Normalize.apply(localContent)
+	}
+	checkRemote := f != nil && remotemd5 != base && remotemd5 != localmd5
+	if checkRemote {
+		if remoteContent, err = s.Remote.Fetch(ctx, f); err != nil {
+			return "", "", err
+		}
+		remoteContent = s.Normalize.apply(remoteContent)
+	}
+
+	if checkLocal && checkBase && bytes.Equal(localContent, baseContent) {
+		s.Logger.Debug("Local file differs from last synced version only in whitespace", "file", name)
+		localmd5 = base
+	}
+	if checkRemote && checkBase && bytes.Equal(remoteContent, baseContent) {
+		s.Logger.Debug("Remote file differs from last synced version only in whitespace", "file", name)
+		remotemd5 = base
+	}
+	if checkLocal && checkRemote && localmd5 != base && remotemd5 != base &&
+		bytes.Equal(localContent, remoteContent) {
+		s.Logger.Debug("Local and remote files differ only in whitespace", "file", name)
+		localmd5 = remotemd5
+	}
+	return localmd5, remotemd5, nil
+}
+
+// Files about to flip between the same two versions for the loopFlips-th
+// time within loopWindow are held back, as apps on either side keep
+// undoing each other's change.
+const (
+	loopFlips  = 4
+	loopWindow = 10 * time.Minute
+)
+
+// flipping reports whether syncing the version with checksum next would
+// flip the file back to the version it had before the last sync once more,
+// after having flipped between the two loopFlips-1 times already.
+func (s *Syncer) flipping(name, next string) bool {
+	fs, ok := s.state.Files[name]
+	if !ok || next == "" || next == fs.MD5 || len(fs.Recent) < loopFlips-1 {
+		return false
+	}
+	recent := fs.Recent[len(fs.Recent)-(loopFlips-1):]
+	if time.Since(recent[0].Synced) > loopWindow {
+		return false
+	}
+	var sums []string
+	for _, v := range recent {
+		sums = append(sums, v.MD5)
+	}
+	sums = append(sums, fs.MD5, next)
+	for i := 2; i < len(sums); i++ {
+		if sums[i] != sums[i-2] {
+			return false
+		}
+	}
+	return true
+}
+
+// hold keeps the file flipping to the version with checksum next as it
+// is, telling once per version.
+func (s *Syncer) hold(name, next string) error {
+	fs := s.state.file(name)
+	if fs.Held == next || s.DryRun {
+		s.Logger.Debug("Holding back file synced back and forth", "file", name)
+		return nil
+	}
+	msg := fmt.Sprintf("%s keeps changing back and forth between two versions, holding it back until it changes otherwise", name)
+	if !s.Normalize.enabled() {
+		msg += "; if they differ only in whitespace, set normalize"
+	}
+	s.Logger.Warn("File synced back and forth, holding it back", "file", name, "md5", next)
+	s.notify(notify.EventConflict, name, msg)
+	fs.Held = next
+	return s.state.save()
+}
+
+// recordVersion keeps the version of the file synced before one with the
+// checksum sum, for flipping to find loops.
+func (fs *fileState) recordVersion(sum string) {
+	if fs.MD5 == "" || fs.MD5 == sum {
+		return
+	}
+	fs.Recent = append(fs.Recent, version{MD5: fs.MD5, Synced: fs.Synced})
+	if n := len(fs.Recent) - (loopFlips - 1); n > 0 {
+		fs.Recent = fs.Recent[n:]
+	}
+	fs.Held = ""
+}
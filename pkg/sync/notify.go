@@ -0,0 +1,25 @@
+package sync
+
+import (
+	"context"
+	"time"
+
+	"github.com/mizhka/todosync/pkg/notify"
+)
+
+// notifyTimeout limits delivery of a single notification.
+const notifyTimeout = 10 * time.Second
+
+// notify sends an event of type typ about the file to the Notifier, if
+// any. Failed notifications are only logged, and a dry run sends none.
+func (s *Syncer) notify(typ, file, msg string) {
+	if s.Notifier == nil || s.DryRun {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+	err := s.Notifier.Notify(ctx, notify.Event{Type: typ, File: file, Message: msg})
+	if err != nil {
+		s.Logger.Warn("Can't send notification", "event", typ, "err", err)
+	}
+}
@@ -0,0 +1,142 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// ErrOffline is wrapped by errors of cycles that couldn't reach the
+// remote. Local changes were committed to the repo and their uploads
+// queued.
+var ErrOffline = errors.New("offline")
+
+// maxOfflineDelay limits the delay between attempts to reconnect, so that
+// queued uploads are sent soon after the network is back.
+const maxOfflineDelay = time.Minute
+
+// isOffline reports whether err comes from a network that is down or a
+// host that can't be reached, rather than from the remote rejecting a
+// request.
+func isOffline(err error) bool {
+	if err == nil {
+		return false
+	}
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	return errors.As(err, &dnsErr) || errors.As(err, &opErr) ||
+		errors.Is(err, syscall.ENETUNREACH) || errors.Is(err, syscall.EHOSTUNREACH) ||
+		errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// Offline reports whether the last cycle couldn't reach the remote.
+func (s *Syncer) Offline() bool {
+	return s.offline.Load()
+}
+
+// commitOffline keeps local changes while the remote can't be reached:
+// files changed locally are committed and queued for upload, after those
+// committed but not uploaded before. The queue is kept in the state and
+// sent in order by the next cycle reaching the remote. It returns err
+// wrapped in ErrOffline, or an error failing to commit.
+func (s *Syncer) commitOffline(ctx context.Context, err error) error {
+	if !s.offline.Swap(true) {
+		s.Logger.Warn("Remote unreachable, committing local changes and queueing uploads", "err", err)
+	}
+	offline := fmt.Errorf("%w: %w", ErrOffline, err)
+	names, lerr := s.localNames()
+	if lerr != nil {
+		return lerr
+	}
+	repo := s.Repo.Path()
+	var changed, queued []string
+	for _, name := range names {
+		if s.direction(name) == PullOnly {
+			continue
+		}
+		localmd5, err := s.localMD5(name)
+		if err != nil {
+			return err
+		}
+		repomd5, err := filemd5(filepath.Join(repo, filepath.FromSlash(name)))
+		if err != nil {
+			return err
+		}
+		if localmd5 != "" && localmd5 != repomd5 {
+			if err := s.copy(s.LocalDir, repo, name); err != nil {
+				return err
+			}
+			changed = append(changed, name)
+			repomd5 = localmd5
+		}
+		if fs, ok := s.state.Files[name]; repomd5 != "" && (!ok || fs.MD5 != repomd5) {
+			queued = append(queued, name)
+		}
+	}
+	if err := s.commit(ctx, paths(repo, changed), "local", "Commit while offline"); err != nil {
+		return err
+	}
+	if s.queue(queued) {
+		s.Logger.Info("Queued uploads", "files", len(s.state.Pending))
+		if err := s.state.save(); err != nil {
+			return err
+		}
+	}
+	return offline
+}
+
+// queue appends names missing from the upload queue to it and reports
+// whether it changed.
+func (s *Syncer) queue(names []string) bool {
+	added := false
+	for _, name := range names {
+		if !contains(s.state.Pending, name) {
+			s.state.Pending = append(s.state.Pending, name)
+			added = true
+		}
+	}
+	return added
+}
+
+// dequeue removes names from the upload queue.
+func (s *Syncer) dequeue(names []string) {
+	pending := s.state.Pending[:0]
+	for _, name := range s.state.Pending {
+		if !contains(names, name) {
+			pending = append(pending, name)
+		}
+	}
+	s.state.Pending = pending
+}
+
+// trimQueue drops from the upload queue files which turn out to need no
+// upload, such as ones since deleted or changed back.
+func (s *Syncer) trimQueue(c *changes) {
+	var done []string
+	for _, name := range s.state.Pending {
+		if !contains(c.fromLocal, name) && !contains(c.conflicting, name) {
+			done = append(done, name)
+		}
+	}
+	s.dequeue(done)
+}
+
+// queuedFirst splits names into those in the upload queue, in its order,
+// and the others.
+func (s *Syncer) queuedFirst(names []string) (queued, rest []string) {
+	for _, name := range s.state.Pending {
+		if contains(names, name) {
+			queued = append(queued, name)
+		}
+	}
+	for _, name := range names {
+		if !contains(queued, name) {
+			rest = append(rest, name)
+		}
+	}
+	return queued, rest
+}
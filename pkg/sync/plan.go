@@ -0,0 +1,30 @@
+package sync
+
+import (
+	"fmt"
+)
+
+// apply runs fn, an action described by desc that changes files, git
+// history or the remote. In DryRun mode the action is printed instead, and
+// it is written to Trace before running otherwise.
+func (s *Syncer) apply(desc string, fn func() error) error {
+	if s.DryRun {
+		fmt.Println("would", desc)
+		return nil
+	}
+	if s.Trace != nil {
+		fmt.Fprintln(s.Trace, desc)
+	}
+	return fn()
+}
+
+// dirName names dir in action descriptions.
+func (s *Syncer) dirName(dir string) string {
+	switch dir {
+	case s.Repo.Path():
+		return "repo"
+	case s.LocalDir:
+		return "local dir"
+	}
+	return dir
+}
@@ -0,0 +1,27 @@
+package sync
+
+// each runs fn for every name on up to Parallelism goroutines, one at a
+// time in a dry run to keep its output in order. It waits for all of them
+// and returns the first error.
+func (s *Syncer) each(names []string, fn func(name string) error) error {
+	n := s.Parallelism
+	if n < 1 || s.DryRun {
+		n = 1
+	}
+	sem := make(chan struct{}, n)
+	errs := make(chan error, len(names))
+	for _, name := range names {
+		sem <- struct{}{}
+		go func(name string) {
+			defer func() { <-sem }()
+			errs <- fn(name)
+		}(name)
+	}
+	var first error
+	for range names {
+		if err := <-errs; err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
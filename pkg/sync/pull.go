@@ -0,0 +1,51 @@
+package sync
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+)
+
+// pullGit brings new commits of the git remote into the local directory.
+// Their changes are merged with local edits against the last synced
+// version, so the rest of the cycle propagates them to the remote just like
+// local edits.
+func (s *Syncer) pullGit(ctx context.Context) error {
+	if s.DryRun {
+		// What would be merged is unknown without fetching.
+		return s.apply("pull from git remote", nil)
+	}
+	rev, err := s.Repo.Pull(ctx)
+	if err != nil {
+		// An unreachable remote mustn't stop syncing with the Remote.
+		s.Logger.Warn("Pull failed", "err", err)
+		return nil
+	}
+	if rev == "" {
+		return nil
+	}
+
+	names, err := s.localNames()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		pulled, err := s.Repo.Content(rev, name)
+		if err != nil {
+			return err
+		}
+		hash := md5.Sum(pulled)
+		if pulled == nil || hex.EncodeToString(hash[:]) == s.baseMD5(name) {
+			continue
+		}
+
+		s.Logger.Info("Changed git remote file", "file", name)
+		if _, err := s.mergeLocal(name, pulled, "git remote"); err != nil {
+			return err
+		}
+	}
+	if err := s.commit(ctx, paths(s.Repo.Path(), names), "git", "Merge from git remote"); err != nil {
+		return err
+	}
+	return s.settle(names)
+}
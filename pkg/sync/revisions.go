@@ -0,0 +1,83 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	"github.com/mizhka/todosync/pkg/fsutil"
+	"github.com/mizhka/todosync/pkg/remote"
+)
+
+// replayRevisions commits the revisions of the remote file saved since the
+// last sync, each dated by the time it was saved, leaving the current one
+// to the caller. Failures are only logged: the file is then committed with
+// its current content alone, as without Revisions.
+func (s *Syncer) replayRevisions(ctx context.Context, f *remote.File) {
+	h, ok := s.Remote.(remote.Historian)
+	if !ok || f == nil {
+		return
+	}
+	revs, err := h.Revisions(ctx, f)
+	if err != nil {
+		s.Logger.Warn("Can't list revisions", "file", f.Path, "err", err)
+		return
+	}
+	missed := missedRevisions(revs, f.Revision, s.state.file(f.Path))
+	if len(missed) == 0 {
+		return
+	}
+	s.Logger.Info("Replaying revisions", "file", f.Path, "count", len(missed))
+	dst := filepath.Join(s.Repo.Path(), filepath.FromSlash(f.Path))
+	for _, rev := range missed {
+		desc := fmt.Sprintf("write revision %s of %s saved at %s to repo", rev.ID, f.Path, rev.Modified.Format("2006-01-02 15:04:05"))
+		err := s.apply(desc, func() error {
+			content, err := h.FetchRevision(ctx, f, rev)
+			if err != nil {
+				return err
+			}
+			return fsutil.WriteFile(dst, content, 0644)
+		})
+		if err == nil {
+			action := "Revision from mobile"
+			if rev.Author != "" {
+				action += " by " + rev.Author
+			}
+			err = s.commitAt(ctx, []string{dst}, "remote", action, rev.Modified)
+		}
+		if err != nil {
+			s.Logger.Warn("Can't replay revision", "file", f.Path, "revision", rev.ID, "err", err)
+			return
+		}
+	}
+}
+
+// missedRevisions returns revisions saved after the last synced one and
+// before head, the current revision. When the last synced revision was
+// pruned they are told by the time of the last sync. Nothing was missed
+// by a file never synced.
+func missedRevisions(revs []*remote.Revision, head string, fs *fileState) []*remote.Revision {
+	if fs.Synced.IsZero() {
+		return nil
+	}
+	end := len(revs)
+	for i, r := range revs {
+		if r.ID == head {
+			end = i
+			break
+		}
+	}
+	revs = revs[:end]
+	for i, r := range revs {
+		if r.ID == fs.Revision {
+			return revs[i+1:]
+		}
+	}
+	var missed []*remote.Revision
+	for _, r := range revs {
+		if r.Modified.After(fs.Synced) {
+			missed = append(missed, r)
+		}
+	}
+	return missed
+}
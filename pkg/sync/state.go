@@ -0,0 +1,120 @@
+package sync
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/mizhka/todosync/pkg/fsutil"
+)
+
+// fileState is what is known about a file after the last sync.
+type fileState struct {
+	// MD5 is the checksum of the last synced content, the merge base.
+	MD5 string `json:"md5"`
+	// Commit is the git commit holding the last synced content.
+	Commit string `json:"commit,omitempty"`
+	// ID identifies the remote file, following it when renamed.
+	ID string `json:"id,omitempty"`
+	// Revision is the remote revision of the last synced content.
+	Revision string `json:"revision,omitempty"`
+	// Synced is the time of the last sync.
+	Synced time.Time `json:"synced"`
+	// Source is where the last committed change came from, as in
+	// CommitInfo.
+	Source string `json:"source,omitempty"`
+	// Recent are versions synced before the last one, oldest first.
+	Recent []version `json:"recent,omitempty"`
+	// Held is the checksum of a version held back for flipping back and
+	// forth.
+	Held string `json:"held,omitempty"`
+	// Encrypted is set once the remote file was synced encrypted, see
+	// remote.File.
+	Encrypted bool `json:"encrypted,omitempty"`
+}
+
+// version is a synced version of a file.
+type version struct {
+	MD5    string    `json:"md5"`
+	Synced time.Time `json:"synced"`
+}
+
+// taskState links a task of the task list to an item of the task service.
+type taskState struct {
+	// Key identifies the task in TodoFile or DoneFile.
+	Key string `json:"key"`
+	// Completed is the status of the task after the last sync.
+	Completed bool `json:"completed"`
+}
+
+// state is persisted between runs in a JSON file.
+type state struct {
+	Files map[string]*fileState `json:"files"`
+	// Tasks maps IDs of task service items to their tasks.
+	Tasks map[string]*taskState `json:"tasks,omitempty"`
+	// Conflicts lists quarantined versions awaiting resolution.
+	Conflicts []*Conflict `json:"conflicts,omitempty"`
+	// Pending lists files committed while the remote was unreachable, in
+	// the order they are to be uploaded.
+	Pending []string `json:"pending,omitempty"`
+	// Rotated is when DoneFile was last due for rotation.
+	Rotated time.Time `json:"rotated,omitempty"`
+	// ConflictLog holds times of recent merges with conflicting edits.
+	ConflictLog []time.Time `json:"conflict_log,omitempty"`
+
+	path string
+	// readonly keeps changes in memory only.
+	readonly bool
+}
+
+// loadState reads the state file at path. An empty path keeps state in
+// memory only.
+func loadState(path string) (*state, error) {
+	st := &state{Files: map[string]*fileState{}, Tasks: map[string]*taskState{}, path: path}
+	if path == "" {
+		return st, nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't read state %s: %w", path, err)
+	}
+	if err := json.Unmarshal(b, st); err != nil {
+		return nil, fmt.Errorf("can't parse state %s: %w", path, err)
+	}
+	if st.Files == nil {
+		st.Files = map[string]*fileState{}
+	}
+	if st.Tasks == nil {
+		st.Tasks = map[string]*taskState{}
+	}
+	return st, nil
+}
+
+func (st *state) save() error {
+	if st.path == "" || st.readonly {
+		return nil
+	}
+	b, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := fsutil.WriteFile(st.path, b, 0600); err != nil {
+		return fmt.Errorf("can't save state %s: %w", st.path, err)
+	}
+	return nil
+}
+
+func (st *state) file(name string) *fileState {
+	fs, ok := st.Files[name]
+	if !ok {
+		fs = &fileState{}
+		st.Files[name] = fs
+	}
+	return fs
+}
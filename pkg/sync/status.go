@@ -0,0 +1,264 @@
+package sync
+
+import (
+	"context"
+	"sort"
+
+	"github.com/mizhka/todosync/pkg/remote"
+)
+
+// changes groups synced files by what happened to them since the last
+// sync.
+type changes struct {
+	unchanged     []string
+	fromRemote    []string
+	fromLocal     []string
+	conflicting   []string
+	deletedRemote []string
+	deletedLocal  []string
+	restoreLocal  []string
+	restoreRemote []string
+	// ignored are files found only on the side their Direction doesn't
+	// sync from.
+	ignored []string
+	// held are files flipping back and forth between two versions.
+	held []string
+}
+
+// FileStatus tells what a sync cycle would do to a file.
+type FileStatus struct {
+	Name string
+	// Status is a short description such as "changed locally".
+	Status string
+}
+
+// Status compares remote, local and last synced versions of files without
+// changing anything.
+func (s *Syncer) Status(ctx context.Context) ([]FileStatus, error) {
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+	}
+	dryRun := s.DryRun
+	s.DryRun = true
+	defer func() { s.DryRun = dryRun }()
+
+	if err := s.initState(); err != nil {
+		return nil, err
+	}
+	rfiles, err := s.listRemote(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c, err := s.classify(ctx, rfiles)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []FileStatus
+	add := func(names []string, status string) {
+		for _, name := range names {
+			res = append(res, FileStatus{Name: name, Status: status})
+		}
+	}
+	add(c.unchanged, "in sync")
+	add(c.fromRemote, "changed remotely")
+	add(c.fromLocal, "changed locally")
+	add(c.conflicting, "changed on both sides")
+	add(c.deletedRemote, "deleted remotely")
+	add(c.deletedLocal, "deleted locally")
+	add(c.held, "changing back and forth, held back")
+	for _, name := range c.restoreLocal {
+		if contains(c.restoreRemote, name) {
+			res = append(res, FileStatus{Name: name, Status: "deleted on both sides, to be restored"})
+		} else {
+			res = append(res, FileStatus{Name: name, Status: "changed or deleted locally, to be restored"})
+		}
+	}
+	for _, name := range c.restoreRemote {
+		if !contains(c.restoreLocal, name) {
+			res = append(res, FileStatus{Name: name, Status: "changed or deleted remotely, to be restored"})
+		}
+	}
+	for _, name := range c.ignored {
+		res = append(res, FileStatus{Name: name, Status: "ignored, " + string(s.direction(name))})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res, nil
+}
+
+// classify compares remote files in rfiles and local files against their
+// last synced versions.
+func (s *Syncer) classify(ctx context.Context, rfiles map[string]*remote.File) (*changes, error) {
+	names, err := s.localNames()
+	if err != nil {
+		return nil, err
+	}
+	for name := range rfiles {
+		names = append(names, name)
+	}
+	// Files deleted on both sides are still in the state.
+	for name, fs := range s.state.Files {
+		if fs.MD5 != "" && s.matches(name) {
+			names = append(names, name)
+		}
+	}
+	names = union(names)
+	s.stats.checked = len(names)
+
+	c := &changes{}
+	for _, name := range names {
+		base := s.baseMD5(name)
+		localmd5, err := s.localMD5(name)
+		if err != nil {
+			return nil, err
+		}
+		// Only files synced before can be deleted, other missing files
+		// are new on the other side.
+		hasLocal := localmd5 != ""
+		localGone := !hasLocal && base != ""
+		if localmd5 == "" {
+			localmd5 = base
+		}
+		f, ok := rfiles[name]
+		remoteGone := !ok && base != ""
+		remotemd5 := base
+		if ok {
+			remotemd5, err = s.remoteMD5(ctx, f)
+			if err != nil {
+				return nil, err
+			}
+		}
+		localmd5, remotemd5, err = s.normalized(ctx, name, f, hasLocal, base, localmd5, remotemd5)
+		if err != nil {
+			return nil, err
+		}
+		// The version a change on one side only would sync.
+		next := ""
+		switch {
+		case localmd5 != base && remotemd5 == base:
+			next = localmd5
+		case remotemd5 != base && localmd5 == base:
+			next = remotemd5
+		}
+
+		dir := s.direction(name)
+		if ok && f.ReadOnly {
+			dir = PullOnly
+		}
+		// Versions equal on both sides need no direction enforced.
+		same := ok && hasLocal && localmd5 == remotemd5
+		switch {
+		case dir == PushOnly && !hasLocal && base == "":
+			s.Logger.Debug("Ignoring remote file of push-only file", "file", name)
+			c.ignored = append(c.ignored, name)
+		case dir == PullOnly && !ok && base == "":
+			s.Logger.Debug("Ignoring local file of pull-only file", "file", name)
+			c.ignored = append(c.ignored, name)
+		case dir == PushOnly && (remoteGone || remotemd5 != base) && !same:
+			s.pushOnly(c, name, ok, localGone, localmd5 != base)
+		case dir == PullOnly && (localGone || localmd5 != base) && !same:
+			s.pullOnly(c, name, localGone, remoteGone, remotemd5 != base)
+		case s.flipping(name, next):
+			if err := s.hold(name, next); err != nil {
+				return nil, err
+			}
+			c.held = append(c.held, name)
+		case (localGone || remoteGone) && s.Deletions == DeletePropagate &&
+			remotemd5 == base && localmd5 == base:
+			if remoteGone {
+				s.Logger.Info("Deleted remote file", "file", name)
+				c.deletedRemote = append(c.deletedRemote, name)
+			} else {
+				s.Logger.Info("Deleted local file", "file", name)
+				c.deletedLocal = append(c.deletedLocal, name)
+			}
+		case remotemd5 == base && localmd5 == base:
+			switch {
+			case localGone && remoteGone:
+				s.Logger.Info("Deleted both remote and local file, restoring", "file", name)
+				c.restoreLocal = append(c.restoreLocal, name)
+				c.restoreRemote = append(c.restoreRemote, name)
+			case localGone:
+				s.Logger.Info("Deleted local file, restoring", "file", name)
+				c.restoreLocal = append(c.restoreLocal, name)
+			case remoteGone:
+				s.Logger.Info("Deleted remote file, restoring", "file", name)
+				c.restoreRemote = append(c.restoreRemote, name)
+			default:
+				s.Logger.Debug("No update", "file", name)
+				c.unchanged = append(c.unchanged, name)
+			}
+			// Files synced before IDs were recorded learn them here.
+			if ok && s.state.file(name).ID != f.ID {
+				s.state.file(name).ID = f.ID
+				if err := s.state.save(); err != nil {
+					return nil, err
+				}
+			}
+		case localmd5 == base || localmd5 == remotemd5:
+			s.Logger.Info("Changed remote file", "file", name, "md5", remotemd5, "rev", f.Revision, "size", f.Size)
+			c.fromRemote = append(c.fromRemote, name)
+		case remotemd5 == base:
+			// Edits win over deletions on the other side.
+			s.Logger.Info("Changed local file", "file", name)
+			c.fromLocal = append(c.fromLocal, name)
+		default:
+			s.Logger.Info("Changed both remote and local file", "file", name)
+			c.conflicting = append(c.conflicting, name)
+		}
+	}
+
+	return c, nil
+}
+
+// pushOnly classifies a push-only file changed or deleted remotely: the
+// local version replaces the remote one.
+func (s *Syncer) pushOnly(c *changes, name string, hasRemote, localGone, localChanged bool) {
+	switch {
+	case localGone && s.Deletions == DeletePropagate && hasRemote:
+		s.Logger.Info("Deleted local file of push-only file, deleting remote file", "file", name)
+		c.deletedLocal = append(c.deletedLocal, name)
+	case localGone && s.Deletions == DeletePropagate:
+		// Deleted on both sides, removing it from the repo is left.
+		s.Logger.Info("Deleted both remote and local file", "file", name)
+		c.deletedRemote = append(c.deletedRemote, name)
+	case localGone:
+		s.Logger.Info("Deleted local file of push-only file, restoring", "file", name)
+		c.restoreLocal = append(c.restoreLocal, name)
+		c.restoreRemote = append(c.restoreRemote, name)
+	case localChanged:
+		s.Logger.Info("Changed local file of push-only file, overwriting remote changes", "file", name)
+		c.fromLocal = append(c.fromLocal, name)
+	case !hasRemote:
+		s.Logger.Info("Deleted remote file of push-only file, restoring", "file", name)
+		c.restoreRemote = append(c.restoreRemote, name)
+	default:
+		s.Logger.Warn("Changed remote file of push-only file, restoring local version", "file", name)
+		c.restoreRemote = append(c.restoreRemote, name)
+	}
+}
+
+// pullOnly classifies a pull-only file changed or deleted locally: the
+// remote version replaces the local one.
+func (s *Syncer) pullOnly(c *changes, name string, localGone, remoteGone, remoteChanged bool) {
+	switch {
+	case remoteGone && s.Deletions == DeletePropagate:
+		s.Logger.Info("Deleted remote file of pull-only file, deleting local file", "file", name)
+		c.deletedRemote = append(c.deletedRemote, name)
+	case remoteGone:
+		s.Logger.Info("Deleted remote file of pull-only file, restoring", "file", name)
+		c.restoreLocal = append(c.restoreLocal, name)
+		c.restoreRemote = append(c.restoreRemote, name)
+	case remoteChanged:
+		s.Logger.Info("Changed remote file of pull-only file, overwriting local changes", "file", name)
+		c.fromRemote = append(c.fromRemote, name)
+	case localGone:
+		s.Logger.Info("Deleted local file of pull-only file, restoring", "file", name)
+		c.restoreLocal = append(c.restoreLocal, name)
+	default:
+		s.Logger.Warn("Changed local file of pull-only file, restoring remote version", "file", name)
+		c.restoreLocal = append(c.restoreLocal, name)
+	}
+}
@@ -0,0 +1,50 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+)
+
+// cycleStats counts what a sync cycle did.
+type cycleStats struct {
+	checked    int
+	downloaded int
+	uploaded   int
+	merged     int
+	deleted    int
+	committed  int
+}
+
+// changed reports whether the cycle changed anything.
+func (st cycleStats) changed() bool {
+	return st.downloaded+st.uploaded+st.merged+st.deleted+st.committed > 0
+}
+
+// logSummary logs the outcome of a cycle that took d. Cycles that changed
+// nothing are only logged at debug level.
+func (s *Syncer) logSummary(d time.Duration, err error) {
+	level := slog.LevelDebug
+	switch {
+	case errors.Is(err, ErrOffline):
+		level = slog.LevelWarn
+	case err != nil:
+		level = slog.LevelError
+	case s.stats.changed():
+		level = slog.LevelInfo
+	}
+	attrs := []any{
+		"checked", s.stats.checked,
+		"downloaded", s.stats.downloaded,
+		"uploaded", s.stats.uploaded,
+		"merged", s.stats.merged,
+		"deleted", s.stats.deleted,
+		"committed", s.stats.committed,
+		"duration", d.Round(time.Millisecond),
+	}
+	if err != nil {
+		attrs = append(attrs, "err", err)
+	}
+	s.Logger.Log(context.Background(), level, "Sync cycle", attrs...)
+}
@@ -0,0 +1,1276 @@
+// Package sync keeps todo files consistent between remote storage such as
+// Google Drive, a git repository and a local directory.
+package sync
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	gosync "sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+	"github.com/mizhka/todosync/pkg/backoff"
+	"github.com/mizhka/todosync/pkg/drive"
+	"github.com/mizhka/todosync/pkg/fsutil"
+	"github.com/mizhka/todosync/pkg/gitstore"
+	"github.com/mizhka/todosync/pkg/health"
+	"github.com/mizhka/todosync/pkg/merge"
+	"github.com/mizhka/todosync/pkg/notify"
+	"github.com/mizhka/todosync/pkg/ratelimit"
+	"github.com/mizhka/todosync/pkg/remote"
+	"github.com/mizhka/todosync/pkg/tasks"
+	"github.com/mizhka/todosync/pkg/todotxt"
+)
+
+// Repository is the git repository the engine commits synced files to,
+// implemented by gitstore.Repo.
+type Repository interface {
+	// Path returns the root directory of the worktree.
+	Path() string
+	// CommitAt commits the changed files, given by paths inside the
+	// worktree, with when as the author date.
+	CommitAt(changes []string, msg string, when time.Time) error
+	// Head returns the hash of the HEAD commit, empty without commits.
+	Head() (string, error)
+	// HeadContent returns content of the slash separated filename at HEAD,
+	// nil if it's missing.
+	HeadContent(filename string) ([]byte, error)
+	// Content returns content of filename at the commit rev.
+	Content(rev, filename string) ([]byte, error)
+	// Restore puts files back to their content at HEAD.
+	Restore(names []string) error
+	// Pull fetches and merges commits of the git remote, returning the
+	// commit bringing new content, if any.
+	Pull(ctx context.Context) (string, error)
+	// Push pushes commits to the git remote.
+	Push(ctx context.Context) error
+}
+
+var _ Repository = (*gitstore.Repo)(nil)
+
+// Syncer periodically synchronizes Files between Remote, Repo and LocalDir.
+type Syncer struct {
+	Remote   remote.Store
+	Repo     Repository
+	LocalDir string
+	// Files are slash separated path patterns of synced files relative to
+	// LocalDir, Repo and the Remote.
+	Files []string
+	// Interval is the delay between polls for changes. While Limiter is
+	// throttled, or once nothing changed for IdleAfter, it's doubled after
+	// each poll up to MaxInterval, and it's back to Interval once changes
+	// are found. QuietHours lengthen it at times of day.
+	Interval    time.Duration
+	MaxInterval time.Duration
+	IdleAfter   time.Duration
+	QuietHours  []QuietHours
+	// Timeout limits duration of a single cycle.
+	Timeout time.Duration
+
+	// Feed, when set, limits access to a Google Drive Remote to cycles
+	// following remote changes instead of listing files every Interval.
+	Feed *drive.ChangeFeed
+	// Webhook is the public address Drive posts change notifications to.
+	// The notification server listens on Listen. The Feed is polled every
+	// Interval when Webhook is empty or can't be subscribed.
+	Webhook string
+	Listen  string
+
+	// StateFile keeps checksums of last synced versions between runs.
+	StateFile string
+	// Conflict selects how merge conflicts are written out.
+	Conflict ConflictMode
+	// ConflictDir keeps versions quarantined with ConflictQuarantine.
+	ConflictDir string
+	// Merge selects how concurrent edits are merged.
+	Merge MergeMode
+	// TodoFile and DoneFile name the task list and the list of finished
+	// tasks merged task by task with MergeTodoTxt. Such merge also moves
+	// completed tasks from TodoFile to DoneFile.
+	TodoFile string
+	DoneFile string
+	// Push enables pushing to the git remote after each commit.
+	Push bool
+	// Pull enables merging commits of the git remote before each cycle.
+	Pull bool
+	// Deletions selects what happens to files deleted on one side.
+	Deletions DeleteMode
+	// LineEnding selects line terminators of text files in LocalDir.
+	LineEnding LineEnding
+	// Targets receive the last synced versions of files after each cycle,
+	// besides LocalDir.
+	Targets []LocalTarget
+	// Duplicates selects which of remote files sharing a path is synced.
+	Duplicates DuplicateMode
+	// Normalize selects differences ignored when comparing versions of
+	// text files.
+	Normalize Normalization
+	// Archive selects when completed tasks of DoneFile are archived.
+	Archive ArchivePolicy
+	// Directions restrict which way files are synced. The first rule
+	// matching a file applies, files matching none are synced both ways.
+	Directions []DirectionRule
+	// Revisions, when the Remote implements remote.Historian, commits
+	// each revision a file changed only remotely went through since the
+	// last sync, instead of its latest content only.
+	Revisions bool
+	// CommitMessage formats messages of commits, DefaultCommitMessage
+	// when nil.
+	CommitMessage *template.Template
+	// DryRun prints the actions of a cycle instead of running them.
+	DryRun bool
+	// Trace, when set, receives the description of every action run, such
+	// as "upload todo.txt", a line each.
+	Trace io.Writer
+	// Parallelism is the number of files downloaded or uploaded at once.
+	Parallelism int
+
+	// Tasks, when set, mirrors open tasks of TodoFile to a task service at
+	// the start of each cycle. Cycles run at least every TasksInterval to
+	// pick up changes made in the service.
+	Tasks         tasks.Provider
+	TasksInterval time.Duration
+
+	// Limiter, when set, paces requests to the Remote and tells when they
+	// were throttled for exceeding quota.
+	Limiter *ratelimit.Limiter
+
+	// Logger receives progress messages and a summary of each cycle.
+	Logger *slog.Logger
+	// Health, when set, records results of cycles and checks for changes.
+	Health *health.Check
+	// Notifier, when set, is told about conflicts, remote changes written
+	// to LocalDir and failures, and gets digests of changes synced.
+	Notifier notify.Notifier
+	// Digests, when set, schedules digests sent through Notifier.
+	Digests *DigestSchedule
+
+	state *state
+	// ignore matches files excluded by IgnoreFile.
+	ignore atomic.Pointer[gitignore.Matcher]
+	// trigger requests a cycle from Run, which ignores changes while
+	// paused. wake makes Run notice Pause.
+	trigger chan struct{}
+	wake    chan struct{}
+	paused  atomic.Bool
+	// pollBase is the base interval pollInterval last found.
+	pollBase time.Duration
+	// offline is set while cycles can't reach the remote.
+	offline atomic.Bool
+	// txn tracks changes of the running cycle.
+	txn *txn
+	// unmirrored are files not written to Targets since they were last
+	// synced or deleted. mirrored is set once all files were written.
+	unmirrored map[string]bool
+	mirrored   bool
+	// racy tells once that uploads may overwrite remote changes.
+	racy gosync.Once
+	// waiters get the result of the next cycle Run starts.
+	waitMu  gosync.Mutex
+	waiters []chan<- error
+	// mu guards stats and remote files listed in a cycle while files are
+	// transferred concurrently.
+	mu    gosync.Mutex
+	stats cycleStats
+	// creating serializes creation of remote files, which may create
+	// their folders.
+	creating gosync.Mutex
+}
+
+// MergeMode selects how files changed both remotely and locally are merged.
+type MergeMode string
+
+const (
+	// MergeLines merges files line by line.
+	MergeLines MergeMode = "lines"
+	// MergeTodoTxt merges TodoFile and DoneFile task by task and other
+	// files line by line.
+	MergeTodoTxt MergeMode = "todotxt"
+)
+
+// ConflictMode selects what happens when concurrent edits can't be merged.
+type ConflictMode string
+
+const (
+	// ConflictMarkers keeps both versions of conflicting lines between
+	// conflict markers.
+	ConflictMarkers ConflictMode = "markers"
+	// ConflictCopy keeps the local version and saves the remote version to
+	// a .conflict file in the local directory.
+	ConflictCopy ConflictMode = "copy"
+	// ConflictQuarantine keeps the local version and saves the remote
+	// version to ConflictDir, recording it for ResolveConflict.
+	ConflictQuarantine ConflictMode = "quarantine"
+)
+
+// DeleteMode selects what happens to files deleted either remotely or
+// locally since the last sync.
+type DeleteMode string
+
+const (
+	// DeleteRestore copies deleted files back from the other side.
+	DeleteRestore DeleteMode = "restore"
+	// DeletePropagate deletes files on the other side too, unless they
+	// were edited there.
+	DeletePropagate DeleteMode = "propagate"
+)
+
+// DuplicateMode selects what happens when several remote files share a
+// path.
+type DuplicateMode string
+
+const (
+	// DuplicateNewest syncs the file synced before, or else the most
+	// recently modified one.
+	DuplicateNewest DuplicateMode = "newest"
+	// DuplicateError fails the cycle until the user removes duplicates.
+	DuplicateError DuplicateMode = "error"
+)
+
+// LineEnding selects line terminators of text files in LocalDir. The repo
+// and the Remote get LF unless files are copied as they are.
+type LineEnding string
+
+const (
+	// LineEndingKeep copies files byte for byte.
+	LineEndingKeep LineEnding = ""
+	// LineEndingLF writes LF to LocalDir and turns CRLF written there into
+	// LF.
+	LineEndingLF LineEnding = "lf"
+	// LineEndingCRLF writes CRLF to LocalDir.
+	LineEndingCRLF LineEnding = "crlf"
+)
+
+// Direction selects which way changes of a file are synced.
+type Direction string
+
+const (
+	// Bidirectional syncs changes made on either side.
+	Bidirectional Direction = "bidirectional"
+	// PushOnly makes the local file authoritative: remote changes and
+	// deletions are overwritten by the local version and files found only
+	// remotely are ignored.
+	PushOnly Direction = "push-only"
+	// PullOnly makes the remote file authoritative: local changes and
+	// deletions are overwritten by the remote version and files found only
+	// locally are ignored. Read-only remote files are always pull-only.
+	PullOnly Direction = "pull-only"
+)
+
+// DirectionRule applies Direction to files matching Pattern, which has the
+// syntax of Files.
+type DirectionRule struct {
+	Pattern   string
+	Direction Direction
+}
+
+// New returns a Syncer for todo.txt and done.txt polling every 5 seconds.
+func New(store remote.Store, repo Repository, localdir string) *Syncer {
+	return &Syncer{
+		Remote:      store,
+		Repo:        repo,
+		LocalDir:    localdir,
+		Files:       []string{"todo.txt", "done.txt"},
+		Interval:    5 * time.Second,
+		MaxInterval: 5 * time.Minute,
+		Timeout:     5 * time.Minute,
+		Conflict:    ConflictCopy,
+		Merge:       MergeLines,
+		Deletions:   DeleteRestore,
+		Duplicates:  DuplicateNewest,
+		TodoFile:    "todo.txt",
+		DoneFile:    "done.txt",
+
+		Parallelism: 4,
+
+		TasksInterval: time.Minute,
+		Logger:        slog.Default(),
+
+		trigger: make(chan struct{}, 1),
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// maxRetryDelay caps the delay before retrying a failed cycle.
+const maxRetryDelay = 10 * time.Minute
+
+// maxChangedRetries limits how many times in a row a cycle is run again
+// because a remote file changed while it was uploading.
+const maxChangedRetries = 3
+
+// Run runs a sync cycle immediately and then whenever remote or local files
+// change, until ctx is cancelled or a fatal error occurs. Local files are
+// watched for modifications and also compared every Interval. Without a
+// Feed a cycle runs every Interval, and with Tasks at least every
+// TasksInterval. Failed cycles are retried with
+// exponential backoff. Trigger runs a cycle on demand, and Pause holds
+// cycles back until Resume. A cycle in progress when ctx is cancelled isn't
+// interrupted, so that remote, git and local files are left consistent.
+func (s *Syncer) Run(ctx context.Context) error {
+	interval, checked, changedAt := s.baseInterval(time.Now()), time.Now(), time.Now()
+	cycle := func() error {
+		waiters := s.startWaiters()
+		err := s.Cycle(context.Background())
+		if s.stats.changed() {
+			changedAt = time.Now()
+		}
+		for _, w := range waiters {
+			w <- err
+		}
+		return err
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var hook *webhook
+	var pushed <-chan struct{}
+	if s.Feed != nil && s.Webhook != "" {
+		var err error
+		hook, err = s.startWebhook(ctx)
+		if err != nil {
+			s.Logger.Warn("Push notifications unavailable, falling back to polling", "err", err)
+		} else {
+			defer func() { s.stopWebhook(hook) }()
+			pushed = s.Feed.Notify()
+		}
+	}
+
+	var tasksTicker <-chan time.Time
+	if s.Tasks != nil {
+		t := time.NewTicker(s.TasksInterval)
+		defer t.Stop()
+		tasksTicker = t.C
+	}
+
+	files, err := s.watchFiles(ctx)
+	if err != nil {
+		s.Logger.Warn("Can't watch local files, relying on polling", "err", err)
+	}
+	if s.Digests != nil && s.Notifier != nil {
+		go s.runDigests(ctx)
+	}
+
+	var retry <-chan time.Time
+	failures, attempts := 0, 0
+	err = cycle()
+	for {
+		if errors.Is(err, ErrOffline) {
+			// Being offline isn't a failure: local changes were committed,
+			// and reconnecting is tried until the queue can be sent.
+			attempts++
+			delay := backoff.Delay(attempts, s.Interval, maxOfflineDelay)
+			s.Logger.Debug("Remote unreachable, retrying", "delay", delay)
+			retry = time.After(delay)
+		} else if err != nil {
+			attempts = 0
+			if IsFatal(err) || ctx.Err() != nil {
+				if ctx.Err() == nil {
+					s.notify(notify.EventError, "", "Sync stopped: "+err.Error())
+				}
+				return err
+			}
+			failures++
+			if failures == 1 {
+				s.notify(notify.EventError, "", "Sync failed: "+err.Error())
+			}
+			delay := backoff.Delay(failures, s.Interval, maxRetryDelay)
+			s.Logger.Warn("Sync failed, retrying", "failures", failures, "delay", delay, "err", err)
+			retry = time.After(delay)
+		} else if retry == nil {
+			attempts = 0
+			if failures > 0 {
+				s.Logger.Info("Sync recovered", "failures", failures)
+				s.notify(notify.EventError, "", fmt.Sprintf("Sync recovered after %d failures", failures))
+				failures = 0
+			}
+		}
+
+		err = nil
+		remote, local := false, false
+		// While paused changes pile up until Resume triggers a cycle.
+		retried, notified, tasksTicked, changed, ticked := retry, pushed, tasksTicker, files, ticker.C
+		if s.Paused() {
+			retried, notified, tasksTicked, changed, ticked = nil, nil, nil, nil, nil
+		}
+		select {
+		case <-s.trigger:
+			retry = nil
+			err = cycle()
+			continue
+		case <-s.wake:
+			continue
+		case <-retried:
+			retry = nil
+			err = cycle()
+			continue
+		case <-notified:
+			remote = true
+		case <-tasksTicked:
+			err = cycle()
+			continue
+		case <-changed:
+			local, err = s.localChanged()
+		case <-ticked:
+			if s.Feed == nil {
+				remote = true
+				break
+			}
+			if hook == nil {
+				remote = true
+			} else if err := s.renew(ctx, hook); err != nil {
+				s.Logger.Warn("Can't renew push notifications, falling back to polling", "err", err)
+				s.stopWebhook(hook)
+				hook, pushed = nil, nil
+			}
+			if s.Pull {
+				if err = s.pullGit(ctx); isOffline(err) {
+					err = nil
+				} else if err != nil {
+					break
+				}
+			}
+			local, err = s.localChanged()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		if err == nil && remote && s.Feed != nil {
+			remote, err = s.Feed.Poll(ctx, s.matchesBase)
+			// The cycle commits local changes while offline.
+			if isOffline(err) {
+				remote, err = true, nil
+			}
+		}
+		if remote || local {
+			changedAt = time.Now()
+		}
+		if next := s.pollInterval(interval, checked, changedAt); next != interval {
+			s.Logger.Info("Changed poll interval", "interval", next)
+			interval = next
+			ticker.Reset(interval)
+		}
+		checked = time.Now()
+		if s.Health != nil {
+			if err != nil {
+				s.recordHealth(err)
+			} else if !remote && !local {
+				s.Health.Checked()
+			}
+		}
+		// A scheduled retry runs a full cycle anyway, except while offline
+		// where local changes are committed right away.
+		if err != nil || (!remote && !local) || (retry != nil && !(local && s.Offline())) {
+			continue
+		}
+		err = cycle()
+	}
+}
+
+// IsFatal reports whether err can't be fixed by retrying, such as revoked
+// authorization.
+func IsFatal(err error) bool {
+	if isOffline(err) {
+		return false
+	}
+	return drive.IsAuthError(err) || errors.Is(err, remote.ErrUnauthorized)
+}
+
+// Cycle runs a single sync pass. Files changed only remotely are committed
+// to git and copied to the local directory, files changed only locally are
+// committed to git and uploaded. Files changed on both sides since
+// the last sync are merged against the last synced version, including
+// files changed remotely while the cycle uploads them. The cycle is
+// aborted after Timeout. A cycle failing halfway puts files it changed in
+// the repo and the local directory but didn't record as synced back as
+// they were. Files synced or deleted are then written to Targets. A
+// summary of the cycle is logged.
+func (s *Syncer) Cycle(ctx context.Context) error {
+	start := time.Now()
+	s.stats = cycleStats{}
+	s.racy.Do(func() {
+		if r, ok := s.Remote.(remote.Racy); ok && r.UploadsRace() {
+			s.Logger.Info("The remote has no conditional uploads: a change made while a file is uploaded is overwritten, and kept only in the remote's version history")
+		}
+	})
+	err := s.runCycle(ctx)
+	// A remote file changed since it was listed is merged with the
+	// version that was to be uploaded by running the cycle again.
+	for i := 0; errors.Is(err, remote.ErrChanged) && i < maxChangedRetries; i++ {
+		s.Logger.Info("Remote file changed during the cycle, syncing again", "err", err)
+		err = s.runCycle(ctx)
+	}
+	s.mirror(ctx)
+	switch {
+	case isOffline(err) && s.state != nil:
+		err = s.commitOffline(ctx, err)
+	case err == nil && s.offline.Swap(false):
+		s.Logger.Info("Remote reachable again, queued uploads sent")
+	}
+	s.logSummary(time.Since(start), err)
+	if s.Health != nil {
+		s.recordHealth(err)
+	}
+	return err
+}
+
+// recordHealth notes the result of a cycle in Health. Being offline isn't
+// a failure: the profile stays healthy, and the watchdog doesn't restart
+// the daemon, while the network is down.
+func (s *Syncer) recordHealth(err error) {
+	if errors.Is(err, ErrOffline) {
+		s.Health.Offline(err)
+		return
+	}
+	s.Health.Record(err)
+}
+
+func (s *Syncer) runCycle(ctx context.Context) (err error) {
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+	}
+
+	if err := s.initState(); err != nil {
+		return err
+	}
+	s.begin()
+	defer func() {
+		if err != nil {
+			s.rollback()
+		}
+		s.txn = nil
+	}()
+	s.loadIgnore()
+	repo := s.Repo.Path()
+
+	if s.Pull {
+		if err := s.pullGit(ctx); isOffline(err) {
+			s.Logger.Warn("Git remote unreachable, skipping pull", "err", err)
+		} else if err != nil {
+			return err
+		}
+	}
+	if s.Tasks != nil && s.matches(s.TodoFile) {
+		if err := s.syncTasks(ctx); err != nil {
+			return err
+		}
+	}
+
+	rfiles, err := s.listRemote(ctx)
+	if err != nil {
+		return err
+	}
+	if err := s.followRenames(ctx, rfiles); err != nil {
+		return err
+	}
+	c, err := s.classify(ctx, rfiles)
+	if err != nil {
+		return err
+	}
+	fromRemote, fromLocal, conflicting := c.fromRemote, c.fromLocal, c.conflicting
+	s.trimQueue(c)
+	restoreLocal, restoreRemote := c.restoreLocal, c.restoreRemote
+
+	if err := s.applyDeletions(ctx, rfiles, c.deletedRemote, c.deletedLocal); err != nil {
+		return err
+	}
+	for _, name := range restoreLocal {
+		if err := s.copy(repo, s.LocalDir, name); err != nil {
+			return err
+		}
+	}
+	if len(restoreRemote) > 0 {
+		err := s.each(restoreRemote, func(name string) error {
+			return s.upload(ctx, name, rfiles)
+		})
+		if err != nil {
+			return err
+		}
+		if err := s.synced(restoreRemote, rfiles); err != nil {
+			return err
+		}
+	}
+
+	// Remote to git
+	if len(fromRemote) > 0 {
+		if s.Revisions {
+			for _, name := range fromRemote {
+				s.replayRevisions(ctx, rfiles[name])
+			}
+		}
+		err := s.each(fromRemote, func(name string) error {
+			return s.download(ctx, rfiles[name])
+		})
+		if err != nil {
+			return err
+		}
+		if err := s.commit(ctx, paths(repo, fromRemote), "remote", "Push from mobile"); err != nil {
+			return err
+		}
+		for _, name := range fromRemote {
+			if err := s.copy(repo, s.LocalDir, name); err != nil {
+				return err
+			}
+			s.notify(notify.EventRemote, name, "Changed remotely: "+name)
+		}
+		if err := s.synced(fromRemote, rfiles); err != nil {
+			return err
+		}
+	}
+
+	// Local to git
+	if len(fromLocal) > 0 {
+		for _, name := range fromLocal {
+			if err := s.copy(s.LocalDir, repo, name); err != nil {
+				return err
+			}
+		}
+		if err := s.commit(ctx, paths(repo, fromLocal), "local", "Push from local"); err != nil {
+			return err
+		}
+		// Changes queued while offline are sent in the order they were
+		// made.
+		queued, rest := s.queuedFirst(fromLocal)
+		for _, name := range queued {
+			if err := s.upload(ctx, name, rfiles); err != nil {
+				return err
+			}
+		}
+		err := s.each(rest, func(name string) error {
+			return s.upload(ctx, name, rfiles)
+		})
+		if err != nil {
+			return err
+		}
+		if err := s.synced(fromLocal, rfiles); err != nil {
+			return err
+		}
+	}
+
+	// Both to git
+	if len(conflicting) > 0 {
+		// The list of finished tasks goes first, so that tasks archived
+		// while merging the task list are added to the merged version.
+		sort.SliceStable(conflicting, func(i, j int) bool {
+			return conflicting[i] == s.DoneFile && conflicting[j] != s.DoneFile
+		})
+		changed := conflicting
+		for _, name := range conflicting {
+			extra, err := s.mergeFile(ctx, rfiles[name], name)
+			if err != nil {
+				return err
+			}
+			for _, e := range extra {
+				if !contains(changed, e) {
+					changed = append(changed, e)
+				}
+			}
+		}
+		if err := s.commit(ctx, paths(repo, changed), "both", "Merge mobile and local changes"); err != nil {
+			return err
+		}
+		err := s.each(changed, func(name string) error {
+			return s.upload(ctx, name, rfiles)
+		})
+		if err != nil {
+			return err
+		}
+		if err := s.synced(changed, rfiles); err != nil {
+			return err
+		}
+	}
+	return s.rotateDone(ctx, rfiles)
+}
+
+// applyDeletions removes files deleted remotely from repo and local dir,
+// and files deleted locally from repo and the remote, committing both
+// deletions.
+func (s *Syncer) applyDeletions(ctx context.Context, rfiles map[string]*remote.File, deletedRemote, deletedLocal []string) error {
+	if len(deletedRemote) > 0 {
+		changes, err := s.remove(deletedRemote, s.Repo.Path(), s.LocalDir)
+		if err != nil {
+			return err
+		}
+		if err := s.commit(ctx, changes, "remote", "Delete from mobile"); err != nil {
+			return err
+		}
+		for _, name := range deletedRemote {
+			s.notify(notify.EventDeleted, name, "Deleted remotely: "+name)
+		}
+	}
+	if len(deletedLocal) > 0 {
+		for _, name := range deletedLocal {
+			f := rfiles[name]
+			err := s.apply("delete remote file "+name, func() error {
+				if err := s.Remote.Delete(ctx, f); err != nil {
+					return err
+				}
+				s.stats.deleted++
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			delete(rfiles, name)
+		}
+		changes, err := s.remove(deletedLocal, s.Repo.Path())
+		if err != nil {
+			return err
+		}
+		if err := s.commit(ctx, changes, "local", "Delete from local"); err != nil {
+			return err
+		}
+	}
+	deleted := append(deletedRemote, deletedLocal...)
+	for _, name := range deleted {
+		delete(s.state.Files, name)
+	}
+	if err := s.state.save(); err != nil {
+		return err
+	}
+	if err := s.settle(deleted); err != nil {
+		return err
+	}
+	s.mirrorLater(deleted)
+	return nil
+}
+
+// remove deletes the files from dirs, the first of which is the repo. It
+// returns repo paths of removed files for committing.
+func (s *Syncer) remove(names []string, dirs ...string) ([]string, error) {
+	var changes []string
+	for _, name := range names {
+		for i, dir := range dirs {
+			dst := filepath.Join(dir, filepath.FromSlash(name))
+			if _, err := os.Stat(dst); os.IsNotExist(err) {
+				continue
+			}
+			err := s.apply("delete "+name+" from "+s.dirName(dir), func() error {
+				if err := s.touch(dir, name); err != nil {
+					return err
+				}
+				if err := os.Remove(dst); err != nil {
+					return err
+				}
+				s.stats.deleted++
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			if i == 0 {
+				changes = append(changes, filepath.Join(dir, filepath.FromSlash(name)))
+			}
+		}
+	}
+	return changes, nil
+}
+
+// listRemote returns synced remote files by path. Of several remote files
+// sharing a path one is picked as selected by Duplicates. Files synced
+// encrypted before are marked Encrypted.
+func (s *Syncer) listRemote(ctx context.Context) (map[string]*remote.File, error) {
+	files, err := s.Remote.List(ctx, s.Files)
+	if err != nil {
+		return nil, err
+	}
+
+	byPath := map[string][]*remote.File{}
+	for _, f := range files {
+		if s.matches(f.Path) {
+			byPath[f.Path] = append(byPath[f.Path], f)
+		}
+	}
+	rfiles := map[string]*remote.File{}
+	for name, candidates := range byPath {
+		f, err := s.pickDuplicate(name, candidates)
+		if err != nil {
+			return nil, err
+		}
+		if fs, ok := s.state.Files[name]; ok && fs.Encrypted {
+			f.Encrypted = true
+		}
+		rfiles[name] = f
+	}
+	return rfiles, nil
+}
+
+// pickDuplicate returns the remote file to sync among candidates sharing
+// the path name: the one synced before, or else the most recently
+// modified one. With DuplicateError several candidates are an error
+// listing them.
+func (s *Syncer) pickDuplicate(name string, candidates []*remote.File) (*remote.File, error) {
+	if len(candidates) == 1 {
+		return candidates[0], nil
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if !a.Modified.Equal(b.Modified) {
+			return a.Modified.After(b.Modified)
+		}
+		return a.ID < b.ID
+	})
+	var list []string
+	for _, f := range candidates {
+		list = append(list, fmt.Sprintf("%s (modified %s)", f.ID, f.Modified.Format(time.RFC3339)))
+	}
+	if s.Duplicates == DuplicateError {
+		return nil, fmt.Errorf("%d remote files named %s: %s; delete or rename all but one",
+			len(candidates), name, strings.Join(list, ", "))
+	}
+
+	pick := candidates[0]
+	if fs, ok := s.state.Files[name]; ok && fs.ID != "" {
+		for _, f := range candidates {
+			if f.ID == fs.ID {
+				pick = f
+				break
+			}
+		}
+	}
+	s.Logger.Warn("Several remote files share the name", "file", name, "candidates", strings.Join(list, ", "), "using", pick.ID)
+	return pick, nil
+}
+
+// remoteMD5 returns checksum of the remote file. A revision unchanged since
+// the last sync means the last synced content. Otherwise the checksum
+// listed by the store is used, or the content is fetched to compute it.
+func (s *Syncer) remoteMD5(ctx context.Context, f *remote.File) (string, error) {
+	if fs := s.state.file(f.Path); f.Revision != "" && f.Revision == fs.Revision && fs.MD5 != "" {
+		return fs.MD5, nil
+	}
+	if f.Checksum != "" {
+		return f.Checksum, nil
+	}
+	content, err := s.Remote.Fetch(ctx, f)
+	if err != nil {
+		return "", err
+	}
+	hash := md5.Sum(content)
+	f.Checksum = hex.EncodeToString(hash[:])
+	return f.Checksum, nil
+}
+
+// upload sends the repo copy of the file to the remote, creating the
+// remote file if it's missing from rfiles, and records the result there.
+// It may run concurrently for different files.
+func (s *Syncer) upload(ctx context.Context, name string, rfiles map[string]*remote.File) error {
+	src := filepath.Join(s.Repo.Path(), filepath.FromSlash(name))
+	s.mu.Lock()
+	old, ok := rfiles[name]
+	s.mu.Unlock()
+	if ok {
+		return s.apply("upload "+name, func() error {
+			f, err := s.Remote.Upload(ctx, old, src)
+			if err == nil {
+				s.uploaded(rfiles, name, f)
+			}
+			return err
+		})
+	}
+	s.Logger.Info("Creating remote file", "file", name)
+	return s.apply("create remote file "+name, func() error {
+		s.creating.Lock()
+		defer s.creating.Unlock()
+		f, err := s.Remote.Create(ctx, name, src)
+		if err == nil {
+			s.uploaded(rfiles, name, f)
+		}
+		return err
+	})
+}
+
+// uploaded records f, the uploaded file name, in rfiles.
+func (s *Syncer) uploaded(rfiles map[string]*remote.File, name string, f *remote.File) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rfiles[name] = f
+	s.stats.uploaded++
+}
+
+// commit commits the changes coming from source, described by action, and
+// pushes them to the git remote if enabled. A failed push is only logged:
+// the commit is pushed with the next one.
+func (s *Syncer) commit(ctx context.Context, changes []string, source, action string) error {
+	return s.commitAt(ctx, changes, source, action, time.Now())
+}
+
+// commitAt is commit with when as the author date.
+func (s *Syncer) commitAt(ctx context.Context, changes []string, source, action string, when time.Time) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	var names []string
+	for _, c := range changes {
+		name, err := filepath.Rel(s.Repo.Path(), c)
+		if err != nil {
+			return err
+		}
+		names = append(names, filepath.ToSlash(name))
+	}
+	msg := s.commitMessage(source, action, names, when)
+	desc := fmt.Sprintf("commit %q: %s", msg, strings.Join(names, ", "))
+	if s.Push {
+		desc += " and push"
+	}
+	return s.apply(desc, func() error {
+		if err := s.Repo.CommitAt(changes, msg, when); err != nil {
+			return err
+		}
+		if s.state != nil {
+			for _, name := range names {
+				s.state.file(name).Source = source
+			}
+		}
+		s.stats.committed++
+		if s.Push {
+			if err := s.Repo.Push(ctx); err != nil {
+				s.Logger.Warn("Push failed", "err", err)
+			}
+		}
+		return nil
+	})
+}
+
+// followRenames moves files renamed or moved in the remote store, found by
+// their IDs, in repo and local dir, so that they keep their merge base
+// instead of being synced as a new file while the old one is restored.
+func (s *Syncer) followRenames(ctx context.Context, rfiles map[string]*remote.File) error {
+	byID := map[string]string{}
+	for name, fs := range s.state.Files {
+		if fs.ID != "" {
+			byID[fs.ID] = name
+		}
+	}
+
+	var renamed []string
+	for name, f := range rfiles {
+		old, ok := byID[f.ID]
+		if !ok || old == name {
+			continue
+		}
+		if _, ok := rfiles[old]; ok {
+			continue
+		}
+		if fs, ok := s.state.Files[name]; ok && fs.MD5 != "" {
+			continue
+		}
+		s.Logger.Info("Renamed remote file", "from", old, "to", name)
+		for _, dir := range []string{s.Repo.Path(), s.LocalDir} {
+			src := filepath.Join(dir, filepath.FromSlash(old))
+			dst := filepath.Join(dir, filepath.FromSlash(name))
+			if _, err := os.Stat(src); os.IsNotExist(err) {
+				continue
+			}
+			err := s.apply("rename "+old+" to "+name+" in "+s.dirName(dir), func() error {
+				for _, n := range []string{old, name} {
+					if err := s.touch(dir, n); err != nil {
+						return err
+					}
+				}
+				if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+					return err
+				}
+				return os.Rename(src, dst)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		renamed = append(renamed, old, name)
+	}
+	if len(renamed) == 0 {
+		return nil
+	}
+
+	if err := s.commit(ctx, paths(s.Repo.Path(), renamed), "remote", "Rename from mobile"); err != nil {
+		return err
+	}
+	// The last synced content is found under the new name from now on.
+	head, err := s.Repo.Head()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(renamed); i += 2 {
+		old, name := renamed[i], renamed[i+1]
+		s.state.Files[name] = s.state.Files[old]
+		delete(s.state.Files, old)
+		s.state.file(name).Commit = head
+	}
+	if err := s.state.save(); err != nil {
+		return err
+	}
+	if err := s.settle(renamed); err != nil {
+		return err
+	}
+	s.mirrorLater(renamed)
+	return nil
+}
+
+// initState loads the state on first use and takes repo copies as the
+// last synced versions of files synced for the first time.
+func (s *Syncer) initState() error {
+	if s.state == nil {
+		st, err := loadState(s.StateFile)
+		if err != nil {
+			return err
+		}
+		st.readonly = s.DryRun
+		s.state = st
+	}
+	local, err := s.localNames()
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, name := range local {
+		if _, ok := s.state.Files[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	return s.synced(names, nil)
+}
+
+// baseMD5 returns checksum of the last synced version of the file.
+func (s *Syncer) baseMD5(name string) string {
+	return s.state.file(name).MD5
+}
+
+// baseContent returns the last synced version of the file.
+func (s *Syncer) baseContent(name string) ([]byte, error) {
+	if rev := s.state.file(name).Commit; rev != "" {
+		content, err := s.Repo.Content(rev, name)
+		if err == nil {
+			return content, nil
+		}
+		s.Logger.Warn("Can't read merge base, using HEAD", "file", name, "err", err)
+	}
+	return s.Repo.HeadContent(name)
+}
+
+// synced records repo copies of files as the new merge base, along with
+// IDs and revisions of their remote copies in rfiles.
+func (s *Syncer) synced(names []string, rfiles map[string]*remote.File) error {
+	head, err := s.Repo.Head()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		sum, err := filemd5(filepath.Join(s.Repo.Path(), filepath.FromSlash(name)))
+		if err != nil {
+			return err
+		}
+		fs := s.state.file(name)
+		fs.recordVersion(sum)
+		fs.MD5 = sum
+		fs.Commit = head
+		fs.Synced = time.Now()
+		if f, ok := rfiles[name]; ok {
+			fs.ID = f.ID
+			fs.Revision = f.Revision
+			fs.Encrypted = f.Encrypted
+		}
+	}
+	s.dequeue(names)
+	if err := s.state.save(); err != nil {
+		return err
+	}
+	if err := s.settle(names); err != nil {
+		return err
+	}
+	s.mirrorLater(names)
+	return nil
+}
+
+// mergeFile combines remote and local versions of the file against the
+// last synced version and writes the result to repo and local dir. It
+// returns names of other files modified by the merge.
+func (s *Syncer) mergeFile(ctx context.Context, f *remote.File, name string) ([]string, error) {
+	content, err := s.Remote.Fetch(ctx, f)
+	if err != nil {
+		return nil, err
+	}
+	return s.mergeLocal(name, content, "remote")
+}
+
+// mergeLocal merges the version of the file coming from the source named
+// from with the local one against the last synced version, and writes the
+// result to repo and local dir. On conflict either the merged text with
+// conflict markers is kept or, with ConflictCopy and ConflictQuarantine,
+// the local version wins and the other one is saved next to it with a
+// .conflict suffix or quarantined. It returns names of other files
+// modified by the merge.
+func (s *Syncer) mergeLocal(name string, remote []byte, from string) ([]string, error) {
+	base, err := s.baseContent(name)
+	if err != nil {
+		return nil, err
+	}
+	local, err := s.readLocal(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if !s.DryRun {
+		s.stats.merged++
+	}
+	if s.Merge == MergeTodoTxt && (name == s.TodoFile || name == s.DoneFile) {
+		extra, err := s.mergeTasks(name, base, local, remote)
+		if err == nil {
+			s.notify(notify.EventRemote, name, "Merged "+from+" changes into "+name)
+		}
+		return extra, err
+	}
+
+	merged, conflict := merge.Lines(base, local, remote)
+	event, msg := notify.EventRemote, "Merged "+from+" changes into "+name
+	if conflict {
+		event = notify.EventConflict
+		switch s.Conflict {
+		case ConflictCopy:
+			copyname := filepath.Join(s.LocalDir, filepath.FromSlash(name)+".conflict")
+			s.Logger.Warn("Merge conflict, saving other version", "file", name, "from", from, "copy", copyname)
+			err := s.apply("write "+from+" version of "+name+" to "+copyname, func() error {
+				return fsutil.WriteFile(copyname, s.toLocal(remote), 0644)
+			})
+			if err != nil {
+				return nil, err
+			}
+			s.conflicted(name, nil)
+			merged = local
+			msg = "Conflicting edits of " + name + ", " + from + " version saved to " + copyname
+		case ConflictQuarantine:
+			path, err := s.quarantine(name, remote, from)
+			if err != nil {
+				return nil, err
+			}
+			s.Logger.Warn("Merge conflict, quarantined other version", "file", name, "from", from, "copy", path)
+			merged = local
+			msg = "Conflicting edits of " + name + ", " + from + " version quarantined to " + path
+		default:
+			s.conflicted(name, nil)
+			s.Logger.Warn("Merge conflict, conflict markers written", "file", name)
+			msg = "Conflicting edits of " + name + ", conflict markers written"
+		}
+	}
+	if err := s.write(name, merged); err != nil {
+		return nil, err
+	}
+	s.notify(event, name, msg)
+	return nil, nil
+}
+
+// mergeTasks merges todo.txt task lists. Completed tasks of TodoFile are
+// moved to DoneFile, which is returned as modified then.
+func (s *Syncer) mergeTasks(name string, base, local, remote []byte) ([]string, error) {
+	b, l, r := todotxt.ParseList(base), todotxt.ParseList(local), todotxt.ParseList(remote)
+	if name == s.DoneFile {
+		return nil, s.write(name, todotxt.Format(todotxt.MergeDone(b, l, r)))
+	}
+
+	tasks := todotxt.Merge(b, l, r)
+	open, completed := todotxt.Split(tasks)
+	if len(completed) == 0 || !s.matches(s.DoneFile) {
+		return nil, s.write(name, todotxt.Format(tasks))
+	}
+	if err := s.write(name, todotxt.Format(open)); err != nil {
+		return nil, err
+	}
+
+	done, err := ioutil.ReadFile(filepath.Join(s.Repo.Path(), filepath.FromSlash(s.DoneFile)))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	archived := map[string]bool{}
+	for _, t := range todotxt.ParseList(done) {
+		archived[t.String()] = true
+	}
+	if len(done) > 0 && done[len(done)-1] != '\n' {
+		done = append(done, '\n')
+	}
+	for _, t := range completed {
+		if !archived[t.String()] {
+			done = append(done, t.Line()+"\n"...)
+		}
+	}
+	s.Logger.Info("Moved completed tasks", "count", len(completed), "file", s.DoneFile)
+	return []string{s.DoneFile}, s.write(s.DoneFile, done)
+}
+
+// write saves content of the file to both repo and local dir.
+func (s *Syncer) write(name string, content []byte) error {
+	return s.apply(fmt.Sprintf("write %s (%d bytes) to repo and local dir", name, len(content)), func() error {
+		for _, dir := range []string{s.Repo.Path(), s.LocalDir} {
+			if err := s.writeFile(dir, name, content); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// download saves the remote file to the repo. It may run concurrently for
+// different files.
+func (s *Syncer) download(ctx context.Context, f *remote.File) error {
+	return s.apply("download "+f.Path+" to repo", func() error {
+		if err := s.touch(s.Repo.Path(), f.Path); err != nil {
+			return err
+		}
+		err := s.Remote.Download(ctx, f, filepath.Join(s.Repo.Path(), filepath.FromSlash(f.Path)))
+		if err == nil {
+			s.mu.Lock()
+			s.stats.downloaded++
+			s.mu.Unlock()
+		}
+		return err
+	})
+}
+
+// copy copies the file from directory from to directory to.
+func (s *Syncer) copy(from, to, name string) error {
+	return s.apply("copy "+name+" from "+s.dirName(from)+" to "+s.dirName(to), func() error {
+		content, err := s.readFile(from, name)
+		if err != nil {
+			return err
+		}
+		return s.writeFile(to, name, content)
+	})
+}
+
+func paths(dir string, names []string) []string {
+	var res []string
+	for _, name := range names {
+		res = append(res, filepath.Join(dir, filepath.FromSlash(name)))
+	}
+	return res
+}
+
+// filemd5 returns hex md5 of the file content or empty string if the file
+// doesn't exist.
+func filemd5(filename string) (string, error) {
+	f, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("can't open file %s: %w", filename, err)
+	}
+	hash := md5.Sum(f)
+	return hex.EncodeToString(hash[:]), nil
+}
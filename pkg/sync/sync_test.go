@@ -0,0 +1,249 @@
+package sync_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/mizhka/todosync/pkg/gitstore"
+	"github.com/mizhka/todosync/pkg/remote"
+	"github.com/mizhka/todosync/pkg/simulate"
+	"github.com/mizhka/todosync/pkg/sync"
+)
+
+// flakyStore fails the next upload with fail, if set.
+type flakyStore struct {
+	*simulate.Store
+	fail error
+}
+
+func (f *flakyStore) Upload(ctx context.Context, file *remote.File, src string) (*remote.File, error) {
+	if err := f.fail; err != nil {
+		f.fail = nil
+		return nil, err
+	}
+	return f.Store.Upload(ctx, file, src)
+}
+
+// setup returns a Syncer of a new repo and local dir with an in-memory
+// remote, keeping its state and conflicts in a temporary directory.
+func setup(t *testing.T) (*sync.Syncer, *flakyStore) {
+	t.Helper()
+	ctx := context.Background()
+	dir := t.TempDir()
+	repoDir, local := filepath.Join(dir, "repo"), filepath.Join(dir, "local")
+	if err := os.Mkdir(local, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := gitstore.Create(ctx, repoDir, "", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	repo, err := gitstore.Open(repoDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo.Author = gitstore.Author{Name: "todosync test", Email: "test@localhost"}
+	logger := slog.New(slog.NewTextHandler(ioutil.Discard, nil))
+	repo.Logger = logger
+
+	store := &flakyStore{Store: simulate.NewStore()}
+	s := sync.New(store, repo, local)
+	s.StateFile = filepath.Join(dir, "state.json")
+	s.ConflictDir = filepath.Join(dir, "conflicts")
+	s.Parallelism = 1
+	s.Logger = logger
+	return s, store
+}
+
+// cycle runs a sync cycle, failing the test if it does.
+func cycle(t *testing.T, s *sync.Syncer) {
+	t.Helper()
+	if err := s.Cycle(context.Background()); err != nil {
+		t.Fatalf("cycle: %v", err)
+	}
+}
+
+// writeLocal sets content of a file in the local dir.
+func writeLocal(t *testing.T, s *sync.Syncer, name, content string) {
+	t.Helper()
+	if err := ioutil.WriteFile(filepath.Join(s.LocalDir, filepath.FromSlash(name)), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readLocal returns content of a file in the local dir, or "<missing>".
+func readLocal(t *testing.T, s *sync.Syncer, name string) string {
+	t.Helper()
+	b, err := ioutil.ReadFile(filepath.Join(s.LocalDir, filepath.FromSlash(name)))
+	if os.IsNotExist(err) {
+		return "<missing>"
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// removeLocal deletes a file from the local dir.
+func removeLocal(t *testing.T, s *sync.Syncer, name string) {
+	t.Helper()
+	if err := os.Remove(filepath.Join(s.LocalDir, filepath.FromSlash(name))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// remoteContent returns content of a remote file, or "<missing>".
+func remoteContent(store *flakyStore, name string) string {
+	b, ok := store.Content(name)
+	if !ok {
+		return "<missing>"
+	}
+	return string(b)
+}
+
+// edit changes files of both sides after an initial sync of a.txt to
+// e.txt: b.txt remotely, c.txt locally, d.txt on both sides, e.txt
+// deleted remotely and f.txt created locally.
+func edit(t *testing.T, s *sync.Syncer, store *flakyStore) {
+	t.Helper()
+	s.Files = []string{"a.txt", "b.txt", "c.txt", "d.txt", "e.txt", "f.txt"}
+	for _, name := range []string{"a.txt", "b.txt", "c.txt", "d.txt", "e.txt"} {
+		store.Put(name, []byte("one\ntwo\nthree\n"))
+	}
+	cycle(t, s)
+	store.Put("b.txt", []byte("one\ntwo\nthree\nfour\n"))
+	writeLocal(t, s, "c.txt", "zero\none\ntwo\nthree\n")
+	store.Put("d.txt", []byte("one\ntwo\nthree\nfour\n"))
+	writeLocal(t, s, "d.txt", "zero\none\ntwo\nthree\n")
+	store.Remove("e.txt")
+	writeLocal(t, s, "f.txt", "new\n")
+}
+
+func TestStatus(t *testing.T) {
+	s, store := setup(t)
+	s.Deletions = sync.DeletePropagate
+	edit(t, s, store)
+	status, err := s.Status(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []sync.FileStatus{
+		{Name: "a.txt", Status: "in sync"},
+		{Name: "b.txt", Status: "changed remotely"},
+		{Name: "c.txt", Status: "changed locally"},
+		{Name: "d.txt", Status: "changed on both sides"},
+		{Name: "e.txt", Status: "deleted remotely"},
+		{Name: "f.txt", Status: "changed locally"},
+	}
+	if !reflect.DeepEqual(status, want) {
+		t.Errorf("got %v, want %v", status, want)
+	}
+
+	s.Deletions = sync.DeleteRestore
+	status, err = s.Status(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status[4] != (sync.FileStatus{Name: "e.txt", Status: "changed or deleted remotely, to be restored"}) {
+		t.Errorf("got %v with deletions restored", status[4])
+	}
+}
+
+func TestCycle(t *testing.T) {
+	s, store := setup(t)
+	s.Deletions = sync.DeletePropagate
+	edit(t, s, store)
+	cycle(t, s)
+	for _, f := range []struct{ name, content string }{
+		{"a.txt", "one\ntwo\nthree\n"},
+		{"b.txt", "one\ntwo\nthree\nfour\n"},
+		{"c.txt", "zero\none\ntwo\nthree\n"},
+		{"d.txt", "zero\none\ntwo\nthree\nfour\n"},
+		{"e.txt", "<missing>"},
+		{"f.txt", "new\n"},
+	} {
+		if got := readLocal(t, s, f.name); got != f.content {
+			t.Errorf("local %s is %q, want %q", f.name, got, f.content)
+		}
+		if got := remoteContent(store, f.name); got != f.content {
+			t.Errorf("remote %s is %q, want %q", f.name, got, f.content)
+		}
+	}
+}
+
+func TestRollback(t *testing.T) {
+	s, store := setup(t)
+	store.Put("todo.txt", []byte("one\ntwo\nthree\n"))
+	cycle(t, s)
+	store.Put("todo.txt", []byte("one\ntwo\nthree\nfour\n"))
+	writeLocal(t, s, "todo.txt", "zero\none\ntwo\nthree\n")
+
+	// The merge is committed and written locally, then fails to upload.
+	store.fail = errors.New("upload failed")
+	if err := s.Cycle(context.Background()); err == nil {
+		t.Fatal("cycle succeeded")
+	}
+	if got := readLocal(t, s, "todo.txt"); got != "zero\none\ntwo\nthree\n" {
+		t.Errorf("local todo.txt not rolled back: %q", got)
+	}
+	info, err := s.Inspect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info) != 1 || info[0].State() != "changed locally" {
+		t.Errorf("got %+v after rollback", info)
+	}
+
+	cycle(t, s)
+	want := "zero\none\ntwo\nthree\nfour\n"
+	if got := readLocal(t, s, "todo.txt"); got != want {
+		t.Errorf("local todo.txt is %q, want %q", got, want)
+	}
+	if got := remoteContent(store, "todo.txt"); got != want {
+		t.Errorf("remote todo.txt is %q, want %q", got, want)
+	}
+}
+
+func TestOfflineQueue(t *testing.T) {
+	s, store := setup(t)
+	store.Put("todo.txt", []byte("Buy milk\n"))
+	cycle(t, s)
+
+	store.SetOffline(true)
+	writeLocal(t, s, "todo.txt", "Buy oat milk\n")
+	writeLocal(t, s, "done.txt", "x Call mom\n")
+	for i := 0; i < 2; i++ {
+		if err := s.Cycle(context.Background()); !errors.Is(err, sync.ErrOffline) {
+			t.Fatalf("got %v, want ErrOffline", err)
+		}
+	}
+	if !s.Offline() {
+		t.Error("not reported offline")
+	}
+	info, err := s.Inspect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range info {
+		if f.State() != "committed, not synced" && f.State() != "not synced yet" {
+			t.Errorf("%s is %s while offline", f.Name, f.State())
+		}
+	}
+
+	store.SetOffline(false)
+	cycle(t, s)
+	if s.Offline() {
+		t.Error("still reported offline")
+	}
+	if got := remoteContent(store, "todo.txt"); got != "Buy oat milk\n" {
+		t.Errorf("remote todo.txt is %q", got)
+	}
+	if got := remoteContent(store, "done.txt"); got != "x Call mom\n" {
+		t.Errorf("remote done.txt is %q", got)
+	}
+}
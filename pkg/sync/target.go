@@ -0,0 +1,211 @@
+package sync
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/mizhka/todosync/pkg/fsutil"
+	"gopkg.in/yaml.v3"
+)
+
+// LocalTarget receives copies of synced files besides LocalDir, such as a
+// mirror directory shared by Syncthing or the notes of an Obsidian vault.
+// Targets are only written to: edits made there aren't synced back.
+type LocalTarget interface {
+	// Write replaces the file with the slash separated path by the last
+	// synced content.
+	Write(ctx context.Context, name string, content []byte) error
+	// Remove deletes the file, if it exists.
+	Remove(ctx context.Context, name string) error
+	// String names the target in logs.
+	String() string
+}
+
+// Transform rewrites content of the file with the slash separated path
+// before it's written to a DirTarget.
+type Transform func(ctx context.Context, name string, content []byte) ([]byte, error)
+
+// DirTarget mirrors files to Dir.
+type DirTarget struct {
+	Dir string
+	// Files, when set, select the files mirrored with patterns of the
+	// syntax of Syncer.Files.
+	Files []string
+	// Prefix is the slash separated path of the directory in Dir files go
+	// to. Ext, when set, replaces the extension of their names.
+	Prefix string
+	Ext    string
+	// Transforms rewrite content in order.
+	Transforms []Transform
+}
+
+// path returns the path of the file in Dir, or empty string if it isn't
+// mirrored.
+func (t *DirTarget) path(name string) string {
+	if len(t.Files) > 0 {
+		found := false
+		for _, pattern := range t.Files {
+			found = found || matchPattern(pattern, name)
+		}
+		if !found {
+			return ""
+		}
+	}
+	if t.Ext != "" {
+		name = strings.TrimSuffix(name, path.Ext(name)) + t.Ext
+	}
+	return filepath.Join(t.Dir, filepath.FromSlash(path.Join(t.Prefix, name)))
+}
+
+// Write implements LocalTarget. Files with the same content are left
+// alone, so that tools watching Dir aren't woken up for nothing.
+func (t *DirTarget) Write(ctx context.Context, name string, content []byte) error {
+	p := t.path(name)
+	if p == "" {
+		return nil
+	}
+	for _, tr := range t.Transforms {
+		var err error
+		if content, err = tr(ctx, name, content); err != nil {
+			return fmt.Errorf("can't transform %s: %w", name, err)
+		}
+	}
+	if old, err := ioutil.ReadFile(p); err == nil && bytes.Equal(old, content) {
+		return nil
+	}
+	return fsutil.WriteFile(p, content, 0644)
+}
+
+// Remove implements LocalTarget.
+func (t *DirTarget) Remove(ctx context.Context, name string) error {
+	p := t.path(name)
+	if p == "" {
+		return nil
+	}
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (t *DirTarget) String() string {
+	return t.Dir
+}
+
+// FrontMatter returns a Transform prepending YAML front matter with the
+// fields, as read by Obsidian and static site generators. The value
+// {{file}} is replaced by the slash separated path of the file.
+func FrontMatter(fields map[string]string) Transform {
+	return func(ctx context.Context, name string, content []byte) ([]byte, error) {
+		values := map[string]string{}
+		for k, v := range fields {
+			values[k] = strings.ReplaceAll(v, "{{file}}", name)
+		}
+		b, err := yaml.Marshal(values)
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		buf.WriteString("---\n")
+		buf.Write(b)
+		buf.WriteString("---\n")
+		buf.Write(content)
+		return buf.Bytes(), nil
+	}
+}
+
+// Command returns a Transform piping content through the command argv,
+// which finds the slash separated path of the file in $TODOSYNC_FILE.
+func Command(argv []string) Transform {
+	return func(ctx context.Context, name string, content []byte) ([]byte, error) {
+		cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+		cmd.Env = append(os.Environ(), "TODOSYNC_FILE="+name)
+		cmd.Stdin = bytes.NewReader(content)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			if msg := strings.TrimSpace(stderr.String()); msg != "" {
+				return nil, fmt.Errorf("%s: %w: %s", argv[0], err, msg)
+			}
+			return nil, fmt.Errorf("%s: %w", argv[0], err)
+		}
+		return out, nil
+	}
+}
+
+// mirrorLater records that files were synced or deleted, for mirror to
+// bring Targets up to date.
+func (s *Syncer) mirrorLater(names []string) {
+	if len(s.Targets) == 0 {
+		return
+	}
+	if s.unmirrored == nil {
+		s.unmirrored = map[string]bool{}
+	}
+	for _, name := range names {
+		s.unmirrored[name] = true
+	}
+}
+
+// mirror writes the last synced versions of files synced or deleted since
+// the last call to Targets, or all synced files on the first call. Failed
+// targets are only logged: they are secondary copies, retried with the
+// next cycle.
+func (s *Syncer) mirror(ctx context.Context) {
+	if len(s.Targets) == 0 || s.state == nil {
+		return
+	}
+	if !s.mirrored {
+		var names []string
+		for name := range s.state.Files {
+			names = append(names, name)
+		}
+		s.mirrorLater(names)
+		s.mirrored = true
+	}
+	var names []string
+	for name := range s.unmirrored {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		content, err := ioutil.ReadFile(filepath.Join(s.Repo.Path(), filepath.FromSlash(name)))
+		gone := os.IsNotExist(err)
+		if err != nil && !gone {
+			s.Logger.Warn("Can't read file to mirror", "file", name, "err", err)
+			continue
+		}
+		failed := false
+		for _, t := range s.Targets {
+			if gone {
+				err := s.apply("delete "+name+" from "+t.String(), func() error {
+					return t.Remove(ctx, name)
+				})
+				if err != nil {
+					s.Logger.Warn("Can't delete mirrored file", "file", name, "target", t.String(), "err", err)
+					failed = true
+				}
+				continue
+			}
+			err := s.apply("write "+name+" to "+t.String(), func() error {
+				return t.Write(ctx, name, content)
+			})
+			if err != nil {
+				s.Logger.Warn("Can't mirror file", "file", name, "target", t.String(), "err", err)
+				failed = true
+			}
+		}
+		if !failed {
+			delete(s.unmirrored, name)
+		}
+	}
+}
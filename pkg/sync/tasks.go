@@ -0,0 +1,199 @@
+package sync
+
+import (
+	"context"
+	"time"
+
+	"github.com/mizhka/todosync/pkg/notify"
+	"github.com/mizhka/todosync/pkg/tasks"
+	"github.com/mizhka/todosync/pkg/todotxt"
+)
+
+// syncTasks mirrors open tasks of TodoFile to the Tasks service. Tasks
+// completed or reopened on either side are updated on the other one, tasks
+// added to the service are appended to TodoFile, and items of tasks no
+// longer found in TodoFile or DoneFile are deleted. Modified task lists are
+// written to repo and local dir and committed, so the rest of the cycle
+// propagates them to the Remote like local edits.
+func (s *Syncer) syncTasks(ctx context.Context) error {
+	items, err := s.Tasks.List(ctx)
+	if err != nil {
+		return err
+	}
+	todo, err := s.readLocal(s.TodoFile)
+	if err != nil {
+		return err
+	}
+	var done []byte
+	if s.matches(s.DoneFile) {
+		if done, err = s.readLocal(s.DoneFile); err != nil {
+			return err
+		}
+	}
+	open, finished := todotxt.ParseList(todo), todotxt.ParseList(done)
+
+	byKey := map[string]*todotxt.Task{}
+	for _, t := range finished {
+		byKey[t.Key()] = t
+	}
+	for _, t := range open {
+		byKey[t.Key()] = t
+	}
+	inTodo := func(t *todotxt.Task) bool {
+		for _, o := range open {
+			if o == t {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Changes of the service go first, so that they are saved before
+	// the service is updated.
+	todoChanged, doneChanged := false, false
+	seen := map[string]bool{}
+	for _, item := range items {
+		seen[item.ID] = true
+		ts, ok := s.state.Tasks[item.ID]
+		if !ok {
+			t := todotxt.Parse(item.Title)
+			if _, ok := byKey[t.Key()]; !ok {
+				if item.Completed {
+					continue
+				}
+				s.Logger.Info("New task in task service", "task", item.Title)
+				s.notify(notify.EventRemote, s.TodoFile, "New task: "+item.Title)
+				open = append(open, t)
+				byKey[t.Key()] = t
+				todoChanged = true
+			}
+			// A task on both sides keeps its local status.
+			ts = &taskState{Key: t.Key(), Completed: item.Completed}
+			s.state.Tasks[item.ID] = ts
+		}
+
+		t, ok := byKey[ts.Key]
+		if !ok || item.Completed == ts.Completed || t.Completed != ts.Completed {
+			continue
+		}
+		s.Logger.Info("Task status changed in task service", "task", item.Title)
+		s.notify(notify.EventRemote, s.TodoFile, "Task status changed: "+item.Title)
+		complete(t, item.Completed)
+		switch {
+		case inTodo(t):
+			todoChanged = true
+		case !t.Completed:
+			// Reopened tasks move back from the list of finished tasks.
+			for i, f := range finished {
+				if f == t {
+					finished = append(finished[:i], finished[i+1:]...)
+					break
+				}
+			}
+			open = append(open, t)
+			todoChanged, doneChanged = true, true
+		default:
+			doneChanged = true
+		}
+		ts.Completed = t.Completed
+	}
+	for id := range s.state.Tasks {
+		if !seen[id] {
+			// Open tasks deleted in the service are added back below.
+			delete(s.state.Tasks, id)
+		}
+	}
+
+	var changed []string
+	if todoChanged {
+		if err := s.write(s.TodoFile, todotxt.Format(open)); err != nil {
+			return err
+		}
+		changed = append(changed, s.TodoFile)
+	}
+	if doneChanged {
+		if err := s.write(s.DoneFile, todotxt.Format(finished)); err != nil {
+			return err
+		}
+		changed = append(changed, s.DoneFile)
+	}
+	if len(changed) > 0 {
+		if err := s.commit(ctx, paths(s.Repo.Path(), changed), "tasks", "Sync with task service"); err != nil {
+			return err
+		}
+	}
+	if err := s.state.save(); err != nil {
+		return err
+	}
+	if err := s.settle(changed); err != nil {
+		return err
+	}
+
+	// Local changes go to the service.
+	linked := map[string]bool{}
+	for _, item := range items {
+		ts, ok := s.state.Tasks[item.ID]
+		if !ok {
+			continue
+		}
+		t, ok := byKey[ts.Key]
+		if !ok || linked[ts.Key] {
+			s.Logger.Info("Deleting task from task service", "task", item.Title)
+			id := item.ID
+			err := s.apply("delete task "+item.Title+" from task service", func() error {
+				return s.Tasks.Delete(ctx, id)
+			})
+			if err != nil {
+				return err
+			}
+			delete(s.state.Tasks, item.ID)
+		} else {
+			linked[ts.Key] = true
+			if t.Completed != item.Completed {
+				s.Logger.Info("Updating task status in task service", "task", item.Title)
+				item.Completed = t.Completed
+				err := s.apply("update status of task "+item.Title+" in task service", func() error {
+					return s.Tasks.Update(ctx, item)
+				})
+				if err != nil {
+					return err
+				}
+			}
+			ts.Completed = t.Completed
+		}
+		if err := s.state.save(); err != nil {
+			return err
+		}
+	}
+	for _, t := range open {
+		if t.Completed || linked[t.Key()] {
+			continue
+		}
+		key := t.Key()
+		s.Logger.Info("Adding task to task service", "task", key)
+		err := s.apply("add task "+key+" to task service", func() error {
+			item, err := s.Tasks.Insert(ctx, &tasks.Item{Title: key})
+			if err == nil {
+				s.state.Tasks[item.ID] = &taskState{Key: key}
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		linked[key] = true
+		if err := s.state.save(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// complete marks the task completed today or reopens it.
+func complete(t *todotxt.Task, completed bool) {
+	t.Completed = completed
+	t.CompletionDate = time.Time{}
+	if completed {
+		t.CompletionDate = time.Now()
+	}
+}
@@ -0,0 +1,177 @@
+package sync
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	gosync "sync"
+	"time"
+
+	"github.com/mizhka/todosync/pkg/fsutil"
+)
+
+// txn tracks files a cycle changes in the repo and LocalDir until they are
+// settled, recorded as synced or committed along with the state that goes
+// with them. Each file is written to a temporary file renamed into place,
+// so it's either old or new, but a cycle failing between steps, such as
+// between downloading files and committing them or between committing a
+// merge and uploading it, would otherwise leave the repo and LocalDir half
+// updated, and the next cycle would take the leftovers for local changes.
+type txn struct {
+	mu gosync.Mutex
+	// repo lists repo files changed, restored from HEAD on rollback.
+	repo map[string]bool
+	// local holds previous content of LocalDir files changed, nil for
+	// those which didn't exist.
+	local map[string][]byte
+	// conflicts and conflictLog hold versions quarantined and times of
+	// merges with conflicting edits of files not settled yet. They are
+	// recorded along with the files, or dropped on rollback together with
+	// the quarantined copies, so that a cycle merging the files again
+	// doesn't record them twice.
+	conflicts   map[string][]*Conflict
+	conflictLog map[string][]time.Time
+}
+
+// begin starts tracking changes of the cycle.
+func (s *Syncer) begin() {
+	s.txn = &txn{
+		repo:        map[string]bool{},
+		local:       map[string][]byte{},
+		conflicts:   map[string][]*Conflict{},
+		conflictLog: map[string][]time.Time{},
+	}
+}
+
+// touch records that the file in dir, the repo or LocalDir, is about to
+// be changed. It may run concurrently for different files. Outside cycles
+// it does nothing.
+func (s *Syncer) touch(dir, name string) error {
+	t := s.txn
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch dir {
+	case s.Repo.Path():
+		t.repo[name] = true
+	case s.LocalDir:
+		if _, ok := t.local[name]; ok {
+			return nil
+		}
+		content, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		t.local[name] = content
+	}
+	return nil
+}
+
+// settle stops tracking the files, whose changes are complete, and records
+// their conflicts in the state.
+func (s *Syncer) settle(names []string) error {
+	t := s.txn
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	recorded := false
+	for _, name := range names {
+		delete(t.repo, name)
+		delete(t.local, name)
+		for _, c := range t.conflicts[name] {
+			c.ID = s.state.nextConflictID()
+			s.state.Conflicts = append(s.state.Conflicts, c)
+			recorded = true
+		}
+		for _, tm := range t.conflictLog[name] {
+			s.state.logConflict(tm)
+			recorded = true
+		}
+		delete(t.conflicts, name)
+		delete(t.conflictLog, name)
+	}
+	t.mu.Unlock()
+	if !recorded {
+		return nil
+	}
+	return s.state.save()
+}
+
+// conflicted notes a merge of the file with conflicting edits, and the
+// version quarantined for it unless c is nil, to be recorded once the file
+// is settled. Outside cycles they are recorded right away.
+func (s *Syncer) conflicted(name string, c *Conflict) {
+	t := s.txn
+	if t == nil {
+		if c != nil {
+			c.ID = s.state.nextConflictID()
+			s.state.Conflicts = append(s.state.Conflicts, c)
+		}
+		s.state.logConflict(time.Now())
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if c != nil {
+		t.conflicts[name] = append(t.conflicts[name], c)
+	}
+	t.conflictLog[name] = append(t.conflictLog[name], time.Now())
+}
+
+// rollback ends tracking after a failed cycle, putting files changed but
+// not settled back as they were: repo files to their content at HEAD,
+// LocalDir files to their content before the cycle, and deleting versions
+// quarantined for them. Commits made by the
+// cycle stay, as the versions they record were in the repo; the next cycle
+// finds the same changes again and completes them.
+func (s *Syncer) rollback() {
+	t := s.txn
+	s.txn = nil
+	if t == nil {
+		return
+	}
+	var quarantined []string
+	for _, cs := range t.conflicts {
+		for _, c := range cs {
+			quarantined = append(quarantined, c.Path)
+		}
+	}
+	if len(t.repo)+len(t.local)+len(quarantined) == 0 {
+		return
+	}
+	var repo, local []string
+	for name := range t.repo {
+		repo = append(repo, name)
+	}
+	for name := range t.local {
+		local = append(local, name)
+	}
+	sort.Strings(repo)
+	sort.Strings(local)
+
+	errs := []error{s.Repo.Restore(repo)}
+	for _, name := range local {
+		path := filepath.Join(s.LocalDir, filepath.FromSlash(name))
+		if content := t.local[name]; content != nil {
+			errs = append(errs, fsutil.WriteFile(path, content, 0644))
+		} else if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+		}
+	}
+	sort.Strings(quarantined)
+	for _, path := range quarantined {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		s.Logger.Error("Can't roll back unfinished changes", "repo", repo, "local", local, "quarantined", quarantined, "err", err)
+		return
+	}
+	s.Logger.Warn("Rolled back unfinished changes", "repo", repo, "local", local, "quarantined", quarantined)
+}
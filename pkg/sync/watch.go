@@ -0,0 +1,105 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// channelTTL is the lifetime requested for Drive push notification channels.
+const channelTTL = 24 * time.Hour
+
+// webhook is a running push notification subscription.
+type webhook struct {
+	srv     *http.Server
+	expires time.Time
+}
+
+// startWebhook serves Drive push notifications on Listen and subscribes
+// Webhook to the changes feed.
+func (s *Syncer) startWebhook(ctx context.Context) (*webhook, error) {
+	if s.Listen == "" {
+		return nil, errors.New("no listen address for webhook")
+	}
+	ln, err := net.Listen("tcp", s.Listen)
+	if err != nil {
+		return nil, err
+	}
+	srv := &http.Server{Handler: s.Feed}
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			s.Logger.Error("Webhook server stopped", "err", err)
+		}
+	}()
+
+	expires, err := s.Feed.Watch(ctx, s.Webhook, channelTTL)
+	if err != nil {
+		srv.Close()
+		return nil, err
+	}
+	s.Logger.Info("Watching drive changes", "webhook", s.Webhook, "until", expires)
+	return &webhook{srv: srv, expires: expires}, nil
+}
+
+// renew re-subscribes the webhook shortly before the channel expires.
+func (s *Syncer) renew(ctx context.Context, w *webhook) error {
+	if time.Until(w.expires) > time.Hour {
+		return nil
+	}
+	expires, err := s.Feed.Watch(ctx, s.Webhook, channelTTL)
+	if err != nil {
+		return err
+	}
+	w.expires = expires
+	return nil
+}
+
+// stopWebhook unsubscribes the webhook. It runs on shutdown too, so it
+// doesn't depend on the Run context.
+func (s *Syncer) stopWebhook(w *webhook) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s.Feed.Stop(ctx); err != nil {
+		s.Logger.Warn("Can't stop push notifications", "err", err)
+	}
+	w.srv.Close()
+}
+
+// localChanged reports whether any local file differs from its repo copy
+// or a synced file was deleted.
+func (s *Syncer) localChanged() (bool, error) {
+	names, err := s.localNames()
+	if err != nil {
+		return false, err
+	}
+	for _, name := range names {
+		localmd5, err := s.localMD5(name)
+		if err != nil {
+			return false, err
+		}
+		repomd5, err := filemd5(filepath.Join(s.Repo.Path(), filepath.FromSlash(name)))
+		if err != nil {
+			return false, err
+		}
+		if localmd5 != "" && localmd5 != repomd5 {
+			return true, nil
+		}
+	}
+	if s.state == nil {
+		return false, nil
+	}
+	for name, fs := range s.state.Files {
+		if fs.MD5 == "" || !s.matches(name) {
+			continue
+		}
+		_, err := os.Stat(filepath.Join(s.LocalDir, filepath.FromSlash(name)))
+		if os.IsNotExist(err) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
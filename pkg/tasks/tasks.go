@@ -0,0 +1,26 @@
+// Package tasks defines task services, such as Google Tasks, mirroring the
+// todo.txt task list.
+package tasks
+
+import "context"
+
+// Item is a task in a task service.
+type Item struct {
+	// ID identifies the item in the service.
+	ID string
+	// Title is the task text.
+	Title     string
+	Completed bool
+}
+
+// Provider is a task list of a task service.
+type Provider interface {
+	// List returns all items of the list, including completed ones.
+	List(ctx context.Context) ([]*Item, error)
+	// Insert adds a new item and returns it with its ID.
+	Insert(ctx context.Context, item *Item) (*Item, error)
+	// Update saves title and status of the item.
+	Update(ctx context.Context, item *Item) error
+	// Delete removes the item with the given ID.
+	Delete(ctx context.Context, id string) error
+}
@@ -0,0 +1,230 @@
+package todotxt
+
+import (
+	"strings"
+)
+
+// Merge reconciles a task list changed concurrently in local and remote
+// against their common base. Tasks are matched by identity, so reordering
+// doesn't conflict. When both sides changed the same task their changes
+// are combined field by field: a task completed on one side and edited on
+// the other becomes a single completed task with the edited text. Deleting
+// a task loses to editing it. If both sides rewrote the text differently,
+// both versions are kept. A task added on both sides is kept once, while
+// duplicates within a side are kept as they are.
+func Merge(base, local, remote []*Task) []*Task {
+	lm, _ := pair(base, local)
+	rm, rnew := pair(base, remote)
+
+	var out []*Task
+	// Local order wins, remote only tasks go to the end.
+	inBase := make(map[int]int, len(lm))
+	for bi, li := range lm {
+		if li >= 0 {
+			inBase[li] = bi
+		}
+	}
+	added := map[string]int{}
+	for li, l := range local {
+		bi, ok := inBase[li]
+		if !ok {
+			added[l.String()]++
+			out = append(out, l)
+			continue
+		}
+		var r *Task
+		if rm[bi] >= 0 {
+			r = remote[rm[bi]]
+		}
+		out = append(out, combine(base[bi], l, r)...)
+	}
+	for bi, li := range lm {
+		if li < 0 && rm[bi] >= 0 {
+			// Deleted locally: keep only if edited remotely.
+			if r := remote[rm[bi]]; r.String() != base[bi].String() {
+				out = append(out, r)
+			}
+		}
+	}
+	for _, ri := range rnew {
+		r := remote[ri]
+		if added[r.String()] > 0 {
+			added[r.String()]--
+			continue
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+// MergeDone reconciles lists of finished tasks such as done.txt, which are
+// mostly appended to: tasks added on either side are kept, tasks removed
+// on one side are dropped. Lines are counted, so that one added on both
+// sides is kept once and repeated ones stay repeated.
+func MergeDone(base, local, remote []*Task) []*Task {
+	nb, nl, nr := count(base), count(local), count(remote)
+	keep := map[string]int{}
+	for _, n := range []map[string]int{nb, nl, nr} {
+		for s := range n {
+			b, l, r := nb[s], nl[s], nr[s]
+			switch {
+			case l == b:
+				keep[s] = r
+			case r == b:
+				keep[s] = l
+			case l > b && r > b:
+				keep[s] = max(l, r)
+			case l < b && r < b:
+				keep[s] = min(l, r)
+			default:
+				keep[s] = l + r - b
+			}
+		}
+	}
+
+	var out []*Task
+	for _, side := range [][]*Task{local, remote} {
+		for _, t := range side {
+			if s := t.String(); keep[s] > 0 {
+				keep[s]--
+				out = append(out, t)
+			}
+		}
+	}
+	return out
+}
+
+// Split separates completed tasks from open ones.
+func Split(tasks []*Task) (open, completed []*Task) {
+	for _, t := range tasks {
+		if t.Completed {
+			completed = append(completed, t)
+		} else {
+			open = append(open, t)
+		}
+	}
+	return open, completed
+}
+
+// combine merges concurrent changes of a base task. A nil side deleted it.
+func combine(b, l, r *Task) []*Task {
+	lChanged := l.String() != b.String()
+	if r == nil {
+		if lChanged {
+			return []*Task{l}
+		}
+		return nil
+	}
+	rChanged := r.String() != b.String()
+	switch {
+	case !rChanged:
+		return []*Task{l}
+	case !lChanged:
+		return []*Task{r}
+	}
+
+	if l.Text != b.Text && r.Text != b.Text && l.Text != r.Text {
+		return []*Task{l, r}
+	}
+
+	// Every field is taken from the side which changed it.
+	text := l.Text
+	if text == b.Text {
+		text = r.Text
+	}
+	t := Parse(text)
+	t.Priority = l.Priority
+	if l.Priority == b.Priority {
+		t.Priority = r.Priority
+	}
+	t.CreationDate = l.CreationDate
+	if l.CreationDate.Equal(b.CreationDate) {
+		t.CreationDate = r.CreationDate
+	}
+	t.Completed, t.CompletionDate = l.Completed, l.CompletionDate
+	if l.Completed == b.Completed {
+		t.Completed, t.CompletionDate = r.Completed, r.CompletionDate
+	}
+	return []*Task{t}
+}
+
+// pair matches tasks of a side to base tasks: first by identity, then
+// edited tasks by similarity of their words. It returns for every base task
+// the index of its counterpart or -1 when it was deleted, and indexes of
+// tasks added on the side.
+func pair(base, side []*Task) ([]int, []int) {
+	m := make([]int, len(base))
+	used := make([]bool, len(side))
+	byKey := map[string][]int{}
+	for i, t := range side {
+		byKey[t.Key()] = append(byKey[t.Key()], i)
+	}
+	for bi, b := range base {
+		m[bi] = -1
+		if idx := byKey[b.Key()]; len(idx) > 0 {
+			m[bi] = idx[0]
+			used[idx[0]] = true
+			byKey[b.Key()] = idx[1:]
+		}
+	}
+
+	for bi, b := range base {
+		if m[bi] >= 0 {
+			continue
+		}
+		best, score := -1, 0.5
+		for si, t := range side {
+			if used[si] {
+				continue
+			}
+			if s := similarity(b.Text, t.Text); s >= score {
+				best, score = si, s
+			}
+		}
+		if best >= 0 {
+			m[bi] = best
+			used[best] = true
+		}
+	}
+
+	var added []int
+	for si := range side {
+		if !used[si] {
+			added = append(added, si)
+		}
+	}
+	return m, added
+}
+
+// similarity is the Jaccard index of the word sets of a and b.
+func similarity(a, b string) float64 {
+	wa, wb := words(a), words(b)
+	common := 0
+	for w := range wa {
+		if wb[w] {
+			common++
+		}
+	}
+	total := len(wa) + len(wb) - common
+	if total == 0 {
+		return 1
+	}
+	return float64(common) / float64(total)
+}
+
+func words(s string) map[string]bool {
+	res := map[string]bool{}
+	for _, w := range strings.Fields(strings.ToLower(s)) {
+		res[w] = true
+	}
+	return res
+}
+
+// count returns how many times each task is listed.
+func count(tasks []*Task) map[string]int {
+	res := make(map[string]int, len(tasks))
+	for _, t := range tasks {
+		res[t.String()]++
+	}
+	return res
+}
@@ -0,0 +1,54 @@
+package todotxt
+
+import (
+	"testing"
+)
+
+func TestMerge(t *testing.T) {
+	tests := []struct {
+		name                string
+		base, local, remote string
+		want                string
+	}{
+		{"unchanged", "(A)  Call mom\nBuy milk\n", "(A)  Call mom\nBuy milk\n", "(A)  Call mom\nBuy milk\n", "(A)  Call mom\nBuy milk\n"},
+		{"both add", "Buy milk\n", "Buy milk\nPay rent\n", "Buy milk\nWater plants\n", "Buy milk\nPay rent\nWater plants\n"},
+		{"same task added on both sides", "Buy milk\n", "Buy milk\nPay rent\n", "Pay rent\nBuy milk\n", "Buy milk\nPay rent\n"},
+		{"duplicates kept", "Buy milk\nBuy milk\n", "Buy milk\nBuy milk\nCall mom\n", "Buy milk\nBuy milk\n", "Buy milk\nBuy milk\nCall mom\n"},
+		{"duplicate added", "Buy milk\n", "Buy milk\nBuy milk\n", "Buy milk\n", "Buy milk\nBuy milk\n"},
+		{"reordered", "Buy milk\nCall mom\n", "Call mom\nBuy milk\n", "Buy milk\n(A) Call mom\n", "(A) Call mom\nBuy milk\n"},
+		{"completed and edited", "Buy milk\n", "x Buy milk\n", "Buy oat milk\n", "x Buy oat milk\n"},
+		{"priority and completion", "(B) Call mom\n", "(A) Call mom\n", "x Call mom\n", "x Call mom\n"},
+		{"rewritten on both sides", "Buy milk\n", "Buy oat milk\n", "Buy soy milk\n", "Buy oat milk\nBuy soy milk\n"},
+		{"deleted locally", "Buy milk\nCall mom\n", "Call mom\n", "Buy milk\nCall mom\n", "Call mom\n"},
+		{"deleted locally, edited remotely", "Buy milk\nCall mom\n", "Call mom\n", "(A) Buy milk\nCall mom\n", "Call mom\n(A) Buy milk\n"},
+		{"remote spacing", "Buy milk\n", "Buy milk\n", "Buy  milk\n", "Buy milk\n"},
+	}
+	for _, tt := range tests {
+		got := Format(Merge(ParseList([]byte(tt.base)), ParseList([]byte(tt.local)), ParseList([]byte(tt.remote))))
+		if string(got) != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMergeDone(t *testing.T) {
+	tests := []struct {
+		name                string
+		base, local, remote string
+		want                string
+	}{
+		{"both append", "x a\n", "x a\nx b\n", "x a\nx c\n", "x a\nx b\nx c\n"},
+		{"same appended on both sides", "x a\n", "x a\nx b\n", "x a\nx b\n", "x a\nx b\n"},
+		{"removed remotely", "x a\nx b\n", "x a\nx b\nx c\n", "x b\n", "x b\nx c\n"},
+		{"removed locally", "x a\nx b\n", "x a\n", "x a\nx b\nx c\n", "x a\nx c\n"},
+		{"repeated kept", "x a\nx a\n", "x a\nx a\nx b\n", "x a\nx a\n", "x a\nx a\nx b\n"},
+		{"repeated appended", "x a\n", "x a\nx a\n", "x a\n", "x a\nx a\n"},
+		{"spacing kept", "x  a\n", "x  a\nx b\n", "x  a\n", "x  a\nx b\n"},
+	}
+	for _, tt := range tests {
+		got := Format(MergeDone(ParseList([]byte(tt.base)), ParseList([]byte(tt.local)), ParseList([]byte(tt.remote))))
+		if string(got) != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
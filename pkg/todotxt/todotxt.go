@@ -0,0 +1,158 @@
+// Package todotxt parses and formats task lists in the todo.txt format
+// (https://github.com/todotxt/todo.txt).
+package todotxt
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"time"
+)
+
+// DateLayout is the date format used in todo.txt files.
+const DateLayout = "2006-01-02"
+
+// Task is a single line of a todo.txt file.
+type Task struct {
+	Completed      bool
+	CompletionDate time.Time
+	// Priority is an upper case letter, or 0 for tasks without priority.
+	Priority     byte
+	CreationDate time.Time
+	// Text is the description including projects, contexts and tags.
+	Text string
+
+	Projects []string
+	Contexts []string
+	// Tags holds key:value pairs of the description such as due:2024-06-01.
+	Tags map[string]string
+
+	// line is the line the task was parsed from, written back as it is
+	// while the task formats as it did when parsed.
+	line, parsed string
+}
+
+// Parse parses a single todo.txt line.
+func Parse(line string) *Task {
+	t := &Task{}
+	rest := strings.TrimSpace(line)
+
+	if strings.HasPrefix(rest, "x ") {
+		t.Completed = true
+		rest = strings.TrimLeft(rest[2:], " ")
+		if d, r, ok := cutDate(rest); ok {
+			t.CompletionDate = d
+			rest = r
+		}
+	} else if len(rest) >= 4 && rest[0] == '(' && rest[1] >= 'A' && rest[1] <= 'Z' &&
+		rest[2] == ')' && rest[3] == ' ' {
+		t.Priority = rest[1]
+		rest = strings.TrimLeft(rest[4:], " ")
+	}
+	if d, r, ok := cutDate(rest); ok {
+		t.CreationDate = d
+		rest = r
+	}
+
+	t.Text = strings.Join(strings.Fields(rest), " ")
+	for _, word := range strings.Fields(t.Text) {
+		switch {
+		case len(word) > 1 && word[0] == '+':
+			t.Projects = append(t.Projects, word[1:])
+		case len(word) > 1 && word[0] == '@':
+			t.Contexts = append(t.Contexts, word[1:])
+		default:
+			if k, v, ok := cutTag(word); ok {
+				if t.Tags == nil {
+					t.Tags = map[string]string{}
+				}
+				t.Tags[k] = v
+			}
+		}
+	}
+	t.line, t.parsed = line, t.String()
+	return t
+}
+
+// cutDate splits a leading date off s.
+func cutDate(s string) (time.Time, string, bool) {
+	if len(s) < len(DateLayout) || (len(s) > len(DateLayout) && s[len(DateLayout)] != ' ') {
+		return time.Time{}, s, false
+	}
+	d, err := time.Parse(DateLayout, s[:len(DateLayout)])
+	if err != nil {
+		return time.Time{}, s, false
+	}
+	return d, strings.TrimLeft(s[len(DateLayout):], " "), true
+}
+
+// cutTag recognizes key:value words. URLs such as http://x aren't tags.
+func cutTag(word string) (string, string, bool) {
+	i := strings.IndexByte(word, ':')
+	if i <= 0 || i == len(word)-1 || strings.HasPrefix(word[i+1:], "//") {
+		return "", "", false
+	}
+	return word[:i], word[i+1:], true
+}
+
+// String formats the task as a todo.txt line without line terminator.
+func (t *Task) String() string {
+	var b strings.Builder
+	if t.Completed {
+		b.WriteString("x ")
+		if !t.CompletionDate.IsZero() {
+			b.WriteString(t.CompletionDate.Format(DateLayout))
+			b.WriteByte(' ')
+		}
+	} else if t.Priority != 0 {
+		b.WriteByte('(')
+		b.WriteByte(t.Priority)
+		b.WriteString(") ")
+	}
+	if !t.CreationDate.IsZero() {
+		b.WriteString(t.CreationDate.Format(DateLayout))
+		b.WriteByte(' ')
+	}
+	b.WriteString(t.Text)
+	return b.String()
+}
+
+// Line returns the line the task was parsed from as it was, with spacing
+// String normalizes, unless the task changed since. Otherwise it returns
+// String.
+func (t *Task) Line() string {
+	if s := t.String(); t.line == "" || s != t.parsed {
+		return s
+	}
+	return t.line
+}
+
+// Key identifies the task regardless of its priority, dates and completion.
+func (t *Task) Key() string {
+	return t.Text
+}
+
+// ParseList parses a todo.txt file skipping blank lines.
+func ParseList(data []byte) []*Task {
+	var tasks []*Task
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	sc.Buffer(nil, 1024*1024)
+	for sc.Scan() {
+		if strings.TrimSpace(sc.Text()) == "" {
+			continue
+		}
+		tasks = append(tasks, Parse(sc.Text()))
+	}
+	return tasks
+}
+
+// Format formats tasks as a todo.txt file. Lines of tasks unchanged since
+// they were parsed are written as they were read.
+func Format(tasks []*Task) []byte {
+	var b bytes.Buffer
+	for _, t := range tasks {
+		b.WriteString(t.Line())
+		b.WriteByte('\n')
+	}
+	return b.Bytes()
+}
@@ -0,0 +1,49 @@
+package todotxt
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	due := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		line string
+		want Task
+	}{
+		{"Buy milk", Task{Text: "Buy milk"}},
+		{"(A) Call mom +family @phone", Task{Priority: 'A', Text: "Call mom +family @phone", Projects: []string{"family"}, Contexts: []string{"phone"}}},
+		{"(B) 2024-06-01 Pay rent due:2024-06-01", Task{Priority: 'B', CreationDate: due, Text: "Pay rent due:2024-06-01", Tags: map[string]string{"due": "2024-06-01"}}},
+		{"x 2024-06-01 2024-06-01 Done", Task{Completed: true, CompletionDate: due, CreationDate: due, Text: "Done"}},
+		{"Read http://example.com", Task{Text: "Read http://example.com"}},
+		{"(a) lower case isn't a priority", Task{Text: "(a) lower case isn't a priority"}},
+	}
+	for _, tt := range tests {
+		got := Parse(tt.line)
+		got.line, got.parsed = "", ""
+		if !reflect.DeepEqual(*got, tt.want) {
+			t.Errorf("Parse(%q) = %+v, want %+v", tt.line, *got, tt.want)
+		}
+		if s := Parse(tt.line).String(); s != tt.line {
+			t.Errorf("Parse(%q).String() = %q", tt.line, s)
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	data := "(A)  Call   mom\n\nx 2024-06-01 Buy milk \nPay rent\n"
+	tasks := ParseList([]byte(data))
+	if len(tasks) != 3 {
+		t.Fatalf("got %d tasks, want 3", len(tasks))
+	}
+	if s := tasks[0].String(); s != "(A) Call mom" {
+		t.Errorf("String() = %q", s)
+	}
+	tasks[2].Priority = 'C'
+	// Blank lines are dropped, unchanged tasks are written as they were.
+	want := "(A)  Call   mom\nx 2024-06-01 Buy milk \n(C) Pay rent\n"
+	if got := Format(tasks); string(got) != want {
+		t.Errorf("Format() = %q, want %q", got, want)
+	}
+}
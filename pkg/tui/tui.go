@@ -0,0 +1,397 @@
+// Package tui shows sync activity of a profile live in the terminal: a
+// table of synced files and how their copies compare, and a scrolling log
+// of events.
+package tui
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	gosync "sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mizhka/todosync/pkg/sync"
+	"golang.org/x/term"
+)
+
+// maxEvents is the number of log lines kept for scrolling.
+const maxEvents = 1000
+
+// refresh is the delay between updates of the file table.
+const refresh = time.Second
+
+// ANSI escape sequences.
+const (
+	altScreen  = "\x1b[?1049h"
+	mainScreen = "\x1b[?1049l"
+	hideCursor = "\x1b[?25l"
+	showCursor = "\x1b[?25h"
+	home       = "\x1b[H"
+	clearLine  = "\x1b[K"
+	clearBelow = "\x1b[J"
+	reverse    = "\x1b[7m"
+	bold       = "\x1b[1m"
+	red        = "\x1b[31m"
+	green      = "\x1b[32m"
+	yellow     = "\x1b[33m"
+	reset      = "\x1b[0m"
+)
+
+// Keys read from the terminal.
+const (
+	keyUp = iota + 256
+	keyDown
+	keyPageUp
+	keyPageDown
+	keyEscape
+)
+
+// UI displays the activity of Syncer, which is run separately.
+type UI struct {
+	Syncer *sync.Syncer
+	// Title names the profile.
+	Title string
+
+	mu     gosync.Mutex
+	files  []sync.FileInfo
+	err    error
+	events []string
+	// scroll is the number of lines the event log or diff is scrolled back
+	// or down.
+	scroll   int
+	selected int
+	// diff of the file diffName is shown instead of the events when set.
+	diff     []string
+	diffName string
+	changed  chan struct{}
+}
+
+// New returns a UI for s.
+func New(s *sync.Syncer, title string) *UI {
+	return &UI{Syncer: s, Title: title, changed: make(chan struct{}, 1)}
+}
+
+// Log returns a writer adding each line written to the event log, meant
+// for the handler of the Syncer's logger.
+func (u *UI) Log() io.Writer {
+	return logWriter{u}
+}
+
+type logWriter struct{ u *UI }
+
+func (w logWriter) Write(p []byte) (int, error) {
+	w.u.mu.Lock()
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		w.u.events = append(w.u.events, line)
+	}
+	if n := len(w.u.events) - maxEvents; n > 0 {
+		w.u.events = append([]string(nil), w.u.events[n:]...)
+	}
+	// The view stays put while scrolled back.
+	if w.u.scroll > 0 && w.u.diff == nil {
+		w.u.scroll++
+	}
+	w.u.mu.Unlock()
+	w.u.redraw()
+	return len(p), nil
+}
+
+// redraw asks Run to draw the screen again.
+func (u *UI) redraw() {
+	select {
+	case u.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Run takes over the terminal until the user quits or ctx is cancelled.
+func (u *UI) Run(ctx context.Context) error {
+	in, out := os.Stdin, os.Stdout
+	if !term.IsTerminal(int(in.Fd())) || !term.IsTerminal(int(out.Fd())) {
+		return fmt.Errorf("tui needs a terminal")
+	}
+	old, err := term.MakeRaw(int(in.Fd()))
+	if err != nil {
+		return err
+	}
+	defer term.Restore(int(in.Fd()), old)
+	fmt.Fprint(out, altScreen+hideCursor)
+	defer fmt.Fprint(out, showCursor+mainScreen)
+
+	keys := make(chan int)
+	go readKeys(in, keys)
+	ticker := time.NewTicker(refresh)
+	defer ticker.Stop()
+	u.inspect()
+	for {
+		u.draw(out)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-u.changed:
+		case <-ticker.C:
+			u.inspect()
+		case k, ok := <-keys:
+			if !ok || !u.key(k) {
+				return nil
+			}
+		}
+	}
+}
+
+// inspect updates the file table.
+func (u *UI) inspect() {
+	files, err := u.Syncer.Inspect()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.err = err
+	if err != nil {
+		return
+	}
+	u.files = files
+	if u.selected >= len(files) {
+		u.selected = len(files) - 1
+	}
+	if u.selected < 0 {
+		u.selected = 0
+	}
+}
+
+// key handles a key press and reports whether to go on.
+func (u *UI) key(k int) bool {
+	// Syncer methods log, which needs the lock.
+	switch k {
+	case 'q', 3: // Ctrl-C
+		return false
+	case 's':
+		// A cycle syncs every changed file, the selected one included.
+		u.mu.Lock()
+		name := u.current()
+		u.mu.Unlock()
+		if name != "" {
+			u.Syncer.Logger.Info("Sync requested", "file", name)
+		}
+		u.Syncer.Trigger()
+		return true
+	case 'p':
+		if u.Syncer.Paused() {
+			u.Syncer.Resume()
+		} else {
+			u.Syncer.Pause()
+		}
+		return true
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	switch k {
+	case keyUp, 'k':
+		if u.selected > 0 {
+			u.selected--
+		}
+	case keyDown, 'j':
+		if u.selected < len(u.files)-1 {
+			u.selected++
+		}
+	case keyPageUp, 'b':
+		if u.diff != nil {
+			u.scroll = max(0, u.scroll-10)
+		} else {
+			u.scroll += 10
+		}
+	case keyPageDown, ' ':
+		if u.diff != nil {
+			u.scroll += 10
+		} else {
+			u.scroll = max(0, u.scroll-10)
+		}
+	case 'd', '\r':
+		name := u.current()
+		if name == "" || name == u.diffName {
+			u.diff, u.diffName, u.scroll = nil, "", 0
+			break
+		}
+		diff, err := u.Syncer.Diff(name)
+		if err != nil {
+			diff = []string{"Can't diff: " + err.Error()}
+		}
+		u.diff, u.diffName, u.scroll = diff, name, 0
+	case keyEscape:
+		u.diff, u.diffName, u.scroll = nil, "", 0
+	}
+	return true
+}
+
+// current returns the name of the selected file.
+func (u *UI) current() string {
+	if u.selected < len(u.files) {
+		return u.files[u.selected].Name
+	}
+	return ""
+}
+
+// draw renders the screen: a status line, the file table, the event log
+// or a diff filling the rest and a line of key bindings.
+func (u *UI) draw(out io.Writer) {
+	width, height, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil || width < 20 || height < 8 {
+		width, height = 80, 24
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	var lines []string
+	status := green + "syncing" + reset
+	switch {
+	case u.Syncer.Paused():
+		status = yellow + "paused" + reset
+	case u.Syncer.Offline():
+		status = yellow + "offline" + reset
+	}
+	lines = append(lines, bold+"todosync "+u.Title+reset+"  "+status+"  "+time.Now().Format("15:04:05"))
+	if u.err != nil {
+		lines = append(lines, red+fit(u.err.Error(), width)+reset)
+	}
+
+	// The table takes up to half of the screen, scrolled to the selection.
+	rows := height/2 - 3
+	if rows > len(u.files) {
+		rows = len(u.files)
+	}
+	first := 0
+	if u.selected >= rows {
+		first = u.selected - rows + 1
+	}
+	nameWidth := 4
+	for _, f := range u.files {
+		if n := utf8.RuneCountInString(f.Name); n > nameWidth {
+			nameWidth = n
+		}
+	}
+	if nameWidth > width/2 {
+		nameWidth = width / 2
+	}
+	row := func(name, source, synced, sum, state string) string {
+		return fmt.Sprintf("%-*s  %-7s  %-11s  %-8s  %s", nameWidth, fit(name, nameWidth), source, synced, sum, state)
+	}
+	lines = append(lines, bold+fit(row("FILE", "SOURCE", "SYNCED", "MD5", "STATE"), width)+reset)
+	for i := first; i < first+rows; i++ {
+		f := u.files[i]
+		synced := "never"
+		if !f.Synced.IsZero() {
+			synced = f.Synced.Format("Jan 2 15:04")
+		}
+		sum := f.Local
+		if sum == "" {
+			sum = "-"
+		} else if len(sum) > 8 {
+			sum = sum[:8]
+		}
+		state := f.State()
+		line := fit(row(f.Name, f.Source, synced, sum, state), width)
+		switch {
+		case i == u.selected:
+			line = reverse + line + reset
+		case state != "in sync":
+			line = yellow + line + reset
+		}
+		lines = append(lines, line)
+	}
+	if len(u.files) == 0 {
+		lines = append(lines, "No synced files yet.")
+	}
+
+	title, body := "Events", u.events
+	if u.diff != nil {
+		title, body = "Last synced "+u.diffName+" vs local copy", u.diff
+	}
+	title = fit(title, width-4)
+	lines = append(lines, bold+"── "+title+" "+strings.Repeat("─", width-utf8.RuneCountInString(title)-4)+reset)
+	free := height - len(lines) - 1
+	// The event log shows its end, a diff its beginning.
+	u.scroll = min(u.scroll, max(0, len(body)-free))
+	start := u.scroll
+	if u.diff == nil {
+		start = max(0, len(body)-free-u.scroll)
+	}
+	for i := start; i < len(body) && i < start+free; i++ {
+		line := fit(body[i], width)
+		if u.diff != nil {
+			switch {
+			case strings.HasPrefix(line, "+"):
+				line = green + line + reset
+			case strings.HasPrefix(line, "-"):
+				line = red + line + reset
+			}
+		}
+		lines = append(lines, line)
+	}
+	for len(lines) < height-1 {
+		lines = append(lines, "")
+	}
+	lines = append(lines, reverse+fit(" ↑↓ select  s sync  d diff  p pause/resume  PgUp/PgDn scroll  q quit", width)+reset)
+
+	w := bufio.NewWriter(out)
+	w.WriteString(home)
+	for i, line := range lines {
+		if i > 0 {
+			w.WriteString("\r\n")
+		}
+		w.WriteString(line)
+		w.WriteString(clearLine)
+	}
+	w.WriteString(clearBelow)
+	w.Flush()
+}
+
+// fit cuts s to width runes.
+func fit(s string, width int) string {
+	if utf8.RuneCountInString(s) <= width {
+		return s
+	}
+	r := []rune(s)
+	return string(r[:width])
+}
+
+// readKeys sends keys read from in, closing keys at the end of input.
+func readKeys(in io.Reader, keys chan<- int) {
+	defer close(keys)
+	r := bufio.NewReader(in)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+		if b != '\x1b' {
+			keys <- int(b)
+			continue
+		}
+		// A lone escape isn't followed by more input right away.
+		if r.Buffered() == 0 {
+			keys <- keyEscape
+			continue
+		}
+		seq := []byte{}
+		for r.Buffered() > 0 {
+			c, _ := r.ReadByte()
+			seq = append(seq, c)
+			if c >= '@' && c <= '~' && c != '[' && c != 'O' {
+				break
+			}
+		}
+		switch string(seq) {
+		case "[A", "OA":
+			keys <- keyUp
+		case "[B", "OB":
+			keys <- keyDown
+		case "[5~":
+			keys <- keyPageUp
+		case "[6~":
+			keys <- keyPageDown
+		}
+	}
+}
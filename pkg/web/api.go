@@ -0,0 +1,194 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	gosync "sync"
+
+	"github.com/mizhka/todosync/pkg/gitstore"
+	"github.com/mizhka/todosync/pkg/health"
+	"github.com/mizhka/todosync/pkg/sync"
+)
+
+// APIPrefix is the path of the JSON API controlling the daemon.
+const APIPrefix = "/api/v1/"
+
+// ProfileInfo describes a profile in answers of /api/v1/profiles.
+type ProfileInfo struct {
+	Name     string   `json:"name"`
+	Repo     string   `json:"repo"`
+	LocalDir string   `json:"localdir"`
+	Files    []string `json:"files"`
+	Paused   bool     `json:"paused"`
+	Offline  bool     `json:"offline"`
+}
+
+// ProfileStatus is the state of a profile in answers of /api/v1/status.
+type ProfileStatus struct {
+	health.ProfileStatus
+	Conflicts  []*sync.Conflict `json:"conflicts"`
+	LastCommit *gitstore.Change `json:"last_commit,omitempty"`
+	Err        string           `json:"error,omitempty"`
+}
+
+// Status answers /api/v1/status.
+type Status struct {
+	Healthy  bool            `json:"healthy"`
+	Profiles []ProfileStatus `json:"profiles"`
+}
+
+// SyncResult is the result of a cycle run through /api/v1/sync?wait=1.
+type SyncResult struct {
+	Name  string `json:"name"`
+	Error string `json:"error,omitempty"`
+}
+
+// apiError is the body of failed API requests.
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// errNoProfile is returned for a profile parameter naming no profile.
+var errNoProfile = errors.New("no such profile")
+
+// handleAPI registers handlers of the API.
+func (s *Server) handleAPI() {
+	s.mux.HandleFunc(APIPrefix+"profiles", s.api(http.MethodGet, s.apiProfiles))
+	s.mux.HandleFunc(APIPrefix+"status", s.api(http.MethodGet, s.apiStatus))
+	s.mux.HandleFunc(APIPrefix+"sync", s.api(http.MethodPost, s.apiSync))
+	s.mux.HandleFunc(APIPrefix+"pause", s.api(http.MethodPost, s.apiPause(true)))
+	s.mux.HandleFunc(APIPrefix+"resume", s.api(http.MethodPost, s.apiPause(false)))
+}
+
+// api returns a handler accepting method, which calls fn with the
+// profiles selected by the profile parameter, all of them when it's
+// missing, and answers with what fn returns as JSON.
+func (s *Server) api(method string, fn func(*http.Request, []Profile) (int, interface{})) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			writeJSON(w, http.StatusMethodNotAllowed, apiError{"method not allowed"})
+			return
+		}
+		if method != http.MethodGet && !sameOrigin(r) {
+			writeJSON(w, http.StatusForbidden, apiError{"cross-origin request refused"})
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			writeJSON(w, http.StatusBadRequest, apiError{err.Error()})
+			return
+		}
+		profiles, err := s.selectProfiles(r)
+		if err != nil {
+			writeJSON(w, http.StatusNotFound, apiError{err.Error()})
+			return
+		}
+		code, body := fn(r, profiles)
+		writeJSON(w, code, body)
+	}
+}
+
+// selectProfiles returns the profile named by the parsed profile
+// parameter of r, or all profiles without one.
+func (s *Server) selectProfiles(r *http.Request) ([]Profile, error) {
+	if _, ok := r.Form["profile"]; !ok {
+		return s.Profiles, nil
+	}
+	name := r.Form.Get("profile")
+	for _, p := range s.Profiles {
+		if p.Name == name {
+			return []Profile{p}, nil
+		}
+	}
+	return nil, errNoProfile
+}
+
+func (s *Server) apiProfiles(r *http.Request, profiles []Profile) (int, interface{}) {
+	return http.StatusOK, infos(profiles)
+}
+
+func infos(profiles []Profile) []ProfileInfo {
+	infos := []ProfileInfo{}
+	for _, p := range profiles {
+		infos = append(infos, ProfileInfo{
+			Name:     p.Name,
+			Repo:     p.Syncer.Repo.Path(),
+			LocalDir: p.Syncer.LocalDir,
+			Files:    p.Syncer.Files,
+			Paused:   p.Syncer.Paused(),
+			Offline:  p.Syncer.Offline(),
+		})
+	}
+	return infos
+}
+
+func (s *Server) apiStatus(r *http.Request, profiles []Profile) (int, interface{}) {
+	st := Status{Healthy: true, Profiles: []ProfileStatus{}}
+	byName := map[string]health.ProfileStatus{}
+	for _, ps := range s.Monitor.Status().Profiles {
+		byName[ps.Name] = ps
+	}
+	for _, p := range profiles {
+		v := s.view(p, byName[p.Name], 1)
+		ps := ProfileStatus{ProfileStatus: v.Health, Conflicts: v.Conflicts, Err: v.Err}
+		if ps.Conflicts == nil {
+			ps.Conflicts = []*sync.Conflict{}
+		}
+		if len(v.Commits) > 0 {
+			ps.LastCommit = &v.Commits[0]
+		}
+		if !ps.Healthy {
+			st.Healthy = false
+		}
+		st.Profiles = append(st.Profiles, ps)
+	}
+	return http.StatusOK, st
+}
+
+// apiSync triggers a cycle of the profiles. With the wait parameter set it
+// answers with their results once they finish.
+func (s *Server) apiSync(r *http.Request, profiles []Profile) (int, interface{}) {
+	if r.FormValue("wait") == "" {
+		for _, p := range profiles {
+			p.Syncer.Trigger()
+		}
+		return http.StatusAccepted, infos(profiles)
+	}
+	results := make([]SyncResult, len(profiles))
+	var wg gosync.WaitGroup
+	for i, p := range profiles {
+		wg.Add(1)
+		go func(i int, p Profile) {
+			defer wg.Done()
+			results[i].Name = p.Name
+			if err := p.Syncer.SyncNow(r.Context()); err != nil {
+				results[i].Error = err.Error()
+			}
+		}(i, p)
+	}
+	wg.Wait()
+	return http.StatusOK, results
+}
+
+// apiPause returns a handler pausing or resuming the profiles.
+func (s *Server) apiPause(pause bool) func(*http.Request, []Profile) (int, interface{}) {
+	return func(r *http.Request, profiles []Profile) (int, interface{}) {
+		for _, p := range profiles {
+			if pause {
+				p.Syncer.Pause()
+			} else {
+				p.Syncer.Resume()
+			}
+		}
+		return http.StatusOK, infos(profiles)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
@@ -0,0 +1,57 @@
+package web
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mizhka/todosync/pkg/ical"
+	"github.com/mizhka/todosync/pkg/todotxt"
+)
+
+// CalendarPath serves the tasks with due dates of a profile's todo file as
+// an iCalendar feed calendar apps can subscribe to.
+const CalendarPath = "/calendar.ics"
+
+// calendar answers CalendarPath with the calendar of the profile named by
+// the profile parameter, which may be left out when a single profile
+// serves one. The calendar is generated from the last synced version of
+// the todo file.
+func (s *Server) calendar(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var serving []Profile
+	for _, p := range s.Profiles {
+		if p.Calendar != nil {
+			serving = append(serving, p)
+		}
+	}
+	var profile *Profile
+	if name, ok := r.URL.Query()["profile"]; ok {
+		for i, p := range serving {
+			if p.Name == name[0] {
+				profile = &serving[i]
+			}
+		}
+	} else if len(serving) == 1 {
+		profile = &serving[0]
+	}
+	if profile == nil {
+		http.Error(w, "no such profile serving a calendar", http.StatusNotFound)
+		return
+	}
+
+	syncer := profile.Syncer
+	content, err := ioutil.ReadFile(filepath.Join(syncer.Repo.Path(), filepath.FromSlash(syncer.TodoFile)))
+	if err != nil && !os.IsNotExist(err) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Write(ical.Calendar(todotxt.ParseList(content), *profile.Calendar, time.Now()))
+}
@@ -0,0 +1,73 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Client calls the API of a running daemon.
+type Client struct {
+	// URL is the address of the daemon's web server, such as
+	// http://127.0.0.1:8088.
+	URL  string
+	HTTP *http.Client
+}
+
+// NewClient returns a Client of the daemon listening on addr, the listen
+// address of its web server.
+func NewClient(addr string) *Client {
+	host, port, err := net.SplitHostPort(addr)
+	if err == nil {
+		// The daemon listening on all addresses is reached locally.
+		if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+			host = "localhost"
+		}
+		addr = net.JoinHostPort(host, port)
+	}
+	return &Client{URL: "http://" + addr, HTTP: http.DefaultClient}
+}
+
+// Sync runs a cycle of the named profile in the daemon and returns its
+// error once it finishes.
+func (c *Client) Sync(ctx context.Context, profile string) error {
+	var results []SyncResult
+	params := url.Values{"profile": {profile}, "wait": {"1"}}
+	if err := c.post(ctx, "sync", params, &results); err != nil {
+		return err
+	}
+	for _, r := range results {
+		if r.Error != "" {
+			return errors.New(r.Error)
+		}
+	}
+	return nil
+}
+
+// post calls the API endpoint with params and decodes the answer into v.
+func (c *Client) post(ctx context.Context, endpoint string, params url.Values, v interface{}) error {
+	u := strings.TrimSuffix(c.URL, "/") + APIPrefix + endpoint
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, strings.NewReader(params.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		var e apiError
+		if err := json.NewDecoder(resp.Body).Decode(&e); err != nil || e.Error == "" {
+			return fmt.Errorf("%s: %s", u, resp.Status)
+		}
+		return fmt.Errorf("%s: %s", u, e.Error)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,181 @@
+// Package web serves a dashboard showing the status of sync profiles run by
+// the daemon and letting the user sync or pause them, a JSON API doing the
+// same for scripts and the command line, and calendars of their tasks.
+package web
+
+import (
+	"embed"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/mizhka/todosync/pkg/gitstore"
+	"github.com/mizhka/todosync/pkg/health"
+	"github.com/mizhka/todosync/pkg/ical"
+	"github.com/mizhka/todosync/pkg/sync"
+)
+
+// historySize is the number of recent commits shown for each profile.
+const historySize = 10
+
+//go:embed templates
+var templates embed.FS
+
+var page = template.Must(template.New("index.html").Funcs(template.FuncMap{
+	"ago": ago,
+}).ParseFS(templates, "templates/index.html"))
+
+// Profile is a sync profile shown on the dashboard.
+type Profile struct {
+	Name   string
+	Syncer *sync.Syncer
+	// Calendar, when set, serves tasks with due dates at CalendarPath.
+	Calendar *ical.Options
+}
+
+// Server serves the dashboard of profiles whose health is recorded by
+// Monitor.
+type Server struct {
+	Monitor  *health.Monitor
+	Profiles []Profile
+
+	mux *http.ServeMux
+}
+
+// New returns a Server for profiles.
+func New(monitor *health.Monitor, profiles []Profile) *Server {
+	s := &Server{Monitor: monitor, Profiles: profiles, mux: http.NewServeMux()}
+	s.mux.HandleFunc("/", s.index)
+	s.mux.HandleFunc("/sync", s.action(func(p Profile) { p.Syncer.Trigger() }))
+	s.mux.HandleFunc("/pause", s.action(func(p Profile) { p.Syncer.Pause() }))
+	s.mux.HandleFunc("/resume", s.action(func(p Profile) { p.Syncer.Resume() }))
+	s.mux.HandleFunc(CalendarPath, s.calendar)
+	s.handleAPI()
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// profileView is what the dashboard shows of a profile.
+type profileView struct {
+	Name    string
+	Health  health.ProfileStatus
+	Paused  bool
+	Offline bool
+	Commits []gitstore.Change
+	// Conflicts are versions quarantined until resolved with the
+	// conflicts command.
+	Conflicts []*sync.Conflict
+	// Err tells why commits or conflicts couldn't be read.
+	Err string
+}
+
+func (s *Server) index(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	st := s.Monitor.Status()
+	byName := map[string]health.ProfileStatus{}
+	for _, ps := range st.Profiles {
+		byName[ps.Name] = ps
+	}
+	var views []profileView
+	for _, p := range s.Profiles {
+		views = append(views, s.view(p, byName[p.Name], historySize))
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := page.Execute(w, struct {
+		Healthy  bool
+		Profiles []profileView
+		Now      time.Time
+	}{st.Healthy, views, time.Now()})
+	if err != nil {
+		slog.Warn("Can't render dashboard", "err", err)
+	}
+}
+
+// view collects what the dashboard shows of p with up to history recent
+// commits. The repo is opened apart from the Syncer's, which may be
+// committing meanwhile.
+func (s *Server) view(p Profile, ps health.ProfileStatus, history int) profileView {
+	v := profileView{Name: p.Name, Health: ps, Paused: p.Syncer.Paused(), Offline: p.Syncer.Offline()}
+	repo, err := gitstore.Open(p.Syncer.Repo.Path())
+	if err == nil {
+		v.Commits, err = repo.Log("", history)
+	}
+	if err != nil {
+		v.Err = err.Error()
+		return v
+	}
+	v.Conflicts, err = sync.ListConflicts(p.Syncer.StateFile)
+	if err != nil {
+		v.Err = err.Error()
+	}
+	return v
+}
+
+// action returns a handler running fn on the profile named by the profile
+// form value and going back to the dashboard.
+func (s *Server) action(fn func(Profile)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !sameOrigin(r) {
+			http.Error(w, "cross-origin request refused", http.StatusForbidden)
+			return
+		}
+		name := r.PostFormValue("profile")
+		for _, p := range s.Profiles {
+			if p.Name == name {
+				fn(p)
+				// A relative address keeps working behind a proxy
+				// serving the dashboard under a prefix.
+				w.Header().Set("Location", ".")
+				w.WriteHeader(http.StatusSeeOther)
+				return
+			}
+		}
+		http.Error(w, "no such profile", http.StatusNotFound)
+	}
+}
+
+// sameOrigin reports whether r comes from a page of the dashboard rather
+// than from another site the user is browsing.
+func sameOrigin(r *http.Request) bool {
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "same-origin", "none":
+		return true
+	case "":
+	default:
+		return false
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+// ago formats the time since t, such as "3m ago".
+func ago(t time.Time) string {
+	d := time.Since(t)
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return fmt.Sprintf("%dm ago", int(d.Minutes()))
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%dh ago", int(d.Hours()))
+	}
+	return t.Format("2006-01-02 15:04")
+}
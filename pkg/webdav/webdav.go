@@ -0,0 +1,309 @@
+// Package webdav stores synced files on a WebDAV server such as Nextcloud.
+package webdav
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/mizhka/todosync/pkg/fsutil"
+	"github.com/mizhka/todosync/pkg/remote"
+)
+
+var _ remote.Store = (*Client)(nil)
+
+// propfind requests properties describing content of files.
+const propfind = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:" xmlns:oc="http://owncloud.org/ns">
+  <d:prop><d:getetag/><d:getcontentlength/><d:resourcetype/><oc:checksums/></d:prop>
+</d:propfind>`
+
+// Client is a WebDAV client with files relative to a base collection. It
+// implements remote.Store, using ETags as revisions.
+type Client struct {
+	base     *url.URL
+	username string
+	password string
+	http     *http.Client
+}
+
+// New returns a client for the collection at rawurl, authenticating with
+// basic auth if username is set.
+func New(rawurl, username, password string) (*Client, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webdav url %s: %w", rawurl, err)
+	}
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	return &Client{base: u, username: username, password: password, http: http.DefaultClient}, nil
+}
+
+// multistatus is the PROPFIND response.
+type multistatus struct {
+	Responses []struct {
+		Href     string `xml:"href"`
+		Propstat []struct {
+			Status string `xml:"status"`
+			Prop   struct {
+				ETag         string `xml:"getetag"`
+				Length       int64  `xml:"getcontentlength"`
+				ResourceType struct {
+					Collection *struct{} `xml:"collection"`
+				} `xml:"resourcetype"`
+				Checksums []string `xml:"checksums>checksum"`
+			} `xml:"prop"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+// List returns all files below the base collection.
+func (c *Client) List(ctx context.Context, patterns []string) ([]*remote.File, error) {
+	var files []*remote.File
+	dirs := []string{""}
+	for len(dirs) > 0 {
+		dir := dirs[0]
+		dirs = dirs[1:]
+
+		entries, subdirs, err := c.propfind(ctx, dir, "1")
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, entries...)
+		dirs = append(dirs, subdirs...)
+	}
+	return files, nil
+}
+
+// propfind lists the collection dir, or describes the file dir with depth
+// 0. It returns files and subcollections.
+func (c *Client) propfind(ctx context.Context, dir, depth string) ([]*remote.File, []string, error) {
+	req, err := c.request(ctx, "PROPFIND", dir, strings.NewReader(propfind))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Depth", depth)
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+	resp, err := c.do(req, http.StatusMultiStatus)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	var ms multistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, nil, fmt.Errorf("invalid PROPFIND response for %s: %w", dir, err)
+	}
+
+	var files []*remote.File
+	var dirs []string
+	for _, r := range ms.Responses {
+		name, err := c.relPath(r.Href)
+		if err != nil {
+			return nil, nil, err
+		}
+		if name == strings.TrimSuffix(dir, "/") && depth != "0" {
+			continue
+		}
+		for _, ps := range r.Propstat {
+			if !strings.Contains(ps.Status, " 200 ") {
+				continue
+			}
+			if ps.Prop.ResourceType.Collection != nil {
+				dirs = append(dirs, name+"/")
+				continue
+			}
+			files = append(files, &remote.File{
+				ID:       name,
+				Path:     name,
+				Checksum: md5Of(ps.Prop.Checksums),
+				Revision: ps.Prop.ETag,
+				Size:     ps.Prop.Length,
+			})
+		}
+	}
+	return files, dirs, nil
+}
+
+// Download saves content of the file to the local path dst. The content
+// must match the checksum of the file, if known, to replace dst.
+func (c *Client) Download(ctx context.Context, f *remote.File, dst string) error {
+	body, err := c.get(ctx, f)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	// Servers may omit the length, so only the checksum is verified.
+	return fsutil.WriteReader(dst, body, 0644, f.Checksum, -1)
+}
+
+// Fetch returns content of the file.
+func (c *Client) Fetch(ctx context.Context, f *remote.File) ([]byte, error) {
+	body, err := c.get(ctx, f)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return ioutil.ReadAll(body)
+}
+
+func (c *Client) get(ctx context.Context, f *remote.File) (io.ReadCloser, error) {
+	req, err := c.request(ctx, http.MethodGet, f.Path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Upload replaces content of the file by the local file src.
+func (c *Client) Upload(ctx context.Context, f *remote.File, src string) (*remote.File, error) {
+	// The ETag is the revision: a file changed since it was listed isn't
+	// overwritten.
+	h := http.Header{}
+	if f.Revision != "" {
+		h.Set("If-Match", f.Revision)
+	}
+	return c.put(ctx, f.Path, src, h)
+}
+
+// Create uploads the local file src at the slash separated path, creating
+// missing collections.
+func (c *Client) Create(ctx context.Context, name, src string) (*remote.File, error) {
+	dir := ""
+	for _, elem := range strings.Split(path.Dir(name), "/") {
+		if elem == "." || elem == "" {
+			continue
+		}
+		dir += elem + "/"
+		req, err := c.request(ctx, "MKCOL", dir, nil)
+		if err != nil {
+			return nil, err
+		}
+		// 405 Method Not Allowed means the collection exists.
+		resp, err := c.do(req, http.StatusCreated, http.StatusMethodNotAllowed)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Close()
+	}
+	// A file created meanwhile isn't overwritten.
+	return c.put(ctx, name, src, http.Header{"If-None-Match": {"*"}})
+}
+
+// Delete removes the file.
+func (c *Client) Delete(ctx context.Context, f *remote.File) error {
+	req, err := c.request(ctx, http.MethodDelete, f.Path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req, http.StatusOK, http.StatusNoContent, http.StatusNotFound)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// put uploads the local file src at the slash separated path, with the
+// conditional headers h. A failed precondition wraps remote.ErrChanged.
+func (c *Client) put(ctx context.Context, name, src string, h http.Header) (*remote.File, error) {
+	content, err := ioutil.ReadFile(src)
+	if err != nil {
+		return nil, fmt.Errorf("can't open file %s: %w", src, err)
+	}
+	req, err := c.request(ctx, http.MethodPut, name, bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range h {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	resp, err := c.do(req, http.StatusOK, http.StatusCreated, http.StatusNoContent)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	// Not every server returns the new ETag of uploaded content.
+	files, _, err := c.propfind(ctx, name, "0")
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("uploaded file %s not found", name)
+	}
+	return files[0], nil
+}
+
+func (c *Client) request(ctx context.Context, method, name string, body io.Reader) (*http.Request, error) {
+	u := *c.base
+	u.Path = c.base.Path + name
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+	return req, nil
+}
+
+// do sends the request and checks that the response has one of codes.
+func (c *Client) do(req *http.Request, codes ...int) (*http.Response, error) {
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %w", req.Method, req.URL.Path, err)
+	}
+	for _, code := range codes {
+		if resp.StatusCode == code {
+			return resp, nil
+		}
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusUnauthorized:
+		return nil, fmt.Errorf("%s %s: %w", req.Method, req.URL.Path, remote.ErrUnauthorized)
+	case http.StatusPreconditionFailed:
+		return nil, fmt.Errorf("%s %s: %w", req.Method, req.URL.Path, remote.ErrChanged)
+	}
+	return nil, fmt.Errorf("%s %s: %s", req.Method, req.URL.Path, resp.Status)
+}
+
+// relPath converts href of a PROPFIND response to a path relative to the
+// base collection.
+func (c *Client) relPath(href string) (string, error) {
+	u, err := url.Parse(href)
+	if err != nil {
+		return "", fmt.Errorf("invalid href %s: %w", href, err)
+	}
+	if !strings.HasPrefix(u.Path, c.base.Path) {
+		return "", fmt.Errorf("href %s is outside of %s", href, c.base.Path)
+	}
+	return strings.Trim(strings.TrimPrefix(u.Path, c.base.Path), "/"), nil
+}
+
+// md5Of extracts the MD5 checksum from ownCloud checksums such as
+// "SHA1:… MD5:…".
+func md5Of(checksums []string) string {
+	for _, list := range checksums {
+		for _, sum := range strings.Fields(list) {
+			if strings.HasPrefix(strings.ToUpper(sum), "MD5:") {
+				return strings.ToLower(sum[4:])
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,161 @@
+package webdav
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	gosync "sync"
+	"testing"
+
+	"github.com/mizhka/todosync/pkg/remote"
+)
+
+// fakeServer is a WebDAV server with files in a single collection at /dav/,
+// honoring If-Match and If-None-Match on PUT as Nextcloud does.
+type fakeServer struct {
+	mu    gosync.Mutex
+	files map[string]string
+	etags map[string]int
+	n     int
+}
+
+func (s *fakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if user, _, _ := r.BasicAuth(); user != "alice" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/dav/")
+	etag := func(name string) string { return fmt.Sprintf(`"%d"`, s.etags[name]) }
+	switch r.Method {
+	case "PROPFIND":
+		var b strings.Builder
+		b.WriteString(`<?xml version="1.0"?><d:multistatus xmlns:d="DAV:">`)
+		prop := func(href, etag string, length int) {
+			fmt.Fprintf(&b, `<d:response><d:href>%s</d:href><d:propstat><d:prop><d:getetag>%s</d:getetag><d:getcontentlength>%d</d:getcontentlength><d:resourcetype/></d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response>`, href, etag, length)
+		}
+		if name == "" {
+			b.WriteString(`<d:response><d:href>/dav/</d:href><d:propstat><d:prop><d:resourcetype><d:collection/></d:resourcetype></d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response>`)
+			for n, content := range s.files {
+				prop("/dav/"+n, etag(n), len(content))
+			}
+		} else if content, ok := s.files[name]; ok {
+			prop("/dav/"+name, etag(name), len(content))
+		} else {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		b.WriteString(`</d:multistatus>`)
+		w.WriteHeader(http.StatusMultiStatus)
+		w.Write([]byte(b.String()))
+	case http.MethodGet:
+		content, ok := s.files[name]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(content))
+	case http.MethodPut:
+		_, exists := s.files[name]
+		if m := r.Header.Get("If-Match"); m != "" && (!exists || m != etag(name)) ||
+			r.Header.Get("If-None-Match") == "*" && exists {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		s.put(name, string(b))
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// put changes a file as another client would.
+func (s *fakeServer) put(name, content string) {
+	s.n++
+	s.files[name] = content
+	s.etags[name] = s.n
+}
+
+func newClient(t *testing.T, user string) (*Client, *fakeServer) {
+	t.Helper()
+	srv := &fakeServer{files: map[string]string{}, etags: map[string]int{}}
+	ts := httptest.NewServer(srv)
+	t.Cleanup(ts.Close)
+	c, err := New(ts.URL+"/dav", user, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, srv
+}
+
+func writeTemp(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "upload")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestUpload(t *testing.T) {
+	ctx := context.Background()
+	c, srv := newClient(t, "alice")
+	f, err := c.Create(ctx, "todo.txt", writeTemp(t, "Buy milk\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := c.List(ctx, nil)
+	if err != nil || len(files) != 1 || files[0].Revision != f.Revision {
+		t.Fatalf("List: %v, %v", files, err)
+	}
+	f, err = c.Upload(ctx, files[0], writeTemp(t, "Buy oat milk\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := c.Fetch(ctx, f); err != nil || string(got) != "Buy oat milk\n" {
+		t.Errorf("Fetch: %q, %v", got, err)
+	}
+
+	// A file changed since it was listed isn't overwritten.
+	srv.put("todo.txt", "Buy soy milk\n")
+	if _, err := c.Upload(ctx, f, writeTemp(t, "Buy rice milk\n")); !errors.Is(err, remote.ErrChanged) {
+		t.Errorf("Upload over a changed file: got %v, want ErrChanged", err)
+	}
+	// Nor is a file created meanwhile.
+	if _, err := c.Create(ctx, "todo.txt", writeTemp(t, "Buy rice milk\n")); !errors.Is(err, remote.ErrChanged) {
+		t.Errorf("Create over an existing file: got %v, want ErrChanged", err)
+	}
+	if srv.files["todo.txt"] != "Buy soy milk\n" {
+		t.Errorf("file overwritten: %q", srv.files["todo.txt"])
+	}
+}
+
+func TestUnauthorized(t *testing.T) {
+	c, _ := newClient(t, "mallory")
+	if _, err := c.List(context.Background(), nil); !errors.Is(err, remote.ErrUnauthorized) {
+		t.Errorf("got %v, want ErrUnauthorized", err)
+	}
+}
+
+func TestMD5Of(t *testing.T) {
+	tests := []struct {
+		checksums []string
+		want      string
+	}{
+		{nil, ""},
+		{[]string{"SHA1:da39a3ee MD5:D41D8CD9 ADLER32:00000001"}, "d41d8cd9"},
+		{[]string{"SHA1:da39a3ee", "md5:abc"}, "abc"},
+	}
+	for _, tt := range tests {
+		if got := md5Of(tt.checksums); got != tt.want {
+			t.Errorf("md5Of(%q) = %q, want %q", tt.checksums, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/mizhka/todosync/pkg/config"
+	"github.com/mizhka/todosync/pkg/drive"
+	"github.com/mizhka/todosync/pkg/fsutil"
+	"github.com/mizhka/todosync/pkg/gauth"
+	"golang.org/x/term"
+	"gopkg.in/yaml.v3"
+)
+
+// initFile is the configuration written by runInit.
+type initFile struct {
+	Repo       string     `yaml:"repo"`
+	LocalDir   string     `yaml:"localdir"`
+	Files      []string   `yaml:"files"`
+	Remote     initRemote `yaml:"remote"`
+	FolderPath string     `yaml:"folderpath,omitempty"`
+	Git        *initGit   `yaml:"git,omitempty"`
+}
+
+type initRemote struct {
+	Type     string `yaml:"type"`
+	URL      string `yaml:"url,omitempty"`
+	Username string `yaml:"username,omitempty"`
+	Password string `yaml:"password,omitempty"`
+}
+
+type initGit struct {
+	URL string `yaml:"url"`
+}
+
+// runInit writes a configuration file at path, or in ConfigDir when path
+// is empty, from flags or answers to questions, and sets up what it
+// refers to: it authorizes access to Drive, creates the Drive folder and
+// the repo, and optionally writes a systemd user unit running the daemon.
+func runInit(ctx context.Context, path string, dirs config.Dirs, args []string) error {
+	flags := flag.NewFlagSet("init", flag.ExitOnError)
+	localDir := flags.String("localdir", "", "directory with working copies of files (default the current directory)")
+	repo := flags.String("repo", "", "git repository keeping history of synced files, created if missing (default repo in the state directory)")
+	files := flags.String("files", "todo.txt,done.txt", "comma separated paths of synced files")
+	remoteType := flags.String("remote", "drive", "drive or webdav")
+	folder := flags.String("folder", "todo", "path of the Drive folder from the root of My Drive, created if missing")
+	url := flags.String("url", "", "WebDAV collection mapped to the repo")
+	username := flags.String("username", "", "WebDAV user name")
+	password := flags.String("password", "", "WebDAV password")
+	gitURL := flags.String("git-url", "", "git repository cloned into repo when it doesn't exist yet")
+	clientSecret := flags.String("credentials", "", "OAuth client secret file downloaded from the Google Cloud console, copied to the configuration directory")
+	noBrowser := flags.Bool("no-browser", false, "authorize in a browser on another device and paste back the redirect address")
+	systemd := flags.Bool("systemd", false, "write a systemd user unit running the daemon")
+	yes := flags.Bool("yes", false, "take flags and defaults without asking")
+	force := flags.Bool("force", false, "overwrite an existing configuration file")
+	flags.Parse(args)
+	if flags.NArg() > 0 {
+		return fmt.Errorf("usage: todosync init [flags]")
+	}
+	set := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	p := &prompter{in: bufio.NewReader(os.Stdin), out: os.Stdout}
+	p.interactive = !*yes && term.IsTerminal(int(os.Stdin.Fd()))
+
+	if path == "" {
+		dir, err := config.ConfigDir()
+		if err != nil {
+			return err
+		}
+		path = filepath.Join(dir, config.DefaultPath)
+	}
+	if _, err := os.Stat(path); err == nil && !*force {
+		return fmt.Errorf("%s already exists, edit it or pass -force to replace it", path)
+	}
+
+	if *localDir == "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		*localDir = wd
+	}
+	if *repo == "" {
+		dir := dirs.State
+		if dir == "" {
+			var err error
+			if dir, err = config.StateDir(); err != nil {
+				return err
+			}
+		}
+		*repo = filepath.Join(dir, "repo")
+	}
+	ask := func(name, question string, value *string) error {
+		if set[name] {
+			return nil
+		}
+		answer, err := p.ask(question, *value)
+		*value = answer
+		return err
+	}
+	type question struct {
+		name, text string
+		value      *string
+	}
+	for _, q := range []question{
+		{"localdir", "Directory with your todo files", localDir},
+		{"repo", "Git repository keeping their history", repo},
+		{"files", "Synced files, comma separated", files},
+		{"remote", "Remote storage, drive or webdav", remoteType},
+	} {
+		if err := ask(q.name, q.text, q.value); err != nil {
+			return err
+		}
+	}
+	f := initFile{
+		Repo:     expand(*repo),
+		LocalDir: expand(*localDir),
+		Remote:   initRemote{Type: *remoteType},
+	}
+	for _, name := range strings.Split(*files, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			f.Files = append(f.Files, name)
+		}
+	}
+	switch *remoteType {
+	case "drive":
+		if err := ask("folder", "Drive folder, created if missing", folder); err != nil {
+			return err
+		}
+		f.FolderPath = *folder
+	case "webdav":
+		for _, q := range []question{
+			{"url", "WebDAV address of the folder", url},
+			{"username", "WebDAV user name", username},
+			{"password", "WebDAV password", password},
+		} {
+			if err := ask(q.name, q.text, q.value); err != nil {
+				return err
+			}
+		}
+		f.Remote.URL, f.Remote.Username, f.Remote.Password = *url, *username, *password
+	default:
+		return fmt.Errorf("remote: %q is neither drive nor webdav", *remoteType)
+	}
+	if err := ask("git-url", "Git repository to clone or push to, if any", gitURL); err != nil {
+		return err
+	}
+	if *gitURL != "" {
+		f.Git = &initGit{URL: *gitURL}
+	}
+
+	var b bytes.Buffer
+	b.WriteString("# Written by todosync init, see todosync.example.yaml for all settings.\n")
+	enc := yaml.NewEncoder(&b)
+	enc.SetIndent(2)
+	if err := enc.Encode(f); err != nil {
+		return err
+	}
+	// The file may hold a password.
+	if err := fsutil.WriteFile(path, b.Bytes(), 0600); err != nil {
+		return fmt.Errorf("can't write config: %w", err)
+	}
+	fmt.Printf("Wrote %s\n", path)
+	// The configuration needs localdir to exist.
+	localPath := f.LocalDir
+	if !filepath.IsAbs(localPath) {
+		localPath = filepath.Join(filepath.Dir(path), localPath)
+	}
+	if err := os.MkdirAll(localPath, 0755); err != nil {
+		return err
+	}
+	profiles, err := config.Load(path, dirs)
+	if err != nil {
+		return err
+	}
+	cfg := profiles[0]
+
+	if cfg.Remote.Type == "drive" {
+		if err := initDrive(ctx, cfg, p, *clientSecret, *noBrowser); err != nil {
+			return err
+		}
+	}
+	if _, err := openRepo(ctx, cfg, false); err != nil {
+		return err
+	}
+	fmt.Printf("Repo ready at %s\n", cfg.Repo)
+
+	next := "Run `todosync sync` to sync once, or `todosync daemon` to keep syncing."
+	if runtime.GOOS == "linux" {
+		if !set["systemd"] {
+			*systemd = p.confirm("Write a systemd user unit running the daemon?", false)
+		}
+		if *systemd {
+			unit, err := writeUnit(path)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Wrote %s\n", unit)
+			next = "Start syncing with `systemctl --user enable --now todosync`."
+		}
+	}
+	fmt.Println(next)
+	return nil
+}
+
+// initDrive authorizes access to Drive, asking for the OAuth client secret
+// if it's missing, and creates the Drive folder.
+func initDrive(ctx context.Context, cfg *config.Config, p *prompter, clientSecret string, noBrowser bool) error {
+	if cfg.Auth == gauth.ModeUser {
+		if err := copySecret(cfg, p, clientSecret); err != nil {
+			return err
+		}
+	}
+	creds, err := credentials(cfg, cfg.Token)
+	if err != nil {
+		return err
+	}
+	if cfg.Auth == gauth.ModeUser {
+		if _, err := creds.Tokens.Load(); errors.Is(err, gauth.ErrNoToken) {
+			if err := drive.Authorize(ctx, creds, noBrowser); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		} else {
+			fmt.Println("Drive access already authorized")
+		}
+	}
+	d, err := drive.NewClient(ctx, creds, nil)
+	if err != nil {
+		return err
+	}
+	id, err := d.MakeFolder(ctx, cfg.FolderPath)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Drive folder %s ready (%s)\n", cfg.FolderPath, id)
+	return nil
+}
+
+// copySecret copies the OAuth client secret file to cfg.Credentials
+// unless it's there already, asking for its path if not given.
+func copySecret(cfg *config.Config, p *prompter, clientSecret string) error {
+	if _, err := os.Stat(cfg.Credentials); !os.IsNotExist(err) {
+		return err
+	}
+	if clientSecret == "" {
+		var err error
+		clientSecret, err = p.ask("OAuth client secret file downloaded from the Google Cloud console", "")
+		if err != nil {
+			return err
+		}
+	}
+	if clientSecret == "" {
+		return fmt.Errorf("%s is missing, pass the OAuth client secret with -credentials", cfg.Credentials)
+	}
+	b, err := ioutil.ReadFile(expand(clientSecret))
+	if err != nil {
+		return err
+	}
+	if err := fsutil.WriteFile(cfg.Credentials, b, 0600); err != nil {
+		return fmt.Errorf("can't copy client secret: %w", err)
+	}
+	fmt.Printf("Copied client secret to %s\n", cfg.Credentials)
+	return nil
+}
+
+// unitTemplate is the systemd user unit running the daemon with the
+// configuration file.
+const unitTemplate = `[Unit]
+Description=ToDo Sync
+After=network-online.target
+
+[Service]
+Type=notify
+ExecStart=%s -config %s daemon
+Restart=on-failure
+
+[Install]
+WantedBy=default.target
+`
+
+// writeUnit writes the systemd user unit running the daemon with the
+// configuration file at path and returns the path of the unit.
+func writeUnit(path string) (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	unit := filepath.Join(dir, "systemd", "user", "todosync.service")
+	content := fmt.Sprintf(unitTemplate, unitQuote(exe), unitQuote(path))
+	if err := fsutil.WriteFile(unit, []byte(content), 0644); err != nil {
+		return "", fmt.Errorf("can't write systemd unit: %w", err)
+	}
+	return unit, nil
+}
+
+// unitQuote quotes s as a word of a systemd command line.
+func unitQuote(s string) string {
+	if !strings.ContainsAny(s, " \t\"'\\") {
+		return s
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// expand makes a path with a leading ~ absolute, leaving others as they
+// are for the configuration to resolve.
+func expand(path string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, path[1:])
+		}
+	}
+	return path
+}
+
+// prompter asks the user questions on a terminal, or takes the defaults
+// when not interactive.
+type prompter struct {
+	in          *bufio.Reader
+	out         io.Writer
+	interactive bool
+}
+
+// ask returns the answer to question, def when it's left empty.
+func (p *prompter) ask(question, def string) (string, error) {
+	if !p.interactive {
+		return def, nil
+	}
+	if def != "" {
+		fmt.Fprintf(p.out, "%s [%s]: ", question, def)
+	} else {
+		fmt.Fprintf(p.out, "%s: ", question)
+	}
+	line, err := p.in.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", fmt.Errorf("no answer to %q: %w", question, err)
+	}
+	if line = strings.TrimSpace(line); line != "" {
+		return line, nil
+	}
+	return def, nil
+}
+
+// confirm asks a yes or no question, def when left empty or not
+// interactive.
+func (p *prompter) confirm(question string, def bool) bool {
+	hint := "y/N"
+	if def {
+		hint = "Y/n"
+	}
+	answer, err := p.ask(question+" ("+hint+")", "")
+	if err != nil || answer == "" {
+		return def
+	}
+	return strings.HasPrefix(strings.ToLower(answer), "y")
+}